@@ -215,17 +215,26 @@ export class FriscyNetworkBridge {
     const conn = this.connections.get(connID);
     if (!conn) return -88;
 
-    const { port, family } = this.parseAddress(addrData);
+    const { host, port, family } = this.parseAddress(addrData);
     const sockType = conn.type === 1 ? SOCK_STREAM : SOCK_DGRAM;
 
+    // Wildcard binds leave the address out, so older proxies still accept them
+    const wildcard = !host || host === '0.0.0.0' || /^[0:]+$/.test(host);
+    const addr = wildcard ? new Uint8Array(0) : new TextEncoder().encode(host);
+
     // Build bind message: msgType(1) + connID(4) + sockType(1) + port(2)
-    const msg = new Uint8Array(1 + 4 + 1 + 2);
+    // [+ addrLen(2) + addr]
+    const msg = new Uint8Array(1 + 4 + 1 + 2 + (wildcard ? 0 : 2 + addr.length));
     const view = new DataView(msg.buffer);
 
     msg[0] = MSG.BIND;
     view.setUint32(1, connID, false);
     msg[5] = sockType;
     view.setUint16(6, port, false);
+    if (!wildcard) {
+      view.setUint16(8, addr.length, false);
+      msg.set(addr, 10);
+    }
 
     this.sendMessage(msg);
     return 0;
@@ -361,29 +370,34 @@ export class FriscyNetworkBridge {
   }
 
   /**
-   * Handle a single incoming stream
+   * Handle an incoming event stream. The proxy writes all events of the
+   * session back to back on one stream; each is
+   * msgType(1) + connID(4) + dataLen(4) + data.
    */
   async handleIncomingStream(stream) {
     try {
       const reader = stream.getReader();
-      const chunks = [];
+      let buf = new Uint8Array(0);
 
       while (true) {
         const { value, done } = await reader.read();
         if (done) break;
-        chunks.push(value);
-      }
 
-      // Combine chunks
-      const totalLen = chunks.reduce((sum, c) => sum + c.length, 0);
-      const data = new Uint8Array(totalLen);
-      let offset = 0;
-      for (const chunk of chunks) {
-        data.set(chunk, offset);
-        offset += chunk.length;
+        const joined = new Uint8Array(buf.length + value.length);
+        joined.set(buf, 0);
+        joined.set(value, buf.length);
+        buf = joined;
+
+        // Dispatch every complete event, keep the partial tail
+        let offset = 0;
+        while (buf.length - offset >= 9) {
+          const dataLen = new DataView(buf.buffer, offset + 5, 4).getUint32(0, false);
+          if (buf.length - offset < 9 + dataLen) break;
+          this.handleProxyMessage(buf.subarray(offset, offset + 9 + dataLen));
+          offset += 9 + dataLen;
+        }
+        buf = buf.slice(offset);
       }
-
-      this.handleProxyMessage(data);
     } catch (e) {
       console.error('[friscy-net] Error handling stream:', e);
     }
@@ -438,14 +452,29 @@ export class FriscyNetworkBridge {
       case MSG.CONNECTED:
         if (conn) {
           conn.connected = true;
-          console.log(`[friscy-net] Connection ${connID} established`);
+          // Binds carry the bound address: addrLen(2) + addr ("ip:port")
+          if (payload.length >= 2) {
+            const addrLen = new DataView(payload.buffer, payload.byteOffset).getUint16(0, false);
+            conn.localAddr = new TextDecoder().decode(payload.slice(2, 2 + addrLen));
+            console.log(`[friscy-net] Connection ${connID} bound to ${conn.localAddr}`);
+          } else {
+            console.log(`[friscy-net] Connection ${connID} established`);
+          }
         }
         break;
 
       case MSG.CONNECT_ERROR:
         if (conn) {
           conn.connected = false;
-          const errorMsg = new TextDecoder().decode(payload);
+          let errorMsg = new TextDecoder().decode(payload);
+          // Policy decision JSON; code is one of the proxy's ConnErr* values
+          try {
+            const decision = JSON.parse(errorMsg);
+            conn.errorCode = decision.code;
+            errorMsg = decision.message;
+          } catch (e) {
+            // Older proxies send plain text
+          }
           console.error(`[friscy-net] Connection ${connID} failed: ${errorMsg}`);
         }
         break;
@@ -463,6 +492,12 @@ export class FriscyNetworkBridge {
       case MSG.CLOSED:
         if (conn) {
           conn.connected = false;
+          // bytesIn (8), bytesOut (8): totals read from / written to the remote
+          if (payload.length >= 16) {
+            const view = new DataView(payload.buffer, payload.byteOffset);
+            conn.bytesIn = Number(view.getBigUint64(0));
+            conn.bytesOut = Number(view.getBigUint64(8));
+          }
           console.log(`[friscy-net] Connection ${connID} closed by remote`);
         }
         break;
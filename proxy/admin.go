@@ -0,0 +1,74 @@
+// admin.go - Operator view of live sessions
+//
+// GET /admin/sessions lists every WebTransport session; POST
+// /admin/sessions/{id}/close ends one, closing its connections, with
+// ErrCodeAdminClose so the client can tell it was deliberate. Both sit
+// behind -admin-token like /admin/transport.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SessionInfo is one /admin/sessions entry
+type SessionInfo struct {
+	ID            uint64    `json:"id"`
+	CorrelationID string    `json:"correlation_id"` // the "session" field of its log lines
+	RemoteIP      string    `json:"remote_ip"`
+	Origin        string    `json:"origin,omitempty"`
+	Token         string    `json:"token,omitempty"` // token name with -token-file
+	Started       time.Time `json:"started"`
+	Connections   int       `json:"connections"`
+	BytesSent     int64     `json:"bytes_sent"`     // to remote hosts
+	BytesReceived int64     `json:"bytes_received"` // from remote hosts
+}
+
+func (sess *Session) info() SessionInfo {
+	info := SessionInfo{
+		ID:            sess.id,
+		CorrelationID: sess.cid,
+		RemoteIP:      sess.remoteIP,
+		Origin:        sess.origin,
+		Started:       sess.started,
+		BytesSent:     sess.bytesSent.Load(),
+		BytesReceived: sess.bytesReceived.Load(),
+	}
+	if sess.token != nil {
+		info.Token = sess.token.Name
+	}
+	sess.connections.Range(func(_, _ any) bool {
+		info.Connections++
+		return true
+	})
+	return info
+}
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	out := []SessionInfo{}
+	s.sessions.Range(func(_, v any) bool {
+		out = append(out, v.(*Session).info())
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (s *Server) handleAdminCloseSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	// handleSession tears the connections down once the session is gone
+	v.(*Session).abort(ErrCodeAdminClose, "closed by operator")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionInfo(t *testing.T) {
+	sess := &Session{id: 3, cid: "0011223344556677", remoteIP: "198.51.100.7:5000", token: &Token{TokenSpec: TokenSpec{Name: "alice"}}}
+	sess.connections.Store(uint32(1), newConnection(1, SOCK_STREAM))
+	sess.bytesSent.Add(10)
+	sess.bytesReceived.Add(20)
+	info := sess.info()
+	if info.ID != 3 || info.CorrelationID != sess.cid || info.Token != "alice" ||
+		info.Connections != 1 || info.BytesSent != 10 || info.BytesReceived != 20 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	setupTestServer(t)
+	testServer.adminToken = "hunter2"
+	defer func() { testServer.adminToken = "" }()
+	mux := testServer.apiMux()
+	do := func(method, target, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	session := connectToProxy(t)
+	defer session.CloseWithError(0, "test done")
+	port := session.LocalAddr().(*net.UDPAddr).Port
+
+	// Find this test's session among any others still open
+	var mine SessionInfo
+	deadline := time.Now().Add(2 * time.Second)
+	for mine.ID == 0 && time.Now().Before(deadline) {
+		w := do("GET", "/admin/sessions", "Bearer hunter2")
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: got %d: %s", w.Code, w.Body)
+		}
+		var list []SessionInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range list {
+			if _, p, _ := net.SplitHostPort(info.RemoteIP); p == strconv.Itoa(port) {
+				mine = info
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if mine.ID == 0 {
+		t.Fatalf("session from port %d not listed", port)
+	}
+	if len(mine.CorrelationID) != 16 || mine.Started.IsZero() {
+		t.Fatalf("unexpected listing %+v", mine)
+	}
+
+	closeURL := "/admin/sessions/" + strconv.FormatUint(mine.ID, 10) + "/close"
+	for _, tc := range []struct {
+		method, target, auth string
+		code                 int
+	}{
+		{"POST", closeURL, "", http.StatusUnauthorized},
+		{"GET", closeURL, "Bearer hunter2", http.StatusMethodNotAllowed},
+		{"POST", "/admin/sessions/x/close", "Bearer hunter2", http.StatusBadRequest},
+		{"POST", "/admin/sessions/999999/close", "Bearer hunter2", http.StatusNotFound},
+	} {
+		if w := do(tc.method, tc.target, tc.auth); w.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.target, w.Code, tc.code)
+		}
+	}
+
+	if w := do("POST", closeURL, "Bearer hunter2"); w.Code != http.StatusNoContent {
+		t.Fatalf("close: got %d: %s", w.Code, w.Body)
+	}
+	select {
+	case <-session.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("client session still open after admin close")
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if _, ok := testServer.sessions.Load(mine.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed session still tracked")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,147 @@
+// auth.go - Scoped, expiring session tokens
+//
+// With -token-file set, /connect requires a token, passed either as
+// "Authorization: Bearer <token>" or as ?token= (browsers cannot set headers
+// on a WebTransport CONNECT). The file is a JSON array of token specs:
+//
+//	[{"token": "s3cret", "name": "alice", "expires": "2026-12-31T00:00:00Z",
+//	  "max_sessions": 2, "allow_hosts": ["*.example.com", "api.github.com"],
+//	  "byte_budget": 1073741824}]
+//
+// Zero/empty limits mean unlimited. Expired tokens are rejected at upgrade,
+// and sessions are closed when their token expires or its byte budget runs out.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenSpec is one entry in the token file
+type TokenSpec struct {
+	Token       string    `json:"token"`
+	Name        string    `json:"name"`
+	Expires     time.Time `json:"expires,omitempty"`
+	MaxSessions int       `json:"max_sessions,omitempty"`
+	AllowHosts  []string  `json:"allow_hosts,omitempty"` // exact host or *.domain; empty = any
+	ByteBudget  int64     `json:"byte_budget,omitempty"`
+}
+
+// Token is a loaded TokenSpec plus its live usage
+type Token struct {
+	TokenSpec
+	sessions  int // guarded by TokenStore.mu
+	bytesUsed atomic.Int64
+}
+
+// TokenStore holds the tokens accepted by /connect
+type TokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*Token
+}
+
+var (
+	errTokenMissing  = errors.New("missing token")
+	errTokenUnknown  = errors.New("invalid token")
+	errTokenExpired  = errors.New("token expired")
+	errTokenSessions = errors.New("token session limit reached")
+)
+
+// LoadTokenStore reads and validates a token file
+func LoadTokenStore(path string) (*TokenStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []TokenSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	ts := &TokenStore{tokens: make(map[string]*Token)}
+	for i, spec := range specs {
+		if spec.Token == "" {
+			return nil, fmt.Errorf("%s: entry %d has no token", path, i)
+		}
+		if _, dup := ts.tokens[spec.Token]; dup {
+			return nil, fmt.Errorf("%s: duplicate token for %q", path, spec.Name)
+		}
+		ts.tokens[spec.Token] = &Token{TokenSpec: spec}
+	}
+	return ts, nil
+}
+
+// Acquire validates a token and reserves one of its session slots
+func (ts *TokenStore) Acquire(secret string, now time.Time) (*Token, error) {
+	if secret == "" {
+		return nil, errTokenMissing
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.tokens[secret]
+	if !ok {
+		return nil, errTokenUnknown
+	}
+	if t.Expired(now) {
+		return nil, errTokenExpired
+	}
+	if t.MaxSessions > 0 && t.sessions >= t.MaxSessions {
+		return nil, errTokenSessions
+	}
+	t.sessions++
+	return t, nil
+}
+
+// Release returns a session slot taken by Acquire
+func (ts *TokenStore) Release(t *Token) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if t.sessions > 0 {
+		t.sessions--
+	}
+}
+
+func (t *Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// AllowsHost reports whether the token may connect to host
+func (t *Token) AllowsHost(host string) bool {
+	if len(t.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range t.AllowHosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChargeBytes debits n bytes and reports whether the budget still holds
+func (t *Token) ChargeBytes(n int) bool {
+	used := t.bytesUsed.Add(int64(n))
+	return t.ByteBudget <= 0 || used <= t.ByteBudget
+}
+
+// tokenFromRequest extracts a bearer token from the header or query string
+func tokenFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,87 @@
+// auth_test.go - Token scope, expiry and budget tests
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTokenFile(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenStoreScopes(t *testing.T) {
+	path := writeTokenFile(t, `[
+		{"token": "alice", "name": "alice", "max_sessions": 1, "allow_hosts": ["*.example.com", "api.github.com"], "byte_budget": 100},
+		{"token": "old", "name": "old", "expires": "2020-01-01T00:00:00Z"}
+	]`)
+	ts, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatalf("LoadTokenStore: %v", err)
+	}
+	now := time.Now()
+
+	if _, err := ts.Acquire("", now); err != errTokenMissing {
+		t.Errorf("missing token: got %v", err)
+	}
+	if _, err := ts.Acquire("nope", now); err != errTokenUnknown {
+		t.Errorf("unknown token: got %v", err)
+	}
+	if _, err := ts.Acquire("old", now); err != errTokenExpired {
+		t.Errorf("expired token: got %v", err)
+	}
+
+	tok, err := ts.Acquire("alice", now)
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if _, err := ts.Acquire("alice", now); err != errTokenSessions {
+		t.Errorf("second session should exceed max_sessions: got %v", err)
+	}
+	ts.Release(tok)
+	if _, err := ts.Acquire("alice", now); err != nil {
+		t.Errorf("slot should be free after Release: %v", err)
+	}
+
+	for host, want := range map[string]bool{
+		"www.example.com": true,
+		"API.GitHub.com.": true,
+		"example.com":     false,
+		"evil.com":        false,
+	} {
+		if got := tok.AllowsHost(host); got != want {
+			t.Errorf("AllowsHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	if !tok.ChargeBytes(60) || tok.ChargeBytes(60) {
+		t.Errorf("byte budget of 100 should allow 60 then reject 120")
+	}
+}
+
+func TestTokenFileValidation(t *testing.T) {
+	for _, body := range []string{`{`, `[{"name": "x"}]`, `[{"token": "a"}, {"token": "a"}]`} {
+		if _, err := LoadTokenStore(writeTokenFile(t, body)); err == nil {
+			t.Errorf("LoadTokenStore(%s) should fail", body)
+		}
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/connect?token=q", nil)
+	if got := tokenFromRequest(r); got != "q" {
+		t.Errorf("query token: got %q", got)
+	}
+	r.Header.Set("Authorization", "Bearer h")
+	if got := tokenFromRequest(r); got != "h" {
+		t.Errorf("header should win over query: got %q", got)
+	}
+}
@@ -0,0 +1,88 @@
+// backpressure.go - Bounded read-ahead between a socket and the event stream
+//
+// readLoop may read up to -read-ahead chunks ahead of the client: each read
+// goes onto a per-connection queue that a sender goroutine drains into
+// MsgData events. Once the queue is full readLoop blocks before its next
+// Read, so a slow client leaves the data in the kernel's socket buffer and
+// TCP flow control pushes back on the remote host, instead of the proxy
+// buffering it. Each connection holds at most depth+2 read buffers: the
+// queued ones, the one being sent, and the one being read into.
+
+package main
+
+// defaultReadAhead is how many reads a connection may queue for its client
+const defaultReadAhead = 4
+
+// readChunk is one queued event; bp is the pooled buffer data lives in,
+// returned to its pool once the event is written, or nil
+type readChunk struct {
+	msgType byte
+	data    []byte
+	bp      *[]byte
+}
+
+// readQueue carries one connection's events from readLoop to its sender
+type readQueue struct {
+	sess *Session
+	conn *Connection
+	ch   chan readChunk
+	done chan struct{} // closed when the sender has drained ch
+}
+
+// newReadQueue starts conn's sender, or returns nil with read-ahead off,
+// in which case readLoop sends each event itself
+func (sess *Session) newReadQueue(conn *Connection) *readQueue {
+	if sess.readAhead <= 0 {
+		return nil
+	}
+	q := &readQueue{
+		sess: sess,
+		conn: conn,
+		ch:   make(chan readChunk, sess.readAhead),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *readQueue) run() {
+	defer close(q.done)
+	for c := range q.ch {
+		if !q.sess.sendEvent(c.msgType, q.conn.id, c.data) && c.msgType == MsgData {
+			q.conn.truncated.Store(true)
+		}
+		if c.bp != nil {
+			putReadBuf(c.bp)
+		}
+	}
+}
+
+// send queues an event behind those already queued, blocking while the
+// queue is full. It reports whether bp was taken; if so the caller must
+// read into a fresh buffer. Without a queue the event is sent inline.
+func (q *readQueue) send(sess *Session, conn *Connection, msgType byte, data []byte, bp *[]byte) bool {
+	if q == nil {
+		if !sess.sendEvent(msgType, conn.id, data) && msgType == MsgData {
+			conn.truncated.Store(true)
+		}
+		return false
+	}
+	select {
+	case q.ch <- readChunk{msgType: msgType, data: data, bp: bp}:
+		return bp != nil
+	case <-sess.ctx.Done():
+		// The session is gone; whatever was queued won't be delivered either
+		conn.truncated.Store(true)
+		return false
+	}
+}
+
+// close waits for the queued events to be written, so nothing readLoop
+// queued is still in flight when it returns
+func (q *readQueue) close() {
+	if q == nil {
+		return
+	}
+	close(q.ch)
+	<-q.done
+}
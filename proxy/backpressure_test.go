@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReadAheadBounded stalls the client and checks readLoop stops reading
+// the socket once its queue is full, then delivers everything in order
+func TestReadAheadBounded(t *testing.T) {
+	const depth = 2
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.readAhead = depth })
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	payload := make([]byte, 8<<20)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	go func() {
+		remote.Write(payload)
+		remote.Close()
+	}()
+
+	// Nothing reads the event stream yet; the remote's writes back up into
+	// the socket buffers rather than the proxy
+	time.Sleep(300 * time.Millisecond)
+	if in := conn.bytesIn.Load(); in > (depth+2)*readBufSize {
+		t.Fatalf("read %d bytes with the client stalled, want at most %d", in, (depth+2)*readBufSize)
+	}
+
+	var got []byte
+	for {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType == MsgClosed {
+			break
+		}
+		if ev.msgType != MsgData {
+			t.Fatalf("unexpected event %#x", ev.msgType)
+		}
+		got = append(got, ev.data...)
+	}
+	if len(got) != len(payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+	for i := range got {
+		if got[i] != payload[i] {
+			t.Fatalf("data differs at byte %d", i)
+		}
+	}
+}
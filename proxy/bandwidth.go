@@ -0,0 +1,40 @@
+// bandwidth.go - Per-session bandwidth limit
+//
+// The session and connection count limits don't stop one session from
+// saturating the host's uplink. With -max-bandwidth set, each session gets
+// a token bucket of that many bytes per second for each direction: egress
+// (MsgSend, MsgSendTo) and ingress (data read from its connections). A
+// session over its rate is slowed down, never has data dropped: the send
+// or read waits until the bucket has refilled.
+
+package main
+
+import (
+	"time"
+)
+
+// defaultBandwidthBurst lets one full read through without waiting
+const defaultBandwidthBurst = readBufSize
+
+// throttle charges n bytes to b, waiting out any deficit. It returns false
+// if the session ended while waiting. A nil bucket is unlimited.
+func (sess *Session) throttle(b *tokenBucket, n int) bool {
+	if b == nil {
+		return true
+	}
+	d := b.take(time.Now(), float64(n))
+	if d <= 0 {
+		return true
+	}
+	if sess.srv != nil {
+		sess.srv.metrics.bandwidthWaitNanos.Add(int64(d))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-sess.ctx.Done():
+		return false
+	}
+}
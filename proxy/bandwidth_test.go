@@ -0,0 +1,76 @@
+// bandwidth_test.go - Per-session bandwidth limit tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	b := newTokenBucket(1000, 500)
+	now := time.Unix(1000, 0)
+	if d := b.take(now, 500); d != 0 {
+		t.Fatalf("burst: waited %v", d)
+	}
+	// 250 bytes of debt at 1000/s
+	if d := b.take(now, 250); d != 250*time.Millisecond {
+		t.Fatalf("debt: waited %v, want 250ms", d)
+	}
+	// The debt is paid off before new tokens accrue
+	if d := b.take(now.Add(250*time.Millisecond), 100); d != 100*time.Millisecond {
+		t.Fatalf("after payoff: waited %v, want 100ms", d)
+	}
+}
+
+// TestBandwidthLimit sends 1MB through a 256KB/s session: after the 64KiB
+// burst the rest takes 3.75s
+func TestBandwidthLimit(t *testing.T) {
+	conn, remote := tcpPair(t)
+	sess := &Session{ctx: context.Background(), sendLimiter: newTokenBucket(256*1024, defaultBandwidthBurst)}
+	sess.connections.Store(conn.id, conn)
+	defer conn.Close()
+
+	want := bytes.Repeat([]byte{0x5a}, 1024*1024)
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(io.LimitReader(remote, int64(len(want))))
+		got <- b
+	}()
+
+	start := time.Now()
+	for off := 0; off < len(want); off += 64 * 1024 {
+		chunk := want[off : off+64*1024]
+		msg := binary.BigEndian.AppendUint32(nil, conn.id)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(chunk)))
+		sess.handleSend(readerStream{r: bytes.NewReader(append(msg, chunk...))})
+	}
+	if b := <-got; !bytes.Equal(b, want) {
+		t.Fatalf("remote got %d of %d bytes", len(b), len(want))
+	}
+	if d := time.Since(start); d < 3500*time.Millisecond || d > 4500*time.Millisecond {
+		t.Fatalf("1MB at 256KB/s took %v, want about 3.75s", d)
+	}
+}
+
+func TestThrottleSessionEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &Session{ctx: ctx}
+	b := newTokenBucket(1, 1)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if sess.throttle(b, 3600) {
+		t.Fatal("throttle reported success after the session ended")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("throttle outlived its session by %v", d)
+	}
+	if !sess.throttle(nil, 1<<30) {
+		t.Fatal("nil bucket throttled")
+	}
+}
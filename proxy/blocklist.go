@@ -0,0 +1,135 @@
+// blocklist.go - Explicitly blocked destination networks
+//
+// Cloud metadata services answer on fixed addresses that hand out instance
+// credentials. Most sit in ranges the private-address check refuses
+// anyway, but they're blocked here by address so that doesn't hinge on
+// how Go classifies them (Alibaba's is in shared 100.64.0.0/10 space, which
+// isn't "private"), and the container is told the destination is blocked.
+// -block-cidrs adds networks to the list. Every address a name resolves to
+// is checked, so a public-looking hostname for a metadata IP is refused too.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// metadataCIDRs are blocked on every proxy
+var metadataCIDRs = []string{
+	"169.254.169.254/32", // AWS, GCP, Azure, OpenStack, DigitalOcean, Oracle
+	"169.254.170.2/32",   // AWS ECS task credentials
+	"fd00:ec2::254/128",  // AWS IMDS over IPv6
+	"100.100.100.200/32", // Alibaba Cloud
+}
+
+var errBlockedDestination = errors.New("destination blocked")
+
+// blockedAddrError is errBlockedDestination with the network that matched
+type blockedAddrError struct {
+	host    string
+	network *net.IPNet
+}
+
+func (e *blockedAddrError) Error() string        { return errBlockedDestination.Error() }
+func (e *blockedAddrError) Is(target error) bool { return target == errBlockedDestination }
+
+// ParseCIDRs parses a comma-separated list of CIDRs, as -block-cidrs and
+// -ratelimit-exempt take
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// defaultBlockedNets returns the parsed metadataCIDRs
+func defaultBlockedNets() []*net.IPNet {
+	return mustParseCIDRs(strings.Join(metadataCIDRs, ","))
+}
+
+// mustParseCIDRs is ParseCIDRs for built-in lists
+func mustParseCIDRs(s string) []*net.IPNet {
+	nets, err := ParseCIDRs(s)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// blockedNet returns the blocked network containing ip, or nil
+func (t *DestinationTable) blockedNet(ip net.IP) *net.IPNet {
+	for _, n := range t.blocked {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// checkLiteral refuses a blocked, private or geofenced IP literal up
+// front; names are left to resolve, which checks every address they
+// resolve to
+func (t *DestinationTable) checkLiteral(host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if n := t.blockedNet(ip); n != nil {
+		return &blockedAddrError{host: host, network: n}
+	}
+	if isPrivateIP(ip) {
+		return &privateAddrError{host: host}
+	}
+	return t.geoCheck(host, ip)
+}
+
+// screenAddrs keeps the addresses of host that may be dialed, or explains
+// why none may
+func (t *DestinationTable) screenAddrs(host string, ips []net.IPAddr) ([]net.IPAddr, error) {
+	var ok []net.IPAddr
+	var blocked *net.IPNet
+	var geoErr error
+	for _, ip := range ips {
+		if n := t.blockedNet(ip.IP); n != nil {
+			blocked = n
+			continue
+		}
+		if isPrivateIP(ip.IP) {
+			continue
+		}
+		if err := t.geoCheck(host, ip.IP); err != nil {
+			geoErr = err
+			continue
+		}
+		ok = append(ok, ip)
+	}
+	switch {
+	case len(ok) > 0:
+		return ok, nil
+	case blocked != nil:
+		return nil, &blockedAddrError{host: host, network: blocked}
+	case geoErr != nil:
+		return nil, geoErr
+	}
+	return nil, &privateAddrError{host: host}
+}
+
+// isPrivateIP reports a private/loopback address (SSRF protection). Names
+// aren't checked up front: a second lookup at dial time could return a
+// different address. Destination.resolve vets names as it resolves them
+// for the dial; IP literals are refused early by checkLiteral.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,79 @@
+// blocklist_test.go - Cloud metadata and -block-cidrs tests
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetadataLiteralBlocked(t *testing.T) {
+	tbl := NewDestinationTable()
+	for _, host := range []string{"169.254.169.254", "fd00:ec2::254", "100.100.100.200"} {
+		err := tbl.checkLiteral(host)
+		if !errors.Is(err, errBlockedDestination) {
+			t.Errorf("%s: got %v, want destination blocked", host, err)
+			continue
+		}
+		if d := dialDecision(err); d.Category != PolicyBlocked || d.Message != "destination blocked" {
+			t.Errorf("%s: decision %+v", host, d)
+		}
+	}
+	// Other private addresses keep their own category
+	if err := tbl.checkLiteral("10.1.2.3"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("10.1.2.3: got %v", err)
+	}
+	if err := tbl.checkLiteral("example.com"); err != nil {
+		t.Errorf("name checked as a literal: %v", err)
+	}
+}
+
+func TestMetadataHostnameBlocked(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("169.254.169.254")}}, nil
+	}
+	dialed := false
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, errors.New("unreachable")
+	}
+
+	_, _, err := tbl.Get("metadata.example.com", 80).Dial(context.Background(), time.Second, "")
+	var blocked *blockedAddrError
+	if !errors.As(err, &blocked) || blocked.network.String() != "169.254.169.254/32" {
+		t.Fatalf("got %v, want blocked by 169.254.169.254/32", err)
+	}
+	if dialed {
+		t.Fatal("dialed a metadata address")
+	}
+	if _, err := tbl.Get("metadata.example.com", 53).ResolveUDP(context.Background()); !errors.Is(err, errBlockedDestination) {
+		t.Fatalf("UDP: got %v", err)
+	}
+}
+
+func TestBlockCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs(" 203.0.113.0/24, 2001:db8::/32 ,")
+	if err != nil || len(nets) != 2 {
+		t.Fatalf("got %v, %v", nets, err)
+	}
+	for _, bad := range []string{"203.0.113.0", "10.0.0.0/33", "nope"} {
+		if _, err := ParseCIDRs(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+
+	tbl := NewDestinationTable()
+	tbl.blocked = append(tbl.blocked, nets...)
+	if err := tbl.checkLiteral("203.0.113.9"); !errors.Is(err, errBlockedDestination) {
+		t.Fatalf("extra CIDR not applied: %v", err)
+	}
+	// A name is refused only if every address it has is refused
+	ips, err := tbl.screenAddrs("mixed.example", []net.IPAddr{{IP: net.ParseIP("203.0.113.9")}, {IP: net.ParseIP("198.51.100.1")}})
+	if err != nil || len(ips) != 1 || !ips[0].IP.Equal(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+}
@@ -0,0 +1,246 @@
+// capture.go - Per-session protocol capture for debugging
+//
+// With -capture-dir set, every message a session receives from the container
+// and every event sent back is appended to a capture file, one per session.
+// Use -dump-capture FILE to pretty-print a capture.
+//
+// File format (integers big-endian):
+//
+//	header:  "FRISCAP1"
+//	record:  timestamp (8, unix nanos), dir (1), flags (1), msgType (1),
+//	         connID (4), length (4), payload (length bytes, absent if redacted)
+//
+// dir is 0 for container -> host and 1 for host -> container. For requests,
+// payload is the raw message body following connID; for events it is the
+// event data. When flagRedacted is set, length is the original payload size
+// and no payload bytes follow.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+const captureMagic = "FRISCAP1"
+
+const (
+	captureIn  = 0 // container -> host
+	captureOut = 1 // host -> container
+)
+
+const flagRedacted = 0x01
+
+// CaptureRecord is one framed message in a capture file
+type CaptureRecord struct {
+	Time     time.Time
+	Dir      byte
+	Redacted bool
+	MsgType  byte
+	ConnID   uint32
+	Length   uint32
+	Payload  []byte
+}
+
+// Recorder appends capture records for a single session
+type Recorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	redact bool
+	closed bool
+}
+
+// NewRecorder creates a capture file in dir named after the session
+func NewRecorder(dir, remoteIP string, redact bool) (*Recorder, error) {
+	name := fmt.Sprintf("%d-%s.cap", time.Now().UnixNano(), strings.NewReplacer(":", "_", "[", "", "]", "").Replace(remoteIP))
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), redact: redact}
+	if _, err := r.w.WriteString(captureMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record appends one message. Data-carrying payloads are dropped when the
+// recorder redacts; control messages are kept so captures stay debuggable.
+func (r *Recorder) Record(dir, msgType byte, connID uint32, payload []byte) {
+	if r == nil {
+		return
+	}
+	var flags byte
+	length := uint32(len(payload))
+	if r.redact && isDataMsg(msgType) {
+		flags |= flagRedacted
+		payload = nil
+	}
+
+	var hdr [8 + 1 + 1 + 1 + 4 + 4]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(time.Now().UnixNano()))
+	hdr[8] = dir
+	hdr[9] = flags
+	hdr[10] = msgType
+	binary.BigEndian.PutUint32(hdr[11:15], connID)
+	binary.BigEndian.PutUint32(hdr[15:19], length)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return // late events from goroutines still winding down
+	}
+	r.w.Write(hdr[:])
+	r.w.Write(payload)
+	r.w.Flush()
+}
+
+// Close flushes and closes the capture file
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.w.Flush()
+	return r.f.Close()
+}
+
+func isDataMsg(msgType byte) bool {
+	return msgType == MsgSend || msgType == MsgData || msgType == MsgSendTo || msgType == MsgRecvFrom
+}
+
+// ReadCapture calls fn for each record in a capture stream
+func ReadCapture(r io.Reader, fn func(CaptureRecord) error) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return fmt.Errorf("not a friscy capture file")
+	}
+
+	for {
+		var hdr [19]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("truncated record header: %w", err)
+		}
+		rec := CaptureRecord{
+			Time:     time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:8]))),
+			Dir:      hdr[8],
+			Redacted: hdr[9]&flagRedacted != 0,
+			MsgType:  hdr[10],
+			ConnID:   binary.BigEndian.Uint32(hdr[11:15]),
+			Length:   binary.BigEndian.Uint32(hdr[15:19]),
+		}
+		if !rec.Redacted {
+			rec.Payload = make([]byte, rec.Length)
+			if _, err := io.ReadFull(br, rec.Payload); err != nil {
+				return fmt.Errorf("truncated record payload: %w", err)
+			}
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// DumpCapture pretty-prints a capture stream, one line per record
+func DumpCapture(w io.Writer, r io.Reader) error {
+	var start time.Time
+	return ReadCapture(r, func(rec CaptureRecord) error {
+		if start.IsZero() {
+			start = rec.Time
+		}
+		arrow := "->"
+		if rec.Dir == captureOut {
+			arrow = "<-"
+		}
+		payload := fmt.Sprintf("%q", truncate(rec.Payload, 64))
+		if rec.Redacted {
+			payload = "<redacted>"
+		}
+		_, err := fmt.Fprintf(w, "%10.6f %s [%d] %-14s len=%-6d %s\n",
+			rec.Time.Sub(start).Seconds(), arrow, rec.ConnID, msgName(rec.MsgType), rec.Length, payload)
+		return err
+	})
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+var msgNames = map[byte]string{
+	MsgConnect:        "Connect",
+	MsgBind:           "Bind",
+	MsgListen:         "Listen",
+	MsgSend:           "Send",
+	MsgClose:          "Close",
+	MsgSendTo:         "SendTo",
+	MsgForward:        "Forward",
+	MsgSetPrio:        "SetPrio",
+	MsgFlush:          "Flush",
+	MsgSetTimeout:     "SetTimeout",
+	MsgCloseWrite:     "CloseWrite",
+	MsgShutdown:       "Shutdown",
+	MsgConnected:      "Connected",
+	MsgConnectError:   "ConnectError",
+	MsgData:           "Data",
+	MsgAccept:         "Accept",
+	MsgClosed:         "Closed",
+	MsgError:          "Error",
+	MsgRecvFrom:       "RecvFrom",
+	MsgTimeout:        "Timeout",
+	MsgCertError:      "CertError",
+	MsgSendToError:    "SendToError",
+	MsgOpened:         "Opened",
+	MsgTransportStats: "TransportStats",
+	MsgAck:            "Ack",
+}
+
+func msgName(t byte) string {
+	if n, ok := msgNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+// teeStream records everything a request handler reads from its stream
+type teeStream struct {
+	webtransport.Stream
+	buf bytes.Buffer
+}
+
+func (t *teeStream) Read(p []byte) (int, error) {
+	n, err := t.Stream.Read(p)
+	t.buf.Write(p[:n])
+	return n, err
+}
+
+// recordRequest captures a request body as consumed by its handler. All
+// requests lead with a 4-byte connID, which is split out into the record.
+func (r *Recorder) recordRequest(msgType byte, body []byte) {
+	var connID uint32
+	if len(body) >= 4 {
+		connID = binary.BigEndian.Uint32(body[0:4])
+		body = body[4:]
+	}
+	r.Record(captureIn, msgType, connID, body)
+}
@@ -0,0 +1,68 @@
+// capture_test.go - Capture file format round-trip tests
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCaptureRoundTrip writes a capture and reads it back, including redaction
+func TestCaptureRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	rec, err := NewRecorder(dir, "[2001:db8::1]:443", true)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	rec.recordRequest(MsgConnect, []byte{0, 0, 0, 7, SOCK_STREAM, 0, 4, 'h', 'o', 's', 't', 0, 80})
+	rec.recordRequest(MsgSend, []byte{0, 0, 0, 7, 0, 0, 0, 5, 's', 'e', 'c', 'r', 't'})
+	rec.Record(captureOut, MsgConnected, 7, nil)
+	rec.Record(captureOut, MsgData, 7, []byte("reply"))
+	rec.Close()
+	rec.Record(captureOut, MsgClosed, 7, nil) // after close: dropped
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cap"))
+	if len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []CaptureRecord
+	if err := ReadCapture(bytes.NewReader(raw), func(r CaptureRecord) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadCapture: %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(got))
+	}
+	if got[0].Dir != captureIn || got[0].MsgType != MsgConnect || got[0].ConnID != 7 || got[0].Redacted {
+		t.Errorf("connect record: %+v", got[0])
+	}
+	if !got[1].Redacted || got[1].Length != 9 || got[1].Payload != nil {
+		t.Errorf("send record should be redacted with original length: %+v", got[1])
+	}
+	if !got[3].Redacted || got[3].Dir != captureOut {
+		t.Errorf("data event should be redacted: %+v", got[3])
+	}
+
+	var out strings.Builder
+	if err := DumpCapture(&out, bytes.NewReader(raw)); err != nil {
+		t.Fatalf("DumpCapture: %v", err)
+	}
+	if !strings.Contains(out.String(), "Connect") || !strings.Contains(out.String(), "<redacted>") {
+		t.Errorf("unexpected dump:\n%s", out.String())
+	}
+
+	if err := ReadCapture(bytes.NewReader(raw[:len(raw)-2]), func(CaptureRecord) error { return nil }); err == nil {
+		t.Errorf("truncated capture should fail to parse")
+	}
+}
@@ -0,0 +1,109 @@
+// certreload.go - Picking up renewed certificates without a restart
+//
+// The WebTransport and API listeners take their certificate from
+// getCertificate on every handshake, so replacing the current one is all
+// a renewal takes: sessions already up keep going, new handshakes see the
+// new certificate. With -cert-reload-interval the cert and key files are
+// stat'ed that often and reread when either changes. A pair that doesn't
+// load (say the cert has been rewritten but not yet the key) is logged
+// and retried next time, while the old certificate stays in use.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// defaultCertReloadInterval is how often the cert files are checked
+const defaultCertReloadInterval = time.Minute
+
+// certFileState identifies one version of the cert and key files
+type certFileState struct {
+	certMod, keyMod   int64 // unix nanos
+	certSize, keySize int64
+}
+
+func statCertFiles(certFile, keyFile string) (certFileState, error) {
+	c, err := os.Stat(certFile)
+	if err != nil {
+		return certFileState{}, err
+	}
+	k, err := os.Stat(keyFile)
+	if err != nil {
+		return certFileState{}, err
+	}
+	return certFileState{c.ModTime().UnixNano(), k.ModTime().UnixNano(), c.Size(), k.Size()}, nil
+}
+
+// loadCert returns the server certificate, reading it on first use
+func (s *Server) loadCert() (*tls.Certificate, error) {
+	if cert := s.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return s.readCert()
+}
+
+// readCert reads the cert and key files and makes them the current
+// certificate
+func (s *Server) readCert() (*tls.Certificate, error) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+	// Stat'ed first: a write landing during the read shows up next time
+	state, _ := statCertFiles(s.certFile, s.keyFile)
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificates: %w", err)
+	}
+	s.cert.Store(&cert)
+	s.certState = state
+	return &cert, nil
+}
+
+// getCertificate is the listeners' tls.Config.GetCertificate
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// reloadCert rereads the cert and key files if they changed since they
+// were last read, reporting whether the certificate was replaced
+func (s *Server) reloadCert() (bool, error) {
+	state, err := statCertFiles(s.certFile, s.keyFile)
+	if err != nil {
+		return false, err
+	}
+	s.certMu.Lock()
+	unchanged := state == s.certState
+	s.certMu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	if _, err := s.readCert(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchCertEvery reloads the certificate when its files change, checking
+// every interval until ctx is done
+func (s *Server) WatchCertEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reloaded, err := s.reloadCert()
+			if err != nil {
+				slog.Warn("certificate reload failed, keeping the current one", "cert", s.certFile, "err", err)
+			} else if reloaded {
+				slog.Info("certificate reloaded", "cert", s.certFile, "not_after", s.cert.Load().Leaf.NotAfter)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
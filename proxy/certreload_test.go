@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertFiles writes cert and its key as PEM, the way a renewal would
+func writeCertFiles(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCertReload swaps the cert files under a running API server and
+// checks the next handshake gets the new certificate
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	old := testCert(t, "old.localhost", false, nil)
+	writeCertFiles(t, old, certFile, keyFile)
+
+	s := NewServer(":0", certFile, keyFile, NewRateLimiter(1, 1), nil)
+	s.apiTLS = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiListener = ln
+	go s.RunAPIServer("")
+	defer s.Shutdown()
+
+	served := func() string {
+		t.Helper()
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := served(); cn != "old.localhost" {
+		t.Fatalf("served %q before the swap", cn)
+	}
+	if reloaded, err := s.reloadCert(); reloaded || err != nil {
+		t.Fatalf("unchanged files: reloaded %v, %v", reloaded, err)
+	}
+
+	renewed := testCert(t, "new.localhost", false, nil)
+	writeCertFiles(t, renewed, certFile, keyFile)
+	later := time.Now().Add(time.Minute) // in case the writes share the old mtime
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if reloaded, err := s.reloadCert(); !reloaded || err != nil {
+		t.Fatalf("renewed files: reloaded %v, %v", reloaded, err)
+	}
+	if cn := served(); cn != "new.localhost" {
+		t.Fatalf("served %q after the swap", cn)
+	}
+
+	// A half-written renewal keeps the current certificate
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := s.reloadCert(); err == nil {
+		t.Fatal("reloaded a mismatched pair")
+	}
+	if cn := served(); cn != "new.localhost" {
+		t.Fatalf("served %q after a failed reload", cn)
+	}
+}
@@ -0,0 +1,142 @@
+// clientauth_test.go - Mutual TLS client certificate tests
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for cn, self-signed when parent is nil
+func testCert(t *testing.T, cn string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	ca := testCert(t, "friscy test CA", true, nil)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600)
+	if _, err := LoadClientCAs(path); err != nil {
+		t.Fatal(err)
+	}
+
+	junk := filepath.Join(dir, "junk.pem")
+	os.WriteFile(junk, []byte("not a certificate"), 0o600)
+	if _, err := LoadClientCAs(junk); err == nil {
+		t.Fatal("accepted a file without certificates")
+	}
+	if _, err := LoadClientCAs(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("accepted a missing file")
+	}
+}
+
+// TestClientCertHandshake checks the server config refuses clients without
+// a certificate from the CA, and exposes the CN of those with one
+func TestClientCertHandshake(t *testing.T) {
+	ca := testCert(t, "friscy test CA", true, nil)
+	serverCert := testCert(t, "localhost", false, &ca)
+	good := testCert(t, "alice", false, &ca)
+	rogue := testCert(t, "mallory", false, nil)
+
+	s := &Server{clientCAs: x509.NewCertPool()}
+	s.clientCAs.AddCert(ca.Leaf)
+
+	handshake := func(client []tls.Certificate) (tls.ConnectionState, error) {
+		cfg := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		s.applyClientAuth(cfg)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: client})
+			if err == nil {
+				c.Read(make([]byte, 1)) // wait for the server's verdict
+				c.Close()
+			}
+		}()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		srv := tls.Server(c, cfg)
+		err = srv.Handshake()
+		return srv.ConnectionState(), err
+	}
+
+	if _, err := handshake(nil); err == nil {
+		t.Error("handshake without a client certificate succeeded")
+	}
+	if _, err := handshake([]tls.Certificate{rogue}); err == nil {
+		t.Error("handshake with an untrusted certificate succeeded")
+	}
+	st, err := handshake([]tls.Certificate{good})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("CONNECT", "/connect", nil)
+	r.TLS = &st
+	if cn, err := s.clientIdentity(r); err != nil || cn != "alice" {
+		t.Fatalf("identity %q, %v; want alice", cn, err)
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	r := httptest.NewRequest("CONNECT", "/connect", nil)
+
+	// Off without -client-ca
+	if cn, err := (&Server{}).clientIdentity(r); cn != "" || err != nil {
+		t.Fatalf("no CA: got %q, %v", cn, err)
+	}
+
+	s := &Server{clientCAs: x509.NewCertPool()}
+	r.TLS = nil
+	if _, err := s.clientIdentity(r); err != errNoClientCert {
+		t.Fatalf("plaintext request: got %v", err)
+	}
+	r.TLS = &tls.ConnectionState{}
+	if _, err := s.clientIdentity(r); err != errNoClientCert {
+		t.Fatalf("unverified request: got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// close.go - MsgClose and MsgShutdown, and reporting connections closed
+//
+// A MsgClose lets data the remote host already sent drain to the container
+// before MsgClosed, for up to -close-drain; MsgShutdown doesn't wait. Either
+// way a connection is reported closed exactly once, whichever path gets
+// there first.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// defaultCloseDrain bounds how long MsgClose keeps relaying data the remote
+// host had already sent
+const defaultCloseDrain = time.Second
+
+func (sess *Session) handleClose(stream webtransport.Stream) {
+	// Read: connID (4)
+	var header [4]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	sess.log().Debug("close", "conn_id", connID)
+
+	var conn *Connection
+	if v, ok := sess.connections.LoadAndDelete(connID); ok {
+		conn = v.(*Connection)
+		if !sess.parkConnection(conn) {
+			if sess.drainConnection(conn) {
+				return // readLoop reports MsgClosed after the last data
+			}
+			conn.Close()
+		}
+		if conn.closeReported.Swap(true) {
+			return // readLoop saw the socket close and reported it
+		}
+	}
+
+	sess.sendEvent(MsgClosed, connID, closedPayload(conn))
+}
+
+// drainConnection starts a graceful close of a connected stream socket:
+// no more sends reach it (it's out of the session's table), a FIN tells
+// the remote host we're done, and readLoop relays whatever is still
+// arriving until EOF or the -close-drain deadline, then closes it. It
+// reports false if conn must be closed at once instead.
+func (sess *Session) drainConnection(conn *Connection) bool {
+	conn.mu.Lock()
+	netConn := conn.conn
+	coalescer := conn.coalescer
+	conn.mu.Unlock()
+	if sess.closeDrain <= 0 || netConn == nil || conn.sockType == SOCK_DGRAM || conn.forwarding.Load() {
+		return false
+	}
+
+	if coalescer != nil {
+		coalescer.Flush()
+	}
+	if cw, ok := netConn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.drainUntil.Store(time.Now().Add(sess.closeDrain).UnixNano())
+	netConn.SetReadDeadline(time.Now()) // readLoop picks up the drain deadline
+	if conn.readExited.Load() {
+		sess.finishDrain(conn)
+	}
+	return true
+}
+
+// finishDrain closes a drained connection and reports it, once
+func (sess *Session) finishDrain(conn *Connection) {
+	if conn.closeReported.Swap(true) {
+		return
+	}
+	conn.Close()
+	sess.sendClosed(conn)
+}
+
+// handleShutdown closes a connection at once, discarding anything unread:
+// stream sockets are reset rather than shut down with a FIN
+func (sess *Session) handleShutdown(stream webtransport.Stream) {
+	// Read: connID (4)
+	var header [4]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	sess.log().Debug("shutdown", "conn_id", connID)
+
+	v, ok := sess.connections.LoadAndDelete(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+	conn.mu.Lock()
+	if tc, ok := tcpConnOf(conn.conn); ok {
+		tc.SetLinger(0)
+	}
+	conn.mu.Unlock()
+	conn.Close()
+	// readLoop, failing its Read, may report it first
+	if !conn.closeReported.Swap(true) {
+		sess.sendClosed(conn)
+	}
+}
+
+// closedPayload is MsgClosed's payload: bytesIn (8), bytesOut (8), the
+// totals read from and written to the remote side over the connection's
+// life. Unknown connections report zeros.
+func closedPayload(conn *Connection) []byte {
+	var p [16]byte
+	if conn != nil {
+		binary.BigEndian.PutUint64(p[0:8], conn.bytesIn.Load())
+		binary.BigEndian.PutUint64(p[8:16], conn.bytesOut.Load())
+	}
+	return p[:]
+}
+
+// sendClosed reports conn closed, with its byte counts
+func (sess *Session) sendClosed(conn *Connection) bool {
+	return sess.sendEvent(MsgClosed, conn.id, closedPayload(conn))
+}
+
+// parkConnection hands an OptPool connection back to its destination's idle
+// pool instead of closing it, reporting whether it took care of conn
+func (sess *Session) parkConnection(conn *Connection) bool {
+	if conn.dest == nil || conn.forwarding.Load() || conn.halfClosed.Load() {
+		return false
+	}
+	conn.mu.Lock()
+	netConn := conn.conn
+	coalescer := conn.coalescer
+	conn.mu.Unlock()
+	if netConn == nil {
+		return false
+	}
+	if coalescer != nil && coalescer.Flush() != nil {
+		return false
+	}
+	if conn.closed.Swap(true) {
+		return true
+	}
+	if conn.release != nil {
+		conn.release()
+	}
+
+	// Kick readLoop out of its Read and wait for it to let go of the socket
+	netConn.SetReadDeadline(time.Now())
+	<-conn.readDone
+	conn.dest.PutIdle(netConn, conn.poolOwner)
+	return true
+}
+
+// poolOwner scopes pooled connections to the session
+func (sess *Session) poolOwner() string {
+	return "session:" + strconv.FormatUint(sess.id, 10)
+}
+
+func (c *Connection) Close() {
+	if c.closed.Swap(true) {
+		return // Already closed
+	}
+	if c.release != nil {
+		c.release()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.listenGrace != nil {
+		c.listenGrace.Stop()
+	}
+
+	if c.coalescer != nil {
+		c.coalescer.Flush() // don't drop sends still waiting on the timer
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.udpConn != nil {
+		c.udpConn.Close()
+	}
+	if c.upstream != nil {
+		c.upstream.Close()
+	}
+}
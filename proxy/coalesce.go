@@ -0,0 +1,106 @@
+// coalesce.go - Egress write coalescing for chatty connections
+//
+// A shell echoing keystrokes sends one MsgSend per byte; writing each one
+// straight to the socket produces a flood of tiny TCP segments. A
+// writeCoalescer buffers consecutive sends and writes them together once the
+// flush delay elapses, the buffer fills, or the container sends MsgFlush.
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCoalesceBytes flushes immediately once this much is buffered
+const maxCoalesceBytes = 64 * 1024
+
+// maxCoalesceDelay caps the container-requested flush delay
+const maxCoalesceDelay = 100 * time.Millisecond
+
+type writeCoalescer struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	connID uint32
+	delay  time.Duration
+	buf    []byte
+	timer  *time.Timer
+
+	timeout *atomic.Int64 // write timeout in nanoseconds (MsgSetTimeout); nil or 0 = none
+	log     *slog.Logger  // the session's; nil = slog.Default()
+}
+
+func newWriteCoalescer(conn net.Conn, connID uint32, delay time.Duration) *writeCoalescer {
+	return &writeCoalescer{conn: conn, connID: connID, delay: delay}
+}
+
+func (wc *writeCoalescer) logger() *slog.Logger {
+	if wc.log != nil {
+		return wc.log
+	}
+	return slog.Default()
+}
+
+// Write buffers p, flushing right away if the buffer is full. Errors from a
+// deferred flush are logged since the MsgSend that caused them has returned.
+func (wc *writeCoalescer) Write(p []byte) error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	wc.buf = append(wc.buf, p...)
+	if len(wc.buf) >= maxCoalesceBytes {
+		return wc.flushLocked()
+	}
+	if wc.timer == nil {
+		wc.timer = time.AfterFunc(wc.delay, func() {
+			if err := wc.Flush(); err != nil {
+				wc.logger().Info("send error", "conn_id", wc.connID, "err", err)
+			}
+		})
+	}
+	return nil
+}
+
+// Buffered reports how many bytes are waiting for the next flush
+func (wc *writeCoalescer) Buffered() int {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return len(wc.buf)
+}
+
+// Discard drops anything buffered without writing it
+func (wc *writeCoalescer) Discard() {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.timer != nil {
+		wc.timer.Stop()
+		wc.timer = nil
+	}
+	wc.buf = wc.buf[:0]
+}
+
+// Flush writes out anything buffered
+func (wc *writeCoalescer) Flush() error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.flushLocked()
+}
+
+func (wc *writeCoalescer) flushLocked() error {
+	if wc.timer != nil {
+		wc.timer.Stop()
+		wc.timer = nil
+	}
+	if len(wc.buf) == 0 {
+		return nil
+	}
+	if wc.timeout != nil {
+		setWriteDeadline(wc.conn, wc.timeout.Load())
+	}
+	_, err := wc.conn.Write(wc.buf)
+	wc.buf = wc.buf[:0]
+	return err
+}
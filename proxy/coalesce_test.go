@@ -0,0 +1,64 @@
+// coalesce_test.go - Write coalescer tests
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn counts the writes that reach the "socket"
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *recordingConn) snapshot() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.writes...)
+}
+
+func TestWriteCoalescerBatches(t *testing.T) {
+	rc := &recordingConn{}
+	wc := newWriteCoalescer(rc, 1, 20*time.Millisecond)
+
+	for _, b := range []string{"l", "s", " ", "-", "l"} {
+		if err := wc.Write([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(rc.snapshot()); n != 0 {
+		t.Fatalf("%d writes before the flush timer fired", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	writes := rc.snapshot()
+	if len(writes) != 1 || string(writes[0]) != "ls -l" {
+		t.Fatalf("expected one coalesced write, got %q", writes)
+	}
+
+	// Explicit flush (MsgFlush) doesn't wait for the timer
+	wc.Write([]byte("\n"))
+	wc.Flush()
+	if writes := rc.snapshot(); len(writes) != 2 || string(writes[1]) != "\n" {
+		t.Fatalf("flush: got %q", writes)
+	}
+
+	// A full buffer is written straight away
+	wc.Write(bytes.Repeat([]byte("x"), maxCoalesceBytes))
+	if writes := rc.snapshot(); len(writes) != 3 {
+		t.Fatalf("full buffer should flush immediately, got %d writes", len(writes))
+	}
+}
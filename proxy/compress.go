@@ -0,0 +1,154 @@
+// compress.go - Optional per-connection compression of proxied data
+//
+// With OptCompress on MsgConnect, every MsgData payload the proxy sends for
+// that connection and every MsgSend payload it receives is one complete,
+// self-contained gzip member or zstd frame. Events share the session's one
+// ordered event stream, but compressing each payload on its own means the
+// container needs no decoder state carried between events, and each
+// MsgSend, on its own request stream, decodes alone too. The remote peer
+// sees plain bytes either way.
+//
+// Compression only pays for text-like traffic (plain HTTP, logs, shells);
+// already-compressed payloads grow slightly, which is why it's opt-in.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for OptCompress
+const (
+	CompressNone = 0
+	CompressGzip = 1
+	CompressZstd = 2
+)
+
+// maxDecompressedSend bounds what one compressed MsgSend may expand to
+const maxDecompressedSend = 4 << 20
+
+var errDecompressedTooLarge = errors.New("decompressed payload too large")
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// zstd encoders and decoders are safe for concurrent EncodeAll/DecodeAll
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSend), zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func compressionName(algo byte) string {
+	switch algo {
+	case CompressGzip:
+		return "gzip"
+	case CompressZstd:
+		return "zstd"
+	}
+	return ""
+}
+
+// compressFrame encodes src as one frame of algo
+func compressFrame(algo byte, src []byte) ([]byte, error) {
+	switch algo {
+	case CompressGzip:
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		if _, err := zw.Write(src); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressZstd:
+		enc, _ := zstdCodecs()
+		return enc.EncodeAll(src, make([]byte, 0, len(src)/2+64)), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", algo)
+}
+
+// decompressFrame decodes one frame of algo, refusing output beyond limit
+func decompressFrame(algo byte, src []byte, limit int) ([]byte, error) {
+	switch algo {
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, errDecompressedTooLarge
+		}
+		return out, nil
+	case CompressZstd:
+		_, dec := zstdCodecs()
+		out, err := dec.DecodeAll(src, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, errDecompressedTooLarge
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", algo)
+}
+
+// compressData frames an outbound MsgData payload and records the savings
+func (sess *Session) compressData(algo byte, data []byte) ([]byte, error) {
+	start := time.Now()
+	out, err := compressFrame(algo, data)
+	if err != nil {
+		return nil, err
+	}
+	if sess.srv != nil {
+		m := &sess.srv.metrics
+		m.compressNanos.Add(int64(time.Since(start)))
+		m.compressRawBytes.Add(int64(len(data)))
+		m.compressWireBytes.Add(int64(len(out)))
+	}
+	return out, nil
+}
+
+// decompressData unframes an inbound MsgSend payload and records the savings
+func (sess *Session) decompressData(algo byte, data []byte) ([]byte, error) {
+	start := time.Now()
+	out, err := decompressFrame(algo, data, maxDecompressedSend)
+	if err != nil {
+		return nil, err
+	}
+	if sess.srv != nil {
+		m := &sess.srv.metrics
+		m.decompressNanos.Add(int64(time.Since(start)))
+		m.decompressRawBytes.Add(int64(len(out)))
+		m.decompressWireBytes.Add(int64(len(data)))
+	}
+	return out, nil
+}
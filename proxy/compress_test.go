@@ -0,0 +1,105 @@
+// compress_test.go - OptCompress framing tests and benchmarks
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// httpLike is representative of the text traffic compression is meant for
+var httpLike = []byte(strings.Repeat("HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nServer: nginx\r\n\r\n<html><body><p>hello world</p></body></html>\n", 200))
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, algo := range []byte{CompressGzip, CompressZstd} {
+		for _, src := range [][]byte{httpLike, {}, []byte("x")} {
+			frame, err := compressFrame(algo, src)
+			if err != nil {
+				t.Fatalf("%s: compress: %v", compressionName(algo), err)
+			}
+			out, err := decompressFrame(algo, frame, maxDecompressedSend)
+			if err != nil {
+				t.Fatalf("%s: decompress: %v", compressionName(algo), err)
+			}
+			if !bytes.Equal(out, src) {
+				t.Fatalf("%s: round trip mismatch for %d bytes", compressionName(algo), len(src))
+			}
+		}
+		frame, _ := compressFrame(algo, httpLike)
+		if len(frame) >= len(httpLike)/4 {
+			t.Errorf("%s: %d -> %d bytes, expected text to compress well", compressionName(algo), len(httpLike), len(frame))
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+	for _, algo := range []byte{CompressGzip, CompressZstd} {
+		frame, _ := compressFrame(algo, bomb)
+		if _, err := decompressFrame(algo, frame, 1<<10); err == nil {
+			t.Errorf("%s: oversized frame accepted", compressionName(algo))
+		}
+		if _, err := decompressFrame(algo, []byte("not a frame"), 1<<10); err == nil {
+			t.Errorf("%s: garbage accepted", compressionName(algo))
+		}
+	}
+}
+
+func TestCompressOption(t *testing.T) {
+	opts, err := readConnectOptions(bytes.NewReader([]byte{OptCompress, 1, CompressZstd}))
+	if err != nil || opts.Compress != CompressZstd {
+		t.Fatalf("opts=%+v err=%v", opts, err)
+	}
+	for _, bad := range [][]byte{{OptCompress, 1, 9}, {OptCompress, 0}, {OptCompress, 2, 1, 1}} {
+		if _, err := readConnectOptions(bytes.NewReader(bad)); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestCompressMetrics(t *testing.T) {
+	srv := &Server{}
+	sess := &Session{srv: srv}
+	frame, err := sess.compressData(CompressGzip, httpLike)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.decompressData(CompressGzip, frame); err != nil {
+		t.Fatal(err)
+	}
+	m := &srv.metrics
+	if m.compressRawBytes.Load() != int64(len(httpLike)) || m.compressWireBytes.Load() != int64(len(frame)) {
+		t.Fatalf("compress raw=%d wire=%d", m.compressRawBytes.Load(), m.compressWireBytes.Load())
+	}
+	if m.decompressRawBytes.Load() != int64(len(httpLike)) || m.decompressWireBytes.Load() != int64(len(frame)) {
+		t.Fatalf("decompress raw=%d wire=%d", m.decompressRawBytes.Load(), m.decompressWireBytes.Load())
+	}
+}
+
+// BenchmarkCompressFrame reports throughput and wire/raw ratio for a 16KB
+// MsgData chunk of text and of incompressible bytes
+func BenchmarkCompressFrame(b *testing.B) {
+	random := make([]byte, 16<<10)
+	rand.Read(random)
+	inputs := []struct {
+		name string
+		data []byte
+	}{{"text", httpLike[:16<<10]}, {"random", random}}
+
+	for _, algo := range []byte{CompressGzip, CompressZstd} {
+		for _, in := range inputs {
+			b.Run(fmt.Sprintf("%s/%s", compressionName(algo), in.name), func(b *testing.B) {
+				b.SetBytes(int64(len(in.data)))
+				var wire int
+				for i := 0; i < b.N; i++ {
+					frame, _ := compressFrame(algo, in.data)
+					wire = len(frame)
+				}
+				b.ReportMetric(float64(wire)/float64(len(in.data)), "wire/raw")
+			})
+		}
+	}
+}
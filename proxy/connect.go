@@ -0,0 +1,233 @@
+// connect.go - MsgConnect: outbound TCP, UDP and Unix socket connections
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+func (sess *Session) handleConnect(stream webtransport.Stream) {
+	// Read: connID (4), sockType (1), hostLen (2), host, port (2), options (see connopts.go)
+	var header [4 + 1 + 2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("connect: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	sockType := int(header[4])
+	hostLen := binary.BigEndian.Uint16(header[5:7])
+	if !sess.checkMessageLen(stream, connID, "host", int(hostLen)) {
+		return
+	}
+	if !hostLenOK(int(hostLen)) {
+		sess.log().Warn("connect: host too long", "conn_id", connID, "len", hostLen)
+		sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "host", Message: "host too long"})
+		return
+	}
+
+	hostBuf := make([]byte, hostLen+2)
+	if _, err := io.ReadFull(stream, hostBuf); err != nil {
+		sess.log().Warn("connect: failed to read host/port", "err", err)
+		return
+	}
+
+	host := unbracketHost(string(hostBuf[:hostLen]))
+	port := binary.BigEndian.Uint16(hostBuf[hostLen:])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if sockType == SOCK_UNIX {
+		host = string(hostBuf[:hostLen])
+		addr = host
+	} else if err := validHost(host); err != nil {
+		sess.log().Warn("connect: bad host", "conn_id", connID, "err", err)
+		sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "host", Message: err.Error()})
+		return
+	}
+
+	opts, err := readConnectOptions(stream)
+	if err != nil {
+		sess.log().Warn("connect: bad options", "conn_id", connID, "err", err)
+		sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "connect-options", Message: err.Error()})
+		return
+	}
+
+	sess.log().Info("connect", "conn_id", connID, "addr", addr, "type", sockType)
+
+	if msg := sess.connIDError(connID); msg != "" {
+		sess.log().Warn("connect refused", "conn_id", connID, "reason", msg)
+		sess.sendEvent(MsgError, connID, []byte(msg))
+		return
+	}
+
+	if opts.TLS != nil {
+		if sockType != SOCK_STREAM {
+			sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "tls", Message: "tls requires a stream socket"})
+			return
+		}
+		if opts.TLS.Insecure && !sess.srv.upstreamTLSInsecure {
+			sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "upstream-tls-insecure", Message: "insecure upstream tls not enabled on this proxy"})
+			return
+		}
+		if opts.Pool {
+			sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "pool", Message: "pooling is not supported with tls"})
+			return
+		}
+	}
+
+	if sockType == SOCK_UNIX {
+		if d, ok := sess.srv.checkUnixConnect(sess.rateLimiter, sess.remoteIP, sess.origin, sess.token, host); !ok {
+			sess.log().Info("connect refused", "conn_id", connID, "addr", addr, "reason", d.Message, "rule", d.Rule)
+			sess.connectDenied(connID, d)
+			return
+		}
+	} else {
+		if !sess.allowLookup(host) {
+			sess.connectDenied(connID, sess.dnsRateDecision())
+			return
+		}
+
+		// Port policy, SSRF guard, token scope and the per-IP quota, shared
+		// with the SOCKS5 front-end
+		if d, ok := sess.srv.checkConnect(sess.rateLimiter, sess.remoteIP, sess.origin, sess.token, host, port); !ok {
+			sess.log().Info("connect refused", "conn_id", connID, "addr", addr, "reason", d.Message, "rule", d.Rule)
+			sess.connectDenied(connID, d)
+			return
+		}
+	}
+
+	// Create connection
+	conn := newConnection(connID, sockType)
+	if !sess.takeConn(conn) {
+		sess.log().Warn("connect refused: session connection limit", "conn_id", connID, "limit", sess.maxConns)
+		sess.connectDenied(connID, sess.sessionLimitDecision())
+		return
+	}
+	conn.compress = opts.Compress
+	conn.readBuf = sess.srv.readBufFor(opts, sockType)
+	var dest *Destination
+	if sockType != SOCK_UNIX {
+		dest = sess.srv.dests.Get(host, int(port))
+	}
+	if sockType == SOCK_STREAM {
+		if opts.Pool {
+			conn.dest = dest
+			conn.poolOwner = sess.poolOwner()
+			conn.readDone = make(chan struct{})
+		}
+	}
+	// Checked above, but another MsgConnect or MsgBind may have raced in
+	if !sess.storeConn(connID, conn) {
+		conn.Close()
+		sess.sendEvent(MsgError, connID, []byte("connID in use"))
+		return
+	}
+
+	span := sess.span.Child("connect", SpanKindClient)
+	span.SetAttr("server.address", host)
+	span.SetAttr("server.port", port)
+	span.SetAttr("friscy.conn_id", connID)
+
+	// Dial in goroutine
+	go func() {
+		defer span.End()
+		var netConn net.Conn
+		var err error
+		reused := false
+
+		timeout := sess.srv.connectTimeout(opts)
+		switch sockType {
+		case SOCK_STREAM:
+			netConn, reused, err = dest.Dial(sess.ctx, timeout, conn.poolOwner)
+		case SOCK_UNIX:
+			ctx, cancel := context.WithTimeout(sess.ctx, timeout)
+			netConn, err = dialUnix(ctx, host)
+			cancel()
+		default:
+			// Nothing to handshake, but the lookup can still hang
+			ctx, cancel := context.WithTimeout(sess.ctx, timeout)
+			netConn, err = dest.DialUDP(ctx)
+			cancel()
+		}
+
+		if err != nil {
+			sess.log().Info("connect failed", "conn_id", connID, "addr", addr, "err", err)
+			span.FailDecision(dialDecision(err))
+			sess.connectDenied(connID, dialDecision(err))
+			conn.Close()
+			sess.connections.Delete(connID)
+			return
+		}
+		if reused {
+			sess.log().Debug("reusing pooled connection", "conn_id", connID, "addr", addr)
+		}
+
+		ka := opts.Keepalive
+		if ka == nil {
+			ka = &sess.srv.keepalive
+		}
+		if sockType == SOCK_STREAM {
+			if err := applyKeepalive(netConn, ka); err != nil {
+				sess.log().Warn("keepalive", "conn_id", connID, "err", err)
+			}
+		}
+
+		if opts.TLS != nil {
+			ctx, cancel := context.WithTimeout(sess.ctx, timeout)
+			tlsConn, err := originateTLS(ctx, netConn, host, opts.TLS)
+			cancel()
+			if err != nil {
+				netConn.Close()
+				conn.Close()
+				sess.connections.Delete(connID)
+				sess.log().Info("tls handshake failed", "conn_id", connID, "addr", addr, "err", err)
+				d := dialDecision(err)
+				if d.Category == PolicyDial {
+					d.Category = PolicyTLS
+				}
+				span.FailDecision(d)
+				sess.connectDenied(connID, d)
+				return
+			}
+			netConn = tlsConn
+		}
+
+		coalesce := sess.srv.coalesceDelay
+		if opts.Coalesce != nil {
+			coalesce = *opts.Coalesce
+		}
+
+		conn.mu.Lock()
+		if conn.closed.Load() {
+			netConn.Close()
+			conn.mu.Unlock()
+			return
+		}
+		conn.conn = netConn
+		if coalesce > 0 && sockType != SOCK_DGRAM {
+			conn.coalescer = newWriteCoalescer(netConn, connID, coalesce)
+			conn.coalescer.timeout = &conn.writeTimeout
+			conn.coalescer.log = sess.log()
+		}
+		conn.mu.Unlock()
+
+		sess.log().Info("connected", "conn_id", connID, "addr", addr)
+		span.SetAttr("network.peer.address", netConn.RemoteAddr().String())
+		span.SetAttr("friscy.reused", reused)
+		sess.sendEvent(MsgConnected, connID, nil)
+		sess.grantWindow(conn)
+
+		info := sess.connInfo(conn, ka)
+		info.TLS = opts.TLS != nil
+		info.Reused = reused
+		sess.sendOpened(info)
+
+		// Start reading from connection
+		go sess.readLoop(conn)
+	}()
+}
@@ -0,0 +1,46 @@
+// connid.go - Connection ID allocation
+//
+// Containers pick the IDs of the connections they open (MsgConnect,
+// MsgBind); the proxy picks the IDs of connections it accepts on their
+// behalf. The two never collide: accepted IDs have serverConnIDBit set and
+// clients may not use it. An ID still held by a live connection can't be
+// reused, so a confused client can't orphan a socket by clobbering its entry.
+
+package main
+
+// serverConnIDBit marks connection IDs the proxy assigned
+const serverConnIDBit = 1 << 31
+
+// connIDError is the MsgError text refusing a client-chosen ID, or ""
+func (sess *Session) connIDError(id uint32) string {
+	if id&serverConnIDBit != 0 {
+		return "connID reserved"
+	}
+	if v, ok := sess.connections.Load(id); ok && !v.(*Connection).closed.Load() {
+		return "connID in use"
+	}
+	return ""
+}
+
+// storeConn registers conn under id unless a live connection holds it;
+// a closed one left behind is replaced
+func (sess *Session) storeConn(id uint32, conn *Connection) bool {
+	for {
+		v, loaded := sess.connections.LoadOrStore(id, conn)
+		if !loaded {
+			return true
+		}
+		old := v.(*Connection)
+		if !old.closed.Load() {
+			return false
+		}
+		if sess.connections.CompareAndSwap(id, old, conn) {
+			return true
+		}
+	}
+}
+
+// newServerConnID picks the ID for an accepted connection
+func (sess *Session) newServerConnID() uint32 {
+	return sess.nextConnID.Add(1) | serverConnIDBit
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestConnIDCollision(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	event := func() testEvent {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	bind := func(connID uint32) testEvent {
+		go sess.handleBind(readerStream{r: bytes.NewReader(bindReq(connID))})
+		return event()
+	}
+
+	ev := bind(5)
+	if ev.msgType != MsgConnected {
+		t.Fatalf("bind: got event %#x %q", ev.msgType, ev.data)
+	}
+	listenAddr := string(ev.data[2:])
+	v, _ := sess.connections.Load(uint32(5))
+	first := v.(*Connection)
+
+	if ev := bind(5); ev.msgType != MsgError || string(ev.data) != "connID in use" {
+		t.Fatalf("second bind: got event %#x %q", ev.msgType, ev.data)
+	}
+	req := binary.BigEndian.AppendUint32(nil, 5)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, uint16(len("example.com")))
+	req = append(req, "example.com"...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+	if ev := event(); ev.msgType != MsgError || string(ev.data) != "connID in use" {
+		t.Fatalf("connect on a bound ID: got event %#x %q", ev.msgType, ev.data)
+	}
+	if v, _ := sess.connections.Load(uint32(5)); v != first {
+		t.Fatal("live connection was replaced")
+	}
+	if ev := bind(serverConnIDBit | 1); ev.msgType != MsgError || string(ev.data) != "connID reserved" {
+		t.Fatalf("bind with a server ID: got event %#x %q", ev.msgType, ev.data)
+	}
+
+	// Accepted connections get IDs from the server's half
+	sess.handleListen(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 5), 16))})
+	peer, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if ev = event(); ev.msgType != MsgAccept || ev.connID&serverConnIDBit == 0 {
+		t.Fatalf("accept: got event %#x for conn %#x", ev.msgType, ev.connID)
+	}
+
+	// Once closed, the ID may be used again
+	first.Close()
+	if ev := bind(5); ev.msgType != MsgConnected {
+		t.Fatalf("bind after close: got event %#x %q", ev.msgType, ev.data)
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
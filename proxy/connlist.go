@@ -0,0 +1,87 @@
+// connlist.go - Listing a session's connections (MsgListConns)
+//
+// A container that restarts its networking, or lost track of its sockets,
+// has no record of which connection IDs the proxy still holds open.
+// MsgListConns (no payload) asks for them: the answer is one MsgConnList
+// (connID 0) carrying a JSON array of ConnListEntry, one per live
+// connection, in connID order. Each entry is read under its connection's
+// lock, so its state and addresses agree with each other; connections
+// opened or closed while the list is built may or may not appear.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Connection states in MsgConnList
+const (
+	ConnStateConnecting = "connecting"  // dial in progress
+	ConnStateConnected  = "connected"   // dialed or accepted stream, or connected UDP
+	ConnStateHalfClosed = "half_closed" // MsgCloseWrite sent FIN; still reading
+	ConnStateForwarding = "forwarding"  // spliced to another host (MsgForward)
+	ConnStateBound      = "bound"       // bound, waiting for MsgListen; or a bound UDP socket
+	ConnStateListening  = "listening"
+)
+
+// ConnListEntry is one connection in the MsgConnList payload
+type ConnListEntry struct {
+	ConnID uint32 `json:"conn_id"`
+	Type   string `json:"type"` // as in ConnInfo: "stream", "dgram" or "unix"
+	State  string `json:"state"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// listEntry describes conn, or reports false if it is closed
+func (c *Connection) listEntry() (ConnListEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed.Load() {
+		return ConnListEntry{}, false
+	}
+	e := ConnListEntry{ConnID: c.id, Type: sockTypeName(c.sockType), State: ConnStateConnecting}
+	switch {
+	case c.conn != nil:
+		e.Local, e.Remote = c.conn.LocalAddr().String(), c.conn.RemoteAddr().String()
+		switch {
+		case c.forwarding.Load():
+			e.State = ConnStateForwarding
+		case c.halfClosed.Load():
+			e.State = ConnStateHalfClosed
+		default:
+			e.State = ConnStateConnected
+		}
+	case c.listener != nil:
+		e.Local = c.listener.Addr().String()
+		e.State = ConnStateListening
+		if c.listenGrace != nil {
+			e.State = ConnStateBound
+		}
+	case c.udpConn != nil:
+		e.Local = c.udpConn.LocalAddr().String()
+		e.State = ConnStateBound
+	}
+	return e, true
+}
+
+// connList describes every live connection of the session, by connID
+func (sess *Session) connList() []ConnListEntry {
+	out := []ConnListEntry{}
+	sess.connections.Range(func(_, v any) bool {
+		if e, ok := v.(*Connection).listEntry(); ok {
+			out = append(out, e)
+		}
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnID < out[j].ConnID })
+	return out
+}
+
+func (sess *Session) handleListConns(stream webtransport.Stream) {
+	data, _ := json.Marshal(sess.connList())
+	sess.sendEvent(MsgConnList, 0, data)
+}
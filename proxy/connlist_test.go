@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListConns(t *testing.T) {
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go func() {
+		for {
+			c, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	var dialer net.Dialer
+	tbl.dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, remote.Addr().String())
+	}
+
+	sess, pr := newTestSession(t, tbl)
+
+	for _, connID := range []uint32{2, 1} {
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len("list.example")))
+		req = append(req, "list.example"...)
+		req = binary.BigEndian.AppendUint16(req, 80)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgConnected {
+			t.Fatalf("got event %#x %q, %v, want MsgConnected", ev.msgType, ev.data, err)
+		}
+	}
+	v, _ := sess.connections.Load(uint32(2))
+	v.(*Connection).halfClosed.Store(true)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listening := newConnection(3, SOCK_STREAM)
+	listening.listener = ln
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := newConnection(4, SOCK_STREAM)
+	bound.listener = ln2
+	bound.listenGrace = time.AfterFunc(time.Hour, func() {})
+	defer bound.listenGrace.Stop()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgram := newConnection(5, SOCK_DGRAM)
+	dgram.udpConn = udp
+	closed := newConnection(7, SOCK_STREAM)
+	closed.closed.Store(true)
+	for _, c := range []*Connection{listening, bound, dgram, newConnection(6, SOCK_STREAM), closed} {
+		sess.connections.Store(c.id, c)
+	}
+
+	go sess.handleListConns(readerStream{r: bytes.NewReader(nil)})
+	ev, err := readEvent(pr, false)
+	if err != nil || ev.msgType != MsgConnList || ev.connID != 0 {
+		t.Fatalf("got event %#x conn %d, %v, want MsgConnList", ev.msgType, ev.connID, err)
+	}
+	var list []ConnListEntry
+	if err := json.Unmarshal(ev.data, &list); err != nil {
+		t.Fatal(err)
+	}
+	for i := range list {
+		if list[i].ConnID <= 2 && list[i].Remote != remote.Addr().String() {
+			t.Errorf("conn %d remote %q, want %s", list[i].ConnID, list[i].Remote, remote.Addr())
+		}
+		list[i].Remote = ""
+		if list[i].ConnID <= 2 {
+			list[i].Local = ""
+		}
+	}
+	want := []ConnListEntry{
+		{ConnID: 1, Type: "stream", State: ConnStateConnected},
+		{ConnID: 2, Type: "stream", State: ConnStateHalfClosed},
+		{ConnID: 3, Type: "stream", State: ConnStateListening, Local: ln.Addr().String()},
+		{ConnID: 4, Type: "stream", State: ConnStateBound, Local: ln2.Addr().String()},
+		{ConnID: 5, Type: "dgram", State: ConnStateBound, Local: udp.LocalAddr().String()},
+		{ConnID: 6, Type: "stream", State: ConnStateConnecting},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("got %+v\nwant %+v", list, want)
+	}
+
+	// An empty session lists an empty array
+	if b, _ := json.Marshal((&Session{}).connList()); string(b) != "[]" {
+		t.Errorf("empty session: %s", b)
+	}
+
+	sess.cancel()
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
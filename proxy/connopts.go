@@ -0,0 +1,194 @@
+// connopts.go - Optional per-connection settings carried by MsgConnect
+//
+// Anything after MsgConnect's port field is a sequence of TLV options, read
+// until the client closes its side of the request stream:
+//
+//	optType (1), optLen (1), value (optLen bytes)
+//
+// Unknown option types are skipped so older proxies ignore newer options.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Connect option types
+const (
+	OptKeepalive = 0x01 // enable (1), idle secs (2), interval secs (2), count (1)
+	OptCoalesce  = 0x02 // flush delay ms (2); 0 disables coalescing
+	OptTLS       = 0x03 // flags (1), server name (rest); see tlsorigin.go
+	OptTLSPin    = 0x04 // SHA-256 of a pinned SubjectPublicKeyInfo (32); repeatable
+	OptPool      = 0x05 // no value; reuse/park the TCP connection (see destination.go)
+	OptCompress  = 0x06 // algorithm (1): CompressGzip or CompressZstd; see compress.go
+	OptTimeout   = 0x07 // connect timeout ms (2); 0 = proxy default, capped by -max-connect-timeout
+	OptReadBuf   = 0x08 // read buffer bytes (4); see readbuf.go
+)
+
+// Connect timeouts; the container may ask for less or more, up to the cap
+const (
+	defaultConnectTimeout    = 10 * time.Second
+	defaultMaxConnectTimeout = 30 * time.Second
+)
+
+// Keepalive bounds applied to container-supplied values
+const (
+	minKeepalivePeriod = 1 * time.Second
+	maxKeepalivePeriod = 2 * time.Hour
+	maxKeepaliveCount  = 30
+)
+
+// ConnectOptions holds the options parsed from a MsgConnect trailer
+type ConnectOptions struct {
+	Keepalive *net.KeepAliveConfig // nil = proxy default
+	Coalesce  *time.Duration       // nil = proxy default (-coalesce-delay)
+	TLS       *OriginTLS           // nil = pass bytes through untouched
+	Pool      bool                 // take from and return to the idle pool
+	Compress  byte                 // CompressNone = data passes as-is
+	Timeout   time.Duration        // 0 = proxy default (-connect-timeout)
+	ReadBuf   int                  // 0 = readBufSize
+}
+
+// readConnectOptions parses TLV options until EOF
+func readConnectOptions(r io.Reader) (*ConnectOptions, error) {
+	opts := &ConnectOptions{}
+	var pins [][32]byte
+	for {
+		var tl [2]byte
+		if _, err := io.ReadFull(r, tl[:1]); err != nil {
+			if err == io.EOF {
+				if len(pins) > 0 {
+					if opts.TLS == nil {
+						return nil, fmt.Errorf("tls pin option without tls option")
+					}
+					opts.TLS.Pins = pins
+				}
+				return opts, nil
+			}
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, tl[1:]); err != nil {
+			return nil, fmt.Errorf("option 0x%02x: missing length", tl[0])
+		}
+		val := make([]byte, tl[1])
+		if _, err := io.ReadFull(r, val); err != nil {
+			return nil, fmt.Errorf("option 0x%02x: truncated value", tl[0])
+		}
+
+		switch tl[0] {
+		case OptKeepalive:
+			ka, err := parseKeepaliveOption(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.Keepalive = ka
+		case OptCoalesce:
+			if len(val) != 2 {
+				return nil, fmt.Errorf("coalesce option: want 2 bytes, got %d", len(val))
+			}
+			d := time.Duration(binary.BigEndian.Uint16(val)) * time.Millisecond
+			if d > maxCoalesceDelay {
+				d = maxCoalesceDelay
+			}
+			opts.Coalesce = &d
+		case OptTLS:
+			o, err := parseTLSOption(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.TLS = o
+		case OptPool:
+			opts.Pool = true
+		case OptCompress:
+			if len(val) != 1 || (val[0] != CompressGzip && val[0] != CompressZstd) {
+				return nil, fmt.Errorf("compress option: unsupported algorithm %v", val)
+			}
+			opts.Compress = val[0]
+		case OptTimeout:
+			if len(val) != 2 {
+				return nil, fmt.Errorf("timeout option: want 2 bytes, got %d", len(val))
+			}
+			opts.Timeout = time.Duration(binary.BigEndian.Uint16(val)) * time.Millisecond
+		case OptReadBuf:
+			if len(val) != 4 {
+				return nil, fmt.Errorf("read buffer option: want 4 bytes, got %d", len(val))
+			}
+			opts.ReadBuf = int(min(binary.BigEndian.Uint32(val), 1<<maxReadBufShift))
+		case OptTLSPin:
+			if len(val) != 32 {
+				return nil, fmt.Errorf("tls pin option: want 32 bytes, got %d", len(val))
+			}
+			pins = append(pins, [32]byte(val))
+		}
+	}
+}
+
+// connectTimeout is how long a connect with opts may take to dial, and
+// then to finish an OptTLS handshake
+func (s *Server) connectTimeout(opts *ConnectOptions) time.Duration {
+	d := s.defaultConnectTimeout
+	if d <= 0 {
+		d = defaultConnectTimeout
+	}
+	if opts.Timeout > 0 {
+		d = opts.Timeout
+	}
+	if s.maxConnectTimeout > 0 && d > s.maxConnectTimeout {
+		d = s.maxConnectTimeout
+	}
+	return d
+}
+
+func parseKeepaliveOption(val []byte) (*net.KeepAliveConfig, error) {
+	if len(val) != 6 {
+		return nil, fmt.Errorf("keepalive option: want 6 bytes, got %d", len(val))
+	}
+	ka := &net.KeepAliveConfig{
+		Enable:   val[0] != 0,
+		Idle:     clampDuration(time.Duration(binary.BigEndian.Uint16(val[1:3]))*time.Second, minKeepalivePeriod, maxKeepalivePeriod),
+		Interval: clampDuration(time.Duration(binary.BigEndian.Uint16(val[3:5]))*time.Second, minKeepalivePeriod, maxKeepalivePeriod),
+		Count:    int(val[5]),
+	}
+	if ka.Count < 1 {
+		ka.Count = 1
+	}
+	if ka.Count > maxKeepaliveCount {
+		ka.Count = maxKeepaliveCount
+	}
+	return ka, nil
+}
+
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
+
+// keepaliveConfig is the -keepalive setting: probes start after period idle
+// and repeat every period, so a peer that vanished behind a NAT is noticed,
+// and its MsgClosed sent, within about ten periods rather than on the next
+// write. A period of 0 turns keepalive off.
+func keepaliveConfig(period time.Duration) net.KeepAliveConfig {
+	if period <= 0 {
+		return net.KeepAliveConfig{Enable: false}
+	}
+	period = clampDuration(period, minKeepalivePeriod, maxKeepalivePeriod)
+	return net.KeepAliveConfig{Enable: true, Idle: period, Interval: period, Count: defaultKeepalive.Count}
+}
+
+// applyKeepalive maps TCP_KEEPIDLE/TCP_KEEPINTVL/TCP_KEEPCNT onto a dialed conn
+func applyKeepalive(c net.Conn, ka *net.KeepAliveConfig) error {
+	tc, ok := tcpConnOf(c)
+	if !ok {
+		return fmt.Errorf("keepalive requires a TCP connection")
+	}
+	return tc.SetKeepAliveConfig(*ka)
+}
@@ -0,0 +1,143 @@
+// connopts_test.go - MsgConnect option parsing tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadConnectOptionsKeepalive(t *testing.T) {
+	// No trailer at all: defaults
+	opts, err := readConnectOptions(bytes.NewReader(nil))
+	if err != nil || opts.Keepalive != nil {
+		t.Fatalf("empty trailer: got %+v, %v", opts, err)
+	}
+
+	// Unknown option skipped, keepalive clamped: idle 0 -> 1s, interval huge -> 2h, count 99 -> 30
+	trailer := []byte{
+		0x7f, 2, 0xaa, 0xbb,
+		OptKeepalive, 6, 1, 0x00, 0x00, 0xff, 0xff, 99,
+	}
+	opts, err = readConnectOptions(bytes.NewReader(trailer))
+	if err != nil {
+		t.Fatalf("readConnectOptions: %v", err)
+	}
+	ka := opts.Keepalive
+	if ka == nil || !ka.Enable || ka.Idle != time.Second || ka.Interval != 2*time.Hour || ka.Count != maxKeepaliveCount {
+		t.Fatalf("keepalive not clamped: %+v", ka)
+	}
+
+	for _, bad := range [][]byte{
+		{OptKeepalive},          // missing length
+		{OptKeepalive, 6, 1, 0}, // truncated value
+		{OptKeepalive, 2, 1, 0}, // wrong size
+	} {
+		if _, err := readConnectOptions(bytes.NewReader(bad)); err == nil {
+			t.Errorf("readConnectOptions(%v) should fail", bad)
+		}
+	}
+}
+
+func TestApplyKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ka := &net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3}
+	if err := applyKeepalive(c, ka); err != nil {
+		t.Fatalf("applyKeepalive: %v", err)
+	}
+
+	u, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer u.Close()
+	if err := applyKeepalive(u.(*net.UDPConn), ka); err == nil {
+		t.Errorf("keepalive on UDP should fail")
+	}
+}
+
+func TestKeepaliveConfig(t *testing.T) {
+	if ka := keepaliveConfig(0); ka.Enable {
+		t.Errorf("-keepalive=0 left keepalive on: %+v", ka)
+	}
+	ka := keepaliveConfig(30 * time.Second)
+	if !ka.Enable || ka.Idle != 30*time.Second || ka.Interval != 30*time.Second || ka.Count != defaultKeepalive.Count {
+		t.Errorf("keepaliveConfig(30s) = %+v", ka)
+	}
+	if ka := keepaliveConfig(time.Millisecond); ka.Idle != minKeepalivePeriod {
+		t.Errorf("1ms period not clamped: %+v", ka)
+	}
+	if ka := keepaliveConfig(defaultKeepalive.Idle); ka != defaultKeepalive {
+		t.Errorf("default period gives %+v, want %+v", ka, defaultKeepalive)
+	}
+}
+
+func TestConnectTimeoutOption(t *testing.T) {
+	s := &Server{defaultConnectTimeout: 10 * time.Second, maxConnectTimeout: 30 * time.Second}
+	for _, tc := range []struct {
+		trailer []byte
+		want    time.Duration
+	}{
+		{nil, 10 * time.Second},
+		{[]byte{OptTimeout, 2, 0, 0}, 10 * time.Second},             // 0 = default
+		{[]byte{OptTimeout, 2, 0x01, 0xf4}, 500 * time.Millisecond}, // 500ms
+		{[]byte{OptTimeout, 2, 0xff, 0xff}, 30 * time.Second},       // capped
+	} {
+		opts, err := readConnectOptions(bytes.NewReader(tc.trailer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.connectTimeout(opts); got != tc.want {
+			t.Errorf("trailer %v: timeout %v, want %v", tc.trailer, got, tc.want)
+		}
+	}
+	if _, err := readConnectOptions(bytes.NewReader([]byte{OptTimeout, 1, 5})); err == nil {
+		t.Error("1-byte timeout option accepted")
+	}
+}
+
+// TestConnectTimeoutBlackhole checks a short OptTimeout fails a connect to
+// an address that never answers quickly
+func TestConnectTimeoutBlackhole(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, uint16(len("blackhole.example")))
+	req = append(req, "blackhole.example"...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	req = append(req, OptTimeout, 2, 0, 100) // 100ms
+	start := time.Now()
+	go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgConnectError {
+		t.Fatalf("got event %#x %q, want MsgConnectError", ev.msgType, ev.data)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("connect failed after %v, want about 100ms", elapsed)
+	}
+}
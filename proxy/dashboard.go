@@ -0,0 +1,114 @@
+// dashboard.go - A live view of sessions for operators
+//
+// GET /dashboard serves a single static page (dashboard.html, embedded)
+// that polls GET /admin/dashboard every few seconds and draws session,
+// connection and bandwidth figures, for a glance without Prometheus. The
+// JSON sits behind -admin-token like the rest of /admin; the page holds
+// no data, but is still only served when a token is configured. A browser
+// can't attach a bearer token to a navigation, so the page takes it from
+// its URL fragment (/dashboard#token=...), which never leaves the
+// browser, or asks for it.
+//
+// Byte totals are since startup, counting sessions that have ended, so
+// the page's bandwidth figures don't dip when a busy session closes.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardTopSessions is how many of the busiest sessions are listed
+const dashboardTopSessions = 20
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// DashboardStats is the /admin/dashboard response
+type DashboardStats struct {
+	Time          time.Time        `json:"time"`
+	Sessions      int              `json:"sessions"`
+	Clients       int              `json:"clients"` // distinct client addresses
+	Connections   ConnectionCounts `json:"connections"`
+	BytesSent     int64            `json:"bytes_sent"`     // to remote hosts since startup
+	BytesReceived int64            `json:"bytes_received"` // from remote hosts since startup
+	TopSessions   []SessionInfo    `json:"top_sessions"`   // most bytes first
+}
+
+// ConnectionCounts breaks down the live connections of every session
+type ConnectionCounts struct {
+	Total     int `json:"total"`
+	Stream    int `json:"stream"` // TCP, dialed or accepted
+	Datagram  int `json:"datagram"`
+	Listeners int `json:"listeners"`
+}
+
+// dashboardStats aggregates over the live sessions and their connections
+func (s *Server) dashboardStats() DashboardStats {
+	out := DashboardStats{
+		Time:          time.Now(),
+		BytesSent:     s.metrics.endedBytesSent.Load(),
+		BytesReceived: s.metrics.endedBytesReceived.Load(),
+		TopSessions:   []SessionInfo{},
+	}
+	clients := make(map[string]bool)
+	s.sessions.Range(func(_, v any) bool {
+		sess := v.(*Session)
+		info := sess.info()
+		out.Sessions++
+		out.BytesSent += info.BytesSent
+		out.BytesReceived += info.BytesReceived
+		host, _, err := net.SplitHostPort(sess.remoteIP)
+		if err != nil {
+			host = sess.remoteIP
+		}
+		clients[host] = true
+		sess.connections.Range(func(_, v any) bool {
+			conn := v.(*Connection)
+			out.Connections.Total++
+			switch {
+			case conn.listener != nil:
+				out.Connections.Listeners++
+			case conn.sockType == SOCK_DGRAM:
+				out.Connections.Datagram++
+			default:
+				out.Connections.Stream++
+			}
+			return true
+		})
+		out.TopSessions = append(out.TopSessions, info)
+		return true
+	})
+	out.Clients = len(clients)
+
+	sort.Slice(out.TopSessions, func(i, j int) bool {
+		a, b := out.TopSessions[i], out.TopSessions[j]
+		return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived
+	})
+	if len(out.TopSessions) > dashboardTopSessions {
+		out.TopSessions = out.TopSessions[:dashboardTopSessions]
+	}
+	return out
+}
+
+func (s *Server) handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s.dashboardStats())
+}
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(dashboardHTML)
+}
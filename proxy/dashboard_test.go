@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminDashboard(t *testing.T) {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	defer s.cancel()
+	s.adminToken = "hunter2"
+	s.metrics.endedBytesSent.Add(1000)
+	s.metrics.endedBytesReceived.Add(2000)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	busy := &Session{id: 1, remoteIP: "198.51.100.7:5000"}
+	busy.bytesSent.Add(300)
+	busy.bytesReceived.Add(700)
+	busy.connections.Store(uint32(1), newConnection(1, SOCK_STREAM))
+	busy.connections.Store(uint32(2), newConnection(2, SOCK_DGRAM))
+	bound := newConnection(3, SOCK_STREAM)
+	bound.listener = ln
+	busy.connections.Store(uint32(3), bound)
+	quiet := &Session{id: 2, remoteIP: "198.51.100.7:5001"} // same client
+	quiet.bytesSent.Add(10)
+	quiet.connections.Store(uint32(1), newConnection(1, SOCK_STREAM))
+	other := &Session{id: 3, remoteIP: "[2001:db8::1]:443"}
+	for _, sess := range []*Session{quiet, busy, other} {
+		s.sessions.Store(sess.id, sess)
+	}
+
+	mux := s.apiMux()
+	get := func(target, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("/admin/dashboard", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("without token: got %d", w.Code)
+	}
+	w := get("/admin/dashboard", "Bearer hunter2")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// The field names are what dashboard.html reads
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"time", "sessions", "clients", "connections", "bytes_sent", "bytes_received", "top_sessions"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("missing %q in %s", key, w.Body)
+		}
+	}
+	var conns map[string]int
+	if err := json.Unmarshal(raw["connections"], &conns); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"total": 4, "stream": 2, "datagram": 1, "listeners": 1}; len(conns) != len(want) ||
+		conns["total"] != 4 || conns["stream"] != 2 || conns["datagram"] != 1 || conns["listeners"] != 1 {
+		t.Errorf("connections = %v, want %v", conns, want)
+	}
+
+	var st DashboardStats
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Sessions != 3 || st.Clients != 2 || st.BytesSent != 1310 || st.BytesReceived != 2700 || st.Time.IsZero() {
+		t.Errorf("unexpected totals %+v", st)
+	}
+	if len(st.TopSessions) != 3 || st.TopSessions[0].ID != 1 || st.TopSessions[1].ID != 2 || st.TopSessions[0].Connections != 3 {
+		t.Errorf("top sessions not busiest first: %+v", st.TopSessions)
+	}
+
+	// The page is only served with a token configured
+	if w := get("/dashboard", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/admin/dashboard") {
+		t.Fatalf("dashboard page: got %d", w.Code)
+	}
+	s.adminToken = ""
+	if w := get("/dashboard", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("dashboard without -admin-token: got %d", w.Code)
+	}
+}
+
+func TestAdminDashboardEmpty(t *testing.T) {
+	st := (&Server{}).dashboardStats()
+	b, _ := json.Marshal(st)
+	// An empty list, not null, so the page can map over it
+	if !strings.Contains(string(b), `"top_sessions":[]`) {
+		t.Fatalf("got %s", b)
+	}
+}
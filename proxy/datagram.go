@@ -0,0 +1,282 @@
+// datagram.go - UDP over WebTransport datagrams
+//
+// MsgSendTo and MsgRecvFrom on streams make every UDP packet reliable and
+// ordered, so a lost packet stalls everything behind it - the opposite of
+// what DNS, QUIC-in-the-container or games want. Sessions can instead carry
+// UDP in unreliable QUIC datagrams (HTTP Datagrams, RFC 9297):
+//
+//	quarter session ID (varint), msgType (1), body
+//
+// The container may always send MsgSendTo as a datagram:
+//
+//	MsgSendTo, connID (4), hostLen (2), host, port (2), data (rest)
+//
+// Sessions that connect with /connect?datagrams=1 also receive MsgRecvFrom
+// as datagrams, in the same layout as the MsgRecvFrom event:
+//
+//	MsgRecvFrom, connID (4), hostLen (2), host, port (2), data (rest)
+//
+// A received packet that wouldn't fit in one QUIC datagram is dropped and
+// reported with MsgError on a stream rather than truncated.
+//
+// Connected datagram sockets (MsgConnect with SOCK_DGRAM) use a shorter
+// framing, as they have only the one peer:
+//
+//	MsgSend, connID (4), data (rest)
+//	MsgData, connID (4), data (rest)
+//
+// The container may always send MsgSend as a datagram; with
+// /connect?datagrams=1 replies come back as MsgData datagrams. A reply too
+// large for one goes out as an ordinary MsgData event instead, which is
+// what the socket would deliver without datagrams. Connections with
+// OptCompress stay on streams both ways.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// maxQUICDatagram is the largest datagram payload we hand to quic-go. QUIC
+// guarantees 1200-byte packets; the rest is headers, AEAD tag and framing.
+const maxQUICDatagram = 1150
+
+var errDatagramTooLarge = errors.New("datagram exceeds QUIC datagram size")
+
+// datagramConn is the part of quic.Connection the datagram path uses
+type datagramConn interface {
+	SendDatagram([]byte) error
+	ReceiveDatagram(context.Context) ([]byte, error)
+	Context() context.Context
+}
+
+// datagramMux reads a QUIC connection's datagrams and hands each to the
+// session whose ID prefixes it; several sessions can share a connection
+type datagramMux struct {
+	conn     datagramConn
+	sessions sync.Map // quarter session ID (uint64) -> *Session
+}
+
+// attachDatagrams registers sess for datagrams on conn, starting the
+// connection's reader on first use
+func (s *Server) attachDatagrams(conn datagramConn, sessionID uint64, sess *Session) {
+	sess.dgram = conn
+	sess.dgramPrefix = quicvarint.Append(nil, sessionID/4)
+
+	v, loaded := s.dgramMuxes.LoadOrStore(conn, &datagramMux{conn: conn})
+	mux := v.(*datagramMux)
+	mux.sessions.Store(sessionID/4, sess)
+	if !loaded {
+		go func() {
+			mux.run()
+			s.dgramMuxes.Delete(conn)
+		}()
+	}
+	go func() {
+		<-sess.ctx.Done()
+		mux.sessions.CompareAndDelete(sessionID/4, sess)
+	}()
+}
+
+func (m *datagramMux) run() {
+	ctx := m.conn.Context()
+	for {
+		b, err := m.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(b)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			continue
+		}
+		v, ok := m.sessions.Load(id)
+		if !ok {
+			continue // unknown or already closed session; datagrams are droppable
+		}
+		v.(*Session).handleDatagram(b[len(b)-r.Len():])
+	}
+}
+
+// handleDatagram processes one container-sent datagram
+func (sess *Session) handleDatagram(b []byte) {
+	sess.heard()
+	if len(b) > 0 && b[0] == MsgSend {
+		sess.handleConnDatagram(b[1:])
+		return
+	}
+	if len(b) == 0 || b[0] != MsgSendTo {
+		return
+	}
+	connID, host, port, data, err := parseDatagramBody(b[1:])
+	if err != nil {
+		sess.log().Warn("sendto datagram", "err", err)
+		return
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+	if conn.udpConn == nil {
+		sess.sendEvent(MsgError, connID, []byte("not a bound datagram socket"))
+		return
+	}
+	if msg, ok := sess.writeDatagram(conn, host, port, data); ok && msg != "" {
+		sess.sendEvent(MsgError, connID, []byte("sendto: "+msg))
+	}
+}
+
+// handleConnDatagram writes a MsgSend datagram's payload to its connected
+// datagram socket
+func (sess *Session) handleConnDatagram(b []byte) {
+	if len(b) < 4 {
+		sess.log().Warn("send datagram", "err", fmt.Errorf("short datagram (%d bytes)", len(b)))
+		return
+	}
+	connID, data := binary.BigEndian.Uint32(b[0:4]), b[4:]
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+	conn.mu.Lock()
+	netConn := conn.conn
+	conn.mu.Unlock()
+	if conn.sockType != SOCK_DGRAM || netConn == nil {
+		sess.sendEvent(MsgError, connID, []byte("not a connected datagram socket"))
+		return
+	}
+	if conn.compress != CompressNone {
+		sess.sendEvent(MsgError, connID, []byte("compressed connections send on streams"))
+		return
+	}
+	if !sess.chargeBytes(len(data)) || !sess.throttle(sess.sendLimiter, len(data)) {
+		return
+	}
+	if _, err := netConn.Write(data); err != nil {
+		sess.sendFailed(connID, err)
+		return
+	}
+	conn.touch()
+	conn.bytesOut.Add(uint64(len(data)))
+	sess.bytesSent.Add(int64(len(data)))
+}
+
+// sendConnDatagram delivers a packet read from a connected datagram socket
+// as a MsgData datagram. It reports false if the session doesn't take
+// datagrams or the packet doesn't fit, leaving it for a MsgData event.
+func (sess *Session) sendConnDatagram(conn *Connection, data []byte) bool {
+	if !sess.datagrams || conn.sockType != SOCK_DGRAM || conn.compress != CompressNone {
+		return false
+	}
+	frame := append(append(make([]byte, 0, len(sess.dgramPrefix)+5+len(data)), sess.dgramPrefix...), MsgData)
+	frame = binary.BigEndian.AppendUint32(frame, conn.id)
+	frame = append(frame, data...)
+	switch err := sess.sendDatagram(frame); {
+	case errors.Is(err, errDatagramTooLarge):
+		return false
+	case err != nil:
+		sess.log().Info("data: dropped packet", "conn_id", conn.id, "bytes", len(data), "err", err)
+	}
+	return true
+}
+
+// parseDatagramBody splits connID (4), hostLen (2), host, port (2), data
+func parseDatagramBody(b []byte) (connID uint32, host string, port uint16, data []byte, err error) {
+	if len(b) < 6 {
+		return 0, "", 0, nil, fmt.Errorf("short datagram (%d bytes)", len(b))
+	}
+	connID = binary.BigEndian.Uint32(b[0:4])
+	hostLen := int(binary.BigEndian.Uint16(b[4:6]))
+	if !hostLenOK(hostLen) {
+		return connID, "", 0, nil, fmt.Errorf("[%d] host too long (%d bytes)", connID, hostLen)
+	}
+	if len(b) < 6+hostLen+2 {
+		return connID, "", 0, nil, fmt.Errorf("[%d] truncated datagram header", connID)
+	}
+	host = string(b[6 : 6+hostLen])
+	port = binary.BigEndian.Uint16(b[6+hostLen:])
+	return connID, host, port, b[6+hostLen+2:], nil
+}
+
+// appendRecvFrom appends connID (4), hostLen (2), host, port (2), data
+func appendRecvFrom(b []byte, connID uint32, from *net.UDPAddr, data []byte) []byte {
+	host := from.IP.String()
+	b = binary.BigEndian.AppendUint32(b, connID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(host)))
+	b = append(b, host...)
+	b = binary.BigEndian.AppendUint16(b, uint16(from.Port))
+	return append(b, data...)
+}
+
+// udpReadLoop delivers each packet arriving on a bound UDP socket as its
+// own MsgRecvFrom, until the socket is closed
+func (sess *Session) udpReadLoop(conn *Connection) {
+	bp := getReadBuf(readBufSize)
+	defer putReadBuf(bp)
+	buf := *bp
+	var frame []byte
+	for {
+		n, from, err := conn.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if !conn.closed.Load() {
+				sess.log().Info("udp read error", "conn_id", conn.id, "err", err)
+			}
+			// Whatever closed the socket (MsgClose, MsgShutdown, the
+			// janitor) may have reported it already
+			if !conn.closeReported.Swap(true) {
+				sess.sendClosed(conn)
+			}
+			return
+		}
+		conn.touch()
+		if !sess.chargeBytes(n) || !sess.throttle(sess.recvLimiter, n) {
+			return
+		}
+		conn.bytesIn.Add(uint64(n))
+		sess.bytesReceived.Add(int64(n))
+
+		if !sess.datagrams {
+			frame = appendRecvFrom(frame[:0], conn.id, from, buf[:n])
+			sess.sendEvent(MsgRecvFrom, conn.id, frame)
+			continue
+		}
+		frame = append(append(frame[:0], sess.dgramPrefix...), MsgRecvFrom)
+		frame = appendRecvFrom(frame, conn.id, from, buf[:n])
+		if err := sess.sendDatagram(frame); err != nil {
+			sess.log().Info("recvfrom: dropped packet", "conn_id", conn.id, "from", from, "bytes", n, "err", err)
+			if errors.Is(err, errDatagramTooLarge) {
+				sess.sendEvent(MsgError, conn.id, []byte("recvfrom: "+strconv.Itoa(n)+"-byte packet exceeds QUIC datagram size"))
+			}
+		}
+	}
+}
+
+// sendDatagram sends one complete datagram frame, refusing anything that
+// quic-go would otherwise drop or the peer couldn't accept
+func (sess *Session) sendDatagram(frame []byte) error {
+	if len(frame) > maxQUICDatagram {
+		return errDatagramTooLarge
+	}
+	err := sess.dgram.SendDatagram(frame)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return errDatagramTooLarge
+	}
+	return err
+}
@@ -0,0 +1,477 @@
+// datagram_test.go - UDP over QUIC datagram tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// fakeDatagramConn records sent datagrams and replays queued received ones
+type fakeDatagramConn struct {
+	ctx  context.Context
+	sent chan []byte
+	recv chan []byte
+}
+
+func newFakeDatagramConn(ctx context.Context) *fakeDatagramConn {
+	return &fakeDatagramConn{ctx: ctx, sent: make(chan []byte, 16), recv: make(chan []byte, 16)}
+}
+
+func (f *fakeDatagramConn) SendDatagram(b []byte) error {
+	f.sent <- append([]byte(nil), b...)
+	return nil
+}
+
+func (f *fakeDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-f.recv:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fakeDatagramConn) Context() context.Context { return f.ctx }
+
+func TestDatagramBodyLayout(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 5353}
+	b := appendRecvFrom(nil, 42, from, []byte("payload"))
+
+	connID, host, port, data, err := parseDatagramBody(b)
+	if err != nil || connID != 42 || host != "203.0.113.9" || port != 5353 || string(data) != "payload" {
+		t.Fatalf("got %d %q %d %q %v", connID, host, port, data, err)
+	}
+
+	for _, short := range [][]byte{nil, b[:5], b[:8]} {
+		if _, _, _, _, err := parseDatagramBody(short); err == nil {
+			t.Errorf("accepted %d-byte body", len(short))
+		}
+	}
+
+	// A host length no name needs is refused before the body is sliced
+	long := binary.BigEndian.AppendUint32(nil, 42)
+	long = binary.BigEndian.AppendUint16(long, maxHostLen+2)
+	long = append(long, make([]byte, maxHostLen+4)...)
+	if _, _, _, _, err := parseDatagramBody(long); err == nil {
+		t.Error("accepted an over-long host")
+	}
+}
+
+func TestUDPRecvFromDatagram(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := newFakeDatagramConn(ctx)
+	// Events (the MsgError for the oversized packet) need a live
+	// WebTransport session; a finished one makes sendEvent a no-op
+	ended, end := context.WithCancel(ctx)
+	end()
+	sess := &Session{ctx: ended, datagrams: true}
+	(&Server{}).attachDatagrams(fake, 8, sess)
+
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(5, SOCK_DGRAM)
+	conn.udpConn = u
+	defer conn.Close()
+	go sess.udpReadLoop(conn)
+
+	peer, err := net.DialUDP("udp", nil, u.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Too big for one QUIC datagram: dropped, not truncated
+	peer.Write(make([]byte, 2000))
+	peer.Write([]byte("ping"))
+
+	select {
+	case frame := <-fake.sent:
+		r := bytes.NewReader(frame)
+		if id, err := quicvarint.Read(r); err != nil || id != 2 {
+			t.Fatalf("quarter session ID %d, %v; want 2", id, err)
+		}
+		body := frame[len(frame)-r.Len():]
+		if body[0] != MsgRecvFrom {
+			t.Fatalf("msgType 0x%02x", body[0])
+		}
+		connID, host, port, data, err := parseDatagramBody(body[1:])
+		if err != nil || connID != 5 || host != "127.0.0.1" || int(port) != peer.LocalAddr().(*net.UDPAddr).Port {
+			t.Fatalf("got %d %s:%d %v", connID, host, port, err)
+		}
+		if string(data) != "ping" {
+			t.Fatalf("first delivered datagram is %d bytes, want the 4-byte ping", len(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no datagram sent")
+	}
+}
+
+// TestUDPCloseReportsOnce checks a bound UDP socket closed by MsgShutdown,
+// while udpReadLoop sees the socket close under it, is reported closed once
+func TestUDPCloseReportsOnce(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(5, SOCK_DGRAM)
+	conn.udpConn = u
+	sess.connections.Store(conn.id, conn)
+	go sess.udpReadLoop(conn)
+
+	go sess.handleShutdown(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, conn.id))})
+	if n := closedEvents(t, pr, conn.id, 500*time.Millisecond); n != 1 {
+		t.Fatalf("got %d MsgClosed events, want 1", n)
+	}
+}
+
+func TestSendDatagramLimit(t *testing.T) {
+	fake := newFakeDatagramConn(context.Background())
+	sess := &Session{dgram: fake}
+	if err := sess.sendDatagram(make([]byte, maxQUICDatagram+1)); err != errDatagramTooLarge {
+		t.Fatalf("oversized frame: %v", err)
+	}
+	if err := sess.sendDatagram(make([]byte, maxQUICDatagram)); err != nil {
+		t.Fatalf("max-size frame: %v", err)
+	}
+}
+
+func TestDatagramMuxDispatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := newFakeDatagramConn(ctx)
+	srv := &Server{}
+	a := &Session{ctx: ctx}
+	bctx, bcancel := context.WithCancel(ctx)
+	b := &Session{ctx: bctx}
+	srv.attachDatagrams(fake, 0, a)
+	srv.attachDatagrams(fake, 4, b)
+
+	v, ok := srv.dgramMuxes.Load(datagramConn(fake))
+	if !ok {
+		t.Fatal("no mux for connection")
+	}
+	mux := v.(*datagramMux)
+	if got, _ := mux.sessions.Load(uint64(1)); got != b {
+		t.Fatal("session 4 not registered under quarter ID 1")
+	}
+
+	// A finished session stops receiving
+	bcancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := mux.sessions.Load(uint64(1)); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := mux.sessions.Load(uint64(0)); !ok {
+		t.Fatal("live session was removed")
+	}
+
+	// The mux goes away with its connection
+	cancel()
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, ok := srv.dgramMuxes.Load(datagramConn(fake)); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mux outlived its connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConnectedUDPEcho runs datagrams through a connected SOCK_DGRAM
+// connection to an echo server, and checks a bound socket refuses MsgSend
+func TestConnectedUDPEcho(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	// A port nothing listens on, for the ICMP refusal
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "udp" {
+			t.Errorf("dialed %s", network)
+		}
+		if addr == "203.0.113.7:9" {
+			return net.Dial("udp", closedAddr)
+		}
+		return net.Dial("udp", echo.LocalAddr().String())
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	event := func() testEvent {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	connect := func(connID uint32, port uint16) {
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_DGRAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len("echo.example")))
+		req = append(req, "echo.example"...)
+		req = binary.BigEndian.AppendUint16(req, port)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		if ev := event(); ev.msgType != MsgConnected || ev.connID != connID {
+			t.Fatalf("connect: got event %#x for conn %d %q", ev.msgType, ev.connID, ev.data)
+		}
+	}
+	send := func(connID uint32, data string) {
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = binary.BigEndian.AppendUint32(req, uint32(len(data)))
+		req = append(req, data...)
+		go sess.handleSend(readerStream{r: bytes.NewReader(req)})
+	}
+
+	connect(1, 7)
+	for _, msg := range []string{"one", "two"} {
+		send(1, msg)
+		if ev := event(); ev.msgType != MsgData || ev.connID != 1 || string(ev.data) != msg {
+			t.Fatalf("got event %#x for conn %d %q, want %q echoed", ev.msgType, ev.connID, ev.data, msg)
+		}
+	}
+
+	// A refusal fails one read, not the connection
+	connect(2, 9)
+	send(2, "anyone?")
+	if ev := event(); ev.msgType != MsgError || ev.connID != 2 || string(ev.data) != "connection refused" {
+		t.Fatalf("got event %#x for conn %d %q, want the refusal", ev.msgType, ev.connID, ev.data)
+	}
+	if v, ok := sess.connections.Load(uint32(2)); !ok || v.(*Connection).closed.Load() {
+		t.Fatal("refused connection was closed")
+	}
+
+	bind := append(binary.BigEndian.AppendUint32(nil, 3), SOCK_DGRAM, 0, 0)
+	go sess.handleBind(readerStream{r: bytes.NewReader(bind)})
+	if ev := event(); ev.msgType != MsgConnected {
+		t.Fatalf("bind: got event %#x %q", ev.msgType, ev.data)
+	}
+	send(3, "ping")
+	if ev := event(); ev.msgType != MsgError || ev.connID != 3 {
+		t.Fatalf("send on a bound socket: got event %#x for conn %d %q", ev.msgType, ev.connID, ev.data)
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
+
+// TestConnectedUDPDatagrams round-trips packets of a connected datagram
+// socket through QUIC datagrams, and checks a reply too large for one
+// comes back as a MsgData event instead
+func TestConnectedUDPDatagrams(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.datagrams = true })
+	fake := newFakeDatagramConn(sess.ctx)
+	(&Server{}).attachDatagrams(fake, 8, sess)
+
+	udp, err := net.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(5, SOCK_DGRAM)
+	conn.conn = udp
+	sess.connections.Store(uint32(5), conn)
+	go sess.readLoop(conn)
+
+	send := func(data []byte) {
+		frame := append(quicvarint.Append(nil, 2), MsgSend)
+		frame = binary.BigEndian.AppendUint32(frame, 5)
+		fake.recv <- append(frame, data...)
+	}
+
+	send([]byte("ping"))
+	select {
+	case frame := <-fake.sent:
+		r := bytes.NewReader(frame)
+		if id, err := quicvarint.Read(r); err != nil || id != 2 {
+			t.Fatalf("quarter session ID %d, %v; want 2", id, err)
+		}
+		body := frame[len(frame)-r.Len():]
+		if body[0] != MsgData || binary.BigEndian.Uint32(body[1:5]) != 5 || string(body[5:]) != "ping" {
+			t.Fatalf("got datagram %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no datagram sent")
+	}
+
+	send(make([]byte, 2000))
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgData || ev.connID != 5 || len(ev.data) != 2000 {
+		t.Fatalf("got event %#x for conn %d with %d bytes, want the 2000-byte reply", ev.msgType, ev.connID, len(ev.data))
+	}
+
+	sess.cancel() // drop the MsgClosed of the teardown below
+	conn.Close()
+}
+
+// sendToBatch is a MsgSendTo body: connID (4), count (1), then count x
+// [hostLen (2), host, port (2), dataLen (2), data]
+func sendToBatch(connID uint32, count int, hosts []string, port uint16, payloads []string) readerStream {
+	req := binary.BigEndian.AppendUint32(nil, connID)
+	req = append(req, byte(count))
+	for i, host := range hosts {
+		req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, port)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(payloads[i])))
+		req = append(req, payloads[i]...)
+	}
+	return readerStream{r: bytes.NewReader(req)}
+}
+
+func TestSendToBatch(t *testing.T) {
+	recv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	port := uint16(recv.LocalAddr().(*net.UDPAddr).Port)
+
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		t.Errorf("looked up %q", host)
+		return nil, errors.New("no lookups")
+	}
+	// A cached answer isn't screened again, so the name can point at the
+	// loopback receiver
+	d := tbl.Get("recv.example", int(port))
+	d.ips = []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}
+	d.resolvedAt = time.Now()
+	sess, pr := newTestSession(t, tbl)
+
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(7, SOCK_DGRAM)
+	conn.udpConn = u
+	defer conn.Close()
+	sess.connections.Store(conn.id, conn)
+
+	received := func(want ...string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		for _, w := range want {
+			recv.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, _, err := recv.ReadFromUDP(buf)
+			if err != nil || string(buf[:n]) != w {
+				t.Fatalf("received %q, %v; want %q", buf[:n], err, w)
+			}
+		}
+	}
+	event := func() testEvent {
+		t.Helper()
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+
+	// Every datagram of a batch goes out, in order
+	sess.handleSendTo(sendToBatch(conn.id, 3, []string{"recv.example", "recv.example", "recv.example"}, port, []string{"one", "two", "three"}))
+	received("one", "two", "three")
+	if out := conn.bytesOut.Load(); out != 11 {
+		t.Fatalf("bytesOut %d, want 11", out)
+	}
+
+	// Refused destinations are reported by index; the rest are still sent.
+	// This is also the first event, so the clean batch sent none.
+	hosts := []string{"recv.example", "169.254.169.254", "evil host", "recv.example"}
+	go sess.handleSendTo(sendToBatch(conn.id, 4, hosts, port, []string{"a", "b", "c", "d"}))
+	received("a", "d")
+	ev := event()
+	if ev.msgType != MsgSendToError || ev.connID != conn.id {
+		t.Fatalf("got event %#x conn %d, want MsgSendToError", ev.msgType, ev.connID)
+	}
+	b := ev.data
+	if b[0] != 2 {
+		t.Fatalf("%d failures reported, want 2", b[0])
+	}
+	b = b[1:]
+	for _, want := range []int{1, 2} {
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if int(b[0]) != want || n == 0 {
+			t.Fatalf("failure for datagram %d (%q), want %d", b[0], b[3:3+n], want)
+		}
+		b = b[3+n:]
+	}
+
+	// More datagrams than a batch may hold are refused outright
+	go sess.handleSendTo(sendToBatch(conn.id, maxSendToBatch+1, nil, port, nil))
+	if ev := event(); ev.msgType != MsgError || string(ev.data) != "invalid datagram batch size" {
+		t.Fatalf("got event %#x %q, want MsgError", ev.msgType, ev.data)
+	}
+
+	// A host no name could be ends the batch unread
+	go sess.handleSendTo(sendToBatch(conn.id, 2, []string{strings.Repeat("x", maxHostLen+2), "recv.example"}, port, []string{"e", "f"}))
+	ev = event()
+	if ev.msgType != MsgSendToError || ev.data[0] != 1 || ev.data[1] != 0 {
+		t.Fatalf("got event %#x %q, want MsgSendToError for datagram 0", ev.msgType, ev.data)
+	}
+}
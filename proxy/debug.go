@@ -0,0 +1,93 @@
+// debug.go - Profiling and runtime stats
+//
+// -pprof ADDR serves net/http/pprof under /debug/pprof/ and a JSON summary
+// under /debug/stats on a listener of its own, for chasing goroutine leaks
+// (a readLoop that never exits) without a rebuild. Profiles expose memory
+// contents, so ADDR must be a loopback address; the flag is off by default.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// checkLoopback refuses debug listen addresses reachable from off the host
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// LimiterStats is a RateLimiter.Stats snapshot
+type LimiterStats struct {
+	Sessions int `json:"sessions"`
+	Keys     int `json:"keys"` // IPs, prefixes or origins holding sessions
+}
+
+// DebugStats is the /debug/stats response
+type DebugStats struct {
+	Goroutines  int           `json:"goroutines"`
+	Sessions    int           `json:"sessions"`
+	Connections int           `json:"connections"`
+	RateLimit   LimiterStats  `json:"rate_limit"`
+	PullLimit   *LimiterStats `json:"pull_limit,omitempty"` // nil without a pull quota
+}
+
+func (s *Server) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	out := DebugStats{Goroutines: runtime.NumGoroutine()}
+	s.sessions.Range(func(_, v any) bool {
+		out.Sessions++
+		v.(*Session).connections.Range(func(_, _ any) bool {
+			out.Connections++
+			return true
+		})
+		return true
+	})
+	out.RateLimit.Sessions, out.RateLimit.Keys = s.rateLimiter.Stats()
+	if s.pullLimiter != nil {
+		out.PullLimit = &LimiterStats{}
+		out.PullLimit.Sessions, out.PullLimit.Keys = s.pullLimiter.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// debugMux routes the -pprof listener
+func (s *Server) debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stats", s.handleDebugStats)
+	return mux
+}
+
+// ServeDebug serves the debug endpoints on ln until the server shuts down
+func (s *Server) ServeDebug(ln net.Listener) error {
+	srv := &http.Server{Handler: s.debugMux()}
+	go func() {
+		<-s.ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("debug endpoints listening", "url", "http://"+ln.Addr().String()+"/debug/")
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"[::1]:6060":     true,
+		"localhost:6060": true,
+		":6060":          false,
+		"0.0.0.0:6060":   false,
+		"10.0.0.1:6060":  false,
+		"example.com:80": false,
+		"127.0.0.1":      false,
+	} {
+		if err := checkLoopback(addr); (err == nil) != ok {
+			t.Errorf("checkLoopback(%q) = %v", addr, err)
+		}
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	s.pullLimiter = NewRateLimiter(2, 50)
+	defer s.cancel()
+	sess := &Session{id: 1}
+	sess.connections.Store(uint32(1), newConnection(1, SOCK_STREAM))
+	sess.connections.Store(uint32(2), newConnection(2, SOCK_STREAM))
+	s.sessions.Store(sess.id, sess)
+	s.rateLimiter.TryAcquireSession("203.0.113.1:1000")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeDebug(ln)
+	base := "http://" + ln.Addr().String()
+
+	resp, err := http.Get(base + "/debug/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats DebugStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines == 0 || stats.Sessions != 1 || stats.Connections != 2 ||
+		stats.RateLimit != (LimiterStats{Sessions: 1, Keys: 1}) || stats.PullLimit == nil {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	resp, err = http.Get(base + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Fatalf("goroutine profile: %d %v", resp.StatusCode, err)
+	}
+}
@@ -0,0 +1,216 @@
+// denyhosts.go - Refusing destinations by name
+//
+// -deny-hosts lists hostnames sessions may never reach, for operators
+// blocking malware C2 domains and the like: exact names, and *.domain
+// patterns matching every name below domain (list domain too to refuse it
+// as well), as in a token's allow_hosts. Entries can also come from
+// -deny-hosts-file, one per line with # comments, which is checked every
+// -deny-hosts-reload and reread when it changes; a file that doesn't read
+// or parse is logged and the previous list stays in force. The requested
+// host is matched before anything is resolved, on connects, forwards and
+// MsgSendTo alike, and a match is refused with PolicyHostDenied. Only
+// names are matched: the address checks (blocklist.go) still apply to
+// whatever a permitted name resolves to, and an IP literal is matched
+// only if it is listed itself.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDenyHostsReload is how often -deny-hosts-file is checked
+const defaultDenyHostsReload = time.Minute
+
+var errHostDenied = errors.New("host denied")
+
+// hostDeniedError is errHostDenied with the entry that matched
+type hostDeniedError struct {
+	host    string
+	pattern string
+}
+
+func (e *hostDeniedError) Error() string        { return errHostDenied.Error() }
+func (e *hostDeniedError) Is(target error) bool { return target == errHostDenied }
+
+// hostPatterns is a parsed deny list
+type hostPatterns struct {
+	exact    map[string]bool
+	suffixes []string // ".domain" for each *.domain
+}
+
+// normalizeHost lowercases a name and drops its trailing dot
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// add parses one entry into p
+func (p *hostPatterns) add(entry string) error {
+	name := normalizeHost(strings.TrimPrefix(entry, "*."))
+	if err := validHost(name); err != nil || strings.Contains(name, "*") {
+		return fmt.Errorf("deny host %q: want a hostname or *.domain", entry)
+	}
+	if strings.HasPrefix(entry, "*.") {
+		p.suffixes = append(p.suffixes, "."+name)
+		return nil
+	}
+	if p.exact == nil {
+		p.exact = make(map[string]bool)
+	}
+	p.exact[name] = true
+	return nil
+}
+
+// match returns the entry denying host, if any
+func (p *hostPatterns) match(host string) (string, bool) {
+	host = normalizeHost(host)
+	if p.exact[host] {
+		return host, true
+	}
+	for _, s := range p.suffixes {
+		if strings.HasSuffix(host, s) {
+			return "*" + s, true
+		}
+	}
+	return "", false
+}
+
+// merge returns p with q's entries added
+func (p hostPatterns) merge(q hostPatterns) hostPatterns {
+	out := hostPatterns{suffixes: append(p.suffixes[:len(p.suffixes):len(p.suffixes)], q.suffixes...)}
+	for _, m := range []map[string]bool{p.exact, q.exact} {
+		for name := range m {
+			if out.exact == nil {
+				out.exact = make(map[string]bool)
+			}
+			out.exact[name] = true
+		}
+	}
+	return out
+}
+
+// parseDenyHostsFile reads a -deny-hosts-file: one entry per line, blank
+// lines and # comments ignored
+func parseDenyHostsFile(b []byte) (hostPatterns, error) {
+	var p hostPatterns
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := p.add(line); err != nil {
+			return hostPatterns{}, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return p, sc.Err()
+}
+
+// hostDenyList is the -deny-hosts list plus -deny-hosts-file's entries
+type hostDenyList struct {
+	static  hostPatterns
+	file    string
+	current atomic.Pointer[hostPatterns]
+
+	mu        sync.Mutex // serializes reloads
+	fileMod   int64      // unix nanos of the file version in current
+	fileSize  int64
+	fileValid bool
+}
+
+// newHostDenyList parses -deny-hosts and reads -deny-hosts-file; nil when
+// neither is set
+func newHostDenyList(list, file string) (*hostDenyList, error) {
+	if list == "" && file == "" {
+		return nil, nil
+	}
+	d := &hostDenyList{file: file}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := d.static.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	d.current.Store(&d.static)
+	if file != "" {
+		if _, err := d.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// match returns the entry denying host, if any
+func (d *hostDenyList) match(host string) (string, bool) {
+	return d.current.Load().match(host)
+}
+
+// reload rereads the file if it changed since it was last read, reporting
+// whether the list was replaced
+func (d *hostDenyList) reload() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fi, err := os.Stat(d.file)
+	if err != nil {
+		return false, err
+	}
+	if d.fileValid && fi.ModTime().UnixNano() == d.fileMod && fi.Size() == d.fileSize {
+		return false, nil
+	}
+	b, err := os.ReadFile(d.file)
+	if err != nil {
+		return false, err
+	}
+	fromFile, err := parseDenyHostsFile(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", d.file, err)
+	}
+	merged := d.static.merge(fromFile)
+	d.current.Store(&merged)
+	d.fileMod, d.fileSize, d.fileValid = fi.ModTime().UnixNano(), fi.Size(), true
+	return true, nil
+}
+
+// WatchEvery reloads the file when it changes, checking every interval
+// until ctx is done
+func (d *hostDenyList) WatchEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reloaded, err := d.reload()
+			if err != nil {
+				slog.Warn("deny hosts reload failed, keeping the current list", "file", d.file, "err", err)
+			} else if reloaded {
+				p := d.current.Load()
+				slog.Info("deny hosts reloaded", "file", d.file, "entries", len(p.exact)+len(p.suffixes))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkHost refuses a denied name, then a blocked, private or geofenced IP
+// literal (checkLiteral)
+func (t *DestinationTable) checkHost(host string) error {
+	if t.denied != nil {
+		if pattern, ok := t.denied.match(host); ok {
+			return &hostDeniedError{host: host, pattern: pattern}
+		}
+	}
+	return t.checkLiteral(host)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostDenyList(t *testing.T) {
+	d, err := newHostDenyList(" c2.example.net, *.Tracker.Example ,203.0.113.9", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"c2.example.net":       "c2.example.net",
+		"C2.Example.NET.":      "c2.example.net",
+		"a.tracker.example":    "*.tracker.example",
+		"x.y.tracker.example":  "*.tracker.example",
+		"203.0.113.9":          "203.0.113.9",
+		"tracker.example":      "", // *. doesn't cover the domain itself
+		"eviltracker.example":  "",
+		"c2.example.net.other": "",
+		"example.net":          "",
+	} {
+		if pattern, denied := d.match(host); denied != (want != "") || pattern != want {
+			t.Errorf("match(%q) = %q, %v, want %q", host, pattern, denied, want)
+		}
+	}
+
+	for _, bad := range []string{"*", "*.", "a.*.example", "bad host", "*example.com"} {
+		if _, err := newHostDenyList(bad, ""); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+	if d, err := newHostDenyList("", ""); d != nil || err != nil {
+		t.Errorf("empty: %v, %v", d, err)
+	}
+}
+
+func TestDenyHostsFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	write := func(content string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("# known C2\nold.example\n\n*.bad.example # and below\n", now)
+
+	d, err := newHostDenyList("flag.example", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"flag.example", "old.example", "x.bad.example"} {
+		if _, denied := d.match(host); !denied {
+			t.Errorf("%s not denied", host)
+		}
+	}
+	if reloaded, err := d.reload(); reloaded || err != nil {
+		t.Errorf("unchanged file: reloaded %v, %v", reloaded, err)
+	}
+
+	write("new.example\n", now.Add(time.Second))
+	if reloaded, err := d.reload(); !reloaded || err != nil {
+		t.Fatalf("changed file: reloaded %v, %v", reloaded, err)
+	}
+	if _, denied := d.match("old.example"); denied {
+		t.Error("entry removed from the file still denied")
+	}
+	for _, host := range []string{"flag.example", "new.example"} {
+		if _, denied := d.match(host); !denied {
+			t.Errorf("%s not denied after reload", host)
+		}
+	}
+
+	// A broken file leaves the list as it was
+	write("new.example\nnot a host\n", now.Add(2*time.Second))
+	if _, err := d.reload(); err == nil {
+		t.Error("bad file reloaded")
+	}
+	if _, denied := d.match("new.example"); !denied {
+		t.Error("list lost after a failed reload")
+	}
+}
+
+func TestConnectDeniedHost(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.denied, _ = newHostDenyList("*.c2.example", "")
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		t.Errorf("looked up %q", host)
+		return nil, errors.New("no lookups")
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	host := "beacon.c2.example"
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d PolicyDecision
+	if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil ||
+		d.Category != PolicyHostDenied || d.Rule != "*.c2.example" || d.Code != ConnErrBlocked || d.Message != "host denied" {
+		t.Fatalf("got event %#x %s", ev.msgType, ev.data)
+	}
+}
@@ -0,0 +1,363 @@
+// destination.go - Per-destination connect state shared across sessions
+//
+// A Destination is one host:port the proxy dials. It keeps everything the
+// proxy learns about that endpoint in one place, consulted by handleConnect:
+//
+//   - DNS cache: resolved addresses are reused for dnsTTL. They are dropped
+//     early when a dial to every cached address fails, so a moved host is
+//     re-resolved on the next connect. Private, loopback and blocked
+//     (blocklist.go) addresses are filtered out as they're resolved, and
+//     dials only ever go to the addresses that passed, so a name can't be
+//     rebound to an internal address between the check and the dial.
+//   - Circuit breaker: after breakerFailures consecutive failed dials the
+//     destination is rejected outright for breakerCooldown. The first dial
+//     after the cooldown is a trial; success closes the breaker, failure
+//     reopens it for another cooldown.
+//   - Latency: a moving average of successful TCP connect times.
+//   - Address racing: a name's addresses are dialed Happy Eyeballs style
+//     (happyeyeballs.go), so a dead IPv6 address doesn't hold up IPv4.
+//   - Idle pool: TCP connections opened with OptPool are parked here on
+//     MsgClose instead of being closed, and handed to the next OptPool
+//     connect from the same owner, the session, so protocol state never
+//     crosses tenants, even ones sharing a client IP or token. Parked
+//     connections expire after poolIdle (-pool-idle), are discarded if the
+//     peer closed or sent data while parked or once their session ends, and
+//     at most poolMax (-pool-max) are kept per destination.
+//
+// Destinations unused for destIdleExpiry are forgotten by Sweep, which the
+// server runs once a minute until it shuts down.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Destination defaults
+const (
+	defaultDNSTTL          = 60 * time.Second
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+	defaultPoolIdle        = 30 * time.Second
+	defaultPoolMax         = 4
+	destIdleExpiry         = 10 * time.Minute
+)
+
+var errCircuitOpen = errors.New("destination temporarily unavailable (circuit open)")
+
+// circuitOpenError is errCircuitOpen with the details a client needs to back off
+type circuitOpenError struct {
+	failures   int           // breaker threshold that tripped
+	retryAfter time.Duration // until the trial dial is allowed
+}
+
+func (e *circuitOpenError) Error() string        { return errCircuitOpen.Error() }
+func (e *circuitOpenError) Is(target error) bool { return target == errCircuitOpen }
+
+var errPrivateAddress = errors.New("connection to private addresses not allowed")
+
+// privateAddrError is errPrivateAddress for a name that resolved only to
+// private addresses
+type privateAddrError struct {
+	host string
+}
+
+func (e *privateAddrError) Error() string        { return errPrivateAddress.Error() }
+func (e *privateAddrError) Is(target error) bool { return target == errPrivateAddress }
+
+// DestinationTable holds the Destinations the proxy has dialed
+type DestinationTable struct {
+	dnsTTL          time.Duration // 0 = resolve on every connect
+	breakerFailures int           // 0 = breaker disabled
+	breakerCooldown time.Duration
+	poolIdle        time.Duration
+	poolMax         int           // 0 = pooling disabled
+	blocked         []*net.IPNet  // never dialed (blocklist.go)
+	attemptDelay    time.Duration // head start per address (happyeyeballs.go)
+	geo             *geoFilter    // nil = any country (geoip.go)
+	denied          *hostDenyList // nil = no names denied (denyhosts.go)
+
+	// Overridable for tests
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+	lookupMX func(ctx context.Context, host string) ([]*net.MX, error)
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	dests map[string]*Destination
+}
+
+// Destination is the shared state for one host:port
+type Destination struct {
+	host string
+	port int
+	tbl  *DestinationTable
+
+	mu         sync.Mutex
+	lastUsed   time.Time
+	ips        []net.IPAddr
+	resolvedAt time.Time
+	latency    time.Duration // moving average; 0 = no successful dial yet
+	failures   int           // consecutive failed dials
+	openUntil  time.Time     // breaker open while now is before this
+	idle       []idleConn
+}
+
+type idleConn struct {
+	conn  net.Conn
+	owner string
+	since time.Time
+}
+
+func NewDestinationTable() *DestinationTable {
+	var d net.Dialer
+	return &DestinationTable{
+		dnsTTL:          defaultDNSTTL,
+		breakerFailures: defaultBreakerFailures,
+		breakerCooldown: defaultBreakerCooldown,
+		poolIdle:        defaultPoolIdle,
+		poolMax:         defaultPoolMax,
+		blocked:         defaultBlockedNets(),
+		attemptDelay:    defaultAttemptDelay,
+		lookup:          net.DefaultResolver.LookupIPAddr,
+		lookupMX:        net.DefaultResolver.LookupMX,
+		dial:            d.DialContext,
+		dests:           make(map[string]*Destination),
+	}
+}
+
+// Get returns the Destination for host:port, creating it on first use
+func (t *DestinationTable) Get(host string, port int) *Destination {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.dests[key]
+	if !ok {
+		d = &Destination{host: host, port: port, tbl: t}
+		t.dests[key] = d
+	}
+	return d
+}
+
+// Sweep forgets unused destinations and closes expired idle connections
+func (t *DestinationTable) Sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, d := range t.dests {
+		d.mu.Lock()
+		d.pruneIdleLocked(now)
+		stale := len(d.idle) == 0 && now.Sub(d.lastUsed) > destIdleExpiry
+		d.mu.Unlock()
+		if stale {
+			delete(t.dests, key)
+		}
+	}
+}
+
+// DropIdle closes every connection owner has parked
+func (t *DestinationTable) DropIdle(owner string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range t.dests {
+		d.mu.Lock()
+		kept := d.idle[:0]
+		for _, ic := range d.idle {
+			if ic.owner == owner {
+				ic.conn.Close()
+			} else {
+				kept = append(kept, ic)
+			}
+		}
+		clear(d.idle[len(kept):])
+		d.idle = kept
+		d.mu.Unlock()
+	}
+}
+
+// SweepEvery runs Sweep every interval until ctx is done
+func (t *DestinationTable) SweepEvery(ctx context.Context, interval time.Duration) {
+	sweepEvery(ctx, interval, t.Sweep)
+}
+
+// Dial connects over TCP, first trying owner's pooled connections unless
+// owner is empty. reused reports whether the connection came from the pool.
+func (d *Destination) Dial(ctx context.Context, timeout time.Duration, owner string) (conn net.Conn, reused bool, err error) {
+	now := time.Now()
+	d.mu.Lock()
+	d.lastUsed = now
+	if d.tbl.breakerFailures > 0 && now.Before(d.openUntil) {
+		retry := d.openUntil.Sub(now)
+		d.mu.Unlock()
+		return nil, false, &circuitOpenError{failures: d.tbl.breakerFailures, retryAfter: retry}
+	}
+	// Probing a parked connection blocks briefly, so it's done unlocked;
+	// the candidate is already out of the pool
+	for owner != "" {
+		c := d.takeIdleLocked(now, owner)
+		if c == nil {
+			break
+		}
+		d.mu.Unlock()
+		if idleConnAlive(c) {
+			return c, true, nil
+		}
+		c.Close()
+		d.mu.Lock()
+	}
+	d.mu.Unlock()
+
+	ips, err := d.resolve(ctx, now)
+	if err != nil {
+		if !errors.Is(err, errPrivateAddress) && !errors.Is(err, errBlockedDestination) {
+			d.dialFailed()
+		}
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, rtt, err := d.tbl.dialRace(ctx, ips, d.port)
+	if err == nil {
+		d.dialSucceeded(rtt)
+		return conn, false, nil
+	}
+
+	// Every cached address failed: re-resolve next time
+	d.mu.Lock()
+	d.ips = nil
+	d.mu.Unlock()
+	d.dialFailed()
+	return nil, false, err
+}
+
+// Latency returns the moving average connect time (0 if never connected)
+func (d *Destination) Latency() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latency
+}
+
+// PutIdle parks owner's connection for reuse, closing it if pooling is off
+// or the pool is full
+func (d *Destination) PutIdle(c net.Conn, owner string) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pruneIdleLocked(now)
+	if len(d.idle) >= d.tbl.poolMax {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	d.idle = append(d.idle, idleConn{conn: c, owner: owner, since: now})
+}
+
+// ResolveUDP picks the address to send datagrams for this destination to
+func (d *Destination) ResolveUDP(ctx context.Context) (*net.UDPAddr, error) {
+	ips, err := d.resolve(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: d.port, Zone: ips[0].Zone}, nil
+}
+
+// DialUDP opens a connected UDP socket to the address ResolveUDP picks
+func (d *Destination) DialUDP(ctx context.Context) (net.Conn, error) {
+	ua, err := d.ResolveUDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.tbl.dial(ctx, "udp", ua.String())
+}
+
+// resolve returns the destination's public addresses, from cache if fresh
+func (d *Destination) resolve(ctx context.Context, now time.Time) ([]net.IPAddr, error) {
+	d.mu.Lock()
+	if len(d.ips) > 0 && d.tbl.dnsTTL > 0 && now.Sub(d.resolvedAt) < d.tbl.dnsTTL {
+		ips := d.ips
+		d.mu.Unlock()
+		return ips, nil
+	}
+	d.mu.Unlock()
+
+	ips, err := d.tbl.lookup(ctx, d.host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: d.host, IsNotFound: true}
+	}
+	if ips, err = d.tbl.screenAddrs(d.host, ips); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.ips = ips
+	d.resolvedAt = now
+	d.mu.Unlock()
+	return ips, nil
+}
+
+func (d *Destination) dialSucceeded(rtt time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = 0
+	d.openUntil = time.Time{}
+	if d.latency == 0 {
+		d.latency = rtt
+	} else {
+		d.latency += (rtt - d.latency) / 4
+	}
+}
+
+func (d *Destination) dialFailed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures++
+	if d.tbl.breakerFailures > 0 && d.failures >= d.tbl.breakerFailures {
+		d.openUntil = time.Now().Add(d.tbl.breakerCooldown)
+		d.failures = d.tbl.breakerFailures - 1 // half-open: one more failure reopens
+	}
+}
+
+// takeIdleLocked removes owner's newest pooled connection from the pool and
+// returns it, if there is one; the caller checks it's still alive
+func (d *Destination) takeIdleLocked(now time.Time, owner string) net.Conn {
+	d.pruneIdleLocked(now)
+	for i := len(d.idle) - 1; i >= 0; i-- {
+		ic := d.idle[i]
+		if ic.owner != owner {
+			continue
+		}
+		d.idle = append(d.idle[:i], d.idle[i+1:]...)
+		return ic.conn
+	}
+	return nil
+}
+
+func (d *Destination) pruneIdleLocked(now time.Time) {
+	kept := d.idle[:0]
+	for _, ic := range d.idle {
+		if now.Sub(ic.since) < d.tbl.poolIdle {
+			kept = append(kept, ic)
+		} else {
+			ic.conn.Close()
+		}
+	}
+	d.idle = kept
+}
+
+// idleConnAlive reports whether a parked connection is still open and
+// quiet: a peer close (EOF) or unsolicited data both make it unusable
+func idleConnAlive(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,475 @@
+// destination_test.go - Destination DNS cache, breaker, latency and pool tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDestTable returns a table whose lookups and dials are counted and scripted
+func fakeDestTable(dialErr *error) (*DestinationTable, *int, *int) {
+	lookups, dials := 0, 0
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if *dialErr != nil {
+			return nil, *dialErr
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	return tbl, &lookups, &dials
+}
+
+// newTestSession returns a session connecting through tbl (nil when the
+// test doesn't connect anywhere), as handleConnect expects one, and the
+// reader its events come out of; opts set anything else the test needs
+func newTestSession(t *testing.T, tbl *DestinationTable, opts ...func(*Session)) (*Session, io.Reader) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	sess := &Session{ctx: ctx, cancel: cancel, events: pipeSendStream{pw}, srv: &Server{dests: tbl}, rateLimiter: NewRateLimiter(1, 100)}
+	for _, opt := range opts {
+		opt(sess)
+	}
+	return sess, pr
+}
+
+func TestDestinationDNSCache(t *testing.T) {
+	var dialErr error
+	tbl, lookups, _ := fakeDestTable(&dialErr)
+	d := tbl.Get("example.com", 443)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := d.Dial(ctx, time.Second, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *lookups != 1 {
+		t.Fatalf("fresh cache should be reused: %d lookups", *lookups)
+	}
+
+	// Expired entry is re-resolved
+	d.resolvedAt = time.Now().Add(-2 * tbl.dnsTTL)
+	d.Dial(ctx, time.Second, "")
+	if *lookups != 2 {
+		t.Fatalf("expired cache should re-resolve: %d lookups", *lookups)
+	}
+
+	// A failed dial to every cached address drops the cache
+	dialErr = errors.New("refused")
+	d.Dial(ctx, time.Second, "")
+	dialErr = nil
+	d.Dial(ctx, time.Second, "")
+	if *lookups != 3 {
+		t.Fatalf("failed dial should invalidate the cache: %d lookups", *lookups)
+	}
+}
+
+func TestDestinationCircuitBreaker(t *testing.T) {
+	dialErr := errors.New("refused")
+	tbl, _, dials := fakeDestTable(&dialErr)
+	tbl.breakerFailures = 3
+	d := tbl.Get("example.com", 443)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		d.Dial(ctx, time.Second, "")
+	}
+	if _, _, err := d.Dial(ctx, time.Second, ""); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("breaker should be open, got %v", err)
+	}
+	if *dials != 3 {
+		t.Fatalf("open breaker must not dial: %d dials", *dials)
+	}
+
+	// Cooldown over: a failed trial reopens immediately
+	d.openUntil = time.Now().Add(-time.Second)
+	d.Dial(ctx, time.Second, "")
+	if _, _, err := d.Dial(ctx, time.Second, ""); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("failed trial should reopen the breaker, got %v", err)
+	}
+
+	// A successful trial closes it
+	d.openUntil = time.Now().Add(-time.Second)
+	dialErr = nil
+	if _, _, err := d.Dial(ctx, time.Second, ""); err != nil {
+		t.Fatalf("trial dial: %v", err)
+	}
+	dialErr = errors.New("refused")
+	if _, _, err := d.Dial(ctx, time.Second, ""); errors.Is(err, errCircuitOpen) {
+		t.Fatalf("one failure after recovery should not reopen the breaker")
+	}
+}
+
+func TestDestinationLatency(t *testing.T) {
+	var dialErr error
+	tbl, _, _ := fakeDestTable(&dialErr)
+	d := tbl.Get("example.com", 443)
+	if d.Latency() != 0 {
+		t.Fatal("latency before any dial should be 0")
+	}
+	d.dialSucceeded(100 * time.Millisecond)
+	d.dialSucceeded(20 * time.Millisecond)
+	if got := d.Latency(); got != 80*time.Millisecond {
+		t.Fatalf("moving average = %v, want 80ms", got)
+	}
+}
+
+func TestDestinationPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peers := make(chan net.Conn, 8)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peers <- c
+		}
+	}()
+
+	// Loopback is refused as a destination, so resolve to a public
+	// address and have the dial land on the local listener
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	var dialer net.Dialer
+	tbl.dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, ln.Addr().String())
+	}
+	d := tbl.Get("pool.example", 443)
+	ctx := context.Background()
+
+	c1, reused, err := d.Dial(ctx, time.Second, "alice")
+	if err != nil || reused {
+		t.Fatalf("first dial: reused=%v err=%v", reused, err)
+	}
+	p1 := <-peers
+	d.PutIdle(c1, "alice")
+
+	// Another owner never sees alice's connection
+	c2, reused, _ := d.Dial(ctx, time.Second, "bob")
+	if reused {
+		t.Fatal("pooled connection crossed owners")
+	}
+	c2.Close()
+	(<-peers).Close()
+
+	c3, reused, _ := d.Dial(ctx, time.Second, "alice")
+	if !reused || c3 != c1 {
+		t.Fatal("owner should get its pooled connection back")
+	}
+
+	// A parked connection the peer closed is discarded
+	d.PutIdle(c3, "alice")
+	p1.Close()
+	time.Sleep(50 * time.Millisecond)
+	c, reused, _ := d.Dial(ctx, time.Second, "alice")
+	if reused {
+		t.Fatal("dead pooled connection was reused")
+	}
+	c.Close()
+	(<-peers).Close()
+
+	// A dead newest connection gives way to an older live one
+	older, _, _ := d.Dial(ctx, time.Second, "alice")
+	olderPeer := <-peers
+	defer olderPeer.Close()
+	newer, _, _ := d.Dial(ctx, time.Second, "alice")
+	d.PutIdle(older, "alice")
+	d.PutIdle(newer, "alice")
+	(<-peers).Close()
+	time.Sleep(50 * time.Millisecond)
+	if c, reused, _ := d.Dial(ctx, time.Second, "alice"); !reused || c != older {
+		t.Fatal("live pooled connection behind a dead one wasn't reused")
+	}
+	older.Close()
+
+	// Expired parked connections are closed by Sweep
+	c4, _, _ := d.Dial(ctx, time.Second, "alice")
+	d.PutIdle(c4, "alice")
+	tbl.Sweep(time.Now().Add(2 * tbl.poolIdle))
+	if len(d.idle) != 0 {
+		t.Fatal("expired idle connection not swept")
+	}
+
+	// Unused destinations are forgotten
+	tbl.Sweep(time.Now().Add(2 * destIdleExpiry))
+	if len(tbl.dests) != 0 {
+		t.Fatal("stale destination not forgotten")
+	}
+}
+
+func TestSweepEveryStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewDestinationTable().SweepEvery(ctx, time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SweepEvery still running after its context ended")
+	}
+}
+
+// rebindingTable answers the first lookup of a name with a public address
+// and every later one with loopback, recording where dials go
+func rebindingTable() (*DestinationTable, chan string) {
+	lookups := 0
+	dialed := make(chan string, 4)
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if lookups == 1 {
+			return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	return tbl, dialed
+}
+
+// TestConnectDNSRebinding checks a connect dials the address that was
+// vetted, not whatever a second lookup of the name returns
+func TestConnectDNSRebinding(t *testing.T) {
+	tbl, dialed := rebindingTable()
+	ended, end := context.WithCancel(context.Background())
+	end() // events are dropped; only the dial matters
+	sess := &Session{ctx: ended, srv: &Server{dests: tbl}, rateLimiter: NewRateLimiter(1, 100)}
+
+	req := []byte{0, 0, 0, 1, SOCK_STREAM}
+	req = binary.BigEndian.AppendUint16(req, uint16(len("rebind.example")))
+	req = append(req, "rebind.example"...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+
+	select {
+	case addr := <-dialed:
+		if addr != "203.0.113.7:443" {
+			t.Fatalf("dialed %s, want the vetted 203.0.113.7:443", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connect never dialed")
+	}
+}
+
+func TestDestinationFiltersPrivate(t *testing.T) {
+	tbl, dialed := rebindingTable()
+	tbl.dnsTTL = 0 // every dial resolves afresh
+	d := tbl.Get("rebind.example", 443)
+	ctx := context.Background()
+
+	if _, _, err := d.Dial(ctx, time.Second, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-dialed
+
+	// Now the name points at loopback: refused without dialing, and
+	// without counting against the breaker
+	_, _, err := d.Dial(ctx, time.Second, "")
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("got %v, want errPrivateAddress", err)
+	}
+	if dec := dialDecision(err); dec.Category != PolicyPrivateAddress || dec.Rule != "rebind.example" {
+		t.Fatalf("decision %+v", dec)
+	}
+	select {
+	case addr := <-dialed:
+		t.Fatalf("dialed %s", addr)
+	default:
+	}
+	if d.failures != 0 {
+		t.Fatalf("private answer counted as %d dial failures", d.failures)
+	}
+
+	// Mixed answers keep only the public addresses
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("::1")}, {IP: net.ParseIP("198.51.100.2")}}, nil
+	}
+	if _, _, err := d.Dial(ctx, time.Second, ""); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-dialed; addr != "198.51.100.2:443" {
+		t.Fatalf("dialed %s", addr)
+	}
+}
+
+// TestConnectIPv6Literals checks IPv6 literals, bare or bracketed, are
+// vetted without a lookup and dialed with a well-formed address
+func TestConnectIPv6Literals(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		// What net.Resolver does for literals, minus any chance of DNS
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		t.Errorf("looked up %q", host)
+		return nil, &net.DNSError{Name: host, IsNotFound: true}
+	}
+	dialed := make(chan string, 4)
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	for i, tc := range []struct {
+		host     string
+		category string // empty = connects
+		dialed   string
+	}{
+		{"::1", PolicyPrivateAddress, ""},
+		{"[::1]", PolicyPrivateAddress, ""},
+		{"::ffff:127.0.0.1", PolicyPrivateAddress, ""},
+		{"fd00::1", PolicyPrivateAddress, ""},
+		{"2606:4700:4700::1111", "", "[2606:4700:4700::1111]:443"},
+		{"[2606:4700:4700::1001]", "", "[2606:4700:4700::1001]:443"},
+	} {
+		connID := uint32(i + 1)
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(tc.host)))
+		req = append(req, tc.host...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.category != "" {
+			var d PolicyDecision
+			if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != tc.category {
+				t.Errorf("%s: got event %#x %s, want %s", tc.host, ev.msgType, ev.data, tc.category)
+			}
+			continue
+		}
+		if ev.msgType != MsgConnected {
+			t.Fatalf("%s: got event %#x %s, want MsgConnected", tc.host, ev.msgType, ev.data)
+		}
+		if addr := <-dialed; addr != tc.dialed {
+			t.Errorf("%s: dialed %s, want %s", tc.host, addr, tc.dialed)
+		}
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
+
+// TestConnectPoolReuse closes an OptPool connection and connects again: the
+// session gets the parked socket back without a second dial, another
+// session dials its own, and ending the session closes what it left parked
+func TestConnectPoolReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	var dials atomic.Int32
+	var dialer net.Dialer
+	tbl.dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		dials.Add(1)
+		return dialer.DialContext(ctx, network, ln.Addr().String())
+	}
+	newSession := func(id uint64) (*Session, io.Reader) {
+		return newTestSession(t, tbl, func(s *Session) { s.id = id })
+	}
+	connect := func(sess *Session, pr io.Reader, connID uint32) {
+		t.Helper()
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len("pool.example")))
+		req = append(req, "pool.example"...)
+		req = binary.BigEndian.AppendUint16(req, 80)
+		req = append(req, OptPool, 0)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgConnected {
+			t.Fatalf("got event %#x %q, %v, want MsgConnected", ev.msgType, ev.data, err)
+		}
+	}
+
+	closeConn := func(sess *Session, pr io.Reader, connID uint32) {
+		t.Helper()
+		go sess.handleClose(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, connID))})
+		if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgClosed {
+			t.Fatalf("got event %#x %q, %v, want MsgClosed", ev.msgType, ev.data, err)
+		}
+	}
+
+	alice, aliceEvents := newSession(1)
+	connect(alice, aliceEvents, 1)
+	closeConn(alice, aliceEvents, 1)
+	connect(alice, aliceEvents, 2)
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("%d dials, want the parked connection reused", n)
+	}
+
+	bob, bobEvents := newSession(2)
+	connect(bob, bobEvents, 1)
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("%d dials, want another session to dial its own", n)
+	}
+
+	closeConn(alice, aliceEvents, 2)
+	d := tbl.Get("pool.example", 80)
+	if len(d.idle) != 1 {
+		t.Fatalf("%d parked, want 1", len(d.idle))
+	}
+	tbl.DropIdle(alice.poolOwner())
+	if len(d.idle) != 0 {
+		t.Fatal("ended session's connection still parked")
+	}
+
+	bob.cancel()
+	bob.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
@@ -0,0 +1,83 @@
+// dnslimit.go - Per-session limit on hostname lookups
+//
+// Every connect, forward or sendto that names a host (rather than an IP
+// literal) costs a resolver query. With -dns-rate set, each session gets a
+// token bucket of that many queries per second with a -dns-burst allowance,
+// so a container can't turn the proxy into a DNS scanner or amplifier.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultDNSBurst = 20
+
+// tokenBucket is a standard token bucket refilled continuously
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// refill adds the tokens earned since the last call. Caller holds mu.
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// allow takes one token if available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take takes n tokens unconditionally, going into debt if there aren't
+// enough, and returns how long until the debt is paid off
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allowLookup charges a DNS query against the session's budget. IP literals
+// need no lookup and are always allowed.
+func (sess *Session) allowLookup(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if sess.srv != nil {
+		sess.srv.metrics.dnsQueries.Add(1)
+	}
+	if sess.dnsLimiter == nil || sess.dnsLimiter.allow(time.Now()) {
+		return true
+	}
+	if sess.srv != nil {
+		sess.srv.metrics.dnsRejected.Add(1)
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+// dnslimit_test.go - Per-session DNS query limit and /metrics tests
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("burst query %d rejected", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("query beyond burst allowed")
+	}
+	// 2/s refills one token every 500ms
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("refilled token not granted")
+	}
+	if b.allow(now.Add(600 * time.Millisecond)) {
+		t.Fatal("token granted before refill")
+	}
+	// A long idle period refills only up to the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(later) {
+			t.Fatalf("query %d after idle rejected", i)
+		}
+	}
+	if b.allow(later) {
+		t.Fatal("idle refill exceeded burst")
+	}
+}
+
+func TestAllowLookup(t *testing.T) {
+	srv := &Server{}
+	sess := &Session{srv: srv, dnsLimiter: newTokenBucket(0.001, 1)}
+
+	if !sess.allowLookup("example.com") {
+		t.Fatal("first lookup rejected")
+	}
+	if sess.allowLookup("example.org") {
+		t.Fatal("second lookup allowed past burst")
+	}
+	// IP literals need no query and don't touch the budget
+	for _, host := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		if !sess.allowLookup(host) {
+			t.Fatalf("IP literal %s rejected", host)
+		}
+	}
+	if q, r := srv.metrics.dnsQueries.Load(), srv.metrics.dnsRejected.Load(); q != 2 || r != 1 {
+		t.Fatalf("queries=%d rejected=%d, want 2 and 1", q, r)
+	}
+
+	d := sess.dnsRateDecision()
+	if d.Category != PolicyDNSRate || !d.Transient || d.RetryAfter == 0 {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+
+	// Unlimited sessions still count queries
+	open := &Session{srv: srv}
+	if !open.allowLookup("example.net") || srv.metrics.dnsQueries.Load() != 3 {
+		t.Fatal("unlimited session lookup not allowed or not counted")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	srv := &Server{}
+	srv.metrics.dnsQueries.Store(7)
+	srv.metrics.dnsRejected.Store(2)
+
+	rec := httptest.NewRecorder()
+	srv.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	for _, want := range []string{
+		"# TYPE friscy_dns_queries_total counter",
+		"friscy_dns_queries_total 7\n",
+		"friscy_dns_queries_rejected_total 2\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// eventretry.go - Keeping connection-ending events when a stream won't open
+//
+// Once the session's ordered event stream has failed, sendEvent opens a uni
+// stream per event. Opening one can fail short of the client not reading
+// (which eventTimeout catches, aborting the session): the connection may
+// report a transient error, or the stream count may be exhausted between
+// the client's credit updates. Opens are retried a few times with backoff.
+// If an event still can't be sent and it ends a connection (MsgClosed,
+// MsgConnectError, MsgCertError), it is held on the session instead of
+// dropped, since the client would otherwise never learn the connection is
+// gone and leak its socket. The next event that gets through carries the
+// held ones ahead of it, on the same stream, so they keep their order.
+// Anything else is dropped as before.
+
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+const (
+	eventOpenRetries = 3                     // retries after a failed open
+	eventOpenBackoff = 10 * time.Millisecond // first retry delay, doubling
+	maxHeldEvents    = 256                   // held events per session
+)
+
+// heldEvent is an event that couldn't be sent, kept for the next stream
+type heldEvent struct {
+	msgType byte
+	connID  uint32
+	ts      int64
+	data    []byte
+}
+
+// holdsEvent reports whether an event is worth holding when it can't be
+// sent: the ones that tell the client a connection is gone
+func holdsEvent(msgType byte) bool {
+	switch msgType {
+	case MsgClosed, MsgConnectError, MsgCertError:
+		return true
+	}
+	return false
+}
+
+// openEventUni opens a uni stream for events, retrying failures with
+// backoff until ctx ends
+func (sess *Session) openEventUni(ctx context.Context) (webtransport.SendStream, error) {
+	open := sess.openUni
+	if open == nil {
+		open = sess.wt.OpenUniStreamSync
+	}
+	backoff := eventOpenBackoff
+	for attempt := 1; ; attempt++ {
+		stream, err := open(ctx)
+		if err == nil || ctx.Err() != nil || attempt > eventOpenRetries {
+			return stream, err
+		}
+		sess.log().Debug("retrying event stream open", "attempt", attempt, "err", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// holdEvent keeps an unsent event if it ends a connection. Caller holds
+// streamMu.
+func (sess *Session) holdEvent(msgType byte, connID uint32, ts int64, data []byte) {
+	if !holdsEvent(msgType) {
+		return
+	}
+	if len(sess.heldEvents) >= maxHeldEvents {
+		sess.log().Warn("dropping event, too many held", "msg_type", msgType, "conn_id", connID)
+		return
+	}
+	sess.heldEvents = append(sess.heldEvents, heldEvent{msgType, connID, ts, append([]byte(nil), data...)})
+	sess.log().Warn("holding event until a stream opens", "msg_type", msgType, "conn_id", connID)
+}
+
+// writeEvents writes any held events and then this one to w. Held events
+// that were written are released even if this one fails. Caller holds
+// streamMu.
+func (sess *Session) writeEvents(w io.Writer, msgType byte, connID uint32, ts int64, data []byte) error {
+	for len(sess.heldEvents) > 0 {
+		ev := sess.heldEvents[0]
+		if err := writeEvent(w, ev.msgType, ev.connID, ev.ts, ev.data); err != nil {
+			return err
+		}
+		sess.heldEvents = sess.heldEvents[1:]
+	}
+	sess.heldEvents = nil
+	return writeEvent(w, msgType, connID, ts, data)
+}
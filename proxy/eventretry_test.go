@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// sharedStream is a per-event stream that leaves the pipe open on Close,
+// so every stream the session opens feeds the same reader
+type sharedStream struct{ pipeSendStream }
+
+func (sharedStream) Close() error { return nil }
+
+// exhaustedSession sends a stream per event, with the next fails opens
+// failing as if the stream limit were hit; a negative count fails every
+// open until it's reset
+func exhaustedSession(t *testing.T, fails *atomic.Int32) (*Session, *io.PipeReader, *atomic.Int32) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	t.Cleanup(func() {
+		cancel()
+		pw.Close()
+	})
+	opens := new(atomic.Int32)
+	sess := &Session{ctx: ctx, eventTimeout: time.Second}
+	sess.openUni = func(context.Context) (webtransport.SendStream, error) {
+		opens.Add(1)
+		if n := fails.Load(); n < 0 || n > 0 && fails.CompareAndSwap(n, n-1) {
+			return nil, errors.New("too many open streams")
+		}
+		return sharedStream{pipeSendStream{pw}}, nil
+	}
+	return sess, pr, opens
+}
+
+func TestEventOpenRetry(t *testing.T) {
+	var fails atomic.Int32
+	fails.Store(eventOpenRetries)
+	sess, pr, opens := exhaustedSession(t, &fails)
+
+	sent := make(chan bool, 1)
+	go func() { sent <- sess.sendEvent(MsgData, 1, []byte("hi")) }()
+	ev, err := readEvent(pr, false)
+	if err != nil || ev.msgType != MsgData || string(ev.data) != "hi" {
+		t.Fatalf("got event %#x %q, %v", ev.msgType, ev.data, err)
+	}
+	if !<-sent {
+		t.Error("sendEvent reported failure")
+	}
+	if n := opens.Load(); n != eventOpenRetries+1 {
+		t.Errorf("opened %d times, want %d", n, eventOpenRetries+1)
+	}
+}
+
+// TestHeldClose runs out of streams for good while a connection closes:
+// its MsgClosed is held, data isn't, and the next event that gets a stream
+// delivers the close first
+func TestHeldClose(t *testing.T) {
+	var fails atomic.Int32
+	fails.Store(-1)
+	sess, pr, _ := exhaustedSession(t, &fails)
+
+	payload := []byte("0123456789abcdef")
+	if sess.sendEvent(MsgClosed, 5, payload) {
+		t.Fatal("sendEvent succeeded with no streams")
+	}
+	clear(payload) // sendEvent doesn't retain data
+	if sess.sendEvent(MsgData, 6, []byte("lost")) {
+		t.Fatal("sendEvent succeeded with no streams")
+	}
+	if n := len(sess.heldEvents); n != 1 {
+		t.Fatalf("%d events held, want only the MsgClosed", n)
+	}
+
+	fails.Store(0)
+	go sess.sendEvent(MsgData, 7, []byte("next"))
+	ev, err := readEvent(pr, false)
+	if err != nil || ev.msgType != MsgClosed || ev.connID != 5 || string(ev.data) != "0123456789abcdef" {
+		t.Fatalf("got event %#x conn %d %x, %v, want the held MsgClosed", ev.msgType, ev.connID, ev.data, err)
+	}
+	ev, err = readEvent(pr, false)
+	if err != nil || ev.msgType != MsgData || ev.connID != 7 {
+		t.Fatalf("got event %#x conn %d, %v, want MsgData for 7", ev.msgType, ev.connID, err)
+	}
+	sess.streamMu.Lock(PrioHigh)
+	defer sess.streamMu.Unlock()
+	if len(sess.heldEvents) != 0 {
+		t.Errorf("%d events still held", len(sess.heldEvents))
+	}
+}
@@ -0,0 +1,240 @@
+// events.go - Writing events to the container
+//
+// Events go out on the session's event stream, one frame each. When several
+// connections have events waiting, MsgSetPrio decides whose goes first.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Connection priorities (MsgSetPrio). quic-go has no per-stream priority
+// API, so priority decides which connection's pending event is written next.
+const (
+	PrioLow    = 0 // bulk transfers
+	PrioNormal = 1 // default
+	PrioHigh   = 2 // interactive (shells, SSH)
+
+	numPriorities = 3
+)
+
+// handleSetPrio changes which connection's events win when several are queued
+func (sess *Session) handleSetPrio(stream webtransport.Stream) {
+	// Read: connID (4), priority (1)
+	var header [5]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("set prio: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	prio := int32(header[4])
+	if prio >= numPriorities {
+		sess.sendEvent(MsgError, connID, []byte("invalid priority"))
+		return
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	v.(*Connection).priority.Store(prio)
+	sess.log().Debug("priority set", "conn_id", connID, "prio", prio)
+}
+
+// eventPriority returns the scheduling priority for a connection's events
+func (sess *Session) eventPriority(connID uint32) int {
+	if v, ok := sess.connections.Load(connID); ok {
+		return int(v.(*Connection).priority.Load())
+	}
+	return PrioNormal
+}
+
+// openEventStream opens the uni stream every event of the session is
+// written to, back to back, so the client sees them in the order they were
+// sent: a connection's last MsgData can't overtake its MsgClosed. Without
+// it, sendEvent falls back to a stream per event.
+func (sess *Session) openEventStream() {
+	ctx, cancel := context.WithTimeout(sess.ctx, sess.eventTimeout)
+	defer cancel()
+	stream, err := sess.openEventUni(ctx)
+	if err != nil {
+		sess.log().Warn("failed to open event stream, sending a stream per event", "err", err)
+		return
+	}
+	sess.streamMu.Lock(PrioHigh)
+	sess.events = stream
+	sess.streamMu.Unlock()
+}
+
+// sendEvent writes one event to the session's event stream and reports
+// whether it was fully written. data is only read during the call and never
+// retained, so callers may pass pooled or reused buffers and overwrite them
+// afterwards.
+func (sess *Session) sendEvent(msgType byte, connID uint32, data []byte) bool {
+	sess.streamMu.Lock(sess.eventPriority(connID))
+	defer sess.streamMu.Unlock()
+
+	if sess.ctx.Err() != nil {
+		return false
+	}
+	sess.capture.Record(captureOut, msgType, connID, data)
+
+	var ts int64
+	if sess.eventTimestamps {
+		ts = sess.nextEventTS()
+	}
+
+	if sess.events != nil {
+		sess.events.SetWriteDeadline(time.Now().Add(sess.eventTimeout))
+		err := sess.writeEvents(sess.events, msgType, connID, ts, data)
+		if err == nil {
+			return true
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			sess.eventWriteFailed(err)
+			return false
+		}
+		// The stream is broken, and may end mid-frame; reset it so the
+		// client drops the partial event, and resend that event below
+		sess.log().Warn("event stream failed, sending a stream per event", "err", err)
+		sess.events.CancelWrite(0)
+		sess.events = nil
+	}
+	return sess.sendEventStream(msgType, connID, ts, data)
+}
+
+// sendEventStream writes one event on its own uni stream. Caller holds
+// streamMu.
+func (sess *Session) sendEventStream(msgType byte, connID uint32, ts int64, data []byte) bool {
+	// A client that never accepts its event streams never hands back stream
+	// credit, so bound the wait instead of wedging every sender behind streamMu
+	ctx, cancel := context.WithTimeout(sess.ctx, sess.eventTimeout)
+	defer cancel()
+
+	stream, err := sess.openEventUni(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			sess.abort(ErrCodeEventsBlocked, "event streams not being read")
+			return false
+		}
+		sess.log().Warn("failed to open stream for event", "msg_type", msgType, "conn_id", connID, "err", err)
+		sess.holdEvent(msgType, connID, ts, data)
+		return false
+	}
+	defer stream.Close()
+	stream.SetWriteDeadline(time.Now().Add(sess.eventTimeout))
+
+	if err := sess.writeEvents(stream, msgType, connID, ts, data); err != nil {
+		sess.eventWriteFailed(err)
+		sess.holdEvent(msgType, connID, ts, data)
+		return false
+	}
+	return true
+}
+
+// eventBufPool recycles event frames; readLoop's reads are at most 64KiB,
+// so pooled buffers settle at that size
+var eventBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1+4+8+4+512)
+		return &b
+	},
+}
+
+// maxPooledEventBuf keeps unusually large frames out of the pool
+const maxPooledEventBuf = 128 * 1024
+
+// writeEvent frames an event and writes it with a single Write:
+// msgType (1), connID (4), [timestamp (8), unix nanos, if ts != 0,] dataLen (4), data
+func writeEvent(w io.Writer, msgType byte, connID uint32, ts int64, data []byte) error {
+	bp := eventBufPool.Get().(*[]byte)
+	b := append((*bp)[:0], msgType)
+	b = binary.BigEndian.AppendUint32(b, connID)
+	if ts != 0 {
+		b = binary.BigEndian.AppendUint64(b, uint64(ts))
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+
+	_, err := w.Write(b)
+
+	if cap(b) <= maxPooledEventBuf {
+		*bp = b[:0]
+		eventBufPool.Put(bp)
+	}
+	return err
+}
+
+// nextEventTS returns the emission time for an event, bumped past the
+// previous one so equal clock readings still order. Caller holds streamMu.
+func (sess *Session) nextEventTS() int64 {
+	ts := time.Now().UnixNano()
+	if ts <= sess.lastEventTS {
+		ts = sess.lastEventTS + 1
+	}
+	sess.lastEventTS = ts
+	return ts
+}
+
+func (sess *Session) eventWriteFailed(err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		sess.abort(ErrCodeEventsBlocked, "event stream not being read")
+		return
+	}
+	sess.log().Warn("failed to write event", "err", err)
+}
+
+// chargeBytes debits the session token's byte budget, closing the session
+// once it is exhausted
+func (sess *Session) chargeBytes(n int) bool {
+	if sess.token == nil || sess.token.ChargeBytes(n) {
+		return true
+	}
+	sess.abort(ErrCodeTokenBudget, "token byte budget exhausted")
+	return false
+}
+
+// prioMutex is a mutex that hands off to the highest-priority waiter, so an
+// interactive connection's events don't queue behind a bulk transfer's.
+// Waiters of equal priority are served FIFO.
+type prioMutex struct {
+	mu      sync.Mutex
+	held    bool
+	waiters [numPriorities][]chan struct{}
+}
+
+func (m *prioMutex) Lock(prio int) {
+	m.mu.Lock()
+	if !m.held {
+		m.held = true
+		m.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	m.waiters[prio] = append(m.waiters[prio], ch)
+	m.mu.Unlock()
+	<-ch // ownership handed over by Unlock
+}
+
+func (m *prioMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := numPriorities - 1; p >= 0; p-- {
+		if q := m.waiters[p]; len(q) > 0 {
+			m.waiters[p] = q[1:]
+			close(q[0])
+			return
+		}
+	}
+	m.held = false
+}
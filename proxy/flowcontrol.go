@@ -0,0 +1,44 @@
+// flowcontrol.go - Send credit advertised to the container (/connect?acks=1)
+//
+// Every MsgSend is written to the socket before its stream is done, but
+// nothing stops a container from opening sends faster than the remote host
+// drains them, each one a goroutine holding its payload. With acks on, a
+// connection starts with -send-window bytes of credit, announced by a
+// MsgAck right after MsgConnected or MsgAccept. Each MsgAck carries
+// credit (4): further bytes the container may send. The proxy hands credit
+// back once MsgSend payloads have been written, batched so it acks about
+// every quarter window. A container should not send beyond its credit;
+// the proxy doesn't enforce it.
+
+package main
+
+import "encoding/binary"
+
+// defaultSendWindow is the credit a connection starts with
+const defaultSendWindow = 256 * 1024
+
+// ackPayload is MsgAck's payload
+func ackPayload(credit int64) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(credit))
+}
+
+// grantWindow announces a new connection's initial credit
+func (sess *Session) grantWindow(conn *Connection) {
+	if sess.sendWindow > 0 {
+		sess.sendEvent(MsgAck, conn.id, ackPayload(int64(sess.sendWindow)))
+	}
+}
+
+// ackSent hands back credit for n bytes of MsgSend written to conn,
+// once a quarter window has built up
+func (sess *Session) ackSent(conn *Connection, n int) {
+	if sess.sendWindow <= 0 {
+		return
+	}
+	if conn.unacked.Add(int64(n)) < int64(max(sess.sendWindow/4, 1)) {
+		return
+	}
+	if credit := conn.unacked.Swap(0); credit > 0 {
+		sess.sendEvent(MsgAck, conn.id, ackPayload(credit))
+	}
+}
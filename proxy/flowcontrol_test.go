@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendAcks(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return local, nil
+	}
+	sess, pr := newTestSession(t, tbl, func(s *Session) { s.sendWindow = 1000 })
+
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, uint16(len("example.com")))
+	req = append(req, "example.com"...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+
+	// Each event the proxy writes is a MsgAck here; nothing else is pending
+	ack := func() int {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType != MsgAck || ev.connID != 1 || len(ev.data) != 4 {
+			t.Fatalf("got event %#x conn %d %q, want MsgAck", ev.msgType, ev.connID, ev.data)
+		}
+		return int(binary.BigEndian.Uint32(ev.data))
+	}
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgConnected {
+		t.Fatalf("got event %#x, %v, want MsgConnected", ev.msgType, err)
+	}
+	if credit := ack(); credit != 1000 {
+		t.Fatalf("initial credit %d, want the 1000 byte window", credit)
+	}
+
+	// Credit comes back once a quarter window has been written out
+	acks := make(chan int, 5)
+	go func() {
+		for {
+			ev, err := readEvent(pr, false)
+			if err != nil {
+				return
+			}
+			if ev.msgType == MsgAck {
+				acks <- int(binary.BigEndian.Uint32(ev.data))
+			}
+		}
+	}()
+	send := func() {
+		req := binary.BigEndian.AppendUint32(nil, 1)
+		req = binary.BigEndian.AppendUint32(req, 200)
+		req = append(req, make([]byte, 200)...)
+		go sess.handleSend(readerStream{r: bytes.NewReader(req)})
+		if _, err := io.ReadFull(remote, make([]byte, 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		send()
+		wantAck := i%2 == 0
+		select {
+		case credit := <-acks:
+			if !wantAck || credit != 400 {
+				t.Fatalf("after send %d: credit %d", i, credit)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if wantAck {
+				t.Fatalf("no ack after send %d", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// forward.go - MsgForward: splicing an accepted connection to a new
+// destination so its data no longer passes through the container
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// handleForward splices an accepted connection to a new outbound destination
+// so its data no longer round-trips through the container. The container
+// keeps close control: MsgClose on connID tears down both sides.
+func (sess *Session) handleForward(stream webtransport.Stream) {
+	// Read: connID (4), hostLen (2), host, port (2)
+	var header [4 + 2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("forward: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	hostLen := binary.BigEndian.Uint16(header[4:6])
+	if !hostLenOK(int(hostLen)) {
+		sess.log().Warn("forward: host too long", "conn_id", connID, "len", hostLen)
+		sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "host", Message: "host too long"})
+		return
+	}
+
+	hostBuf := make([]byte, hostLen+2)
+	if _, err := io.ReadFull(stream, hostBuf); err != nil {
+		sess.log().Warn("forward: failed to read host/port", "err", err)
+		return
+	}
+
+	host := unbracketHost(string(hostBuf[:hostLen]))
+	port := binary.BigEndian.Uint16(hostBuf[hostLen:])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if err := validHost(host); err != nil {
+		sess.log().Warn("forward: bad host", "conn_id", connID, "err", err)
+		sess.connectDenied(connID, PolicyDecision{Category: PolicyInvalidRequest, Rule: "host", Message: err.Error()})
+		return
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.log().Warn("forward: connection not found", "conn_id", connID)
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+
+	conn.mu.Lock()
+	netConn := conn.conn
+	conn.mu.Unlock()
+
+	// Only accepted connections have a readLoop we can take over
+	if netConn == nil || conn.readDone == nil || conn.dest != nil {
+		sess.log().Warn("forward: not an accepted connection", "conn_id", connID)
+		sess.sendEvent(MsgError, connID, []byte("not an accepted connection"))
+		return
+	}
+
+	sess.log().Info("forward", "conn_id", connID, "addr", addr)
+
+	if !sess.allowLookup(host) {
+		sess.connectDenied(connID, sess.dnsRateDecision())
+		return
+	}
+
+	// A forward is an outbound connect like any other
+	if d, ok := sess.srv.checkConnect(sess.rateLimiter, sess.remoteIP, sess.origin, sess.token, host, port); !ok {
+		sess.log().Info("forward refused", "conn_id", connID, "addr", addr, "reason", d.Message, "rule", d.Rule)
+		sess.connectDenied(connID, d)
+		return
+	}
+
+	go func() {
+		// Dial first so a failure leaves the accepted connection untouched
+		timeout := sess.srv.connectTimeout(&ConnectOptions{})
+		upstream, _, err := sess.srv.dests.Get(host, int(port)).Dial(sess.ctx, timeout, "")
+		if err != nil {
+			sess.log().Info("forward failed", "conn_id", connID, "addr", addr, "err", err)
+			sess.connectDenied(connID, dialDecision(err))
+			return
+		}
+
+		if !conn.forwarding.CompareAndSwap(false, true) {
+			upstream.Close()
+			sess.sendEvent(MsgError, connID, []byte("connection already forwarded"))
+			return
+		}
+
+		// Kick readLoop out of its Read and wait for it to let go of the socket
+		netConn.SetReadDeadline(time.Now())
+		<-conn.readDone
+		netConn.SetReadDeadline(time.Time{})
+
+		conn.mu.Lock()
+		if conn.closed.Load() {
+			conn.mu.Unlock()
+			upstream.Close()
+			return
+		}
+		conn.upstream = upstream
+		conn.mu.Unlock()
+
+		sess.log().Info("forwarding", "conn_id", connID, "addr", addr)
+		sess.sendEvent(MsgConnected, connID, nil)
+
+		go sess.splice(conn, netConn, upstream)
+	}()
+}
+
+// splice copies between an accepted connection and its forward destination
+// until either side finishes, then closes both and reports MsgClosed.
+func (sess *Session) splice(conn *Connection, a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(a, b)
+		conn.bytesOut.Add(uint64(n))
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(b, a)
+		conn.bytesIn.Add(uint64(n))
+		done <- struct{}{}
+	}()
+	<-done
+
+	// MsgClose may be tearing it down at the same moment
+	if conn.closeReported.Swap(true) {
+		return
+	}
+	conn.Close()
+	<-done // the other direction stops once both are closed
+	sess.connections.CompareAndDelete(conn.id, conn)
+	sess.log().Info("forward finished", "conn_id", conn.id)
+	sess.sendClosed(conn)
+}
@@ -0,0 +1,107 @@
+// geoip.go - Country filtering of outbound destinations
+//
+// Some operators may only let traffic leave for certain countries. With
+// -geoip-db naming a MaxMind Country or City database (mmdb.go), every
+// address a session would reach is looked up and checked against
+// -geo-allow and -geo-deny, comma-separated ISO 3166-1 alpha-2 codes: with
+// an allow list only those countries may be reached, and denied countries
+// never may. An address the database doesn't place is refused under an
+// allow list and permitted otherwise. The check sits with the private and
+// blocked address checks (blocklist.go), after them, so it covers IP
+// literals, every address a name resolves to, UDP and MsgResolve alike.
+// Refusals are PolicyGeo decisions. Without -geoip-db nothing is checked.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errGeoDenied = errors.New("destination country not permitted")
+
+// geoDeniedError is errGeoDenied with the country that was refused
+type geoDeniedError struct {
+	host    string
+	country string // "" if the database doesn't place the address
+}
+
+func (e *geoDeniedError) Error() string        { return errGeoDenied.Error() }
+func (e *geoDeniedError) Is(target error) bool { return target == errGeoDenied }
+
+// geoFilter decides destinations by country
+type geoFilter struct {
+	country func(net.IP) (string, error) // ISO code, "" if unknown; the database's Country outside tests
+	allow   map[string]bool              // nil = any country not denied
+	deny    map[string]bool
+}
+
+// parseCountries reads a -geo-allow or -geo-deny list
+func parseCountries(list string) (map[string]bool, error) {
+	var codes map[string]bool
+	for _, c := range strings.Split(list, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+			return nil, fmt.Errorf("country %q: want a two-letter ISO 3166-1 code", c)
+		}
+		if codes == nil {
+			codes = make(map[string]bool)
+		}
+		codes[c] = true
+	}
+	return codes, nil
+}
+
+// permits reports whether ip may be reached, and the country it's in
+func (g *geoFilter) permits(ip net.IP) (string, bool) {
+	country, err := g.country(ip)
+	if err != nil {
+		country = ""
+	}
+	if g.deny[country] {
+		return country, false
+	}
+	return country, g.allow == nil || g.allow[country]
+}
+
+// geoCheck refuses ip if the table has a country filter that denies it
+func (t *DestinationTable) geoCheck(host string, ip net.IP) error {
+	if t.geo == nil {
+		return nil
+	}
+	if country, ok := t.geo.permits(ip); !ok {
+		return &geoDeniedError{host: host, country: country}
+	}
+	return nil
+}
+
+// newGeoFilter opens -geoip-db for the -geo-allow and -geo-deny lists; nil
+// without a database
+func newGeoFilter(dbPath, allowList, denyList string) (*geoFilter, error) {
+	allow, err := parseCountries(allowList)
+	if err != nil {
+		return nil, fmt.Errorf("-geo-allow: %w", err)
+	}
+	deny, err := parseCountries(denyList)
+	if err != nil {
+		return nil, fmt.Errorf("-geo-deny: %w", err)
+	}
+	switch {
+	case dbPath == "" && allow == nil && deny == nil:
+		return nil, nil
+	case dbPath == "":
+		return nil, errors.New("-geo-allow and -geo-deny need -geoip-db")
+	case allow == nil && deny == nil:
+		return nil, errors.New("-geoip-db needs -geo-allow or -geo-deny")
+	}
+	db, err := openMMDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return &geoFilter{country: db.Country, allow: allow, deny: deny}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// stubCountries places addresses by a fixed table
+func stubCountries(table map[string]string) func(net.IP) (string, error) {
+	return func(ip net.IP) (string, error) { return table[ip.String()], nil }
+}
+
+func TestGeoFilter(t *testing.T) {
+	country := stubCountries(map[string]string{"198.51.100.1": "DE", "198.51.100.2": "RU", "198.51.100.3": "US"})
+	for _, tc := range []struct {
+		allow, deny string
+		permitted   map[string]bool
+	}{
+		{"", "RU", map[string]bool{"198.51.100.1": true, "198.51.100.2": false, "198.51.100.3": true, "192.0.2.1": true}},
+		{"de, us", "", map[string]bool{"198.51.100.1": true, "198.51.100.2": false, "198.51.100.3": true, "192.0.2.1": false}},
+		{"DE,US", "US", map[string]bool{"198.51.100.1": true, "198.51.100.3": false}},
+	} {
+		allow, _ := parseCountries(tc.allow)
+		deny, _ := parseCountries(tc.deny)
+		g := &geoFilter{country: country, allow: allow, deny: deny}
+		for ip, want := range tc.permitted {
+			if _, ok := g.permits(net.ParseIP(ip)); ok != want {
+				t.Errorf("allow %q deny %q: %s permitted %v, want %v", tc.allow, tc.deny, ip, ok, want)
+			}
+		}
+	}
+
+	if _, err := parseCountries("DE,Germany"); err == nil {
+		t.Error("accepted a country name")
+	}
+	if g, err := newGeoFilter("", "", ""); g != nil || err != nil {
+		t.Errorf("no database: %v, %v", g, err)
+	}
+	if _, err := newGeoFilter("", "DE", ""); err == nil {
+		t.Error("-geo-allow accepted without -geoip-db")
+	}
+
+	g, err := newGeoFilter("testdata/country.mmdb", "", "DE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, ok := g.permits(net.ParseIP("198.51.100.7")); ok || country != "DE" {
+		t.Errorf("-geo-deny DE: 198.51.100.7 in %q permitted %v", country, ok)
+	}
+	if _, ok := g.permits(net.ParseIP("203.0.113.9")); !ok {
+		t.Error("-geo-deny DE: 203.0.113.9 (US) refused")
+	}
+}
+
+// TestConnectGeo refuses a name that resolves into a denied country, and
+// keeps addresses elsewhere
+func TestConnectGeo(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.geo = &geoFilter{country: stubCountries(map[string]string{"203.0.113.7": "KP", "198.51.100.7": "DE"}), deny: map[string]bool{"KP": true}}
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Errorf("dialed %s", addr)
+		return nil, context.Canceled
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	for i, host := range []string{"denied.example", "203.0.113.7"} {
+		req := binary.BigEndian.AppendUint32(nil, uint32(1+i))
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d PolicyDecision
+		if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil ||
+			d.Category != PolicyGeo || d.Rule != "KP" || d.Code != ConnErrBlocked || d.Message != "destination country not permitted" {
+			t.Errorf("%s: got event %#x %s", host, ev.msgType, ev.data)
+		}
+	}
+
+	// Only the permitted address of a name is kept
+	ips, err := tbl.screenAddrs("mixed.example", []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}, {IP: net.ParseIP("198.51.100.7")}})
+	if err != nil || len(ips) != 1 || !ips[0].IP.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("screenAddrs = %v, %v", ips, err)
+	}
+	// Private addresses stay private_address, checked first
+	if d := dialDecision(tbl.checkLiteral("10.0.0.1")); d.Category != PolicyPrivateAddress {
+		t.Errorf("private literal: %+v", d)
+	}
+}
@@ -0,0 +1,110 @@
+// happyeyeballs.go - Racing a destination's addresses (RFC 8305)
+//
+// Dialing a name's addresses one after another stalls for the whole
+// connect timeout on the first dead one, typically an IPv6 address on a
+// host without working IPv6. Instead the addresses are interleaved by
+// family and a new attempt starts every attemptDelay, or as soon as the
+// previous one fails, while earlier attempts keep going. The first to
+// connect wins and the rest are cancelled. Only the addresses resolve
+// screened are ever dialed.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultAttemptDelay is the head start each attempt gets before the next
+// address is tried, RFC 8305's recommended Connection Attempt Delay
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4,
+// starting with the family of the first, keeping the order within each
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) < 2 {
+		return ips
+	}
+	var first, second []net.IPAddr
+	v4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == v4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+type dialAttempt struct {
+	conn net.Conn
+	err  error
+	rtt  time.Duration
+}
+
+// dialRace connects to the first of ips to answer, returning its connect
+// time, or the last attempt's error if none does
+func (t *DestinationTable) dialRace(ctx context.Context, ips []net.IPAddr, port int) (net.Conn, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ips = interleaveFamilies(ips)
+	results := make(chan dialAttempt, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			begin := time.Now()
+			c, err := t.dial(ctx, "tcp", addr)
+			results <- dialAttempt{conn: c, err: err, rtt: time.Since(begin)}
+		}()
+	}
+
+	start()
+	delay := time.NewTimer(t.attemptDelay)
+	defer delay.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Attempts that connect anyway lose the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.rtt, nil
+			}
+			err = r.err
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+				delay.Reset(t.attemptDelay)
+			}
+		case <-delay.C:
+			if next < len(ips) {
+				start()
+				delay.Reset(t.attemptDelay)
+			}
+		}
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := func(ss ...string) []net.IPAddr {
+		var out []net.IPAddr
+		for _, s := range ss {
+			out = append(out, net.IPAddr{IP: net.ParseIP(s)})
+		}
+		return out
+	}
+	got := interleaveFamilies(addrs("2001:db8::1", "2001:db8::2", "2001:db8::3", "203.0.113.1", "203.0.113.2"))
+	want := addrs("2001:db8::1", "203.0.113.1", "2001:db8::2", "203.0.113.2", "2001:db8::3")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestDialRacesAddresses gives a name a blackholed IPv6 address ahead of a
+// working IPv4 one and checks the connect doesn't wait out the first
+func TestDialRacesAddresses(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	abandoned := make(chan struct{})
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "[2001:db8::1]:443" {
+			<-ctx.Done() // never answers
+			close(abandoned)
+			return nil, ctx.Err()
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	start := time.Now()
+	conn, _, err := tbl.Get("dual.example", 443).Dial(context.Background(), 10*time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("connect took %v", elapsed)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("losing attempt not cancelled")
+	}
+}
@@ -0,0 +1,172 @@
+// health.go - Liveness and readiness checks for the API server
+//
+// /livez only says the process is up. /health checks the proxy itself:
+// the WebTransport listener is serving, its certificate is within its
+// validity period and the rate limiter isn't wedged. /ready (and /readyz)
+// additionally verify the proxy's dependencies (DNS and outbound
+// connectivity). Either answers 503 with the failing checks when anything
+// is broken, so orchestrators can stop routing to a degraded instance
+// without restarting it.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyCacheTTL bounds how often probes actually hit the network
+const readyCacheTTL = 5 * time.Second
+
+// rateLimiterCheckTimeout is how long the rate limiter's lock may stay
+// busy before the limiter counts as unresponsive
+const rateLimiterCheckTimeout = time.Second
+
+// ReadinessChecker probes outbound dependencies, caching the last result
+type ReadinessChecker struct {
+	probe string // host:port dialed to verify DNS + egress; empty = skip
+
+	mu      sync.Mutex
+	checked time.Time
+	last    map[string]string
+}
+
+func NewReadinessChecker(probe string) *ReadinessChecker {
+	return &ReadinessChecker{probe: probe}
+}
+
+// Check returns the status of each dependency ("ok" or an error string)
+func (rc *ReadinessChecker) Check(ctx context.Context) map[string]string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.last != nil && time.Since(rc.checked) < readyCacheTTL {
+		return rc.last
+	}
+
+	checks := make(map[string]string)
+	if rc.probe != "" {
+		host, _, err := net.SplitHostPort(rc.probe)
+		if err != nil {
+			checks["dns"] = err.Error()
+		} else if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			checks["dns"] = err.Error()
+		} else {
+			checks["dns"] = "ok"
+		}
+
+		var d net.Dialer
+		if conn, err := d.DialContext(ctx, "tcp", rc.probe); err != nil {
+			checks["egress"] = err.Error()
+		} else {
+			conn.Close()
+			checks["egress"] = "ok"
+		}
+	}
+
+	rc.last = checks
+	rc.checked = time.Now()
+	return checks
+}
+
+// serverChecks reports the proxy's own state. Unlike the dependency
+// probes these are cheap, so they're never cached.
+func (s *Server) serverChecks() map[string]string {
+	checks := map[string]string{"webtransport": "ok", "certificate": "ok", "rate_limiter": "ok"}
+	switch {
+	case s.ctx.Err() != nil:
+		checks["webtransport"] = "shutting down"
+	case !s.serving.Load():
+		checks["webtransport"] = "not serving"
+	}
+	// Run loads the certificate before it starts serving
+	if s.serving.Load() {
+		checks["certificate"] = certStatus(s.cert.Load(), time.Now())
+	} else {
+		checks["certificate"] = "not loaded"
+	}
+	if s.rateLimiter != nil && !s.rateLimiter.responsive(rateLimiterCheckTimeout) {
+		checks["rate_limiter"] = "unresponsive"
+	}
+	return checks
+}
+
+// certStatus checks cert is within its validity period at now
+func certStatus(cert *tls.Certificate, now time.Time) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return "not loaded"
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err.Error()
+		}
+	}
+	if now.After(leaf.NotAfter) {
+		return "expired " + leaf.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if now.Before(leaf.NotBefore) {
+		return "not valid until " + leaf.NotBefore.UTC().Format(time.RFC3339)
+	}
+	return "ok"
+}
+
+// responsive reports whether rl's lock can be taken within timeout
+func (rl *RateLimiter) responsive(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		rl.mu.Lock()
+		rl.mu.Unlock()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// handleHealth answers /health from the proxy's own checks
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, s.serverChecks())
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := s.serverChecks()
+	for k, v := range s.readiness.Check(ctx) {
+		checks[k] = v
+	}
+	writeChecks(w, checks)
+}
+
+// writeChecks answers with each check's status, and 503 if any failed
+func writeChecks(w http.ResponseWriter, checks map[string]string) {
+	status := "ok"
+	for _, v := range checks {
+		if v != "ok" {
+			status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
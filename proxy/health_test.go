@@ -0,0 +1,114 @@
+// health_test.go - Readiness endpoint tests
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// servingServer is a Server that looks like Run has it serving, with a
+// currently valid certificate
+func servingServer(t *testing.T) *Server {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(1, 1), nil)
+	cert := testCert(t, "localhost", false, nil)
+	s.cert.Store(&cert)
+	s.serving.Store(true)
+	return s
+}
+
+func readyStatus(t *testing.T, s *Server) (int, map[string]interface{}) {
+	return checkStatus(t, s, "/ready")
+}
+
+func checkStatus(t *testing.T, s *Server, path string) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	s.apiMux().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("bad %s body %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+// TestReadyReportsEgress checks /ready is 200 when the probe target is
+// reachable and 503 with a failing egress check when it isn't
+func TestReadyReportsEgress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := servingServer(t)
+
+	s.readiness = NewReadinessChecker(ln.Addr().String())
+	if code, body := readyStatus(t, s); code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("reachable probe: got %d %v", code, body)
+	}
+
+	// Grab a free port, then close it so the dial is refused
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	s.readiness = NewReadinessChecker(deadAddr)
+	code, body := readyStatus(t, s)
+	if code != http.StatusServiceUnavailable || body["status"] != "degraded" {
+		t.Fatalf("unreachable probe: got %d %v", code, body)
+	}
+	if checks := body["checks"].(map[string]interface{}); checks["egress"] == "ok" || checks["dns"] != "ok" {
+		t.Fatalf("expected only egress to fail: %v", checks)
+	}
+
+	// No probe configured: nothing to check, always ready
+	s.readiness = NewReadinessChecker("")
+	if code, _ := readyStatus(t, s); code != http.StatusOK {
+		t.Fatalf("no probe: got %d", code)
+	}
+}
+
+// TestHealthChecksServer checks /health and /ready fail on an expired
+// certificate, a listener that isn't serving and a wedged rate limiter,
+// while /livez stays up
+func TestHealthChecksServer(t *testing.T) {
+	s := servingServer(t)
+	for _, path := range []string{"/health", "/ready", "/readyz"} {
+		if code, body := checkStatus(t, s, path); code != http.StatusOK {
+			t.Fatalf("%s: got %d %v", path, code, body)
+		}
+	}
+
+	failed := func(path, check string) {
+		t.Helper()
+		code, body := checkStatus(t, s, path)
+		checks := body["checks"].(map[string]interface{})
+		if code != http.StatusServiceUnavailable || body["status"] != "degraded" || checks[check] == "ok" {
+			t.Fatalf("%s: got %d %v, want %s failing", path, code, body, check)
+		}
+	}
+
+	s.cert.Load().Leaf.NotAfter = time.Now().Add(-time.Minute)
+	failed("/health", "certificate")
+	failed("/readyz", "certificate")
+	s.cert.Load().Leaf.NotAfter = time.Now().Add(time.Hour)
+
+	s.serving.Store(false)
+	failed("/health", "webtransport")
+	s.serving.Store(true)
+
+	s.rateLimiter.mu.Lock()
+	failed("/health", "rate_limiter")
+	s.rateLimiter.mu.Unlock()
+
+	s.serving.Store(false)
+	rec := httptest.NewRecorder()
+	s.apiMux().ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("/livez: got %d %q", rec.Code, rec.Body.String())
+	}
+}
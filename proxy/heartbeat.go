@@ -0,0 +1,70 @@
+// heartbeat.go - Detecting dead sessions on quiet links
+//
+// A NAT or proxy that silently drops an idle flow leaves both ends holding
+// a session that no longer goes anywhere. With -heartbeat-interval, a
+// session the proxy has heard nothing from for an interval is sent MsgPing
+// (connID 0, an 8-byte sequence number), which the container answers with
+// MsgPong carrying the same number. Any request or datagram from the
+// container counts as hearing from it, so busy sessions aren't pinged. Once
+// -heartbeat-misses pings in a row go unanswered, the session is closed
+// with ErrCodeHeartbeat and its connections torn down. The pings are also
+// how a container notices a dead proxy: a quiet session that goes a few
+// intervals without a MsgPing is gone. Containers must answer MsgPing
+// before an operator turns this on, or their quiet sessions get closed.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// defaultHeartbeatMisses is how many unanswered pings close a session
+const defaultHeartbeatMisses = 3
+
+// heard records that the container is still there
+func (sess *Session) heard() {
+	sess.lastHeard.Store(time.Now().UnixNano())
+}
+
+// heartbeatLoop pings the container whenever it has been quiet for an
+// interval. It reports true once misses pings in a row went unanswered,
+// and false if the session ended first.
+func (sess *Session) heartbeatLoop(interval time.Duration, misses int) bool {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var seq uint64
+	missed := 0
+	for {
+		select {
+		case <-sess.ctx.Done():
+			return false
+		case now := <-t.C:
+			if now.Sub(time.Unix(0, sess.lastHeard.Load())) < interval {
+				missed = 0
+				continue
+			}
+			if missed >= misses {
+				sess.log().Info("heartbeat lost", "pings", missed, "interval", interval)
+				return true
+			}
+			seq++
+			missed++
+			sess.sendEvent(MsgPing, 0, binary.BigEndian.AppendUint64(nil, seq))
+		}
+	}
+}
+
+func (sess *Session) handlePong(stream webtransport.Stream) {
+	// Read: seq (8), the MsgPing being answered
+	var seq [8]byte
+	if _, err := io.ReadFull(stream, seq[:]); err != nil {
+		sess.log().Warn("pong: failed to read sequence", "err", err)
+		return
+	}
+	sess.heard()
+	sess.log().Debug("pong", "seq", binary.BigEndian.Uint64(seq[:]))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatIdle(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	sess.heard()
+
+	lost := make(chan bool, 1)
+	go func() { lost <- sess.heartbeatLoop(20*time.Millisecond, 2) }()
+
+	// An idle session is pinged, then closed once its pings go unanswered
+	for want := uint64(1); want <= 2; want++ {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType != MsgPing || ev.connID != 0 || len(ev.data) != 8 || binary.BigEndian.Uint64(ev.data) != want {
+			t.Fatalf("got event %#x conn %d %x, want MsgPing %d", ev.msgType, ev.connID, ev.data, want)
+		}
+	}
+	select {
+	case l := <-lost:
+		if !l {
+			t.Fatal("heartbeat loop ended without losing the session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not closed after missed pings")
+	}
+}
+
+func TestHeartbeatAnswered(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	sess.heard()
+
+	// The container answers every ping
+	pings := make(chan struct{}, 100)
+	go func() {
+		for {
+			ev, err := readEvent(pr, false)
+			if err != nil {
+				return
+			}
+			pings <- struct{}{}
+			sess.handlePong(readerStream{r: bytes.NewReader(ev.data)})
+		}
+	}()
+
+	lost := make(chan bool, 1)
+	go func() { lost <- sess.heartbeatLoop(10*time.Millisecond, 1) }()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-lost:
+		t.Fatal("answered heartbeat closed the session")
+	default:
+	}
+	if len(pings) == 0 {
+		t.Fatal("no pings sent")
+	}
+	sess.cancel()
+	if <-lost {
+		t.Fatal("ended session reported as lost")
+	}
+}
+
+// TestHeartbeatDatagrams checks a session sending only datagrams isn't
+// pinged: any datagram, even one the proxy ignores, counts as hearing from
+// the container
+func TestHeartbeatDatagrams(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	sess.heard()
+
+	pings := make(chan struct{}, 100)
+	go func() {
+		for {
+			if _, err := readEvent(pr, false); err != nil {
+				return
+			}
+			pings <- struct{}{}
+		}
+	}()
+
+	lost := make(chan bool, 1)
+	go func() { lost <- sess.heartbeatLoop(20*time.Millisecond, 1) }()
+	for range 60 {
+		sess.handleDatagram([]byte{0xff})
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(pings) != 0 {
+		t.Fatalf("sent %d pings to a session sending datagrams", len(pings))
+	}
+	select {
+	case <-lost:
+		t.Fatal("session sending datagrams closed as lost")
+	default:
+	}
+}
@@ -0,0 +1,71 @@
+// hostname.go - Sanity checks on the host a request names
+//
+// The host length is a uint16, so a malformed MsgConnect, MsgForward or
+// MsgSendTo could make the proxy read up to 64KiB of what is meant to be
+// a name. Hosts are held to maxHostLen, the longest a DNS name can be, and
+// refused unread past it; a host that is neither an IP literal nor a
+// well-formed hostname is refused before any lookup or dial. Connects and
+// forwards get MsgConnectError with PolicyInvalidRequest; a datagram gets
+// its MsgSendToError entry. SOCK_UNIX paths skip the name check; the
+// -unix-sockets allowlist vets them.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// maxHostLen is the longest hostname DNS can carry, without a trailing dot
+const maxHostLen = 253
+
+// hostLenOK reports whether a host length field is one a name could need;
+// a fully qualified name may end in a dot
+func hostLenOK(n int) bool {
+	return n <= maxHostLen+1
+}
+
+// validHost reports why host is neither an IP literal nor a hostname made
+// of 1-63 character labels of letters, digits, hyphens and underscores, or
+// nil if it is one
+func validHost(host string) error {
+	if host == "" {
+		return errors.New("empty host")
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	name := strings.TrimSuffix(host, ".")
+	if len(name) > maxHostLen {
+		return errors.New("hostname too long")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return errors.New("hostname label empty or over 63 characters")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("hostname label starts or ends with a hyphen")
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return errors.New("hostname has characters other than letters, digits, hyphens and underscores")
+			}
+		}
+	}
+	return nil
+}
+
+// unbracketHost accepts an IPv6 literal in URL form, "[2001:db8::1]", as
+// the bare address, so it's vetted and dialed as a literal rather than
+// looked up as a name
+func unbracketHost(host string) string {
+	if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+		if inner := host[1 : len(host)-1]; net.ParseIP(inner) != nil {
+			return inner
+		}
+	}
+	return host
+}
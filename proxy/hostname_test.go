@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidHost(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tooLong := strings.Repeat(long+".", 4) + "com" // 259 characters
+	for host, ok := range map[string]bool{
+		"example.com":      true,
+		"example.com.":     true,
+		"_dmarc.x-y.test":  true,
+		"localhost":        true,
+		"203.0.113.7":      true,
+		"2001:db8::1":      true,
+		"fe80::1%eth0":     true,
+		long + "." + long:  true,
+		long + "a.com":     false, // 64-character label
+		"":                 false,
+		".":                false,
+		"a..b":             false,
+		"-lead.example":    false,
+		"trail-.example":   false,
+		"evil host":        false,
+		"evil\x00.example": false,
+		"a/b":              false,
+		"[2001:db8::1]":    false, // handleConnect unbrackets first
+		tooLong:            false,
+	} {
+		if err := validHost(host); (err == nil) != ok {
+			t.Errorf("validHost(%q) = %v, want ok %v", host, err, ok)
+		}
+	}
+}
+
+func TestConnectBadHost(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		t.Errorf("looked up %q", host)
+		return nil, errors.New("no lookups")
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Errorf("dialed %s", addr)
+		return nil, errors.New("no dials")
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	refused := func(name string, req []byte) {
+		t.Helper()
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d PolicyDecision
+		if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicyInvalidRequest || d.Rule != "host" {
+			t.Errorf("%s: got event %#x %s, want %s", name, ev.msgType, ev.data, PolicyInvalidRequest)
+		}
+	}
+
+	// Refused on the length alone: nothing follows the header
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, 0xFFFF)
+	refused("over-long host", req)
+
+	for i, host := range []string{"\x00\xff\xfe", "evil host", "a..b", strings.Repeat("x", 254)} {
+		req := binary.BigEndian.AppendUint32(nil, uint32(2+i))
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		refused(strings.ToValidUTF8(host, "?"), req)
+	}
+}
+
+func TestForwardBadHost(t *testing.T) {
+	sess, pr := newTestSession(t, NewDestinationTable())
+
+	for i, host := range []string{strings.Repeat("x", 0xFFFF), "evil host", "a..b"} {
+		req := binary.BigEndian.AppendUint32(nil, uint32(1+i))
+		req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		go sess.handleForward(readerStream{r: bytes.NewReader(req)})
+
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d PolicyDecision
+		if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicyInvalidRequest || d.Rule != "host" {
+			t.Errorf("%.20q: got event %#x %s, want %s", host, ev.msgType, ev.data, PolicyInvalidRequest)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// idle.go - Closing connections that have gone quiet or lived too long
+//
+// A connection that neither sends nor receives keeps its goroutine, socket
+// and connection slot forever. With -idle-timeout set, each session runs a
+// janitor that closes connections with no data in either direction for
+// that long, reporting MsgClosed as if the peer had closed them. Listeners
+// and bound UDP sockets are exempt: waiting for a peer is their job. So are
+// forwarded connections, whose data never passes through the session.
+//
+// -max-conn-lifetime caps how long any connection, listeners included,
+// stays open however busy it is. The same janitor enforces it.
+
+package main
+
+import (
+	"time"
+)
+
+// touch records data moving on the connection
+func (c *Connection) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleFor reports how long the connection has been without data
+func (c *Connection) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActivity.Load()))
+}
+
+// idleExempt reports connections the idle timeout doesn't apply to
+func (c *Connection) idleExempt() bool {
+	return c.listener != nil || c.udpConn != nil || c.forwarding.Load()
+}
+
+// janitorInterval is how often the janitor scans: often enough to close a
+// connection within a quarter of its limit late
+func janitorInterval(idle, lifetime time.Duration) time.Duration {
+	d := idle
+	if d == 0 || (lifetime > 0 && lifetime < d) {
+		d = lifetime
+	}
+	return max(d/4, 250*time.Millisecond)
+}
+
+// janitor closes idle and expired connections until the session ends
+func (sess *Session) janitor(idle, lifetime time.Duration) {
+	t := time.NewTicker(janitorInterval(idle, lifetime))
+	defer t.Stop()
+	for {
+		select {
+		case <-sess.ctx.Done():
+			return
+		case now := <-t.C:
+			sess.reap(now, idle, lifetime)
+		}
+	}
+}
+
+// reap closes every connection idle for at least idle, or open for at
+// least lifetime; zero disables either check
+func (sess *Session) reap(now time.Time, idle, lifetime time.Duration) {
+	sess.connections.Range(func(key, value any) bool {
+		conn := value.(*Connection)
+		var reason string
+		switch {
+		case lifetime > 0 && now.Sub(conn.createdAt) >= lifetime:
+			reason = "lifetime of " + lifetime.String() + " reached"
+		case idle > 0 && !conn.idleExempt() && conn.idleFor(now) >= idle:
+			reason = "idle for " + conn.idleFor(now).Round(time.Second).String()
+		default:
+			return true
+		}
+		if !sess.connections.CompareAndDelete(key, conn) {
+			return true
+		}
+		sess.log().Info("closing connection", "conn_id", conn.id, "reason", reason)
+		conn.Close()
+		// readLoop, failing its Read, may report it first
+		if !conn.closeReported.Swap(true) {
+			sess.sendClosed(conn)
+		}
+		return true
+	})
+}
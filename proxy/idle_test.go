@@ -0,0 +1,210 @@
+// idle_test.go - Idle connection timeout tests
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+// pipeSendStream is an event stream whose frames come out of a pipe
+type pipeSendStream struct{ *io.PipeWriter }
+
+func (pipeSendStream) StreamID() quic.StreamID                  { return 0 }
+func (pipeSendStream) CancelWrite(webtransport.StreamErrorCode) {}
+func (pipeSendStream) SetWriteDeadline(time.Time) error         { return nil }
+
+func TestReapIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // events are dropped
+	sess := &Session{ctx: ctx}
+
+	idle, _ := tcpPair(t)
+	busy, _ := tcpPair(t)
+	busy.id = 2
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newConnection(3, SOCK_STREAM)
+	listener.listener = ln
+	defer ln.Close()
+
+	old := time.Now().Add(-time.Minute).UnixNano()
+	idle.lastActivity.Store(old)
+	listener.lastActivity.Store(old)
+	busy.touch()
+	for _, c := range []*Connection{idle, busy, listener} {
+		sess.connections.Store(c.id, c)
+	}
+
+	sess.reap(time.Now(), 30*time.Second, 0)
+
+	if _, ok := sess.connections.Load(idle.id); ok {
+		t.Error("idle connection still registered")
+	}
+	if !idle.closed.Load() {
+		t.Error("idle connection not closed")
+	}
+	if _, ok := sess.connections.Load(busy.id); !ok || busy.closed.Load() {
+		t.Error("busy connection closed")
+	}
+	if _, ok := sess.connections.Load(listener.id); !ok || listener.closed.Load() {
+		t.Error("listener closed")
+	}
+}
+
+func TestIdleFor(t *testing.T) {
+	c := newConnection(1, SOCK_STREAM)
+	now := time.Now()
+	if d := c.idleFor(now); d > time.Second {
+		t.Fatalf("new connection idle for %v", d)
+	}
+	if d := c.idleFor(now.Add(time.Minute)); d < time.Minute-time.Second {
+		t.Fatalf("idleFor = %v, want about a minute", d)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.janitor(0, time.Second)
+
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgClosed || ev.connID != conn.id {
+		t.Fatalf("got event %#x for %d, want MsgClosed for %d", ev.msgType, ev.connID, conn.id)
+	}
+	if d := time.Since(conn.createdAt); d < time.Second || d > 2*time.Second {
+		t.Fatalf("closed after %v, want about 1s", d)
+	}
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("peer read: %v, want EOF", err)
+	}
+}
+
+// closedEvents counts the MsgClosed events for connID that arrive on r
+// within wait of each other
+func closedEvents(t *testing.T, r io.Reader, connID uint32, wait time.Duration) int {
+	t.Helper()
+	events := make(chan testEvent)
+	go func() {
+		for {
+			ev, err := readEvent(r, false)
+			if err != nil {
+				close(events)
+				return
+			}
+			events <- ev
+		}
+	}()
+	n := 0
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return n
+			}
+			if ev.msgType == MsgClosed && ev.connID == connID {
+				n++
+			}
+		case <-time.After(wait):
+			return n
+		}
+	}
+}
+
+// TestReapIdleReportsOnce checks a reaped connection whose readLoop sees
+// the socket close under it is reported closed only once
+func TestReapIdleReportsOnce(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	conn, _ := tcpPair(t)
+	conn.lastActivity.Store(time.Now().Add(-time.Minute).UnixNano())
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	go sess.reap(time.Now(), 30*time.Second, 0)
+
+	if n := closedEvents(t, pr, conn.id, 500*time.Millisecond); n != 1 {
+		t.Fatalf("got %d MsgClosed events, want 1", n)
+	}
+}
+
+// TestMaxConnLifetimeReportsOnce is TestReapIdleReportsOnce for a
+// connection that outlived -max-conn-lifetime while still busy
+func TestMaxConnLifetimeReportsOnce(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	conn, _ := tcpPair(t)
+	conn.createdAt = time.Now().Add(-time.Hour)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	go sess.reap(time.Now(), 0, time.Minute)
+
+	if n := closedEvents(t, pr, conn.id, 500*time.Millisecond); n != 1 {
+		t.Fatalf("got %d MsgClosed events, want 1", n)
+	}
+}
+
+// TestUDPActivityKeepsConn checks a connected UDP socket whose traffic goes
+// over QUIC datagrams, both ways, stays open past the idle timeout
+func TestUDPActivityKeepsConn(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.datagrams = true })
+	go io.Copy(io.Discard, pr)
+	fake := newFakeDatagramConn(sess.ctx)
+	(&Server{}).attachDatagrams(fake, 8, sess)
+	go func() {
+		for {
+			select {
+			case <-fake.sent:
+			case <-sess.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	local, err := net.DialUDP("udp", nil, remote.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(3, SOCK_DGRAM)
+	conn.conn = local
+	defer conn.Close()
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+	go sess.janitor(200*time.Millisecond, 0)
+
+	// Alternate directions, so neither alone keeps it busy enough
+	send := binary.BigEndian.AppendUint32([]byte{MsgSend}, conn.id)
+	send = append(send, "ping"...)
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			sess.handleDatagram(send)
+		} else {
+			remote.WriteToUDP([]byte("pong"), local.LocalAddr().(*net.UDPAddr))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if conn.closed.Load() {
+		t.Fatal("active UDP connection closed as idle")
+	}
+}
@@ -0,0 +1,183 @@
+// imagecache.go - On-disk cache of exported image tars for /pull
+//
+// Exporting an image means fetching every layer from the registry and
+// flattening it, for each pull, which costs bandwidth and Docker Hub rate
+// limit. With -cache-dir set, exports are kept on disk keyed by manifest
+// digest and architecture, so pulling the same image again streams the
+// cached tar. A miss exports to a temp file and renames it into place;
+// pulls of the same image that arrive meanwhile wait for that one export
+// instead of starting their own. Least recently used tars are removed once
+// the cache exceeds -cache-max-bytes.
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheMaxBytes = 10 << 30
+
+// ImageCache is a size-bounded LRU of exported tars in one directory
+type ImageCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	total    int64
+	inflight map[string]*cacheFill
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// cacheFill is an export in progress that later pulls of the key wait on
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+// OpenImageCache uses dir as the cache, adopting tars left by an earlier
+// run and removing unfinished temp files
+func OpenImageCache(dir string, maxBytes int64) (*ImageCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &ImageCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*cacheFill),
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range des {
+		if strings.HasPrefix(de.Name(), ".export-") {
+			os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		key, ok := strings.CutSuffix(de.Name(), ".tar")
+		info, err := de.Info()
+		if !ok || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		c.entries[key] = &cacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		c.total += info.Size()
+	}
+	c.mu.Lock()
+	c.evictLocked("")
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *ImageCache) path(key string) string {
+	return filepath.Join(c.dir, key+".tar")
+}
+
+// Open returns the cached tar for key, running export to fill the cache on
+// a miss. hit reports whether the tar was already cached. Concurrent misses
+// for one key share a single export.
+func (c *ImageCache) Open(key string, export func(io.Writer) error) (f *os.File, hit bool, err error) {
+	for {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			f, err := os.Open(c.path(key))
+			if err == nil {
+				e.lastUsed = time.Now()
+				c.mu.Unlock()
+				return f, true, nil
+			}
+			// Removed behind our back; forget it and export again
+			c.total -= e.size
+			delete(c.entries, key)
+		}
+		if fill, ok := c.inflight[key]; ok {
+			c.mu.Unlock()
+			<-fill.done
+			if fill.err != nil {
+				return nil, false, fill.err
+			}
+			continue
+		}
+		fill := &cacheFill{done: make(chan struct{})}
+		c.inflight[key] = fill
+		c.mu.Unlock()
+
+		f, err = c.fill(key, export)
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		fill.err = err
+		close(fill.done)
+		return f, false, err
+	}
+}
+
+// fill exports key into the cache and opens the result
+func (c *ImageCache) fill(key string, export func(io.Writer) error) (*os.File, error) {
+	tmp, err := os.CreateTemp(c.dir, ".export-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := export(tmp); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return nil, err
+	}
+	// Opened before evicting, so even a tar bigger than the whole cache
+	// is served once
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = &cacheEntry{size: size, lastUsed: time.Now()}
+	c.total += size
+	c.evictLocked(key)
+	return f, nil
+}
+
+// evictLocked removes least recently used tars until the cache fits,
+// sparing keep unless it alone is over the limit. Caller holds mu.
+func (c *ImageCache) evictLocked(keep string) {
+	for c.total > c.maxBytes && len(c.entries) > 0 {
+		victim := ""
+		var oldest time.Time
+		for k, e := range c.entries {
+			if k == keep && len(c.entries) > 1 {
+				continue
+			}
+			if victim == "" || e.lastUsed.Before(oldest) {
+				victim, oldest = k, e.lastUsed
+			}
+		}
+		if err := os.Remove(c.path(victim)); err != nil && !os.IsNotExist(err) {
+			slog.Error("image cache eviction failed", "key", victim, "err", err)
+		}
+		c.total -= c.entries[victim].size
+		delete(c.entries, victim)
+	}
+}
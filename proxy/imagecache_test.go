@@ -0,0 +1,142 @@
+// imagecache_test.go - Image tar cache tests
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readAllClose(t *testing.T, f *os.File) string {
+	t.Helper()
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestImageCacheHitAndCoalesce(t *testing.T) {
+	c, err := OpenImageCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exports atomic.Int32
+	release := make(chan struct{})
+	export := func(w io.Writer) error {
+		exports.Add(1)
+		<-release
+		_, err := io.WriteString(w, "tar bytes")
+		return err
+	}
+
+	// Concurrent misses for one image share a single export
+	var wg sync.WaitGroup
+	results := make([]string, 4)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, _, err := c.Open("sha-riscv64", export)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = readAllClose(t, f)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := exports.Load(); n != 1 {
+		t.Fatalf("%d exports for concurrent pulls, want 1", n)
+	}
+	for i, r := range results {
+		if r != "tar bytes" {
+			t.Errorf("pull %d read %q", i, r)
+		}
+	}
+
+	f, hit, err := c.Open("sha-riscv64", export)
+	if err != nil || !hit {
+		t.Fatalf("second pull: hit=%v err=%v", hit, err)
+	}
+	if got := readAllClose(t, f); got != "tar bytes" || exports.Load() != 1 {
+		t.Errorf("cached read %q after %d exports", got, exports.Load())
+	}
+}
+
+func TestImageCacheEvictsLRU(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenImageCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string) {
+		t.Helper()
+		f, _, err := c.Open(key, func(w io.Writer) error {
+			_, err := io.WriteString(w, strings.Repeat("x", 4))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	put("a")
+	put("b")
+	time.Sleep(10 * time.Millisecond)
+	f, hit, _ := c.Open("a", nil) // a is now more recent than b
+	if !hit {
+		t.Fatal("a not cached")
+	}
+	f.Close()
+	put("c") // 12 bytes > 10: b goes
+
+	if _, err := os.Stat(filepath.Join(dir, "b.tar")); !os.IsNotExist(err) {
+		t.Errorf("least recently used tar kept: %v", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := os.Stat(filepath.Join(dir, k+".tar")); err != nil {
+			t.Errorf("%s evicted: %v", k, err)
+		}
+	}
+
+	// A restart adopts what's on disk and clears half-written exports
+	os.WriteFile(filepath.Join(dir, ".export-123"), []byte("partial"), 0o644)
+	c2, err := OpenImageCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.total != 8 || len(c2.entries) != 2 {
+		t.Errorf("reopened cache has %d entries, %d bytes; want 2, 8", len(c2.entries), c2.total)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".export-123")); !os.IsNotExist(err) {
+		t.Error("temp file left behind")
+	}
+}
+
+func TestImageCacheExportError(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenImageCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.Open("bad", func(w io.Writer) error {
+		io.WriteString(w, "half")
+		return io.ErrUnexpectedEOF
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want the export error", err)
+	}
+	if des, _ := os.ReadDir(dir); len(des) != 0 {
+		t.Errorf("failed export left %d files", len(des))
+	}
+}
@@ -0,0 +1,112 @@
+// inspect.go - Image metadata without the download
+//
+// /inspect?image= resolves an image the way /pull does (same arch order,
+// credentials and quota) but answers with JSON describing it instead of the
+// flattened tar, so clients can show the size before committing to a pull.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ImageInspect is the /inspect response
+type ImageInspect struct {
+	Image          string   `json:"image"`
+	Digest         string   `json:"digest"`
+	ConfigDigest   string   `json:"config_digest"`
+	Architecture   string   `json:"architecture"` // the platform /pull would fetch
+	OS             string   `json:"os"`
+	Variant        string   `json:"variant,omitempty"`
+	CompressedSize int64    `json:"compressed_size"` // sum of layer blobs; the tar is larger
+	Layers         int      `json:"layers"`
+	Platforms      []string `json:"platforms,omitempty"` // all index entries; empty for single-platform images
+}
+
+func (s *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	s.corsHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	req, ok := s.imageRequest(w, r)
+	if !ok {
+		return
+	}
+	slog.Info("inspect", "image", req.ref.String(), "remote_ip", r.RemoteAddr)
+
+	release, ok := s.acquirePull(w, r.RemoteAddr)
+	if !ok {
+		return
+	}
+	defer release()
+
+	img, platform, err := s.resolveRequest(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to inspect image: %v", err), resolveStatus(err))
+		return
+	}
+
+	out := ImageInspect{
+		Image:        req.imageRef,
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		Variant:      platform.Variant,
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to resolve image digest: %v", err), http.StatusBadGateway)
+		return
+	}
+	out.Digest = digest.String()
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to resolve config digest: %v", err), http.StatusBadGateway)
+		return
+	}
+	out.ConfigDigest = configDigest.String()
+	manifest, err := img.Manifest()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read manifest: %v", err), http.StatusBadGateway)
+		return
+	}
+	out.Layers = len(manifest.Layers)
+	if out.CompressedSize, err = compressedImageSize(img); err != nil {
+		http.Error(w, fmt.Sprintf("failed to size layers: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// The resolved image is a single platform's; the index, if any, lists
+	// the rest
+	desc, err := remote.Get(req.ref, req.auth)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch manifest: %v", err), http.StatusBadGateway)
+		return
+	}
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read index: %v", err), http.StatusBadGateway)
+			return
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read index: %v", err), http.StatusBadGateway)
+			return
+		}
+		for _, m := range im.Manifests {
+			if m.Platform != nil {
+				out.Platforms = append(out.Platforms, m.Platform.String())
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
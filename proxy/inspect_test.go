@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestInspect(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer reg.Close()
+	arm, err := random.Image(128, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd, err := random.Image(256, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+		mutate.IndexAddendum{Add: amd, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+	)
+	imageRef := strings.TrimPrefix(reg.URL, "http://") + "/multi/app:latest"
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("push index: %v", err)
+	}
+
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	s.pullLimiter = NewRateLimiter(1, 1)
+	rec := httptest.NewRecorder()
+	s.handleInspect(rec, httptest.NewRequest("GET", "/inspect?image="+imageRef, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if rec.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Fatalf("missing CORS headers")
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	want := []string{"architecture", "compressed_size", "config_digest", "digest", "image", "layers", "os", "platforms"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys %v, want %v", keys, want)
+	}
+
+	var got ImageInspect
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	digest, _ := amd.Digest()
+	configDigest, _ := amd.ConfigName()
+	size, _ := compressedImageSize(amd)
+	if got.Image != imageRef || got.Architecture != "amd64" || got.OS != "linux" ||
+		got.Digest != digest.String() || got.ConfigDigest != configDigest.String() ||
+		got.Layers != 3 || got.CompressedSize != size {
+		t.Fatalf("unexpected inspect result %+v", got)
+	}
+	if !reflect.DeepEqual(got.Platforms, []string{"linux/arm64", "linux/amd64"}) {
+		t.Fatalf("platforms %v", got.Platforms)
+	}
+
+	// Inspecting is charged to the pull quota
+	rec = httptest.NewRecorder()
+	s.handleInspect(rec, httptest.NewRequest("GET", "/inspect?image="+imageRef, nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over daily quota: got %d, want 429", rec.Code)
+	}
+}
@@ -0,0 +1,335 @@
+// listen.go - MsgBind and MsgListen: sockets that wait for peers
+//
+// A bind reserves a local address, within -bind-cidrs, and reports it back;
+// a listen starts accepting on it, announcing each peer with MsgAccept.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+func (sess *Session) handleBind(stream webtransport.Stream) {
+	// Read: connID (4), sockType (1), port (2); port 0 = ephemeral, see boundPayload
+	var header [4 + 1 + 2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("bind: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	sockType := int(header[4])
+	port := binary.BigEndian.Uint16(header[5:7])
+
+	// Optionally addrLen (2), addr (IP literal); without it, or with an
+	// empty one, the socket binds every interface as it always has. Then
+	// optionally flags (1), see reuseaddr.go.
+	var ip net.IP
+	var flags [1]byte
+	var lenBuf [2]byte
+	if n, _ := io.ReadFull(stream, lenBuf[:]); n == 2 {
+		addrLen := binary.BigEndian.Uint16(lenBuf[:])
+		if addrLen > maxBindAddrLen {
+			sess.sendEvent(MsgError, connID, []byte("bind address too long"))
+			return
+		}
+		host := make([]byte, addrLen)
+		if _, err := io.ReadFull(stream, host); err != nil {
+			sess.log().Warn("bind: failed to read address", "conn_id", connID, "err", err)
+			return
+		}
+		if addrLen > 0 {
+			if ip = net.ParseIP(string(host)); ip == nil {
+				sess.sendEvent(MsgError, connID, []byte("invalid bind address"))
+				return
+			}
+			if !sess.srv.bindAllowed(ip) {
+				sess.log().Warn("bind address not allowed", "conn_id", connID, "ip", ip)
+				sess.sendEvent(MsgError, connID, []byte("bind address not allowed"))
+				return
+			}
+		}
+		io.ReadFull(stream, flags[:])
+	}
+	reusePort := flags[0]&BindReusePort != 0
+	if reusePort && (sess.srv == nil || !sess.srv.reusePort) {
+		sess.sendEvent(MsgError, connID, []byte("SO_REUSEPORT not allowed"))
+		return
+	}
+
+	addr := net.JoinHostPort("", strconv.Itoa(int(port)))
+	if ip != nil {
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	sess.log().Info("bind", "conn_id", connID, "addr", addr, "type", sockType)
+
+	if msg := sess.connIDError(connID); msg != "" {
+		sess.log().Warn("bind refused", "conn_id", connID, "reason", msg)
+		sess.sendEvent(MsgError, connID, []byte(msg))
+		return
+	}
+
+	if sockType == SOCK_UNIX {
+		sess.sendEvent(MsgError, connID, []byte("unix sockets can't be bound"))
+		return
+	}
+
+	conn := newConnection(connID, sockType)
+	if !sess.takeListener(conn) {
+		sess.log().Warn("bind refused: listener limit", "conn_id", connID, "limit", sess.maxListeners)
+		sess.sendEvent(MsgError, connID, []byte("listener limit reached"))
+		return
+	}
+
+	var err error
+	lc := sess.srv.bindConfig(reusePort)
+	if sockType == SOCK_STREAM {
+		conn.listener, err = lc.Listen(sess.ctx, "tcp", addr)
+	} else {
+		var pc net.PacketConn
+		if pc, err = lc.ListenPacket(sess.ctx, "udp", addr); err == nil {
+			conn.udpConn = pc.(*net.UDPConn)
+		}
+	}
+
+	if err != nil {
+		sess.log().Info("bind failed", "conn_id", connID, "addr", addr, "err", err)
+		conn.Close()
+		sess.sendEvent(MsgError, connID, []byte(err.Error()))
+		return
+	}
+
+	// Armed first: a MsgListen may follow as soon as the ID is stored
+	sess.armListenGrace(conn)
+	if !sess.storeConn(connID, conn) {
+		conn.Close()
+		sess.sendEvent(MsgError, connID, []byte("connID in use"))
+		return
+	}
+	var bound string
+	if conn.listener != nil {
+		bound = conn.listener.Addr().String()
+	} else {
+		bound = conn.udpConn.LocalAddr().String()
+	}
+	sess.log().Info("bound", "conn_id", connID, "addr", bound)
+	sess.sendEvent(MsgConnected, connID, boundPayload(bound))
+	sess.sendOpened(sess.connInfo(conn, nil))
+
+	if conn.udpConn != nil {
+		go sess.udpReadLoop(conn)
+	}
+}
+
+// defaultBindCIDRs lets sessions bind loopback, which exposes less than
+// the all-interfaces bind they could always make
+const defaultBindCIDRs = "127.0.0.0/8,::1/128"
+
+// maxBindAddrLen is the longest address a MsgBind may carry; IPv6 text
+// fits in 45 bytes
+const maxBindAddrLen = 64
+
+// bindAllowed reports whether a session may bind ip. The wildcard
+// addresses are what a bind without an address gets, so they always are;
+// anything else must fall inside -bind-cidrs.
+func (s *Server) bindAllowed(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range s.bindNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundPayload is MsgConnected's payload for a bind, so port 0 binds learn
+// their ephemeral port: addrLen (2), addr ("ip:port", as getsockname sees it)
+func boundPayload(addr string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(addr)))
+	return append(payload, addr...)
+}
+
+func (sess *Session) handleListen(stream webtransport.Stream) {
+	// Read: connID (4), backlog (4), optionally workers (1), worker mode (1)
+	var header [8]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("listen: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+
+	// Without the worker trailer, MsgAccept keeps its original layout
+	var workers [2]byte
+	n, _ := io.ReadFull(stream, workers[:])
+	picker := &workerPicker{n: int(workers[0])}
+	if n == 2 {
+		picker.mode = workers[1]
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.log().Warn("listen: connection not found", "conn_id", connID)
+		return
+	}
+	conn := v.(*Connection)
+
+	if conn.listener == nil {
+		sess.log().Warn("listen: not a listening socket", "conn_id", connID)
+		return
+	}
+	if !conn.disarmListenGrace() {
+		sess.log().Warn("listen: bound socket already reclaimed", "conn_id", connID)
+		return
+	}
+
+	sess.log().Info("listening", "conn_id", connID)
+
+	gate := &acceptGate{rate: sess.srv.maxAcceptRate, pause: sess.srv.acceptPause}
+
+	// Accept incoming connections
+	go func() {
+		for {
+			// Over the accept rate: stop calling Accept so the flood queues
+			// (and overflows) in the kernel backlog instead of costing an fd each
+			if wait := gate.wait(time.Now()); wait > 0 {
+				sess.log().Warn("accept burst, pausing accepts", "conn_id", connID, "rate", gate.rate, "pause", wait)
+				select {
+				case <-time.After(wait):
+				case <-sess.ctx.Done():
+					return
+				}
+				if conn.closed.Load() {
+					return
+				}
+			}
+
+			netConn, err := conn.listener.Accept()
+			if err != nil {
+				if conn.closed.Load() {
+					return
+				}
+				sess.log().Warn("accept error", "conn_id", connID, "err", err)
+				continue
+			}
+
+			// Create new connection for the accepted socket
+			newConnID := sess.newServerConnID()
+			if err := applyKeepalive(netConn, &sess.srv.keepalive); err != nil {
+				sess.log().Warn("keepalive", "conn_id", newConnID, "err", err)
+			}
+			newConn := newConnection(newConnID, SOCK_STREAM)
+			if !sess.takeConn(newConn) {
+				sess.log().Warn("accept refused: session connection limit", "conn_id", connID, "limit", sess.maxConns)
+				netConn.Close()
+				continue
+			}
+			newConn.conn = netConn
+			newConn.readDone = make(chan struct{})
+			// Only a wrapped counter can land on an ID still in use
+			for !sess.storeConn(newConnID, newConn) {
+				newConnID = sess.newServerConnID()
+				newConn.id = newConnID
+			}
+
+			remoteAddr := netConn.RemoteAddr().String()
+			sess.log().Info("accepted", "conn_id", newConnID, "listener", connID, "peer", remoteAddr)
+
+			// Notify container of new connection
+			// Format: listenerConnID (4), newConnID (4), addrLen (2), addr,
+			// worker (1, only when the listen requested workers)
+			addrBytes := []byte(remoteAddr)
+			payload := make([]byte, 4+4+2+len(addrBytes), 4+4+2+len(addrBytes)+1)
+			binary.BigEndian.PutUint32(payload[0:4], connID)
+			binary.BigEndian.PutUint32(payload[4:8], newConnID)
+			binary.BigEndian.PutUint16(payload[8:10], uint16(len(addrBytes)))
+			copy(payload[10:], addrBytes)
+			if picker.n > 0 {
+				payload = append(payload, byte(picker.pick(netConn.RemoteAddr())))
+			}
+
+			// MsgData for newConnID must never precede its MsgAccept, so
+			// reading only starts once the accept has been written
+			info := sess.connInfo(newConn, &sess.srv.keepalive)
+			info.Listener = connID
+			if !sess.sendEvent(MsgAccept, newConnID, payload) || !sess.sendOpened(info) {
+				sess.connections.Delete(newConnID)
+				close(newConn.readDone)
+				newConn.Close()
+				continue
+			}
+			sess.grantWindow(newConn)
+
+			// Start reading from new connection
+			go sess.readLoop(newConn)
+		}
+	}()
+}
+
+// Worker distribution modes for MsgListen's worker trailer
+const (
+	WorkersRoundRobin = 0 // spread accepts evenly
+	WorkersByClient   = 1 // same client IP -> same worker (sticky)
+)
+
+// workerPicker assigns accepted connections to one of n container-side
+// handlers. It is only used from the listener's accept goroutine.
+type workerPicker struct {
+	n    int
+	mode byte
+	next int
+}
+
+func (p *workerPicker) pick(remote net.Addr) int {
+	if p.mode == WorkersByClient {
+		if tcp, ok := remote.(*net.TCPAddr); ok {
+			h := fnv.New32a()
+			h.Write(tcp.IP.To16())
+			return int(h.Sum32() % uint32(p.n))
+		}
+	}
+	w := p.next
+	p.next = (p.next + 1) % p.n
+	return w
+}
+
+// acceptGate is per-listener admission control: once more than rate
+// connections are accepted within a one-second window, wait reports how long
+// the accept loop should stop accepting
+type acceptGate struct {
+	rate  int
+	pause time.Duration
+
+	windowStart time.Time
+	count       int
+}
+
+func (g *acceptGate) wait(now time.Time) time.Duration {
+	if g.rate <= 0 {
+		return 0
+	}
+	if now.Before(g.windowStart) {
+		return g.windowStart.Sub(now) // still paused
+	}
+	if now.Sub(g.windowStart) >= time.Second {
+		g.windowStart = now
+		g.count = 0
+	}
+	if g.count >= g.rate {
+		// Start a fresh window once the pause is over
+		g.windowStart = now.Add(g.pause)
+		g.count = 0
+		return g.pause
+	}
+	g.count++
+	return 0
+}
@@ -0,0 +1,42 @@
+// listengrace.go - Reclaiming bound sockets that never listen
+//
+// MsgBind opens the TCP listener straight away, so a container that binds
+// and never sends MsgListen holds the port, and a -max-listeners-per-session
+// slot, for the rest of the session. A stream bind starts a timer of
+// -listen-grace; if MsgListen hasn't arrived by then the socket is closed
+// and forgotten, and the container told with MsgError. Datagram binds are
+// usable as soon as they're bound and have no deadline.
+
+package main
+
+import "time"
+
+// defaultListenGrace is how long a bound stream socket may wait for MsgListen
+const defaultListenGrace = 30 * time.Second
+
+// armListenGrace starts conn's MsgListen deadline
+func (sess *Session) armListenGrace(conn *Connection) {
+	if sess.listenGrace <= 0 || conn.listener == nil {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.listenGrace = time.AfterFunc(sess.listenGrace, func() {
+		if !sess.connections.CompareAndDelete(conn.id, conn) {
+			return // closed meanwhile; its ID may already be reused
+		}
+		sess.log().Info("bound socket never listened, closing", "conn_id", conn.id, "grace", sess.listenGrace)
+		conn.Close()
+		sess.sendEvent(MsgError, conn.id, []byte("listen timeout: bound socket reclaimed"))
+	})
+}
+
+// disarmListenGrace stops conn's MsgListen deadline, reporting false if it
+// has already expired
+func (c *Connection) disarmListenGrace() bool {
+	c.mu.Lock()
+	t := c.listenGrace
+	c.listenGrace = nil
+	c.mu.Unlock()
+	return t == nil || t.Stop()
+}
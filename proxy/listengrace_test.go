@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenGrace(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) {
+		s.listenGrace = 100 * time.Millisecond
+		s.maxListeners = 1
+	})
+
+	event := func() testEvent {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	bind := func(connID uint32) string {
+		go sess.handleBind(readerStream{r: bytes.NewReader(bindReq(connID))})
+		ev := event()
+		if ev.msgType != MsgConnected {
+			t.Fatalf("bind: got event %#x %q", ev.msgType, ev.data)
+		}
+		return string(ev.data[2:])
+	}
+
+	// Never listened: reclaimed, along with its listener slot
+	addr := bind(1)
+	start := time.Now()
+	if ev := event(); ev.msgType != MsgError || ev.connID != 1 {
+		t.Fatalf("got event %#x for conn %d %q, want MsgError", ev.msgType, ev.connID, ev.data)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("reclaimed after %v", elapsed)
+	}
+	if _, ok := sess.connections.Load(uint32(1)); ok {
+		t.Fatal("reclaimed socket still registered")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("reclaimed socket still accepting")
+	}
+
+	// Listened in time: kept past the grace period
+	addr = bind(2)
+	sess.handleListen(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 2), 16))})
+	time.Sleep(300 * time.Millisecond)
+	peer, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if ev := event(); ev.msgType != MsgAccept {
+		t.Fatalf("got event %#x %q, want MsgAccept", ev.msgType, ev.data)
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
@@ -0,0 +1,57 @@
+// logging.go - Structured logging
+//
+// Logs go through log/slog in the -log-format (text or json) at -log-level.
+// Every session gets a random correlation ID, logged as "session" with its
+// remote_ip on each of its lines, so one client's lifecycle can be pulled out
+// of a busy log. Per-read and per-write lines are at debug; production runs
+// at info.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger builds the process logger from -log-format and -log-level
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("-log-level: %q is not debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("-log-format: %q is not text or json", format)
+}
+
+// newCorrelationID returns a random ID for one session's log lines
+func newCorrelationID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// log returns the session's logger, or the default for sessions built
+// without one (tests)
+func (sess *Session) log() *slog.Logger {
+	if sess.logger != nil {
+		return sess.logger
+	}
+	return slog.Default()
+}
+
+// fatal logs at error and exits, for startup failures
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
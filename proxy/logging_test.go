@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept", "conn_id", uint32(7))
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("want one JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["msg"] != "kept" || line["level"] != "WARN" || line["conn_id"] != float64(7) {
+		t.Fatalf("unexpected line %v", line)
+	}
+
+	buf.Reset()
+	if logger, err = newLogger(&buf, "text", "DEBUG"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("read", "bytes", 3)
+	if !strings.Contains(buf.String(), "msg=read bytes=3") {
+		t.Fatalf("text debug line: %q", buf.String())
+	}
+
+	for _, bad := range [][2]string{{"xml", "info"}, {"json", "loud"}} {
+		if _, err := newLogger(&buf, bad[0], bad[1]); err == nil {
+			t.Errorf("newLogger(%q, %q) accepted", bad[0], bad[1])
+		}
+	}
+}
+
+// TestSessionLogCorrelation checks a session's lines carry its correlation
+// ID and remote IP
+func TestSessionLogCorrelation(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newCorrelationID()
+	if len(id) != 16 || id == newCorrelationID() {
+		t.Fatalf("correlation IDs should be random 16-digit hex, got %q", id)
+	}
+	sess := &Session{logger: logger.With("session", id, "remote_ip", "203.0.113.9:4000")}
+	sess.handleSetTimeout(readerStream{r: strings.NewReader("")})
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("want one JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["session"] != id || line["remote_ip"] != "203.0.113.9:4000" {
+		t.Fatalf("line lacks session fields: %v", line)
+	}
+}
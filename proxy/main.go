@@ -21,135 +21,94 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
+	"golang.org/x/sync/singleflight"
 )
 
-// Rate limiter tracks per-IP usage
-type RateLimiter struct {
-	mu              sync.Mutex
-	ipSessions      map[string]int       // current concurrent sessions per IP
-	ipConnections   map[string]int       // total connections made today per IP
-	ipLastReset     map[string]time.Time // when counters were last reset
-	maxSessions     int                  // max concurrent sessions per IP
-	maxConnsPerDay  int                  // max outbound connections per IP per day
-}
-
-func NewRateLimiter(maxSessions, maxConnsPerDay int) *RateLimiter {
-	return &RateLimiter{
-		ipSessions:     make(map[string]int),
-		ipConnections:  make(map[string]int),
-		ipLastReset:    make(map[string]time.Time),
-		maxSessions:    maxSessions,
-		maxConnsPerDay: maxConnsPerDay,
-	}
-}
-
-func (rl *RateLimiter) extractIP(addr string) string {
-	// Handle both "ip:port" and bare "ip"
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return addr
-	}
-	return host
-}
-
-// TryAcquireSession returns true if a new session is allowed for this IP
-func (rl *RateLimiter) TryAcquireSession(remoteAddr string) bool {
-	ip := rl.extractIP(remoteAddr)
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	if rl.ipSessions[ip] >= rl.maxSessions {
-		return false
-	}
-	rl.ipSessions[ip]++
-	return true
-}
-
-// ReleaseSession decrements the session count for an IP
-func (rl *RateLimiter) ReleaseSession(remoteAddr string) {
-	ip := rl.extractIP(remoteAddr)
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	if rl.ipSessions[ip] > 0 {
-		rl.ipSessions[ip]--
-	}
-	if rl.ipSessions[ip] == 0 {
-		delete(rl.ipSessions, ip)
-	}
-}
-
-// TryConnection returns true if a new outbound connection is allowed for this IP
-func (rl *RateLimiter) TryConnection(remoteAddr string) bool {
-	ip := rl.extractIP(remoteAddr)
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	// Reset daily counter if needed
-	now := time.Now()
-	if last, ok := rl.ipLastReset[ip]; !ok || now.Sub(last) > 24*time.Hour {
-		rl.ipConnections[ip] = 0
-		rl.ipLastReset[ip] = now
-	}
-
-	if rl.ipConnections[ip] >= rl.maxConnsPerDay {
-		return false
-	}
-	rl.ipConnections[ip]++
-	return true
-}
-
-func (rl *RateLimiter) Stats() (totalSessions int, totalIPs int) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	for _, v := range rl.ipSessions {
-		totalSessions += v
-	}
-	return totalSessions, len(rl.ipSessions)
-}
-
 // Protocol message types (varint prefix)
 const (
 	// Container -> Host (requests)
-	MsgConnect = 0x01 // Connect to remote host
-	MsgBind    = 0x02 // Bind to local port
-	MsgListen  = 0x03 // Start listening
-	MsgSend    = 0x04 // Send data on connection
-	MsgClose   = 0x05 // Close connection
-	MsgSendTo  = 0x06 // Send UDP datagram
+	MsgConnect    = 0x01 // Connect to remote host
+	MsgBind       = 0x02 // Bind to local port, optionally on one address
+	MsgListen     = 0x03 // Start listening
+	MsgSend       = 0x04 // Send data on connection
+	MsgClose      = 0x05 // Close connection, first relaying data already on its way
+	MsgSendTo     = 0x06 // Send one or more UDP datagrams
+	MsgForward    = 0x07 // Splice an accepted connection to a remote host
+	MsgSetPrio    = 0x08 // Set a connection's event scheduling priority
+	MsgFlush      = 0x09 // Flush a connection's coalesced sends now
+	MsgSetTimeout = 0x0A // Set a connection's read/write timeouts (SO_RCVTIMEO/SO_SNDTIMEO)
+	MsgCloseWrite = 0x0B // Half-close: send FIN, keep reading (shutdown(SHUT_WR))
+	MsgSetOption  = 0x0C // Set a socket option such as TCP_NODELAY (sockopt.go)
+	MsgGetName    = 0x0D // Query a connection's local or peer address (sockname.go)
+	MsgResolve    = 0x0E // Look up a hostname (resolve.go)
+	MsgShutdown   = 0x0F // Close a connection at once, discarding unread data
+	MsgPong       = 0x10 // Answer a MsgPing (heartbeat.go)
+	MsgListConns  = 0x11 // List the session's live connections (connlist.go)
 
 	// Host -> Container (responses/events)
-	MsgConnected    = 0x81 // Connection established
-	MsgConnectError = 0x82 // Connection failed
-	MsgData         = 0x83 // Incoming data
-	MsgAccept       = 0x84 // New incoming connection
-	MsgClosed       = 0x85 // Connection closed
-	MsgError        = 0x86 // General error
-	MsgRecvFrom     = 0x87 // UDP datagram received
+	MsgConnected      = 0x81 // Connection established
+	MsgConnectError   = 0x82 // Connection failed
+	MsgData           = 0x83 // Incoming data
+	MsgAccept         = 0x84 // New incoming connection
+	MsgClosed         = 0x85 // Connection closed; payload is closedPayload's byte counts
+	MsgError          = 0x86 // General error
+	MsgRecvFrom       = 0x87 // UDP datagram received
+	MsgTimeout        = 0x88 // Read or write timeout (MsgSetTimeout) expired
+	MsgCertError      = 0x89 // Upstream TLS certificate rejected (OptTLS)
+	MsgSendToError    = 0x8A // Some datagrams in a MsgSendTo batch failed
+	MsgOpened         = 0x8B // Effective connection parameters (opened.go)
+	MsgTransportStats = 0x8C // Periodic QUIC path stats (quicstats.go)
+	MsgName           = 0x8D // MsgGetName answer: a local or peer address
+	MsgResolved       = 0x8E // MsgResolve answers
+	MsgResolveError   = 0x8F // MsgResolve refused or failed (policy decision JSON)
+	MsgAck            = 0x90 // Send credit for a connection (flowcontrol.go)
+	MsgPing           = 0x91 // Heartbeat on a quiet session; answer with MsgPong (heartbeat.go)
+	MsgConnList       = 0x92 // MsgListConns answer: JSON ConnListEntry array (connlist.go)
 )
 
+// Session close codes sent to the client with CloseWithError
+const (
+	ErrCodeEventsBlocked webtransport.SessionErrorCode = 0x01 // client stopped reading events
+	ErrCodeTokenExpired  webtransport.SessionErrorCode = 0x02 // auth token reached its expiry
+	ErrCodeTokenBudget   webtransport.SessionErrorCode = 0x03 // auth token byte budget exhausted
+	ErrCodeInternal      webtransport.SessionErrorCode = 0x04 // proxy-side failure; the reason carries detail
+	ErrCodeShutdown      webtransport.SessionErrorCode = 0x05 // proxy is shutting down (SIGINT/SIGTERM)
+	ErrCodeAdminClose    webtransport.SessionErrorCode = 0x06 // closed by an operator via /admin/sessions
+	ErrCodeHeartbeat     webtransport.SessionErrorCode = 0x07 // -heartbeat-misses pings went unanswered
+)
+
+// defaultEventTimeout bounds how long an event may wait for stream credit
+const defaultEventTimeout = 10 * time.Second
+
 // Socket types
 const (
 	SOCK_STREAM = 1
 	SOCK_DGRAM  = 2
+	SOCK_UNIX   = 3 // MsgConnect only: host is a socket path (unixsock.go)
 )
 
 // Connection represents a virtual socket
@@ -161,137 +120,580 @@ type Connection struct {
 	udpConn  *net.UDPConn
 	closed   atomic.Bool
 	mu       sync.Mutex
+
+	// Forwarding (MsgForward): readLoop hands the socket over to splice
+	readDone   chan struct{} // closed when readLoop exits (accepted and OptPool conns)
+	forwarding atomic.Bool
+	upstream   net.Conn // destination the accepted conn is spliced to
+
+	priority atomic.Int32 // PrioLow..PrioHigh; zero value is set to PrioNormal on creation
+
+	coalescer *writeCoalescer // nil = every MsgSend is written immediately
+
+	dest      *Destination // set for OptPool connections, parked here on MsgClose
+	poolOwner string
+
+	compress byte // OptCompress: MsgData/MsgSend payloads are frames of this algorithm
+	readBuf  int  // OptReadBuf: readLoop's buffer size; 0 = readBufSize
+
+	// Mid-transfer state consulted when the session drops (teardown.go)
+	truncated    atomic.Bool  // a MsgSend was cut short or a MsgData went undelivered
+	pendingSends atomic.Int32 // MsgSend writes in progress
+
+	halfClosed atomic.Bool // MsgCloseWrite sent FIN; never pooled
+
+	// Per-operation timeouts (MsgSetTimeout), in nanoseconds; 0 = none
+	readTimeout  atomic.Int64
+	writeTimeout atomic.Int64
+
+	createdAt    time.Time
+	lastActivity atomic.Int64 // unix nanos of the last data either way (idle.go)
+
+	// Payload bytes read from and written to the remote socket, reported
+	// in MsgClosed
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	release func() // gives back the session slot it holds (sessionlimits.go); nil = none
+
+	listenGrace *time.Timer // closes a bound stream socket MsgListen never came for (listengrace.go)
+
+	unacked atomic.Int64 // MsgSend bytes written but not yet acked (flowcontrol.go)
+
+	// Graceful MsgClose: readLoop relays what's left until EOF or
+	// drainUntil, and whichever of it and handleClose finishes last
+	// closes the socket and reports MsgClosed
+	drainUntil atomic.Int64 // unix nanos; 0 = not draining
+	readExited atomic.Bool
+
+	// Set by whoever sends MsgClosed, so readLoop and the handler that
+	// closed the socket under it don't both report it
+	closeReported atomic.Bool
+}
+
+// newConnection creates a Connection at normal priority
+func newConnection(id uint32, sockType int) *Connection {
+	c := &Connection{id: id, sockType: sockType, createdAt: time.Now()}
+	c.priority.Store(PrioNormal)
+	c.touch()
+	return c
 }
 
 // Session represents a WebTransport client session
 type Session struct {
-	wt          *webtransport.Session
-	connections sync.Map // uint32 -> *Connection
-	nextConnID  atomic.Uint32
-	ctx         context.Context
-	cancel      context.CancelFunc
-	streamMu    sync.Mutex
-	rateLimiter *RateLimiter
-	remoteIP    string
+	wt           *webtransport.Session
+	connections  sync.Map // uint32 -> *Connection
+	nextConnID   atomic.Uint32
+	ctx          context.Context
+	cancel       context.CancelFunc
+	streamMu     prioMutex
+	events       webtransport.SendStream // all events, in order; nil = one uni stream each. Guarded by streamMu.
+	rateLimiter  *RateLimiter
+	remoteIP     string
+	origin       string // Origin header; the rate-limit key with -limit-by-origin
+	eventTimeout time.Duration
+	closeDrain   time.Duration // how long MsgClose waits for data in flight; 0 = close at once
+	readAhead    int           // reads each connection may queue for the client; see backpressure.go
+	maxMessage   int           // largest MsgSend payload or host (msgsize.go); 0 = unlimited
+	listenGrace  time.Duration // how long a stream bind waits for MsgListen; 0 = forever
+	streams      chan struct{} // one slot per stream in handleStream; nil = unlimited (streamlimit.go)
+	srv          *Server
+	logger       *slog.Logger // carries the session's correlation ID; see log()
+	capture      *Recorder    // nil unless -capture-dir is set
+	token        *Token       // nil unless -token-file is set
+	span         *Span        // nil unless -otel-endpoint is set (tracing.go)
+
+	// Event timestamps (/connect?event_ts=1): each event header carries its
+	// emission time, strictly increasing within the session so the client
+	// can restore emission order across independently delivered streams
+	eventTimestamps bool
+	lastEventTS     int64 // guarded by streamMu
+
+	// Connection-ending events no stream could be opened for yet
+	// (eventretry.go); guarded by streamMu
+	heldEvents []heldEvent
+	openUni    func(context.Context) (webtransport.SendStream, error) // nil = wt.OpenUniStreamSync
+
+	openedEvents bool // /connect?opened=1: send MsgOpened for every connection
+
+	sendWindow int // /connect?acks=1: initial MsgAck credit per connection; 0 = no acks
+
+	dnsLimiter *tokenBucket // nil unless -dns-rate is set
+
+	// Bytes per second each way (bandwidth.go); nil unless -max-bandwidth is set
+	sendLimiter *tokenBucket
+	recvLimiter *tokenBucket
+
+	id       uint64 // admin endpoint handle
+	cid      string // log correlation ID
+	started  time.Time
+	quic     *quicStats // nil if the QUIC connection wasn't traced
+	clientCN string     // client certificate CN with -client-ca; empty otherwise
+
+	// Payload bytes relayed to and from remote hosts, for /admin/sessions
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	// Open sockets and their caps (sessionlimits.go); 0 = unlimited
+	listeners    atomic.Int32
+	conns        atomic.Int32
+	maxListeners int
+	maxConns     int
+
+	// QUIC datagrams (datagram.go); dgram is nil if the client can't do them
+	dgram       datagramConn
+	dgramPrefix []byte // quarter session ID varint
+	datagrams   bool   // /connect?datagrams=1: MsgRecvFrom goes out as datagrams
+
+	lastHeard atomic.Int64 // unix nanos of the container's last request (heartbeat.go)
+}
+
+// sessionTransport is what handleSession needs from the session's QUIC connection
+type sessionTransport struct {
+	ctx       context.Context // cancelled with the close cause when the connection ends
+	dgram     datagramConn    // nil without datagram support
+	sessionID uint64          // CONNECT stream ID; prefixes the session's datagrams
+	clientCN  string          // verified client certificate CN (-client-ca)
+
+	traceparent string // W3C trace context of the /connect request, if any
 }
 
 // Server is the WebTransport proxy server
 type Server struct {
-	certFile    string
-	keyFile     string
-	listen      string
-	sessions    sync.Map
-	rateLimiter *RateLimiter
-	allowedOrigins map[string]bool // nil = allow all
+	certFile       string
+	keyFile        string
+	listen         string
+	sessions       sync.Map // session id (uint64) -> *Session
+	nextSessionID  atomic.Uint64
+	rateLimiter    *RateLimiter
+	allowedOrigins []originPattern   // nil = allow all
+	tlsPolicy      *TLSPolicy        // nil = Go defaults
+	clientCAs      *x509.CertPool    // -client-ca: require client certificates on /connect; nil = off
+	pullLimiter    *RateLimiter      // image API quota, separate from networking; nil = unlimited
+	imageCache     *ImageCache       // exported tars by digest; nil = export every pull
+	registryAuth   *RegistryKeychain // pull credentials by registry; nil = anonymous
+	archOrder      []v1.Platform     // platforms /pull tries in turn, unless ?arch= is given
+	maxImageBytes  int64             // cap on both compressed layers and exported tar; 0 = unlimited
+	pulls          singleflight.Group
+
+	// Overridable for tests
+	remoteImage   func(name.Reference, ...remote.Option) (v1.Image, error)
+	apiTLS        bool          // serve the API over TLS instead of plain HTTP
+	eventTimeout  time.Duration // see defaultEventTimeout
+	closeDrain    time.Duration // see defaultCloseDrain
+	readAhead     int           // see defaultReadAhead; 0 = each read waits for its event to be written
+	maxMessage    int           // see defaultMaxMessageBytes; 0 = unlimited
+	listenGrace   time.Duration // see defaultListenGrace
+	sendWindow    int           // initial send credit for /connect?acks=1 sessions; 0 = acks off
+	captureDir    string        // empty = no protocol capture
+	captureRedact bool          // drop data payloads from captures
+	tracer        *Tracer       // nil = tracing off (tracing.go)
+	readiness     *ReadinessChecker
+	tokens        *TokenStore         // nil = /connect needs no token
+	maxAcceptRate int                 // accepts per second per bound listener; 0 = unlimited
+	acceptPause   time.Duration       // how long a listener backs off after exceeding maxAcceptRate
+	coalesceDelay time.Duration       // default MsgSend coalescing window; 0 = off
+	keepalive     net.KeepAliveConfig // dialed and accepted TCP sockets, unless OptKeepalive overrides
+
+	upstreamTLSInsecure bool // honor OptTLS's skip-verification flag (testing only)
+
+	unixSockets map[string]bool // -unix-sockets: paths SOCK_UNIX may dial; nil = none
+
+	defaultConnectTimeout time.Duration // dial timeout without OptTimeout; 0 = defaultConnectTimeout
+	maxConnectTimeout     time.Duration // cap on OptTimeout; 0 = uncapped
+
+	minReadBuf int // OptReadBuf is raised to at least this; 0 = no floor
+	maxReadBuf int // and lowered to at most this; 0 = no cap but the hard limit
+
+	maxQueryLen int // longest accepted API query parameter (image ref, search query)
+
+	dests *DestinationTable // DNS cache, circuit breaker and idle pool per host:port
+	ports *PortPolicy       // nil = every port
+
+	bindNets []*net.IPNet // addresses MsgBind may name besides the wildcard; see bindAllowed
+
+	noReuseAddr bool // -reuse-addr=false: bound sockets don't get SO_REUSEADDR (reuseaddr.go)
+	reusePort   bool // MsgBind may ask for SO_REUSEPORT
+
+	maxListeners    int // MsgBind sockets per session; 0 = unlimited
+	maxSessionConns int // dialed and accepted connections per session; 0 = unlimited
+	maxStreams      int // request streams being handled at once per session; 0 = unlimited
+
+	disconnectMode  string        // DisconnectAuto, DisconnectGraceful or DisconnectAbort
+	idleTimeout     time.Duration // close connections without data for this long; 0 = never
+	maxConnLifetime time.Duration // close any connection open this long; 0 = unlimited
+
+	heartbeatInterval time.Duration // ping sessions quiet this long; 0 = no heartbeat (heartbeat.go)
+	heartbeatMisses   int           // unanswered pings that close a session
+
+	adminToken string   // bearer token for /admin/*; empty = admin endpoints off
+	quicConns  sync.Map // remote addr -> *quicStats
+	dgramMuxes sync.Map // datagramConn -> *datagramMux
+
+	dnsRate  float64 // hostname lookups per second per session; 0 = unlimited
+	dnsBurst int
+	metrics  Metrics
+
+	maxBandwidth   float64 // bytes per second per session, each direction; 0 = unlimited
+	bandwidthBurst int
+
+	// Cancelled by Shutdown; every session's context derives from it
+	ctx             context.Context
+	cancel          context.CancelFunc
+	shutdownTimeout time.Duration // how long Shutdown waits for sessions and API requests to drain
+
+	srvMu     sync.Mutex // guards wtServer and apiServer, set once serving starts
+	wtServer  *webtransport.Server
+	apiServer *http.Server
+
+	serving atomic.Bool // the WebTransport listener is bound and serving (health.go)
+
+	// The current certificate, swapped when its files change (certreload.go)
+	cert      atomic.Pointer[tls.Certificate]
+	certMu    sync.Mutex // serializes reads of the files
+	certState certFileState
+
+	// Set by Bind when sockets must be opened before dropping privileges;
+	// otherwise Run and RunAPIServer open their own
+	packetConn  net.PacketConn
+	apiListener net.Listener
 }
 
 func NewServer(listen, certFile, keyFile string, rl *RateLimiter, origins []string) *Server {
 	s := &Server{
-		listen:      listen,
-		certFile:    certFile,
-		keyFile:     keyFile,
-		rateLimiter: rl,
+		listen:       listen,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		rateLimiter:  rl,
+		eventTimeout: defaultEventTimeout,
+		closeDrain:   defaultCloseDrain,
+		readAhead:    defaultReadAhead,
+		maxMessage:   defaultMaxMessageBytes,
+		listenGrace:  defaultListenGrace,
+		sendWindow:   defaultSendWindow,
+		readiness:    NewReadinessChecker(""),
+		acceptPause:  time.Second,
+		maxQueryLen:  defaultMaxQueryLen,
+		dests:        NewDestinationTable(),
+		bindNets:     mustParseCIDRs(defaultBindCIDRs),
+		dnsBurst:     defaultDNSBurst,
+		keepalive:    defaultKeepalive,
+		archOrder:    defaultArchOrder,
+		remoteImage:  remote.Image,
+
+		maxListeners:    defaultMaxListeners,
+		maxSessionConns: defaultMaxSessionConns,
+		maxStreams:      defaultMaxStreams,
+
+		defaultConnectTimeout: defaultConnectTimeout,
+		maxConnectTimeout:     defaultMaxConnectTimeout,
+
+		minReadBuf: defaultMinReadBuf,
+		maxReadBuf: defaultMaxReadBuf,
+
+		bandwidthBurst: defaultBandwidthBurst,
+
+		disconnectMode:  DisconnectAuto,
+		shutdownTimeout: defaultShutdownTimeout,
+
+		heartbeatMisses: defaultHeartbeatMisses,
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	if len(origins) > 0 {
-		s.allowedOrigins = make(map[string]bool)
 		for _, o := range origins {
-			s.allowedOrigins[o] = true
+			s.allowedOrigins = append(s.allowedOrigins, parseOriginPattern(o))
 		}
 	}
 	return s
 }
 
-func (s *Server) Run() error {
-	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+// Bind opens the WebTransport and API sockets and loads the certificate
+// up front, so privileges can be dropped before serving. An empty
+// apiListen opens no API socket, for -api-disable.
+func (s *Server) Bind(apiListen string) error {
+	if _, err := s.loadCert(); err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", s.listen)
 	if err != nil {
-		return fmt.Errorf("failed to load certificates: %w", err)
+		return err
+	}
+	if apiListen != "" {
+		ln, err := net.Listen("tcp", apiListen)
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		s.apiListener = ln
+	}
+	s.packetConn = pc
+	return nil
+}
+
+func (s *Server) Run() error {
+	if _, err := s.loadCert(); err != nil {
+		return err
 	}
 
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3"},
+		GetCertificate: s.getCertificate,
+		NextProtos:     []string{"h3"},
 	}
+	s.tlsPolicy.Apply(tlsConfig)
+	s.applyClientAuth(tlsConfig)
 
+	// Not http.DefaultServeMux: anything registered there (net/http/pprof
+	// registers itself on import) would be served to every client
+	mux := http.NewServeMux()
 	wtServer := &webtransport.Server{
 		H3: http3.Server{
-			Addr:      s.listen,
-			TLSConfig: tlsConfig,
+			Handler:    mux,
+			Addr:       s.listen,
+			TLSConfig:  tlsConfig,
+			QuicConfig: &quic.Config{Tracer: s.quicTracer},
 		},
 		CheckOrigin: func(r *http.Request) bool {
-			if s.allowedOrigins == nil {
-				return true
-			}
-			origin := r.Header.Get("Origin")
-			return s.allowedOrigins[origin]
+			return s.originAllowed(r.Header.Get("Origin"))
 		},
 	}
 
-	http.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+	s.srvMu.Lock()
+	s.wtServer = wtServer
+	s.srvMu.Unlock()
+	if s.ctx.Err() != nil {
+		return http.ErrServerClosed
+	}
+
+	go s.dests.SweepEvery(s.ctx, time.Minute)
+
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
 		remoteIP := r.RemoteAddr
-		// Check rate limit: concurrent sessions per IP
-		if !s.rateLimiter.TryAcquireSession(remoteIP) {
-			log.Printf("Rate limited (sessions): %s", remoteIP)
+
+		if s.ctx.Err() != nil {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Authenticate before taking a session slot
+		clientCN, err := s.clientIdentity(r)
+		if err != nil {
+			slog.Warn("session rejected", "remote_ip", remoteIP, "err", err)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		var token *Token
+		if s.tokens != nil {
+			var err error
+			token, err = s.tokens.Acquire(tokenFromRequest(r), time.Now())
+			if err != nil {
+				slog.Warn("session rejected", "remote_ip", remoteIP, "err", err)
+				status := http.StatusUnauthorized
+				if err == errTokenSessions {
+					status = http.StatusTooManyRequests
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
+		// Check rate limit: concurrent sessions per IP (optionally waiting
+		// briefly for a slot held by a session that's still tearing down)
+		origin := r.Header.Get("Origin")
+		if !s.rateLimiter.AcquireSessionFrom(r.Context(), remoteIP, origin) {
+			slog.Warn("session rate limited", "remote_ip", remoteIP, "origin", origin)
+			if token != nil {
+				s.tokens.Release(token)
+			}
 			http.Error(w, "too many sessions", http.StatusTooManyRequests)
 			return
 		}
 
+		// The QUIC connection's context records why it closed (idle
+		// timeout, stateless reset, ...), which the session alone doesn't;
+		// the connection itself carries the session's datagrams
+		qc := sessionTransport{clientCN: clientCN, traceparent: r.Header.Get("traceparent")}
+		if h, ok := w.(http3.Hijacker); ok {
+			sc := h.StreamCreator()
+			qc.ctx = sc.Context()
+			if dc, ok := sc.(datagramConn); ok && sc.ConnectionState().SupportsDatagrams {
+				qc.dgram = dc
+			}
+		}
+		if hs, ok := r.Body.(http3.HTTPStreamer); ok {
+			qc.sessionID = uint64(hs.HTTPStream().StreamID())
+		}
+
 		session, err := wtServer.Upgrade(w, r)
 		if err != nil {
-			s.rateLimiter.ReleaseSession(remoteIP)
-			log.Printf("WebTransport upgrade failed: %v", err)
+			s.rateLimiter.ReleaseSessionFrom(remoteIP, origin)
+			if token != nil {
+				s.tokens.Release(token)
+			}
+			slog.Warn("webtransport upgrade failed", "remote_ip", remoteIP, "err", err)
 			return
 		}
-		s.handleSession(session, remoteIP)
+		s.handleSession(session, remoteIP, origin, token, qc, r.URL.Query())
 	})
 
-	log.Printf("friscy-proxy listening on https://localhost%s/connect", s.listen)
-	log.Printf("WebTransport ready for bidirectional networking")
+	slog.Info("friscy-proxy listening", "url", "https://localhost"+s.listen+"/connect")
 
-	return wtServer.ListenAndServe()
+	// Opened here rather than by ListenAndServe so a bind failure is
+	// known before /health reports the listener serving
+	pc := s.packetConn
+	if pc == nil {
+		var err error
+		if pc, err = net.ListenPacket("udp", s.listen); err != nil {
+			return err
+		}
+	}
+	s.serving.Store(true)
+	defer s.serving.Store(false)
+	return wtServer.Serve(pc)
 }
 
-func (s *Server) handleSession(wt *webtransport.Session, remoteIP string) {
-	ctx, cancel := context.WithCancel(context.Background())
+func (s *Server) handleSession(wt *webtransport.Session, remoteIP, origin string, token *Token, qc sessionTransport, query url.Values) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	cid := newCorrelationID()
 	session := &Session{
-		wt:          wt,
-		ctx:         ctx,
-		cancel:      cancel,
-		rateLimiter: s.rateLimiter,
-		remoteIP:    remoteIP,
+		logger:       slog.Default().With("session", cid, "remote_ip", remoteIP),
+		cid:          cid,
+		started:      time.Now(),
+		wt:           wt,
+		ctx:          ctx,
+		cancel:       cancel,
+		rateLimiter:  s.rateLimiter,
+		remoteIP:     remoteIP,
+		origin:       origin,
+		eventTimeout: s.eventTimeout,
+		closeDrain:   s.closeDrain,
+		readAhead:    s.readAhead,
+		maxMessage:   s.maxMessage,
+		listenGrace:  s.listenGrace,
+		maxListeners: s.maxListeners,
+		maxConns:     s.maxSessionConns,
+		token:        token,
+		srv:          s,
+
+		eventTimestamps: query.Get("event_ts") == "1",
+		openedEvents:    query.Get("opened") == "1",
+	}
+	if query.Get("acks") == "1" {
+		session.sendWindow = s.sendWindow
+	}
+	if s.maxStreams > 0 {
+		session.streams = make(chan struct{}, s.maxStreams)
+	}
+	if s.dnsRate > 0 {
+		session.dnsLimiter = newTokenBucket(s.dnsRate, s.dnsBurst)
+	}
+	if s.maxBandwidth > 0 {
+		session.sendLimiter = newTokenBucket(s.maxBandwidth, s.bandwidthBurst)
+		session.recvLimiter = newTokenBucket(s.maxBandwidth, s.bandwidthBurst)
+	}
+	session.quic = s.lookupQUICStats(wt.RemoteAddr())
+	session.clientCN = qc.clientCN
+	session.openEventStream()
+	if qc.dgram != nil {
+		s.attachDatagrams(qc.dgram, qc.sessionID, session)
+		session.datagrams = query.Get("datagrams") == "1"
+	}
+	session.id = s.nextSessionID.Add(1)
+	s.sessions.Store(session.id, session)
+	defer func() {
+		s.metrics.endedBytesSent.Add(session.bytesSent.Load())
+		s.metrics.endedBytesReceived.Add(session.bytesReceived.Load())
+		s.sessions.Delete(session.id)
+		s.dests.DropIdle(session.poolOwner())
+	}()
+
+	session.span = s.tracer.Start("session", qc.traceparent, SpanKindServer)
+	session.span.SetAttr("client.address", remoteIP)
+	session.span.SetAttr("friscy.session_id", session.id)
+
+	if token != nil {
+		defer s.tokens.Release(token)
+		if !token.Expires.IsZero() {
+			expiry := time.AfterFunc(time.Until(token.Expires), func() {
+				session.abort(ErrCodeTokenExpired, "token expired")
+			})
+			defer expiry.Stop()
+		}
 	}
 
-	log.Printf("New WebTransport session from %s", wt.RemoteAddr())
+	if session.clientCN != "" {
+		session.log().Info("session opened", "addr", wt.RemoteAddr(), "client", session.clientCN)
+	} else {
+		session.log().Info("session opened", "addr", wt.RemoteAddr())
+	}
+
+	if s.captureDir != "" {
+		rec, err := NewRecorder(s.captureDir, remoteIP, s.captureRedact)
+		if err != nil {
+			session.log().Error("capture disabled", "err", err)
+		} else {
+			session.capture = rec
+			defer rec.Close()
+		}
+	}
 
 	// Handle incoming streams (from container)
 	go session.acceptStreams()
 
-	// Note: Datagrams (UDP) would require quic-go datagram API access
-	// For now, UDP is tunneled over streams like TCP
+	if d := parseTransportStatsInterval(query.Get("transport_stats")); d > 0 && session.quic != nil {
+		go session.transportStatsLoop(d)
+	}
+	if s.idleTimeout > 0 || s.maxConnLifetime > 0 {
+		go session.janitor(s.idleTimeout, s.maxConnLifetime)
+	}
+	if s.heartbeatInterval > 0 {
+		session.heard()
+		go func() {
+			if session.heartbeatLoop(s.heartbeatInterval, s.heartbeatMisses) {
+				session.abort(ErrCodeHeartbeat, "heartbeat lost")
+			}
+		}()
+	}
 
 	// Wait for session to close
 	<-wt.Context().Done()
 	cancel()
+	reason := sessionCloseReason(wt, qc.ctx)
+	session.log().Info("session ended", "reason", reason)
+	defer func() {
+		session.span.SetAttr("friscy.close_reason", reason)
+		session.span.SetAttr("friscy.bytes_sent", session.bytesSent.Load())
+		session.span.SetAttr("friscy.bytes_received", session.bytesReceived.Load())
+		session.span.End()
+	}()
 
 	// Cleanup all connections
 	session.connections.Range(func(key, value interface{}) bool {
 		if conn, ok := value.(*Connection); ok {
-			conn.Close()
+			conn.teardown(session.log(), s.disconnectMode)
 		}
 		return true
 	})
 
-	s.rateLimiter.ReleaseSession(remoteIP)
-	log.Printf("WebTransport session closed (released session for %s)", remoteIP)
+	s.rateLimiter.ReleaseSessionFrom(remoteIP, origin)
+	session.log().Debug("session released")
 }
 
 func (sess *Session) acceptStreams() {
 	for {
 		stream, err := sess.wt.AcceptStream(sess.ctx)
 		if err != nil {
+			if sess.srv.ctx.Err() != nil {
+				// Shutdown: ending the session has handleSession tear
+				// down its connections
+				sess.abort(ErrCodeShutdown, "server shutting down")
+				return
+			}
 			if sess.ctx.Err() != nil {
 				return
 			}
-			log.Printf("AcceptStream error: %v", err)
+			// The session is still up but unusable; tell the client why
+			// rather than leaving it waiting on a dead session
+			sess.abort(ErrCodeInternal, fmt.Sprintf("accept stream: %v", err))
 			return
 		}
 
@@ -300,14 +702,25 @@ func (sess *Session) acceptStreams() {
 }
 
 func (sess *Session) handleStream(stream webtransport.Stream) {
+	if !sess.acquireStream(stream) {
+		return
+	}
+	defer sess.releaseStream()
 	defer stream.Close()
 
 	// Read message type
 	msgType, err := binary.ReadUvarint(byteReader{stream})
 	if err != nil {
-		log.Printf("Failed to read message type: %v", err)
+		sess.log().Warn("failed to read message type", "err", err)
 		return
 	}
+	sess.heard()
+
+	if sess.capture != nil {
+		tee := &teeStream{Stream: stream}
+		stream = tee
+		defer func() { sess.capture.recordRequest(byte(msgType), tee.buf.Bytes()) }()
+	}
 
 	switch msgType {
 	case MsgConnect:
@@ -320,497 +733,469 @@ func (sess *Session) handleStream(stream webtransport.Stream) {
 		sess.handleSend(stream)
 	case MsgClose:
 		sess.handleClose(stream)
+	case MsgSendTo:
+		sess.handleSendTo(stream)
+	case MsgForward:
+		sess.handleForward(stream)
+	case MsgSetPrio:
+		sess.handleSetPrio(stream)
+	case MsgFlush:
+		sess.handleFlush(stream)
+	case MsgSetTimeout:
+		sess.handleSetTimeout(stream)
+	case MsgCloseWrite:
+		sess.handleCloseWrite(stream)
+	case MsgSetOption:
+		sess.handleSetOption(stream)
+	case MsgGetName:
+		sess.handleGetName(stream)
+	case MsgResolve:
+		sess.handleResolve(stream)
+	case MsgShutdown:
+		sess.handleShutdown(stream)
+	case MsgPong:
+		sess.handlePong(stream)
+	case MsgListConns:
+		sess.handleListConns(stream)
 	default:
-		log.Printf("Unknown message type: %d", msgType)
+		sess.log().Warn("unknown message type", "msg_type", msgType)
 	}
 }
 
-func (sess *Session) handleConnect(stream webtransport.Stream) {
-	// Read: connID (4), sockType (1), hostLen (2), host, port (2)
-	var header [4 + 1 + 2]byte
-	if _, err := io.ReadFull(stream, header[:]); err != nil {
-		log.Printf("Connect: failed to read header: %v", err)
-		return
-	}
-
-	connID := binary.BigEndian.Uint32(header[0:4])
-	sockType := int(header[4])
-	hostLen := binary.BigEndian.Uint16(header[5:7])
-
-	hostBuf := make([]byte, hostLen+2)
-	if _, err := io.ReadFull(stream, hostBuf); err != nil {
-		log.Printf("Connect: failed to read host/port: %v", err)
-		return
-	}
-
-	host := string(hostBuf[:hostLen])
-	port := binary.BigEndian.Uint16(hostBuf[hostLen:])
-	addr := fmt.Sprintf("%s:%d", host, port)
-
-	log.Printf("[%d] Connect to %s (type=%d)", connID, addr, sockType)
-
-	// Block connections to private/loopback addresses (prevent SSRF)
-	if isPrivateAddr(host) {
-		log.Printf("[%d] Blocked connect to private address %s", connID, addr)
-		sess.sendEvent(MsgConnectError, connID, []byte("connection to private addresses not allowed"))
-		return
-	}
-
-	// Rate limit outbound connections per IP
-	if !sess.rateLimiter.TryConnection(sess.remoteIP) {
-		log.Printf("[%d] Rate limited (connections): %s", connID, sess.remoteIP)
-		sess.sendEvent(MsgConnectError, connID, []byte("daily connection limit exceeded"))
-		return
-	}
-
-	// Create connection
-	conn := &Connection{
-		id:       connID,
-		sockType: sockType,
+// sessionCloseReason explains why a finished session ended, preferring the
+// QUIC connection's error when the whole connection went away
+func sessionCloseReason(wt *webtransport.Session, connCtx context.Context) string {
+	if connCtx != nil && connCtx.Err() != nil {
+		if cause := context.Cause(connCtx); cause != nil && cause != context.Canceled {
+			return quicCloseReason(cause)
+		}
 	}
-	sess.connections.Store(connID, conn)
-
-	// Dial in goroutine
-	go func() {
-		var netConn net.Conn
-		var err error
 
-		if sockType == SOCK_STREAM {
-			netConn, err = net.DialTimeout("tcp", addr, 10*time.Second)
-		} else {
-			netConn, err = net.Dial("udp", addr)
+	// A closed session returns its close error from AcceptStream right away
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := wt.AcceptStream(done)
+	var connErr *webtransport.ConnectionError
+	if errors.As(err, &connErr) {
+		side := "proxy"
+		if connErr.Remote {
+			side = "client"
 		}
-
-		if err != nil {
-			log.Printf("[%d] Connect failed: %v", connID, err)
-			sess.sendEvent(MsgConnectError, connID, []byte(err.Error()))
-			sess.connections.Delete(connID)
-			return
+		if connErr.ErrorCode == 0 && connErr.Message == "" {
+			return fmt.Sprintf("closed by %s", side)
 		}
-
-		conn.mu.Lock()
-		if conn.closed.Load() {
-			netConn.Close()
-			conn.mu.Unlock()
-			return
-		}
-		conn.conn = netConn
-		conn.mu.Unlock()
-
-		log.Printf("[%d] Connected to %s", connID, addr)
-		sess.sendEvent(MsgConnected, connID, nil)
-
-		// Start reading from connection
-		go sess.readLoop(conn)
-	}()
-}
-
-func (sess *Session) handleBind(stream webtransport.Stream) {
-	// Read: connID (4), sockType (1), port (2)
-	var header [4 + 1 + 2]byte
-	if _, err := io.ReadFull(stream, header[:]); err != nil {
-		log.Printf("Bind: failed to read header: %v", err)
-		return
-	}
-
-	connID := binary.BigEndian.Uint32(header[0:4])
-	sockType := int(header[4])
-	port := binary.BigEndian.Uint16(header[5:7])
-
-	addr := fmt.Sprintf(":%d", port)
-	log.Printf("[%d] Bind to %s (type=%d)", connID, addr, sockType)
-
-	conn := &Connection{
-		id:       connID,
-		sockType: sockType,
+		return fmt.Sprintf("closed by %s (code 0x%x): %s", side, connErr.ErrorCode, connErr.Message)
 	}
+	return "session closed"
+}
 
-	var err error
-	if sockType == SOCK_STREAM {
-		conn.listener, err = net.Listen("tcp", addr)
-	} else {
-		conn.udpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+// quicCloseReason describes a QUIC connection-level error
+func quicCloseReason(err error) string {
+	var (
+		idleErr  *quic.IdleTimeoutError
+		hsErr    *quic.HandshakeTimeoutError
+		resetErr *quic.StatelessResetError
+		appErr   *quic.ApplicationError
+		tErr     *quic.TransportError
+	)
+	switch {
+	case errors.As(err, &idleErr):
+		return "QUIC idle timeout: nothing heard from the client (network lost, or an MTU black hole)"
+	case errors.As(err, &hsErr):
+		return "QUIC handshake timeout"
+	case errors.As(err, &resetErr):
+		return "QUIC stateless reset: the peer lost the connection's state"
+	case errors.As(err, &appErr):
+		return fmt.Sprintf("QUIC connection closed by %s (code 0x%x): %s", quicSide(appErr.Remote), uint64(appErr.ErrorCode), appErr.ErrorMessage)
+	case errors.As(err, &tErr):
+		return fmt.Sprintf("QUIC transport error from %s: %v", quicSide(tErr.Remote), tErr)
 	}
+	return fmt.Sprintf("QUIC connection error: %v", err)
+}
 
-	if err != nil {
-		log.Printf("[%d] Bind failed: %v", connID, err)
-		sess.sendEvent(MsgError, connID, []byte(err.Error()))
-		return
+func quicSide(remote bool) string {
+	if remote {
+		return "client"
 	}
+	return "proxy"
+}
 
-	sess.connections.Store(connID, conn)
-	sess.sendEvent(MsgConnected, connID, nil) // Bound successfully
+// abort tears down the session, passing the reason to the client in the
+// WebTransport close so it can tell a proxy-side kill from a network drop
+func (sess *Session) abort(code webtransport.SessionErrorCode, reason string) {
+	sess.log().Info("closing session", "reason", reason)
+	sess.cancel()
+	sess.wt.CloseWithError(code, reason)
 }
 
-func (sess *Session) handleListen(stream webtransport.Stream) {
-	// Read: connID (4), backlog (4)
-	var header [8]byte
-	if _, err := io.ReadFull(stream, header[:]); err != nil {
-		log.Printf("Listen: failed to read header: %v", err)
-		return
-	}
+// byteReader wraps an io.Reader to implement io.ByteReader
+type byteReader struct {
+	io.Reader
+}
 
-	connID := binary.BigEndian.Uint32(header[0:4])
+func (b byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	_, err := b.Read(buf[:])
+	return buf[0], err
+}
 
-	v, ok := sess.connections.Load(connID)
-	if !ok {
-		log.Printf("[%d] Listen: connection not found", connID)
-		return
-	}
-	conn := v.(*Connection)
+func main() {
+	listen := flag.String("listen", ":4433", "Address to listen on")
+	certFile := flag.String("cert", "cert.pem", "TLS certificate file")
+	keyFile := flag.String("key", "key.pem", "TLS key file")
+	certReload := flag.Duration("cert-reload-interval", defaultCertReloadInterval, "How often to check the cert and key files and reload them if changed (0 = never)")
+	maxSessions := flag.Int("max-sessions", 3, "Max concurrent sessions per IP")
+	maxConns := flag.Int("max-conns", 100, "Max outbound connections per IP in any 24 hours")
+	maxPulls := flag.Int("max-pulls", 2, "Max concurrent image pulls per IP")
+	maxPullsPerDay := flag.Int("max-pulls-per-day", 50, "Max image pulls per IP per day")
+	cacheDir := flag.String("cache-dir", "", "Directory to cache exported image tars in, by digest (empty = export on every pull)")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", defaultCacheMaxBytes, "Size above which -cache-dir drops least recently pulled images")
+	archOrder := flag.String("default-arch-order", archOrderKey(defaultArchOrder), "Comma-separated architectures /pull tries in turn when the client sends no ?arch=")
+	maxImageBytes := flag.Int64("max-image-bytes", 0, "Refuse to pull images whose compressed layers or flattened tar exceed this many bytes (0 = no limit)")
+	registryAuth := flag.String("registry-auth", "", "Docker config.json whose \"auths\" are used to pull from private registries")
+	origins := flag.String("origins", "", "Comma-separated allowed origins; https://*.example.com allows subdomains (empty = allow all)")
+	limitByOrigin := flag.Bool("limit-by-origin", false, "Apply -max-sessions and -max-conns per Origin header instead of per IP, for browsers behind a shared NAT (use with -origins)")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Minimum TLS version for both servers (1.2 or 1.3)")
+	tls13Only := flag.Bool("tls13-only", false, "Require TLS 1.3 on both servers")
+	tlsCiphers := flag.String("tls-ciphers", "", "Comma-separated TLS 1.2 cipher suite names (empty = Go defaults)")
+	clientCA := flag.String("client-ca", "", "PEM CA bundle; when set, /connect requires a client certificate issued by one of these CAs")
+	allowPorts := flag.String("allow-ports", "", "Comma-separated destination ports and ranges (e.g. 80,443,8000-8999) sessions may reach (empty = all)")
+	denyPorts := flag.String("deny-ports", "", "Comma-separated destination ports and ranges sessions may not reach; overrides -allow-ports")
+	blockCIDRs := flag.String("block-cidrs", "", "Comma-separated CIDRs sessions may never reach, in addition to the cloud metadata addresses")
+	geoipDB := flag.String("geoip-db", "", "MaxMind Country or City database (.mmdb) to check destination countries against -geo-allow/-geo-deny")
+	geoAllow := flag.String("geo-allow", "", "Comma-separated ISO country codes sessions may reach; others are refused (needs -geoip-db)")
+	geoDeny := flag.String("geo-deny", "", "Comma-separated ISO country codes sessions may never reach (needs -geoip-db)")
+	denyHosts := flag.String("deny-hosts", "", "Comma-separated hostnames, and *.domain patterns for the names below a domain, sessions may never reach")
+	denyHostsFile := flag.String("deny-hosts-file", "", "File of -deny-hosts entries, one per line (# comments), reread when it changes")
+	denyHostsReload := flag.Duration("deny-hosts-reload", defaultDenyHostsReload, "How often to check -deny-hosts-file for changes (0 = never)")
+	maxListeners := flag.Int("max-listeners-per-session", defaultMaxListeners, "Max sockets a session may hold open from MsgBind (0 = unlimited)")
+	maxSessionConns := flag.Int("max-conns-per-session", defaultMaxSessionConns, "Max dialed and accepted connections a session may hold open at once (0 = unlimited)")
+	maxStreams := flag.Int("max-streams-per-session", defaultMaxStreams, "Max request streams a session may have in progress at once; more are reset (0 = unlimited)")
+	reuseAddr := flag.Bool("reuse-addr", true, "Set SO_REUSEADDR on MsgBind sockets, so a restarted server can rebind a port with connections in TIME_WAIT")
+	reusePort := flag.Bool("reuse-port", false, "Let MsgBind ask for SO_REUSEPORT; sessions could then bind ports other sessions are using")
+	bindCIDRs := flag.String("bind-cidrs", defaultBindCIDRs, "Comma-separated CIDRs a session may name as its MsgBind address; binding all interfaces is always allowed")
+	eventTimeout := flag.Duration("event-timeout", defaultEventTimeout, "Drop a session whose client stops reading events for this long")
+	listenGrace := flag.Duration("listen-grace", defaultListenGrace, "How long a bound stream socket may wait for MsgListen before it's closed (0 = forever)")
+	closeDrain := flag.Duration("close-drain", defaultCloseDrain, "How long MsgClose keeps relaying data still arriving on a connection before closing it (0 = close at once)")
+	connectTimeout := flag.Duration("connect-timeout", defaultConnectTimeout, "How long an outbound connect may take, unless the container asks otherwise")
+	maxConnectTimeout := flag.Duration("max-connect-timeout", defaultMaxConnectTimeout, "Longest connect timeout a container may ask for (0 = no cap)")
+	minReadBuf := flag.Int("min-read-buf", defaultMinReadBuf, "Smallest read buffer a container may ask for with OptReadBuf, in bytes")
+	maxReadBuf := flag.Int("max-read-buf", defaultMaxReadBuf, "Largest read buffer a container may ask for with OptReadBuf, in bytes (at most 4MiB)")
+	sendWindow := flag.Int("send-window", defaultSendWindow, "Bytes of MsgSend credit each connection starts with for clients that ask for acks (0 = never ack)")
+	maxMessage := flag.Int("max-message-bytes", defaultMaxMessageBytes, "Largest MsgSend payload or MsgConnect host a request may claim; longer ones are refused before reading (0 = unlimited)")
+	readAhead := flag.Int("read-ahead", defaultReadAhead, "Reads (each up to the connection's read buffer) a connection may queue ahead of a slow client before it stops reading the socket (0 = none)")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP collector to export trace spans to, e.g. http://localhost:4318 (empty = no tracing)")
+	captureDir := flag.String("capture-dir", "", "Record every session's protocol messages to files in this directory")
+	captureRedact := flag.Bool("capture-redact", false, "Omit data payloads (MsgSend/MsgData) from captures")
+	dumpCapture := flag.String("dump-capture", "", "Pretty-print a capture file and exit")
+	readyProbe := flag.String("ready-probe", "", "host:port dialed by /ready to verify DNS and egress (empty = skip)")
+	socks5Listen := flag.String("socks5", "", "Also serve SOCKS5 CONNECT on this address, e.g. :1080, with the same policy as /connect (empty = off)")
+	tokenFile := flag.String("token-file", "", "JSON file of scoped session tokens; when set, /connect requires a token")
+	maxAcceptRate := flag.Int("max-accept-rate", 0, "Max connections accepted per second per bound listener (0 = unlimited)")
+	acceptPause := flag.Duration("accept-pause", time.Second, "How long a listener stops accepting after exceeding -max-accept-rate")
+	keepalive := flag.Duration("keepalive", defaultKeepalive.Idle, "TCP keepalive idle time and probe interval for dialed and accepted connections, so dead peers surface as MsgClosed (0 = off; OptKeepalive overrides per connection)")
+	coalesceDelay := flag.Duration("coalesce-delay", 0, "Default window for batching small sends into one write (0 = off; MsgConnect can override)")
+	sessionQueue := flag.Int("session-queue", 0, "Sessions per IP that may wait for a free slot instead of getting 429 (0 = no queue)")
+	sessionQueueWait := flag.Duration("session-queue-wait", 5*time.Second, "Max time a queued session waits for a slot")
+	apiTLS := flag.Bool("api-tls", false, "Serve the API over TLS using -cert/-key instead of plain HTTP")
+	apiListen := flag.String("api-listen", ":4434", "Address for the API server (image pulls, /health, /metrics, /admin)")
+	apiDisable := flag.Bool("api-disable", false, "Don't run the API server at all; image pulls, /health, /metrics and /admin go with it")
+	unixSockets := flag.String("unix-sockets", "", "Comma-separated Unix socket paths containers may connect to with SOCK_UNIX, @name for abstract sockets (empty = none)")
+	upstreamProxy := flag.String("upstream-proxy", "", "Make outbound TCP connections through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (empty = dial directly)")
+	upstreamTLSInsecure := flag.Bool("upstream-tls-insecure", false, "Let containers skip upstream certificate verification when originating TLS (testing only)")
+	maxQueryLen := flag.Int("max-query-len", defaultMaxQueryLen, "Longest image reference or search query accepted by the API")
+	dnsCacheTTL := flag.Duration("dns-cache-ttl", defaultDNSTTL, "How long resolved destination addresses are reused (0 = resolve every connect)")
+	breakerFailures := flag.Int("breaker-failures", defaultBreakerFailures, "Consecutive failed dials before a destination is rejected for -breaker-cooldown (0 = never)")
+	breakerCooldown := flag.Duration("breaker-cooldown", defaultBreakerCooldown, "How long a failing destination is rejected")
+	poolMax := flag.Int("pool-max", defaultPoolMax, "Idle OptPool connections kept per destination (0 = no pooling)")
+	poolIdle := flag.Duration("pool-idle", defaultPoolIdle, "How long an idle OptPool connection is kept for its session's next connect to the same destination")
+	dnsRate := flag.Float64("dns-rate", 0, "Hostname lookups per second allowed per session (0 = unlimited)")
+	dnsBurst := flag.Int("dns-burst", defaultDNSBurst, "Lookups a session may make in a burst above -dns-rate")
+	maxBandwidth := flag.Float64("max-bandwidth", 0, "Bytes per second each session may send, and receive, across its connections (0 = unlimited)")
+	bandwidthBurst := flag.Int("bandwidth-burst", defaultBandwidthBurst, "Bytes a session may move in a burst above -max-bandwidth")
+	adminToken := flag.String("admin-token", "", "Bearer token for the API server's /admin endpoints and /dashboard (empty = both disabled)")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "Send MsgPing to sessions quiet for this long, closing those that miss -heartbeat-misses in a row; containers must answer with MsgPong (0 = off)")
+	heartbeatMisses := flag.Int("heartbeat-misses", defaultHeartbeatMisses, "Unanswered MsgPings in a row that close a session")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close connections that carry no data in either direction for this long (0 = never; listeners are exempt)")
+	maxConnLifetime := flag.Duration("max-conn-lifetime", 0, "Close any connection, busy or not, after it has been open this long (0 = unlimited)")
+	disconnectMode := flag.String("disconnect-mode", DisconnectAuto, "On session loss: auto (reset connections mid-transfer, close idle ones), graceful or abort")
+	runAsUser := flag.String("user", "", "Drop to this user (name or uid) after binding listeners; requires starting as root")
+	runAsGroup := flag.String("group", "", "Drop to this group (name or gid) after binding; default is -user's primary group")
+	rateState := flag.String("ratelimit-state", "", "File to save per-IP daily connection counts to on shutdown and restore them from on startup")
+	v4Prefix := flag.Int("ratelimit-v4-prefix", 32, "Count IPv4 clients in the same network of this prefix length as one (32 = per address)")
+	v6Prefix := flag.Int("ratelimit-v6-prefix", 128, "Count IPv6 clients in the same network of this prefix length as one, e.g. 64 (128 = per address)")
+	rateExempt := flag.String("ratelimit-exempt", "", "Comma-separated CIDRs of clients never rate limited, e.g. monitoring (empty = none)")
+	sweepInterval := flag.Duration("ratelimit-sweep-interval", 10*time.Minute, "How often to forget rate-limit counters whose daily window has reset")
+	rateStateInterval := flag.Duration("ratelimit-save-interval", defaultRateStateInterval, "How often to also save -ratelimit-state while running (0 = only on shutdown)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "On SIGINT/SIGTERM, how long to let sessions and API requests drain before closing")
+	pprofListen := flag.String("pprof", "", "Loopback address (e.g. 127.0.0.1:6060) to serve /debug/pprof/ and /debug/stats on (empty = off)")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error (debug logs every read and write)")
+	flag.Parse()
 
-	if conn.listener == nil {
-		log.Printf("[%d] Listen: not a listening socket", connID)
-		return
+	logger, err := newLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
 
-	log.Printf("[%d] Listening for connections", connID)
-
-	// Accept incoming connections
-	go func() {
-		for {
-			netConn, err := conn.listener.Accept()
-			if err != nil {
-				if conn.closed.Load() {
-					return
-				}
-				log.Printf("[%d] Accept error: %v", connID, err)
-				continue
-			}
-
-			// Create new connection for the accepted socket
-			newConnID := sess.nextConnID.Add(1)
-			newConn := &Connection{
-				id:       newConnID,
-				sockType: SOCK_STREAM,
-				conn:     netConn,
-			}
-			sess.connections.Store(newConnID, newConn)
-
-			remoteAddr := netConn.RemoteAddr().String()
-			log.Printf("[%d] Accepted connection from %s -> new conn %d", connID, remoteAddr, newConnID)
-
-			// Notify container of new connection
-			// Format: listenerConnID (4), newConnID (4), addrLen (2), addr
-			addrBytes := []byte(remoteAddr)
-			payload := make([]byte, 4+4+2+len(addrBytes))
-			binary.BigEndian.PutUint32(payload[0:4], connID)
-			binary.BigEndian.PutUint32(payload[4:8], newConnID)
-			binary.BigEndian.PutUint16(payload[8:10], uint16(len(addrBytes)))
-			copy(payload[10:], addrBytes)
-
-			sess.sendEvent(MsgAccept, newConnID, payload)
-
-			// Start reading from new connection
-			go sess.readLoop(newConn)
+	if *dumpCapture != "" {
+		f, err := os.Open(*dumpCapture)
+		if err != nil {
+			fatal("-dump-capture", "err", err)
+		}
+		defer f.Close()
+		if err := DumpCapture(os.Stdout, f); err != nil {
+			fatal("-dump-capture", "err", err)
 		}
-	}()
-}
-
-func (sess *Session) handleSend(stream webtransport.Stream) {
-	// Read: connID (4), dataLen (4), data
-	var header [8]byte
-	if _, err := io.ReadFull(stream, header[:]); err != nil {
-		log.Printf("Send: failed to read header: %v", err)
 		return
 	}
 
-	connID := binary.BigEndian.Uint32(header[0:4])
-	dataLen := binary.BigEndian.Uint32(header[4:8])
-
-	data := make([]byte, dataLen)
-	if _, err := io.ReadFull(stream, data); err != nil {
-		log.Printf("Send: failed to read data: %v", err)
-		return
+	tlsPolicy, err := ParseTLSPolicy(*tlsMinVersion, *tls13Only, *tlsCiphers)
+	if err != nil {
+		fatal("invalid TLS settings", "err", err)
 	}
-
-	v, ok := sess.connections.Load(connID)
-	if !ok {
-		return
+	portPolicy, err := ParsePortPolicy(*allowPorts, *denyPorts)
+	if err != nil {
+		fatal("invalid port policy", "err", err)
 	}
-	conn := v.(*Connection)
-
-	conn.mu.Lock()
-	netConn := conn.conn
-	conn.mu.Unlock()
-
-	if netConn == nil {
-		return
+	blockedNets, err := ParseCIDRs(*blockCIDRs)
+	if err != nil {
+		fatal("-block-cidrs", "err", err)
 	}
-
-	if _, err := netConn.Write(data); err != nil {
-		log.Printf("[%d] Send error: %v", connID, err)
+	geo, err := newGeoFilter(*geoipDB, *geoAllow, *geoDeny)
+	if err != nil {
+		fatal("geoip", "err", err)
 	}
-}
-
-func (sess *Session) handleClose(stream webtransport.Stream) {
-	// Read: connID (4)
-	var header [4]byte
-	if _, err := io.ReadFull(stream, header[:]); err != nil {
-		return
+	deniedHosts, err := newHostDenyList(*denyHosts, *denyHostsFile)
+	if err != nil {
+		fatal("-deny-hosts", "err", err)
 	}
-
-	connID := binary.BigEndian.Uint32(header[0:4])
-	log.Printf("[%d] Close", connID)
-
-	if v, ok := sess.connections.LoadAndDelete(connID); ok {
-		conn := v.(*Connection)
-		conn.Close()
+	bindNets, err := ParseCIDRs(*bindCIDRs)
+	if err != nil {
+		fatal("-bind-cidrs", "err", err)
 	}
 
-	sess.sendEvent(MsgClosed, connID, nil)
-}
-
-func (sess *Session) readLoop(conn *Connection) {
-	buf := make([]byte, 65536)
-
-	for {
-		if conn.closed.Load() {
-			return
-		}
-
-		conn.mu.Lock()
-		netConn := conn.conn
-		conn.mu.Unlock()
-
-		if netConn == nil {
-			return
+	rl := NewRateLimiter(*maxSessions, *maxConns)
+	rl.EnableSessionQueue(*sessionQueue, *sessionQueueWait)
+	if err := rl.GroupByPrefix(*v4Prefix, *v6Prefix); err != nil {
+		fatal("-ratelimit-v4-prefix/-ratelimit-v6-prefix", "err", err)
+	}
+	exemptNets, err := ParseCIDRs(*rateExempt)
+	if err != nil {
+		fatal("-ratelimit-exempt", "err", err)
+	}
+	rl.Exempt(exemptNets)
+	if *limitByOrigin {
+		if *origins == "" {
+			slog.Warn("-limit-by-origin without -origins lets clients pick their own rate-limit bucket")
 		}
-
-		netConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		n, err := netConn.Read(buf)
-
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			if err == io.EOF || conn.closed.Load() {
-				sess.sendEvent(MsgClosed, conn.id, nil)
-				return
-			}
-			log.Printf("[%d] Read error: %v", conn.id, err)
-			sess.sendEvent(MsgClosed, conn.id, nil)
-			return
+		rl.LimitByOrigin()
+	}
+	if *rateState != "" {
+		if err := rl.LoadState(*rateState); err != nil {
+			// Start with fresh counters rather than refusing to come up
+			slog.Warn("ignoring rate-limit state", "err", err)
 		}
+	}
 
-		if n > 0 {
-			data := make([]byte, n)
-			copy(data, buf[:n])
-			sess.sendEvent(MsgData, conn.id, data)
+	var originList []string
+	if *origins != "" {
+		for _, o := range strings.Split(*origins, ",") {
+			originList = append(originList, strings.TrimSpace(o))
 		}
 	}
-}
 
-
-func (sess *Session) sendEvent(msgType byte, connID uint32, data []byte) {
-	sess.streamMu.Lock()
-	defer sess.streamMu.Unlock()
-
-	stream, err := sess.wt.OpenUniStream()
-	if err != nil {
-		log.Printf("Failed to open stream for event: %v", err)
-		return
+	server := NewServer(*listen, *certFile, *keyFile, rl, originList)
+	server.tlsPolicy = tlsPolicy
+	if *clientCA != "" {
+		if server.clientCAs, err = LoadClientCAs(*clientCA); err != nil {
+			fatal("failed to load -client-ca", "err", err)
+		}
 	}
-	defer stream.Close()
-
-	// Write: msgType (1), connID (4), dataLen (4), data
-	header := make([]byte, 1+4+4)
-	header[0] = msgType
-	binary.BigEndian.PutUint32(header[1:5], connID)
-	binary.BigEndian.PutUint32(header[5:9], uint32(len(data)))
-
-	stream.Write(header)
-	if len(data) > 0 {
-		stream.Write(data)
+	server.ports = portPolicy
+	server.bindNets = bindNets
+	server.maxListeners = max(*maxListeners, 0)
+	server.maxSessionConns = max(*maxSessionConns, 0)
+	server.maxStreams = max(*maxStreams, 0)
+	server.noReuseAddr = !*reuseAddr
+	server.reusePort = *reusePort
+	server.pullLimiter = NewRateLimiter(*maxPulls, *maxPullsPerDay)
+	server.pullLimiter.GroupByPrefix(*v4Prefix, *v6Prefix) // validated above
+	server.pullLimiter.Exempt(exemptNets)
+	server.apiTLS = *apiTLS
+	server.eventTimeout = *eventTimeout
+	server.closeDrain = *closeDrain
+	server.listenGrace = *listenGrace
+	server.readAhead = max(*readAhead, 0)
+	server.maxMessage = max(*maxMessage, 0)
+	server.sendWindow = max(*sendWindow, 0)
+	server.defaultConnectTimeout = *connectTimeout
+	server.maxConnectTimeout = *maxConnectTimeout
+	server.minReadBuf = max(*minReadBuf, 0)
+	server.maxReadBuf = max(*maxReadBuf, 0)
+	server.captureDir = *captureDir
+	if server.tracer, err = NewTracer(*otelEndpoint); err != nil {
+		fatal("-otel-endpoint", "err", err)
 	}
-}
-
-func (c *Connection) Close() {
-	if c.closed.Swap(true) {
-		return // Already closed
+	server.captureRedact = *captureRedact
+	server.readiness = NewReadinessChecker(*readyProbe)
+	server.maxAcceptRate = *maxAcceptRate
+	server.acceptPause = *acceptPause
+	server.coalesceDelay = min(*coalesceDelay, maxCoalesceDelay)
+	server.keepalive = keepaliveConfig(*keepalive)
+	server.upstreamTLSInsecure = *upstreamTLSInsecure
+	if server.unixSockets, err = parseUnixSockets(*unixSockets); err != nil {
+		fatal("-unix-sockets", "err", err)
 	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.conn != nil {
-		c.conn.Close()
+	server.maxQueryLen = *maxQueryLen
+	server.dests.dnsTTL = *dnsCacheTTL
+	server.dests.breakerFailures = *breakerFailures
+	server.dests.breakerCooldown = *breakerCooldown
+	server.dests.poolMax = *poolMax
+	server.dests.poolIdle = *poolIdle
+	server.dests.blocked = append(server.dests.blocked, blockedNets...)
+	server.dests.geo = geo
+	server.dests.denied = deniedHosts
+	if *upstreamProxy != "" {
+		if server.dests.dial, err = upstreamDialer(*upstreamProxy); err != nil {
+			fatal("-upstream-proxy", "err", err)
+		}
 	}
-	if c.listener != nil {
-		c.listener.Close()
+	server.dnsRate = *dnsRate
+	server.dnsBurst = max(*dnsBurst, 1)
+	server.maxBandwidth = *maxBandwidth
+	server.bandwidthBurst = max(*bandwidthBurst, 1)
+	server.adminToken = *adminToken
+	server.shutdownTimeout = *shutdownTimeout
+	server.idleTimeout = *idleTimeout
+	server.heartbeatInterval = *heartbeatInterval
+	server.heartbeatMisses = max(*heartbeatMisses, 1)
+	server.maxConnLifetime = *maxConnLifetime
+	if server.disconnectMode, err = parseDisconnectMode(*disconnectMode); err != nil {
+		fatal("-disconnect-mode", "err", err)
 	}
-	if c.udpConn != nil {
-		c.udpConn.Close()
+	if *tokenFile != "" {
+		tokens, err := LoadTokenStore(*tokenFile)
+		if err != nil {
+			fatal("failed to load tokens", "err", err)
+		}
+		server.tokens = tokens
 	}
-}
-
-// isPrivateAddr checks if a host resolves to a private/loopback address (SSRF protection)
-func isPrivateAddr(host string) bool {
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		// If we can't resolve, allow (the connection will fail naturally)
-		return false
+	server.maxImageBytes = *maxImageBytes
+	if server.archOrder, err = parseArchOrder(*archOrder); err != nil {
+		fatal("-default-arch-order", "err", err)
 	}
-	for _, ip := range ips {
-		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-			return true
+	if *registryAuth != "" {
+		if server.registryAuth, err = LoadRegistryKeychain(*registryAuth); err != nil {
+			fatal("failed to load registry credentials", "err", err)
 		}
 	}
-	return false
-}
-
-// --- Docker Pull API (HTTP on :4434, behind Caddy reverse proxy) ---
-
-func (s *Server) RunAPIServer(apiListen string) error {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/pull", s.handleDockerPull)
-	mux.HandleFunc("/search", s.handleDockerSearch)
-
-	// Health check (CORS handled by Caddy reverse proxy)
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok"))
-	})
 
-	srv := &http.Server{
-		Addr:         apiListen,
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 10 * time.Minute, // large images take time to stream
+	// Bound up front, like the other listeners, so it survives -user
+	var socksLn net.Listener
+	if *socks5Listen != "" {
+		if socksLn, err = net.Listen("tcp", *socks5Listen); err != nil {
+			fatal("failed to listen for SOCKS5", "err", err)
+		}
 	}
 
-	log.Printf("API server listening on http://0.0.0.0%s (behind reverse proxy)", apiListen)
-	return srv.ListenAndServe()
-}
-
-func (s *Server) corsHeaders(w http.ResponseWriter) {
-	// CORS allow-origin/methods/headers handled by Caddy; only expose-headers needed here
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Image-Name")
-}
-
-func (s *Server) handleDockerPull(w http.ResponseWriter, r *http.Request) {
-	s.corsHeaders(w)
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusNoContent)
-		return
+	var debugLn net.Listener
+	if *pprofListen != "" {
+		if err := checkLoopback(*pprofListen); err != nil {
+			fatal("-pprof", "err", err)
+		}
+		if debugLn, err = net.Listen("tcp", *pprofListen); err != nil {
+			fatal("failed to listen for -pprof", "err", err)
+		}
 	}
 
-	imageRef := r.URL.Query().Get("image")
-	if imageRef == "" {
-		http.Error(w, "missing ?image= parameter", http.StatusBadRequest)
-		return
+	// Open privileged sockets while still root, then give root up
+	if *runAsUser != "" || *runAsGroup != "" {
+		uid, gid, err := lookupIDs(*runAsUser, *runAsGroup)
+		if err != nil {
+			fatal("invalid -user/-group", "err", err)
+		}
+		apiAddr := *apiListen
+		if *apiDisable {
+			apiAddr = ""
+		}
+		if err := server.Bind(apiAddr); err != nil {
+			fatal("failed to bind listeners", "err", err)
+		}
+		if err := dropPrivileges(uid, gid); err != nil {
+			fatal("failed to drop privileges", "err", err)
+		}
+		slog.Info("dropped privileges", "uid", uid, "gid", gid)
 	}
 
-	// Validate image reference
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid image reference: %v", err), http.StatusBadRequest)
-		return
+	// Opened as the user it will be written as
+	if *cacheDir != "" {
+		if server.imageCache, err = OpenImageCache(*cacheDir, *cacheMaxBytes); err != nil {
+			fatal("-cache-dir", "err", err)
+		}
 	}
 
-	log.Printf("[API] Pull request: %s", ref.String())
-
-	// Rate limit: reuse connection rate limiter
-	remoteIP := r.RemoteAddr
-	if !s.rateLimiter.TryConnection(remoteIP) {
-		http.Error(w, "daily pull limit exceeded", http.StatusTooManyRequests)
-		return
+	// Drain on SIGINT/SIGTERM; a second signal kills the process outright
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *sweepInterval > 0 {
+		go rl.SweepEvery(ctx, *sweepInterval)
+		go server.pullLimiter.SweepEvery(ctx, *sweepInterval)
 	}
-
-	// Try riscv64 first, fall back to amd64
-	platform := v1.Platform{Architecture: "riscv64", OS: "linux"}
-	img, err := remote.Image(ref, remote.WithPlatform(platform))
-	if err != nil {
-		log.Printf("[API] riscv64 not available for %s, trying amd64: %v", imageRef, err)
-		platform = v1.Platform{Architecture: "amd64", OS: "linux"}
-		img, err = remote.Image(ref, remote.WithPlatform(platform))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to pull image: %v", err), http.StatusInternalServerError)
-			return
-		}
+	if *rateState != "" && *rateStateInterval > 0 {
+		go rl.SaveStateEvery(ctx, *rateState, *rateStateInterval)
 	}
-
-	log.Printf("[API] Pulled %s (%s), exporting as tar...", imageRef, platform.Architecture)
-
-	w.Header().Set("Content-Type", "application/x-tar")
-	w.Header().Set("X-Image-Name", imageRef)
-	w.Header().Set("X-Image-Arch", platform.Architecture)
-
-	// Export flattened filesystem as tar directly to response
-	if err := crane.Export(img, w); err != nil {
-		log.Printf("[API] Export error for %s: %v", imageRef, err)
-		// Can't set status code after streaming started
-		return
+	if *certReload > 0 {
+		go server.WatchCertEvery(ctx, *certReload)
 	}
-
-	log.Printf("[API] Finished exporting %s", imageRef)
-}
-
-func (s *Server) handleDockerSearch(w http.ResponseWriter, r *http.Request) {
-	s.corsHeaders(w)
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusNoContent)
-		return
+	if *denyHostsFile != "" && *denyHostsReload > 0 {
+		go deniedHosts.WatchEvery(ctx, *denyHostsReload)
 	}
+	drained := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		stop()
+		server.Shutdown()
+		close(drained)
+	}()
 
-	q := r.URL.Query().Get("q")
-	if q == "" {
-		http.Error(w, "missing ?q= parameter", http.StatusBadRequest)
-		return
+	// Start API server (Docker pull) in background
+	if *apiDisable {
+		slog.Info("API server disabled")
+	} else {
+		go func() {
+			if err := server.RunAPIServer(*apiListen); err != nil && err != http.ErrServerClosed {
+				fatal("API server failed", "err", err)
+			}
+		}()
 	}
 
-	// Proxy Docker Hub search API
-	url := fmt.Sprintf("https://hub.docker.com/v2/search/repositories/?query=%s&page_size=20", q)
-	resp, err := http.Get(url)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("search failed: %v", err), http.StatusBadGateway)
-		return
+	if socksLn != nil {
+		go func() {
+			if err := server.ServeSOCKS5(socksLn); err != nil {
+				fatal("SOCKS5 server failed", "err", err)
+			}
+		}()
 	}
-	defer resp.Body.Close()
-
-	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, resp.Body)
-}
-
-// byteReader wraps an io.Reader to implement io.ByteReader
-type byteReader struct {
-	io.Reader
-}
-
-func (b byteReader) ReadByte() (byte, error) {
-	var buf [1]byte
-	_, err := b.Read(buf[:])
-	return buf[0], err
-}
 
-func main() {
-	listen := flag.String("listen", ":4433", "Address to listen on")
-	certFile := flag.String("cert", "cert.pem", "TLS certificate file")
-	keyFile := flag.String("key", "key.pem", "TLS key file")
-	maxSessions := flag.Int("max-sessions", 3, "Max concurrent sessions per IP")
-	maxConns := flag.Int("max-conns", 100, "Max outbound connections per IP per day")
-	origins := flag.String("origins", "", "Comma-separated allowed origins (empty = allow all)")
-	flag.Parse()
-
-	rl := NewRateLimiter(*maxSessions, *maxConns)
-
-	var originList []string
-	if *origins != "" {
-		for _, o := range strings.Split(*origins, ",") {
-			originList = append(originList, strings.TrimSpace(o))
-		}
+	if debugLn != nil {
+		go func() {
+			if err := server.ServeDebug(debugLn); err != nil {
+				fatal("debug server failed", "err", err)
+			}
+		}()
 	}
 
-	server := NewServer(*listen, *certFile, *keyFile, rl, originList)
+	if err := server.Run(); err != nil && err != http.ErrServerClosed {
+		fatal("server failed", "err", err)
+	}
+	<-drained
 
-	// Start API server (Docker pull) on :4434 in background
-	go func() {
-		if err := server.RunAPIServer(":4434"); err != nil {
-			log.Fatalf("API server failed: %v", err)
+	if *rateState != "" {
+		if err := rl.SaveState(*rateState); err != nil {
+			slog.Error("failed to save rate-limit state", "err", err)
 		}
-	}()
-
-	if err := server.Run(); err != nil {
-		log.Fatal(err)
 	}
 }
@@ -0,0 +1,52 @@
+// metrics.go - Counters exported on the API server's /metrics
+//
+// Plain Prometheus text exposition; no client library needed for a handful
+// of counters.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics holds process-wide counters
+type Metrics struct {
+	dnsQueries  atomic.Int64 // by-name lookups requested by sessions
+	dnsRejected atomic.Int64 // lookups refused by the per-session DNS rate limit
+
+	// OptCompress: raw bytes in, framed bytes out and time spent, per direction
+	compressRawBytes    atomic.Int64
+	compressWireBytes   atomic.Int64
+	compressNanos       atomic.Int64
+	decompressRawBytes  atomic.Int64
+	decompressWireBytes atomic.Int64
+	decompressNanos     atomic.Int64
+
+	bandwidthWaitNanos atomic.Int64 // time sessions spent held back by -max-bandwidth
+
+	streamsRejected atomic.Int64 // request streams reset by -max-streams-per-session
+
+	// Bytes moved by sessions that have ended, for /admin/dashboard's totals
+	endedBytesSent     atomic.Int64
+	endedBytesReceived atomic.Int64
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "friscy_dns_queries_total", "Hostname lookups requested by sessions.", s.metrics.dnsQueries.Load())
+	writeCounter(w, "friscy_dns_queries_rejected_total", "Lookups rejected by the per-session DNS rate limit.", s.metrics.dnsRejected.Load())
+	writeCounter(w, "friscy_compress_raw_bytes_total", "MsgData bytes before compression.", s.metrics.compressRawBytes.Load())
+	writeCounter(w, "friscy_compress_wire_bytes_total", "MsgData bytes after compression.", s.metrics.compressWireBytes.Load())
+	writeCounter(w, "friscy_compress_nanoseconds_total", "Time spent compressing MsgData.", s.metrics.compressNanos.Load())
+	writeCounter(w, "friscy_decompress_raw_bytes_total", "MsgSend bytes after decompression.", s.metrics.decompressRawBytes.Load())
+	writeCounter(w, "friscy_decompress_wire_bytes_total", "MsgSend bytes before decompression.", s.metrics.decompressWireBytes.Load())
+	writeCounter(w, "friscy_decompress_nanoseconds_total", "Time spent decompressing MsgSend.", s.metrics.decompressNanos.Load())
+	writeCounter(w, "friscy_bandwidth_wait_nanoseconds_total", "Time sessions spent waiting on the -max-bandwidth limit.", s.metrics.bandwidthWaitNanos.Load())
+	writeCounter(w, "friscy_streams_rejected_total", "Request streams reset by the -max-streams-per-session limit.", s.metrics.streamsRejected.Load())
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
@@ -0,0 +1,61 @@
+// mmdb.go - Country lookups in MaxMind DB files
+//
+// -geoip-db takes a GeoLite2/GeoIP2 Country (or City) database in the
+// MaxMind DB format. The file is read into memory at startup and decoded
+// by MaxMind's maintained reader, which validates the search tree and data
+// section of what is, to the proxy, an untrusted binary file. Only the
+// country fields of each record are decoded.
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbReader is an opened MaxMind DB
+type mmdbReader struct {
+	db *maxminddb.Reader
+}
+
+// mmdbCountry is the part of a Country or City record a lookup needs
+type mmdbCountry struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// openMMDB reads the database at path
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(buf)
+}
+
+func parseMMDB(buf []byte) (*mmdbReader, error) {
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbReader{db: db}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country ip is in, or
+// registered to, or "" if the database doesn't say
+func (r *mmdbReader) Country(ip net.IP) (string, error) {
+	var rec mmdbCountry
+	if err := r.db.Lookup(ip, &rec); err != nil {
+		return "", err
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode, nil
+	}
+	return rec.RegisteredCountry.ISOCode, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+// testdata/country.mmdb is a small IPv6 database in MaxMind's layout:
+//
+//	198.51.100.0/24  country.iso_code DE
+//	203.0.113.0/25   registered_country.iso_code US, and no country
+//	2001:db8::/32    country, a pointer to the DE map above
+func TestMMDBCountry(t *testing.T) {
+	db, err := openMMDB("testdata/country.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]string{
+		"198.51.100.7":  "DE",
+		"203.0.113.9":   "US", // registered_country only
+		"203.0.113.200": "",   // outside the /25
+		"2001:db8::1":   "DE", // via a pointer
+		"2001:db9::1":   "",
+		"192.0.2.1":     "",
+	} {
+		if got, err := db.Country(net.ParseIP(ip)); err != nil || got != want {
+			t.Errorf("Country(%s) = %q, %v, want %q", ip, got, err, want)
+		}
+	}
+
+	buf, err := os.ReadFile("testdata/country.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMMDB([]byte("not a database")); err == nil {
+		t.Error("parsed garbage")
+	}
+	if _, err := parseMMDB(buf[len(buf)-60:]); err == nil {
+		t.Error("parsed a truncated database")
+	}
+}
@@ -0,0 +1,39 @@
+// msgsize.go - Cap on the lengths a request claims
+//
+// MsgSend carries a 4-byte data length and handleSend allocates that much
+// before reading, so one header claiming 4GiB could exhaust the proxy's
+// memory before any data arrived. With -max-message-bytes, a request whose
+// length field is over the cap is refused before anything is allocated:
+// its stream is reset with StreamErrTooLarge, unread, and the container
+// gets a MsgError for the connection. MsgConnect's host length is held to
+// the same cap, ahead of the tighter bound every destination host gets
+// (hostname.go).
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// defaultMaxMessageBytes is the largest MsgSend payload accepted
+const defaultMaxMessageBytes = 16 << 20
+
+// StreamErrTooLarge resets a request stream whose length field is over
+// -max-message-bytes
+const StreamErrTooLarge webtransport.StreamErrorCode = 0x02
+
+// checkMessageLen refuses a request claiming n bytes of what if that's
+// over the session's cap, resetting its stream and sending MsgError.
+// Sessions without a cap accept any length.
+func (sess *Session) checkMessageLen(stream webtransport.Stream, connID uint32, what string, n int) bool {
+	if sess.maxMessage <= 0 || n <= sess.maxMessage {
+		return true
+	}
+	stream.CancelRead(StreamErrTooLarge)
+	stream.CancelWrite(StreamErrTooLarge)
+	sess.log().Warn("request refused: too large", "conn_id", connID, "field", what, "len", n, "limit", sess.maxMessage)
+	sess.sendEvent(MsgError, connID, fmt.Appendf(nil, "%s of %d bytes is over the %d byte limit", what, n, sess.maxMessage))
+	return false
+}
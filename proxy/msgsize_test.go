@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+)
+
+func TestMaxMessageBytes(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.maxMessage = 1024 })
+
+	refused := func(name string, stream *fakeStream, handle func()) {
+		t.Helper()
+		done := make(chan uint64)
+		go func() {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			handle()
+			runtime.ReadMemStats(&after)
+			done <- after.TotalAlloc - before.TotalAlloc
+		}()
+		ev, err := readEvent(pr, false)
+		if err != nil || ev.msgType != MsgError || ev.connID != 7 {
+			t.Fatalf("%s: got event %#x conn %d %q, %v, want MsgError", name, ev.msgType, ev.connID, ev.data, err)
+		}
+		if n := <-done; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes for a refused request", name, n)
+		}
+		for range 2 {
+			if code := <-stream.reset; code != StreamErrTooLarge {
+				t.Errorf("%s: reset with %#x, want StreamErrTooLarge", name, code)
+			}
+		}
+	}
+
+	// A 4GiB claim with nothing behind it
+	req := binary.BigEndian.AppendUint32(nil, 7)
+	req = binary.BigEndian.AppendUint32(req, 0xFFFFFFFF)
+	stream := newFakeStream(bytes.NewReader(req))
+	refused("send", stream, func() { sess.handleSend(stream) })
+
+	req = binary.BigEndian.AppendUint32(nil, 7)
+	req = append(req, SOCK_STREAM)
+	req = binary.BigEndian.AppendUint16(req, 2000)
+	stream = newFakeStream(bytes.NewReader(req))
+	refused("connect", stream, func() { sess.handleConnect(stream) })
+
+	// At the limit is fine; the connection doesn't exist, so no event
+	req = binary.BigEndian.AppendUint32(nil, 7)
+	req = binary.BigEndian.AppendUint32(req, 1024)
+	req = append(req, make([]byte, 1024)...)
+	stream = newFakeStream(bytes.NewReader(req))
+	sess.handleSend(stream)
+	if len(stream.reset) != 0 {
+		t.Error("send at the limit was reset")
+	}
+}
@@ -0,0 +1,130 @@
+// opened.go - MsgOpened: one authoritative summary of a connection's setup
+//
+// MsgConnected only says "it worked". Sessions that connect with
+// /connect?opened=1 also get MsgOpened once per connection (outbound,
+// bound and accepted), carrying a JSON ConnInfo with the parameters the
+// proxy actually applied, after defaults, clamping and connect options.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// TCP keepalive for dialed and accepted sockets when -keepalive is left at
+// its default and no connect option overrides it; these are Go's own values
+var defaultKeepalive = net.KeepAliveConfig{Enable: true, Idle: 15 * time.Second, Interval: 15 * time.Second, Count: 9}
+
+// ConnInfo is the MsgOpened payload
+type ConnInfo struct {
+	ConnID   uint32 `json:"conn_id"`
+	Listener uint32 `json:"listener,omitempty"` // accepted conns: the listening conn ID
+	Type     string `json:"type"`               // "stream", "dgram" or "unix"
+	Family   string `json:"family"`             // "inet" or "inet6"
+	Local    string `json:"local"`
+	Remote   string `json:"remote,omitempty"` // empty for bound sockets
+
+	NoDelay   bool           `json:"nodelay"`
+	Keepalive *KeepaliveInfo `json:"keepalive,omitempty"` // nil = off (and for dgram)
+
+	ReadTimeoutMs  int64 `json:"read_timeout_ms"`
+	WriteTimeoutMs int64 `json:"write_timeout_ms"`
+	CoalesceUs     int64 `json:"coalesce_us"`
+	Priority       int32 `json:"priority"`
+
+	Compress string `json:"compress,omitempty"` // OptCompress algorithm
+
+	TLS     bool `json:"tls"`
+	Pooled  bool `json:"pooled"`
+	Reused  bool `json:"reused"`   // pooled socket handed back from the idle pool
+	EventTS bool `json:"event_ts"` // event headers carry timestamps
+}
+
+// KeepaliveInfo reports TCP_KEEPIDLE/TCP_KEEPINTVL/TCP_KEEPCNT
+type KeepaliveInfo struct {
+	IdleSecs     int `json:"idle_secs"`
+	IntervalSecs int `json:"interval_secs"`
+	Count        int `json:"count"`
+}
+
+// connInfo collects the effective configuration of conn. ka is the
+// keepalive applied to it (nil = the Go default for TCP).
+func (sess *Session) connInfo(conn *Connection, ka *net.KeepAliveConfig) ConnInfo {
+	info := ConnInfo{
+		ConnID:         conn.id,
+		Type:           sockTypeName(conn.sockType),
+		ReadTimeoutMs:  time.Duration(conn.readTimeout.Load()).Milliseconds(),
+		WriteTimeoutMs: time.Duration(conn.writeTimeout.Load()).Milliseconds(),
+		Priority:       conn.priority.Load(),
+		Pooled:         conn.dest != nil,
+		Compress:       compressionName(conn.compress),
+		EventTS:        sess.eventTimestamps,
+	}
+	if conn.coalescer != nil {
+		info.CoalesceUs = conn.coalescer.delay.Microseconds()
+	}
+
+	local, remote := conn.addrs()
+	if local != nil {
+		info.Local = local.String()
+		info.Family = addrFamily(local)
+	}
+	if remote != nil {
+		info.Remote = remote.String()
+	}
+
+	// Stream sockets that carry data: Go sets TCP_NODELAY and keepalive
+	if conn.sockType == SOCK_STREAM && conn.conn != nil {
+		info.NoDelay = true
+		if ka == nil {
+			ka = &defaultKeepalive
+		}
+		if ka.Enable {
+			info.Keepalive = &KeepaliveInfo{
+				IdleSecs:     int(ka.Idle / time.Second),
+				IntervalSecs: int(ka.Interval / time.Second),
+				Count:        ka.Count,
+			}
+		}
+	}
+	return info
+}
+
+// sockTypeName is ConnInfo's name for a socket type
+func sockTypeName(sockType int) string {
+	switch sockType {
+	case SOCK_DGRAM:
+		return "dgram"
+	case SOCK_UNIX:
+		return "unix"
+	}
+	return "stream"
+}
+
+// addrFamily reports "inet6" for IPv6 socket addresses, "inet" otherwise
+func addrFamily(a net.Addr) string {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		return "unix"
+	}
+	if ip != nil && ip.To4() == nil {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// sendOpened emits MsgOpened for a session that asked for it
+func (sess *Session) sendOpened(info ConnInfo) bool {
+	if !sess.openedEvents {
+		return true
+	}
+	data, _ := json.Marshal(info)
+	return sess.sendEvent(MsgOpened, info.ConnID, data)
+}
@@ -0,0 +1,83 @@
+// opened_test.go - MsgOpened connection summary tests
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sess := &Session{eventTimestamps: true}
+	conn := newConnection(7, SOCK_STREAM)
+	conn.conn = c
+	conn.writeTimeout.Store(int64(1500 * time.Millisecond))
+	conn.coalescer = newWriteCoalescer(c, 7, 2*time.Millisecond)
+
+	info := sess.connInfo(conn, &net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 4})
+	if info.Type != "stream" || info.Family != "inet" || !info.NoDelay || !info.EventTS {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if info.Local != c.LocalAddr().String() || info.Remote != ln.Addr().String() {
+		t.Fatalf("addresses %s -> %s", info.Local, info.Remote)
+	}
+	if info.WriteTimeoutMs != 1500 || info.ReadTimeoutMs != 0 || info.CoalesceUs != 2000 || info.Priority != PrioNormal {
+		t.Fatalf("unexpected timeouts/coalesce/priority %+v", info)
+	}
+	if ka := info.Keepalive; ka == nil || ka.IdleSecs != 30 || ka.IntervalSecs != 5 || ka.Count != 4 {
+		t.Fatalf("keepalive %+v", ka)
+	}
+
+	// No override reports Go's defaults; disabled keepalive is omitted
+	if ka := sess.connInfo(conn, nil).Keepalive; ka == nil || ka.IdleSecs != 15 {
+		t.Fatalf("default keepalive %+v", ka)
+	}
+	off := sess.connInfo(conn, &net.KeepAliveConfig{Enable: false})
+	data, _ := json.Marshal(off)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	if _, ok := m["keepalive"]; ok {
+		t.Fatalf("disabled keepalive encoded: %s", data)
+	}
+}
+
+func TestConnInfoBound(t *testing.T) {
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	defer u.Close()
+
+	conn := newConnection(3, SOCK_DGRAM)
+	conn.udpConn = u
+	info := (&Session{}).connInfo(conn, nil)
+	if info.Type != "dgram" || info.Family != "inet6" || info.Remote != "" || info.NoDelay || info.Keepalive != nil {
+		t.Fatalf("unexpected info %+v", info)
+	}
+}
+
+func TestSendOpenedOptIn(t *testing.T) {
+	// Sessions that didn't ask never emit MsgOpened
+	if !(&Session{}).sendOpened(ConnInfo{ConnID: 1}) {
+		t.Fatal("sendOpened without opt-in reported failure")
+	}
+}
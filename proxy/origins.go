@@ -0,0 +1,94 @@
+// origins.go - Matching the Origin header against -origins
+//
+// Entries are compared as origins, not strings: scheme and host are
+// case-insensitive and a default port is the same as none, so
+// "https://app.example.com:443" matches "https://app.example.com". A
+// leading "*." in the host allows any subdomain at any depth, though not
+// the domain itself ("https://*.example.com" matches
+// "https://a.b.example.com" but not "https://example.com"). The scheme
+// always has to match, and a non-default port has to be given explicitly.
+// Entries that aren't scheme://host[:port], such as "null", are matched
+// exactly as before.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// originPattern is one parsed -origins entry
+type originPattern struct {
+	raw      string // set when the entry isn't an origin URL: exact match
+	scheme   string
+	host     string // without the "*." for a wildcard
+	port     string // always explicit
+	wildcard bool
+}
+
+// parseOrigin splits an origin into lowercase scheme and host and its
+// port, filling in the scheme's default
+func parseOrigin(origin string) (scheme, host, port string, ok bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", "", false
+	}
+	scheme = strings.ToLower(u.Scheme)
+	host, port = strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		switch scheme {
+		case "https", "wss":
+			port = "443"
+		case "http", "ws":
+			port = "80"
+		}
+	}
+	return scheme, host, port, true
+}
+
+// parseOriginPattern parses an -origins entry
+func parseOriginPattern(entry string) originPattern {
+	// "*" isn't valid in a URL host, so the wildcard is taken off first
+	wildcard := false
+	parseable := entry
+	if i := strings.Index(entry, "://*."); i >= 0 {
+		wildcard = true
+		parseable = entry[:i+3] + entry[i+5:]
+	}
+	scheme, host, port, ok := parseOrigin(parseable)
+	if !ok || strings.Contains(host, "*") || (wildcard && net.ParseIP(host) != nil) {
+		return originPattern{raw: entry}
+	}
+	return originPattern{scheme: scheme, host: host, port: port, wildcard: wildcard}
+}
+
+// matches reports whether the request Origin origin is allowed by p
+func (p originPattern) matches(origin string) bool {
+	if p.raw != "" {
+		return origin == p.raw
+	}
+	scheme, host, port, ok := parseOrigin(origin)
+	if !ok || scheme != p.scheme || port != p.port {
+		return false
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// originAllowed reports whether a request with this Origin header may open
+// a session; with no -origins every origin may
+func (s *Server) originAllowed(origin string) bool {
+	if s.allowedOrigins == nil {
+		return true
+	}
+	for _, p := range s.allowedOrigins {
+		if p.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestOriginAllowed(t *testing.T) {
+	s := NewServer(":0", "", "", NewRateLimiter(1, 1), []string{
+		"https://app.example.com",
+		"https://*.friscy.dev",
+		"http://localhost:5173",
+		"https://Staging.Example.com:443",
+		"null",
+	})
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://app.example.com:443", true},
+		{"https://APP.example.com", true},
+		{"https://staging.example.com", true},
+		{"https://app.example.com:8443", false},
+		{"http://app.example.com", false}, // scheme mismatch
+		{"wss://app.example.com", false},  // same default port, other scheme
+		{"https://evil-app.example.com", false},
+		{"https://app.example.com.evil.net", false},
+
+		{"https://a.friscy.dev", true},
+		{"https://a.b.friscy.dev:443", true},
+		{"https://friscy.dev", false}, // a wildcard doesn't cover the apex
+		{"https://evilfriscy.dev", false},
+		{"http://a.friscy.dev", false},
+		{"https://a.friscy.dev:8443", false},
+
+		{"http://localhost:5173", true},
+		{"http://localhost", false},
+		{"http://localhost:5174", false},
+		{"https://localhost:5173", false},
+
+		{"null", true},
+		{"", false},
+		{"app.example.com", false},
+	} {
+		if got := s.originAllowed(tc.origin); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+
+	if !NewServer(":0", "", "", NewRateLimiter(1, 1), nil).originAllowed("https://anywhere.test") {
+		t.Error("no -origins should allow every origin")
+	}
+}
+
+func TestParseOriginPattern(t *testing.T) {
+	for entry, want := range map[string]originPattern{
+		"https://*.example.com":    {scheme: "https", host: "example.com", port: "443", wildcard: true},
+		"HTTP://Example.com:8080/": {scheme: "http", host: "example.com", port: "8080"},
+		"https://*.10.0.0.1":       {raw: "https://*.10.0.0.1"},
+		"https://a.*.example.com":  {raw: "https://a.*.example.com"},
+		"https://example.com/app":  {raw: "https://example.com/app"},
+		"*.example.com":            {raw: "*.example.com"},
+	} {
+		if got := parseOriginPattern(entry); got != want {
+			t.Errorf("%q: got %+v, want %+v", entry, got, want)
+		}
+	}
+}
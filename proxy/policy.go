@@ -0,0 +1,218 @@
+// policy.go - Structured reasons for refused or failed connects
+//
+// MsgConnectError (and MsgCertError, MsgResolveError) carry a JSON policy decision so the
+// container can tell the user exactly what stopped a connect and whether
+// retrying makes sense:
+//
+//	{"category": "rate_limit", "code": 5, "rule": "max-conns=100/day",
+//	 "transient": true, "retry_after": 5400, "message": "daily connection limit exceeded"}
+//
+//	category     one of the Policy* constants below
+//	code         the category folded into a ConnErr* number, for clients
+//	             that only branch on the broad failure kind
+//	rule         the specific rule or limit that matched (may be empty)
+//	transient    true if the same connect may succeed later unchanged
+//	retry_after  seconds until a retry can succeed, when known (0 = omitted)
+//	message      human-readable summary, also what older clients display
+//
+// The payload is plain JSON text, so clients that only print the error
+// string keep working.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Policy decision categories
+const (
+	PolicyInvalidRequest = "invalid_request" // malformed or unsupported connect options
+	PolicyPrivateAddress = "private_address" // SSRF guard: loopback/private/link-local target
+	PolicyPort           = "port"            // destination port refused by -allow-ports/-deny-ports
+	PolicyBlocked        = "blocked"         // cloud metadata address or -block-cidrs network
+	PolicyTokenExpired   = "token_expired"   // session token reached its expiry
+	PolicyTokenScope     = "token_scope"     // destination outside the token's allow_hosts
+	PolicyRateLimit      = "rate_limit"      // per-IP daily connection quota used up
+	PolicyCircuitOpen    = "circuit_open"    // destination failing; proxy backing off
+	PolicyDNS            = "dns"             // name did not resolve
+	PolicyDNSRate        = "dns_rate_limit"  // session exceeded its -dns-rate lookup budget
+	PolicyDial           = "dial"            // refused, unreachable or timed out
+	PolicyTLS            = "tls"             // upstream TLS handshake failed
+	PolicyTLSVerify      = "tls_verify"      // upstream certificate rejected (MsgCertError)
+	PolicySessionLimit   = "session_limit"   // session holds -max-conns-per-session connections
+	PolicyUnixSocket     = "unix_socket"     // SOCK_UNIX path not in -unix-sockets
+	PolicyGeo            = "geo"             // destination country refused by -geo-allow/-geo-deny
+	PolicyHostDenied     = "host_denied"     // destination name matched -deny-hosts
+)
+
+// Connect error codes: a coarse, stable classification of every decision
+const (
+	ConnErrOther       = 0 // anything below doesn't cover (TLS, circuit open, expired token...)
+	ConnErrRefused     = 1 // remote host actively refused (ECONNREFUSED)
+	ConnErrTimeout     = 2 // dial or handshake timed out
+	ConnErrDNS         = 3 // name did not resolve
+	ConnErrBlocked     = 4 // proxy policy forbids the destination
+	ConnErrRateLimited = 5 // a quota or rate limit ran out; see retry_after
+)
+
+// PolicyDecision is the MsgConnectError/MsgCertError payload
+type PolicyDecision struct {
+	Category   string `json:"category"`
+	Code       int    `json:"code"` // filled in by Encode
+	Rule       string `json:"rule,omitempty"`
+	Transient  bool   `json:"transient"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+	Message    string `json:"message"`
+}
+
+// Encode returns the JSON wire form
+func (d PolicyDecision) Encode() []byte {
+	d.Code = d.errorCode()
+	b, _ := json.Marshal(d)
+	return b
+}
+
+// errorCode maps the decision onto the ConnErr* codes
+func (d PolicyDecision) errorCode() int {
+	switch d.Category {
+	case PolicyDial, PolicyTLS:
+		switch d.Rule {
+		case "refused":
+			return ConnErrRefused
+		case "timeout":
+			return ConnErrTimeout
+		}
+	case PolicyDNS:
+		return ConnErrDNS
+	case PolicyPrivateAddress, PolicyPort, PolicyBlocked, PolicyTokenScope, PolicyUnixSocket, PolicyGeo, PolicyHostDenied:
+		return ConnErrBlocked
+	case PolicyRateLimit, PolicyDNSRate, PolicySessionLimit:
+		return ConnErrRateLimited
+	}
+	return ConnErrOther
+}
+
+// retryAfterSecs rounds a wait up to whole seconds
+func retryAfterSecs(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// dialDecision classifies a failed dial or handshake
+func dialDecision(err error) PolicyDecision {
+	var (
+		circuitErr *circuitOpenError
+		privateErr *privateAddrError
+		blockedErr *blockedAddrError
+		geoErr     *geoDeniedError
+		deniedErr  *hostDeniedError
+		dnsErr     *net.DNSError
+		verifyErr  *tlsVerifyError
+		netErr     net.Error
+	)
+	switch {
+	case errors.As(err, &circuitErr):
+		return PolicyDecision{
+			Category:   PolicyCircuitOpen,
+			Rule:       fmt.Sprintf("breaker-failures=%d", circuitErr.failures),
+			Transient:  true,
+			RetryAfter: retryAfterSecs(circuitErr.retryAfter),
+			Message:    err.Error(),
+		}
+	case errors.As(err, &blockedErr):
+		return PolicyDecision{Category: PolicyBlocked, Rule: blockedErr.network.String(), Message: err.Error()}
+	case errors.As(err, &privateErr):
+		return PolicyDecision{Category: PolicyPrivateAddress, Rule: privateErr.host, Message: err.Error()}
+	case errors.As(err, &deniedErr):
+		return PolicyDecision{Category: PolicyHostDenied, Rule: deniedErr.pattern, Message: err.Error()}
+	case errors.As(err, &geoErr):
+		return PolicyDecision{Category: PolicyGeo, Rule: cmp.Or(geoErr.country, "unknown"), Message: err.Error()}
+	case errors.As(err, &verifyErr):
+		return PolicyDecision{Category: PolicyTLSVerify, Message: err.Error()}
+	case errors.As(err, &dnsErr):
+		return PolicyDecision{
+			Category:  PolicyDNS,
+			Transient: dnsErr.IsTemporary || dnsErr.IsTimeout,
+			Message:   err.Error(),
+		}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return PolicyDecision{Category: PolicyDial, Rule: "timeout", Transient: true, Message: err.Error()}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return PolicyDecision{Category: PolicyDial, Rule: "refused", Transient: true, Message: err.Error()}
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return PolicyDecision{Category: PolicyDial, Rule: "unreachable", Transient: true, Message: err.Error()}
+	}
+	return PolicyDecision{Category: PolicyDial, Transient: true, Message: err.Error()}
+}
+
+// rateLimitDecision describes an exhausted daily connection quota
+func (sess *Session) rateLimitDecision() PolicyDecision {
+	return quotaDecision(sess.rateLimiter, sess.remoteIP, sess.origin)
+}
+
+// quotaDecision describes a client's exhausted daily connection quota
+func quotaDecision(rl *RateLimiter, remoteIP, origin string) PolicyDecision {
+	return PolicyDecision{
+		Category:   PolicyRateLimit,
+		Rule:       fmt.Sprintf("max-conns=%d/day", rl.maxConnsPerDay),
+		Transient:  true,
+		RetryAfter: retryAfterSecs(rl.ResetInFrom(remoteIP, origin)),
+		Message:    "daily connection limit exceeded",
+	}
+}
+
+// checkConnect applies the checks every outbound TCP connect passes,
+// whichever front-end it came through: the port policy, the host deny list,
+// the SSRF guard on IP literals (names are screened when they resolve), the
+// token's expiry and scope, and last, so refusals don't use it up, the
+// client's daily quota
+func (s *Server) checkConnect(rl *RateLimiter, remoteIP, origin string, token *Token, host string, port uint16) (PolicyDecision, bool) {
+	if rule, ok := s.ports.Check(port); !ok {
+		return portDecision(rule, port), false
+	}
+	if err := s.dests.checkHost(host); err != nil {
+		return dialDecision(err), false
+	}
+	if token != nil {
+		if token.Expired(time.Now()) {
+			return PolicyDecision{Category: PolicyTokenExpired, Rule: token.Name, Message: "token expired"}, false
+		}
+		if !token.AllowsHost(host) {
+			return PolicyDecision{Category: PolicyTokenScope, Rule: token.Name, Message: "destination not permitted by token"}, false
+		}
+	}
+	if !rl.TryConnectionFrom(remoteIP, origin) {
+		return quotaDecision(rl, remoteIP, origin), false
+	}
+	return PolicyDecision{}, true
+}
+
+// dnsRateDecision describes a lookup refused by the session's DNS rate limit
+func (sess *Session) dnsRateDecision() PolicyDecision {
+	return PolicyDecision{
+		Category:   PolicyDNSRate,
+		Rule:       fmt.Sprintf("dns-rate=%g/s", sess.dnsLimiter.rate),
+		Transient:  true,
+		RetryAfter: 1,
+		Message:    "dns query rate exceeded",
+	}
+}
+
+// connectDenied reports a refused or failed connect to the container
+func (sess *Session) connectDenied(connID uint32, d PolicyDecision) {
+	msgType := byte(MsgConnectError)
+	if d.Category == PolicyTLSVerify {
+		msgType = MsgCertError
+	}
+	sess.sendEvent(msgType, connID, d.Encode())
+}
@@ -0,0 +1,107 @@
+// policy_test.go - Connect policy decision payload tests
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPolicyDecisionEncode(t *testing.T) {
+	d := PolicyDecision{Category: PolicyRateLimit, Rule: "max-conns=1/day", Transient: true, RetryAfter: 60, Message: "daily connection limit exceeded"}
+	var got map[string]interface{}
+	if err := json.Unmarshal(d.Encode(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"category", "code", "rule", "transient", "retry_after", "message"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("encoded decision missing %q: %s", key, d.Encode())
+		}
+	}
+
+	// Optional fields are omitted, transient is always present
+	var sparse map[string]interface{}
+	json.Unmarshal(PolicyDecision{Category: PolicyPrivateAddress, Message: "no"}.Encode(), &sparse)
+	if _, ok := sparse["retry_after"]; ok {
+		t.Errorf("zero retry_after should be omitted")
+	}
+	if sparse["transient"] != false {
+		t.Errorf("transient should be encoded as false")
+	}
+}
+
+func TestDialDecision(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	cases := []struct {
+		err       error
+		category  string
+		rule      string
+		transient bool
+	}{
+		{&circuitOpenError{failures: 5, retryAfter: 1500 * time.Millisecond}, PolicyCircuitOpen, "breaker-failures=5", true},
+		{&tlsVerifyError{err: fmt.Errorf("x509: unknown authority")}, PolicyTLSVerify, "", false},
+		{&net.DNSError{Name: "nope.invalid", IsNotFound: true}, PolicyDNS, "", false},
+		{&net.DNSError{Name: "slow.example", IsTimeout: true}, PolicyDNS, "", true},
+		{context.DeadlineExceeded, PolicyDial, "timeout", true},
+		{refused, PolicyDial, "refused", true},
+	}
+	for _, c := range cases {
+		d := dialDecision(c.err)
+		if d.Category != c.category || d.Rule != c.rule || d.Transient != c.transient || d.Message == "" {
+			t.Errorf("dialDecision(%v) = %+v, want %s/%q transient=%v", c.err, d, c.category, c.rule, c.transient)
+		}
+	}
+	if d := dialDecision(&circuitOpenError{failures: 5, retryAfter: 1500 * time.Millisecond}); d.RetryAfter != 2 {
+		t.Errorf("circuit retry_after = %d, want 2 (rounded up)", d.RetryAfter)
+	}
+}
+
+func TestConnectErrorCodes(t *testing.T) {
+	_, metadata, _ := net.ParseCIDR("169.254.169.254/32")
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, c := range []struct {
+		d    PolicyDecision
+		code int
+	}{
+		{dialDecision(opErr(syscall.ECONNREFUSED)), ConnErrRefused},
+		{dialDecision(context.DeadlineExceeded), ConnErrTimeout},
+		{dialDecision(opErr(syscall.ETIMEDOUT)), ConnErrTimeout},
+		{PolicyDecision{Category: PolicyTLS, Rule: "timeout"}, ConnErrTimeout},
+		{dialDecision(&net.DNSError{Name: "nope.invalid", IsNotFound: true}), ConnErrDNS},
+		{dialDecision(&privateAddrError{host: "internal.example"}), ConnErrBlocked},
+		{dialDecision(&blockedAddrError{host: "metadata.example", network: metadata}), ConnErrBlocked},
+		{portDecision("deny-ports", 25), ConnErrBlocked},
+		{quotaDecision(NewRateLimiter(1, 1), "203.0.113.5:1000", ""), ConnErrRateLimited},
+		{(&Session{maxConns: 4}).sessionLimitDecision(), ConnErrRateLimited},
+		{dialDecision(opErr(syscall.EHOSTUNREACH)), ConnErrOther},
+		{dialDecision(&circuitOpenError{failures: 5}), ConnErrOther},
+	} {
+		var got struct{ Code *int }
+		if err := json.Unmarshal(c.d.Encode(), &got); err != nil || got.Code == nil {
+			t.Fatalf("%s: no code in %s", c.d.Message, c.d.Encode())
+		}
+		if *got.Code != c.code {
+			t.Errorf("%s/%s: code %d, want %d", c.d.Category, c.d.Rule, *got.Code, c.code)
+		}
+	}
+}
+
+func TestRateLimitDecision(t *testing.T) {
+	sess := &Session{rateLimiter: NewRateLimiter(1, 1), remoteIP: "203.0.113.5:1000"}
+	sess.rateLimiter.TryConnection(sess.remoteIP)
+	d := sess.rateLimitDecision()
+	if d.Category != PolicyRateLimit || d.Rule != "max-conns=1/day" || !d.Transient {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if d.RetryAfter <= 23*3600 || d.RetryAfter > 24*3600 {
+		t.Fatalf("retry_after = %d, want about a day", d.RetryAfter)
+	}
+}
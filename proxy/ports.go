@@ -0,0 +1,96 @@
+// ports.go - Destination port allowlist and blocklist
+//
+// -allow-ports and -deny-ports take comma-separated ports and ranges
+// ("22,80,443,8000-8999"). A connect, forward or sendto to a port on the
+// deny list is refused; with an allow list, so is one to any port not on
+// it. Deny wins over allow.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	lo, hi uint16
+}
+
+// PortPolicy decides which destination ports sessions may reach
+type PortPolicy struct {
+	allow []portRange // empty = every port not denied
+	deny  []portRange
+}
+
+// ParsePortPolicy validates the -allow-ports and -deny-ports flags. It
+// returns nil, permitting every port, when both are empty.
+func ParsePortPolicy(allow, deny string) (*PortPolicy, error) {
+	p := &PortPolicy{}
+	var err error
+	if p.allow, err = parsePortRanges(allow); err != nil {
+		return nil, fmt.Errorf("-allow-ports: %w", err)
+	}
+	if p.deny, err = parsePortRanges(deny); err != nil {
+		return nil, fmt.Errorf("-deny-ports: %w", err)
+	}
+	if p.allow == nil && p.deny == nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func parsePortRanges(s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(f, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		h, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err1 != nil || err2 != nil || l == 0 || l > h {
+			return nil, fmt.Errorf("invalid port or range %q", f)
+		}
+		ranges = append(ranges, portRange{uint16(l), uint16(h)})
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether port may be reached and, if not, which flag
+// refused it. A nil policy permits every port.
+func (p *PortPolicy) Check(port uint16) (rule string, ok bool) {
+	if p == nil {
+		return "", true
+	}
+	if inRanges(p.deny, port) {
+		return "deny-ports", false
+	}
+	if len(p.allow) > 0 && !inRanges(p.allow, port) {
+		return "allow-ports", false
+	}
+	return "", true
+}
+
+// portDecision describes a connect refused by the port policy
+func portDecision(rule string, port uint16) PolicyDecision {
+	return PolicyDecision{
+		Category: PolicyPort,
+		Rule:     fmt.Sprintf("%s (%d)", rule, port),
+		Message:  "port not permitted",
+	}
+}
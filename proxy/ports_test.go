@@ -0,0 +1,67 @@
+// ports_test.go - Destination port allowlist/blocklist tests
+
+package main
+
+import "testing"
+
+func checkPorts(t *testing.T, p *PortPolicy, want map[uint16]bool) {
+	t.Helper()
+	for port, ok := range want {
+		if _, got := p.Check(port); got != ok {
+			t.Errorf("port %d: permitted=%v, want %v", port, got, ok)
+		}
+	}
+}
+
+func TestPortPolicySinglePort(t *testing.T) {
+	p, err := ParsePortPolicy("443", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPorts(t, p, map[uint16]bool{443: true, 80: false, 444: false})
+	if rule, _ := p.Check(80); rule != "allow-ports" {
+		t.Errorf("rule %q, want allow-ports", rule)
+	}
+
+	p, err = ParsePortPolicy("", "25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPorts(t, p, map[uint16]bool{25: false, 24: true, 26: true, 65535: true})
+}
+
+func TestPortPolicyRange(t *testing.T) {
+	p, err := ParsePortPolicy(" 80, 8000-8999 ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPorts(t, p, map[uint16]bool{80: true, 7999: false, 8000: true, 8500: true, 8999: true, 9000: false})
+}
+
+func TestPortPolicyDenyWins(t *testing.T) {
+	p, err := ParsePortPolicy("1-1024", "22,100-199")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPorts(t, p, map[uint16]bool{21: true, 22: false, 23: true, 100: false, 199: false, 443: true, 1025: false})
+	if rule, _ := p.Check(22); rule != "deny-ports" {
+		t.Errorf("rule %q, want deny-ports", rule)
+	}
+}
+
+func TestParsePortPolicy(t *testing.T) {
+	if p, err := ParsePortPolicy("", " , "); p != nil || err != nil {
+		t.Fatalf("empty flags: got %+v, %v; want no policy", p, err)
+	}
+	if _, ok := (*PortPolicy)(nil).Check(22); !ok {
+		t.Fatal("nil policy refused a port")
+	}
+	for _, bad := range []string{"0", "65536", "http", "90-80", "1-", "-5"} {
+		if _, err := ParsePortPolicy(bad, ""); err == nil {
+			t.Errorf("allow %q accepted", bad)
+		}
+		if _, err := ParsePortPolicy("", bad); err == nil {
+			t.Errorf("deny %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// privdrop.go - Dropping root after binding privileged listeners
+//
+// With -user (and optionally -group), main binds the WebTransport and API
+// sockets and loads the certificate while still root, then switches to the
+// unprivileged ids before serving. Sockets opened later, such as MsgBind
+// listeners, get the unprivileged user's permissions, so containers cannot
+// bind ports below 1024.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// lookupIDs resolves -user/-group (names or numeric ids) to a uid and gid.
+// Without a group, the user's primary group is used.
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	if userName == "" {
+		return 0, 0, fmt.Errorf("-group requires -user")
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("user %q has non-numeric uid %q", userName, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, fmt.Errorf("non-numeric gid %q", gidStr)
+	}
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("-user must not be root")
+	}
+	return uid, gid, nil
+}
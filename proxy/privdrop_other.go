@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func dropPrivileges(uid, gid int) error {
+	return fmt.Errorf("dropping privileges is not supported on this platform")
+}
@@ -0,0 +1,37 @@
+// privdrop_test.go - -user/-group resolution tests
+
+package main
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestLookupIDs(t *testing.T) {
+	if _, _, err := lookupIDs("", "wheel"); err == nil {
+		t.Error("-group without -user should fail")
+	}
+	if _, _, err := lookupIDs("root", ""); err == nil {
+		t.Error("dropping to root should be refused")
+	}
+	if _, _, err := lookupIDs("no-such-user-friscy", ""); err == nil {
+		t.Error("unknown user should fail")
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user on this system")
+	}
+	byName, gid, err := lookupIDs("nobody", "")
+	if err != nil {
+		t.Fatalf("lookupIDs(nobody): %v", err)
+	}
+	byID, _, err := lookupIDs(nobody.Uid, "")
+	if err != nil || byID != byName {
+		t.Fatalf("numeric uid should resolve to the same user: %d vs %d (%v)", byID, byName, err)
+	}
+	if strconv.Itoa(gid) != nobody.Gid {
+		t.Fatalf("gid = %d, want nobody's primary group %s", gid, nobody.Gid)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dropPrivileges permanently switches the process (all threads) to uid/gid,
+// clearing supplementary groups first while that is still allowed
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	// Make sure root can't be regained
+	if syscall.Setuid(0) == nil || os.Geteuid() != uid {
+		return fmt.Errorf("privileges were not dropped")
+	}
+	return nil
+}
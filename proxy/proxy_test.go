@@ -10,19 +10,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 )
@@ -47,7 +63,8 @@ func setupTestServer(t *testing.T) {
 			t.Fatalf("Failed to generate test certs: %v", err)
 		}
 
-		testServer = NewServer(":4433", testCertFile, testKeyFile)
+		testServer = NewServer(":4433", testCertFile, testKeyFile, NewRateLimiter(100, 10000), nil)
+		testServer.eventTimeout = 2 * time.Second
 		go func() {
 			if err := testServer.Run(); err != nil {
 				// Server stopped, that's ok for tests
@@ -80,6 +97,11 @@ func generateTestCerts() error {
 
 // connectToProxy establishes a WebTransport session to the proxy
 func connectToProxy(t *testing.T) *webtransport.Session {
+	return connectToProxyPath(t, "/connect")
+}
+
+// connectToProxyPath is connectToProxy with query options, e.g. /connect?event_ts=1
+func connectToProxyPath(t *testing.T, path string) *webtransport.Session {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true, // Self-signed cert for testing
 		NextProtos:         []string{"h3"},
@@ -94,7 +116,7 @@ func connectToProxy(t *testing.T) *webtransport.Session {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, session, err := dialer.Dial(ctx, fmt.Sprintf("https://%s/connect", testProxyAddr), nil)
+	_, session, err := dialer.Dial(ctx, fmt.Sprintf("https://%s%s", testProxyAddr, path), nil)
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -102,6 +124,56 @@ func connectToProxy(t *testing.T) *webtransport.Session {
 	return session
 }
 
+// testEvent is one decoded host->container event
+type testEvent struct {
+	msgType byte
+	connID  uint32
+	ts      uint64 // 0 unless the session has event_ts=1
+	data    []byte
+}
+
+// readEvents decodes events from every uni stream the proxy opens, in
+// arrival order per stream, until the session ends
+func readEvents(session *webtransport.Session, timestamped bool) <-chan testEvent {
+	events := make(chan testEvent, 256)
+	go func() {
+		for {
+			uni, err := session.AcceptUniStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					ev, err := readEvent(uni, timestamped)
+					if err != nil {
+						return
+					}
+					events <- ev
+				}
+			}()
+		}
+	}()
+	return events
+}
+
+// readEvent reads msgType (1), connID (4), [timestamp (8),] dataLen (4), data
+func readEvent(r io.Reader, timestamped bool) (testEvent, error) {
+	hdr := make([]byte, 9)
+	if timestamped {
+		hdr = make([]byte, 17)
+	}
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return testEvent{}, err
+	}
+	ev := testEvent{msgType: hdr[0], connID: binary.BigEndian.Uint32(hdr[1:5])}
+	if timestamped {
+		ev.ts = binary.BigEndian.Uint64(hdr[5:13])
+	}
+	ev.data = make([]byte, binary.BigEndian.Uint32(hdr[len(hdr)-4:]))
+	_, err := io.ReadFull(r, ev.data)
+	return ev, err
+}
+
 // TestOutgoingTCPConnection tests connecting to an external TCP server
 func TestOutgoingTCPConnection(t *testing.T) {
 	setupTestServer(t)
@@ -445,3 +517,1494 @@ func TestHTTPRequest(t *testing.T) {
 		t.Logf("HTTP Response (%d bytes):\n%s", n-9, respBuf[9:n])
 	}
 }
+
+// TestParseTLSPolicy covers flag validation for the TLS hardening options
+func TestParseTLSPolicy(t *testing.T) {
+	p, err := ParseTLSPolicy("1.2", false, "")
+	if err != nil || p.MinVersion != tls.VersionTLS12 || p.CipherSuites != nil {
+		t.Fatalf("defaults: got %+v, %v", p, err)
+	}
+
+	p, err = ParseTLSPolicy("1.2", true, "")
+	if err != nil || p.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("-tls13-only should force TLS 1.3: got %+v, %v", p, err)
+	}
+
+	p, err = ParseTLSPolicy("1.2", false, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if err != nil || len(p.CipherSuites) != 2 {
+		t.Fatalf("cipher list: got %+v, %v", p, err)
+	}
+
+	for _, bad := range []struct {
+		min     string
+		only13  bool
+		ciphers string
+	}{
+		{"1.0", false, ""},
+		{"1.3", false, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{"1.2", false, "TLS_RSA_WITH_RC4_128_SHA"},
+		{"1.2", false, "NOT_A_SUITE"},
+		{"1.2", false, " , "},
+	} {
+		if _, err := ParseTLSPolicy(bad.min, bad.only13, bad.ciphers); err == nil {
+			t.Errorf("ParseTLSPolicy(%q, %v, %q) should fail", bad.min, bad.only13, bad.ciphers)
+		}
+	}
+
+	cfg := &tls.Config{}
+	(*TLSPolicy)(nil).Apply(cfg)
+	if cfg.MinVersion != 0 {
+		t.Errorf("nil policy should leave config untouched")
+	}
+}
+
+// TestPullLimiterIndependent checks image pulls use their own quota rather
+// than the networking connection budget
+func TestPullLimiterIndependent(t *testing.T) {
+	rl := NewRateLimiter(3, 1)
+	s := NewServer(":0", testCertFile, testKeyFile, rl, nil)
+	s.pullLimiter = NewRateLimiter(1, 0)
+
+	req := httptest.NewRequest("GET", "/pull?image=alpine", nil)
+	req.RemoteAddr = "203.0.113.7:5555"
+	rec := httptest.NewRecorder()
+	s.handleDockerPull(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 from exhausted pull quota, got %d", rec.Code)
+	}
+	if !rl.TryConnection("203.0.113.7:5555") {
+		t.Fatalf("pull attempt must not consume the networking connection budget")
+	}
+	if sessions, _ := s.pullLimiter.Stats(); sessions != 0 {
+		t.Fatalf("concurrent pull slot leaked: %d", sessions)
+	}
+}
+
+// TestAPIQueryLimits checks oversized parameters are rejected before any
+// registry or Docker Hub request is made
+func TestAPIQueryLimits(t *testing.T) {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	s.maxQueryLen = 16
+	long := strings.Repeat("a", 17)
+
+	for _, tc := range []struct {
+		target  string
+		handler http.HandlerFunc
+	}{
+		{"/pull?image=" + long, s.handleDockerPull},
+		{"/search?q=" + long, s.handleDockerSearch},
+		{"/search?q=ok&pad=" + strings.Repeat("x", 64), s.handleDockerSearch},
+		{"/pull", s.handleDockerPull},
+		{"/inspect?image=" + long, s.handleInspect},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("GET", tc.target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", tc.target, rec.Code)
+		}
+	}
+}
+
+// TestConcurrentPullsCoalesce checks simultaneous pulls of one image share a
+// single registry lookup
+func TestConcurrentPullsCoalesce(t *testing.T) {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	s.remoteImage = func(name.Reference, ...remote.Option) (v1.Image, error) {
+		calls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return img, nil
+	}
+
+	const n = 8
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			s.handleDockerPull(rec, httptest.NewRequest("GET", "/pull?image=alpine", nil))
+		}(recs[i])
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("remote.Image called %d times for %d concurrent pulls, want 1", got, n)
+	}
+	want, _ := img.Digest()
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("pull %d: got %d", i, rec.Code)
+		}
+		if got := rec.Header().Get("X-Image-Digest"); got != want.String() {
+			t.Fatalf("pull %d: digest %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestPullDigestHeaders checks a pull names the manifest and config it
+// resolved before streaming the export
+func TestPullDigestHeaders(t *testing.T) {
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.remoteImage = func(name.Reference, ...remote.Option) (v1.Image, error) {
+		return img, nil
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleDockerPull(rec, httptest.NewRequest("GET", "/pull?image=alpine", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	digest, _ := img.Digest()
+	config, _ := img.ConfigName()
+	if got := rec.Header().Get("X-Image-Digest"); got != digest.String() {
+		t.Errorf("X-Image-Digest %q, want %q", got, digest)
+	}
+	if got := rec.Header().Get("X-Image-Config-Digest"); got != config.String() {
+		t.Errorf("X-Image-Config-Digest %q, want %q", got, config)
+	}
+}
+
+// TestPullArchFallback checks /pull walks the arch order until a platform
+// of a multi-arch index resolves
+func TestPullArchFallback(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer reg.Close()
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	})
+	imageRef := strings.TrimPrefix(reg.URL, "http://") + "/multi/app:latest"
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("push index: %v", err)
+	}
+
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleDockerPull(rec, httptest.NewRequest("GET", "/pull?image="+imageRef+query, nil))
+		return rec
+	}
+
+	if rec := get(""); rec.Code == http.StatusOK {
+		t.Fatalf("default order riscv64,amd64 resolved an arm64-only index as %s", rec.Header().Get("X-Image-Arch"))
+	}
+	if rec := get("&arch=riscv64,arm64,amd64"); rec.Code != http.StatusOK || rec.Header().Get("X-Image-Arch") != "arm64" {
+		t.Fatalf("?arch=: got %d arch %q, want 200 arm64", rec.Code, rec.Header().Get("X-Image-Arch"))
+	}
+	if s.archOrder, err = parseArchOrder("riscv64,arm64,amd64"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(""); rec.Code != http.StatusOK || rec.Header().Get("X-Image-Arch") != "arm64" {
+		t.Fatalf("-default-arch-order: got %d arch %q, want 200 arm64", rec.Code, rec.Header().Get("X-Image-Arch"))
+	}
+	for _, bad := range []string{"arm64,,amd64", "ARM64", "../x", strings.Repeat("a,", maxArchOrder) + "a"} {
+		if rec := get("&arch=" + url.QueryEscape(bad)); rec.Code != http.StatusBadRequest {
+			t.Errorf("?arch=%s: got %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// TestPullPinnedDigest checks ?digest= selects that manifest's platform and
+// refuses a reference that resolves elsewhere
+func TestPullPinnedDigest(t *testing.T) {
+	reg := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+	arm, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A lone image's platform comes from its config
+	if amd, err = mutate.ConfigFile(amd, &v1.ConfigFile{OS: "linux", Architecture: "amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+		mutate.IndexAddendum{Add: amd, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+	)
+	for refStr, push := range map[string]func(name.Reference) error{
+		host + "/multi/app:latest":  func(r name.Reference) error { return remote.WriteIndex(r, idx) },
+		host + "/single/app:latest": func(r name.Reference) error { return remote.Write(r, amd) },
+	} {
+		ref, err := name.ParseReference(refStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := push(ref); err != nil {
+			t.Fatalf("push %s: %v", refStr, err)
+		}
+	}
+	armDigest, _ := arm.Digest()
+	amdDigest, _ := amd.Digest()
+
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	for _, tc := range []struct {
+		image  string
+		digest string
+		code   int
+		arch   string
+	}{
+		// arm64 isn't in the default order, so this only works if the
+		// pinned manifest picks the platform
+		{"multi/app:latest", armDigest.String(), http.StatusOK, "arm64"},
+		{"multi/app:latest", amdDigest.String(), http.StatusOK, "amd64"},
+		{"single/app:latest", amdDigest.String(), http.StatusOK, "amd64"},
+		{"single/app:latest", armDigest.String(), http.StatusConflict, ""},
+		{"multi/app:latest", "sha256:" + strings.Repeat("0", 64), http.StatusConflict, ""},
+		{"multi/app:latest", "sha256:nothex", http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		target := "/pull?image=" + host + "/" + tc.image + "&digest=" + tc.digest
+		s.handleDockerPull(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s@%s: got %d, want %d: %s", tc.image, tc.digest, rec.Code, tc.code, rec.Body)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := rec.Header().Get("X-Image-Digest"); got != tc.digest {
+			t.Errorf("%s@%s: X-Image-Digest %s", tc.image, tc.digest, got)
+		}
+		if got := rec.Header().Get("X-Image-Arch"); got != tc.arch {
+			t.Errorf("%s@%s: X-Image-Arch %s, want %s", tc.image, tc.digest, got, tc.arch)
+		}
+	}
+}
+
+// understatedImage reports 1-byte layers, like a manifest lying about size
+type understatedImage struct{ v1.Image }
+
+type understatedLayer struct{ v1.Layer }
+
+func (l understatedLayer) Size() (int64, error) { return 1, nil }
+
+func (i understatedImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	for n, l := range layers {
+		layers[n] = understatedLayer{l}
+	}
+	return layers, err
+}
+
+// TestPullMaxImageBytes checks -max-image-bytes refuses oversized images
+// up front and aborts exports that outgrow the manifest's claim
+func TestPullMaxImageBytes(t *testing.T) {
+	img, err := random.Image(8192, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := compressedImageSize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	served := img
+	s.remoteImage = func(name.Reference, ...remote.Option) (v1.Image, error) { return served, nil }
+	pull := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleDockerPull(rec, httptest.NewRequest("GET", "/pull?image=alpine", nil))
+		return rec
+	}
+
+	// Pre-check on the manifest's layer sizes
+	s.maxImageBytes = size - 1
+	if rec := pull(); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("over-limit manifest: got %d, want 413", rec.Code)
+	}
+	s.maxImageBytes = 4 * size
+	if rec := pull(); rec.Code != http.StatusOK || rec.Result().Trailer.Get("X-Export-Status") != "ok" {
+		t.Fatalf("under-limit image: got %d, status %q", rec.Code, rec.Result().Trailer.Get("X-Export-Status"))
+	}
+
+	// The manifest claims 2 bytes, so only the streaming guard catches it
+	served = understatedImage{img}
+	s.maxImageBytes = 4096
+	rec := pull()
+	if got := rec.Result().Trailer.Get("X-Export-Status"); got != "error" {
+		t.Fatalf("understated image streamed with export status %q", got)
+	}
+	if rec.Body.Len() > 4096 {
+		t.Fatalf("sent %d bytes past a 4096 byte limit", rec.Body.Len())
+	}
+
+	// With a cache nothing has been sent yet, so it gets a proper status
+	if s.imageCache, err = OpenImageCache(t.TempDir(), defaultCacheMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+	if rec := pull(); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("understated image with cache: got %d, want 413", rec.Code)
+	}
+}
+
+// TestClientNeverReadsEvents verifies that a client which never reads its
+// events gets its session torn down instead of wedging event delivery
+func TestClientNeverReadsEvents(t *testing.T) {
+	setupTestServer(t)
+
+	session := connectToProxy(t)
+	defer session.CloseWithError(0, "test done")
+
+	listenID := uint32(220)
+	listenPort := uint16(19879)
+	send := func(msg []byte) {
+		str, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		str.Write(msg)
+		str.Close()
+	}
+
+	bind := []byte{MsgBind, 0, 0, 0, 0, SOCK_STREAM, 0, 0}
+	binary.BigEndian.PutUint32(bind[1:5], listenID)
+	binary.BigEndian.PutUint16(bind[6:8], listenPort)
+	send(bind)
+	time.Sleep(100 * time.Millisecond)
+	listen := []byte{MsgListen, 0, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint32(listen[1:5], listenID)
+	send(listen)
+	time.Sleep(100 * time.Millisecond)
+
+	// Stream more data than QUIC flow control will buffer for an unread
+	// event stream
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 512; i++ {
+			if _, err := c.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-session.Context().Done():
+		t.Logf("Session closed: %v", context.Cause(session.Context()))
+	case <-time.After(10 * time.Second):
+		t.Fatal("session was not closed after the client stopped reading events")
+	}
+}
+
+// TestEventsInOrder checks a connection's data and its MsgClosed arrive on
+// one stream in the order they happened, with nothing after MsgClosed
+func TestEventsInOrder(t *testing.T) {
+	setupTestServer(t)
+
+	session := connectToProxy(t)
+	defer session.CloseWithError(0, "test done")
+
+	listenID := uint32(230)
+	listenPort := uint16(19880)
+	send := func(msg []byte) {
+		str, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		str.Write(msg)
+		str.Close()
+	}
+
+	bind := []byte{MsgBind, 0, 0, 0, 0, SOCK_STREAM, 0, 0}
+	binary.BigEndian.PutUint32(bind[1:5], listenID)
+	binary.BigEndian.PutUint16(bind[6:8], listenPort)
+	send(bind)
+	time.Sleep(100 * time.Millisecond)
+	listen := []byte{MsgListen, 0, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint32(listen[1:5], listenID)
+	send(listen)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	uni, err := session.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second event stream would mean events were sent independently
+	go func() {
+		if _, err := session.AcceptUniStream(ctx); err == nil {
+			t.Error("proxy opened more than one event stream")
+		}
+	}()
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	c.Write(want)
+	c.Close()
+
+	var accepted uint32
+	var got []byte
+	for {
+		ev, err := readEvent(uni, false)
+		if err != nil {
+			t.Fatalf("after %d bytes: %v", len(got), err)
+		}
+		switch ev.msgType {
+		case MsgAccept:
+			accepted = ev.connID
+		case MsgData:
+			if ev.connID != accepted {
+				t.Fatalf("data for conn %d before its MsgAccept", ev.connID)
+			}
+			got = append(got, ev.data...)
+		case MsgClosed:
+			if ev.connID != accepted {
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("MsgClosed after %d of %d bytes", len(got), len(want))
+			}
+			return
+		}
+	}
+}
+
+// TestPrioMutexOrder checks queued high-priority events are written before
+// low-priority ones regardless of arrival order
+func TestPrioMutexOrder(t *testing.T) {
+	var m prioMutex
+	m.Lock(PrioNormal)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for _, p := range []int{PrioLow, PrioLow, PrioHigh, PrioNormal} {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			m.Lock(p)
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			m.Unlock()
+		}(p)
+		time.Sleep(10 * time.Millisecond) // let each waiter enqueue
+	}
+
+	m.Unlock()
+	wg.Wait()
+
+	want := []int{PrioHigh, PrioNormal, PrioLow, PrioLow}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("lock order = %v, want %v", order, want)
+		}
+	}
+}
+
+// TestAcceptGateBurst simulates a connection flood against a bound listener:
+// accepts beyond the per-second rate pause the loop, then resume
+func TestAcceptGateBurst(t *testing.T) {
+	g := &acceptGate{rate: 10, pause: 2 * time.Second}
+	now := time.Now()
+
+	admitted := 0
+	for i := 0; i < 25; i++ {
+		if g.wait(now) > 0 {
+			break
+		}
+		admitted++
+	}
+	if admitted != 10 {
+		t.Fatalf("admitted %d connections in the burst, want 10", admitted)
+	}
+
+	// Still paused within the same window
+	if d := g.wait(now.Add(500 * time.Millisecond)); d != 1500*time.Millisecond {
+		t.Fatalf("gate should stay closed for the rest of the pause, got %v", d)
+	}
+
+	// After the pause the listener accepts again
+	resume := now.Add(5 * time.Second)
+	for i := 0; i < 10; i++ {
+		if d := g.wait(resume); d != 0 {
+			t.Fatalf("accept %d after pause was throttled (%v)", i, d)
+		}
+	}
+
+	if (&acceptGate{}).wait(now) != 0 {
+		t.Fatalf("rate 0 must never throttle")
+	}
+}
+
+// TestWorkerPicker checks round-robin and per-client accept distribution
+func TestWorkerPicker(t *testing.T) {
+	addr := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+
+	rr := &workerPicker{n: 3}
+	for i := 0; i < 7; i++ {
+		if got := rr.pick(addr("192.0.2.1", 1000+i)); got != i%3 {
+			t.Fatalf("round robin accept %d -> worker %d, want %d", i, got, i%3)
+		}
+	}
+
+	sticky := &workerPicker{n: 4, mode: WorkersByClient}
+	first := sticky.pick(addr("192.0.2.1", 1000))
+	seen := map[int]bool{}
+	for i := 0; i < 5; i++ {
+		if got := sticky.pick(addr("192.0.2.1", 2000+i)); got != first {
+			t.Fatalf("same client moved from worker %d to %d", first, got)
+		}
+	}
+	for i := 0; i < 64; i++ {
+		w := sticky.pick(addr(fmt.Sprintf("198.51.100.%d", i), 1000))
+		if w < 0 || w >= 4 {
+			t.Fatalf("worker %d out of range", w)
+		}
+		seen[w] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("sticky mode put 64 clients on one worker")
+	}
+}
+
+// TestSessionQueueHandoff checks a queued session gets the slot released by
+// an older session, while overflow and timeouts are still rejected
+func TestSessionQueueHandoff(t *testing.T) {
+	rl := NewRateLimiter(1, 100)
+	rl.EnableSessionQueue(1, 2*time.Second)
+	ip := "198.51.100.9:1000"
+	ctx := context.Background()
+
+	if !rl.AcquireSession(ctx, ip) {
+		t.Fatal("first session should get a slot")
+	}
+
+	got := make(chan bool)
+	go func() { got <- rl.AcquireSession(ctx, ip) }()
+	time.Sleep(50 * time.Millisecond) // let it enqueue
+
+	// Queue (len 1) is full: a third session is rejected immediately
+	start := time.Now()
+	if rl.AcquireSession(ctx, ip) {
+		t.Fatal("queue overflow should be rejected")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("overflow rejection should not wait")
+	}
+
+	// Another IP is unaffected by this IP's queue
+	if !rl.AcquireSession(ctx, "198.51.100.10:1000") {
+		t.Fatal("other IP should not be blocked")
+	}
+
+	rl.ReleaseSession(ip)
+	if !<-got {
+		t.Fatal("queued session should receive the released slot")
+	}
+	if sessions, _ := rl.Stats(); sessions != 2 {
+		t.Fatalf("slot handoff should keep the count at 2, got %d", sessions)
+	}
+
+	// With the slot held, a waiter times out
+	rl.EnableSessionQueue(1, 50*time.Millisecond)
+	if rl.AcquireSession(ctx, ip) {
+		t.Fatal("waiter should time out")
+	}
+	rl.mu.Lock()
+	left := len(rl.waiters)
+	rl.mu.Unlock()
+	if left != 0 {
+		t.Fatalf("timed-out waiter left in queue")
+	}
+}
+
+// TestLimitByOrigin checks two browsers behind one NAT get a budget each
+// when keyed by origin, and share one when not
+func TestLimitByOrigin(t *testing.T) {
+	const nat = "198.51.100.1:4000"
+	srv := &Server{dests: NewDestinationTable()}
+	connect := func(sess *Session) bool {
+		_, ok := srv.checkConnect(sess.rateLimiter, sess.remoteIP, sess.origin, nil, "203.0.113.7", 443)
+		return ok
+	}
+
+	for _, byOrigin := range []bool{false, true} {
+		rl := NewRateLimiter(1, 1)
+		if byOrigin {
+			rl.LimitByOrigin()
+		}
+		a := &Session{rateLimiter: rl, remoteIP: nat, origin: "https://a.example"}
+		b := &Session{rateLimiter: rl, remoteIP: "198.51.100.1:4001", origin: "https://b.example"}
+
+		if !rl.AcquireSessionFrom(context.Background(), a.remoteIP, a.origin) {
+			t.Fatalf("byOrigin=%v: first session refused", byOrigin)
+		}
+		if got := rl.AcquireSessionFrom(context.Background(), b.remoteIP, b.origin); got != byOrigin {
+			t.Errorf("byOrigin=%v: second origin's session allowed=%v", byOrigin, got)
+		}
+		if !connect(a) {
+			t.Fatalf("byOrigin=%v: first connect refused", byOrigin)
+		}
+		if got := connect(b); got != byOrigin {
+			t.Errorf("byOrigin=%v: second origin's connect allowed=%v", byOrigin, got)
+		}
+		if connect(a) {
+			t.Errorf("byOrigin=%v: origin went over its quota", byOrigin)
+		}
+	}
+
+	// No Origin header (non-browser clients) falls back to the IP
+	rl := NewRateLimiter(1, 1)
+	rl.LimitByOrigin()
+	if !rl.TryConnectionFrom(nat, "") || rl.TryConnectionFrom("198.51.100.1:5000", "") {
+		t.Error("clients without an origin weren't keyed by IP")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := NewRateLimiter(3, 5)
+	now := time.Now()
+	old := now.Add(-25 * time.Hour)
+	for _, ip := range []string{"old", "busy", "fresh"} {
+		rl.ipConnections[ip] = &connWindow{}
+		rl.ipConnections[ip].add(old, 1)
+	}
+	rl.ipConnections["fresh"].add(now, 1)
+	rl.ipSessions["busy"] = 1 // still connected
+
+	rl.Sweep(now)
+
+	if _, ok := rl.ipConnections["old"]; ok {
+		t.Error("old entry not swept")
+	}
+	for _, ip := range []string{"busy", "fresh"} {
+		if _, ok := rl.ipConnections[ip]; !ok {
+			t.Errorf("%s entry swept", ip)
+		}
+	}
+}
+
+func TestRateLimiterPrefixGrouping(t *testing.T) {
+	rl := NewRateLimiter(3, 1)
+	if err := rl.GroupByPrefix(24, 64); err != nil {
+		t.Fatal(err)
+	}
+	if !rl.TryConnection("[2001:db8:1:2::1]:4000") {
+		t.Fatal("first connection refused")
+	}
+	if rl.TryConnection("[2001:db8:1:2:ffff::9]:4000") {
+		t.Error("second address in the same /64 got its own quota")
+	}
+	if !rl.TryConnection("[2001:db8:1:3::1]:4000") {
+		t.Error("address in a different /64 shares the quota")
+	}
+	if !rl.TryConnection("192.0.2.1:4000") || rl.TryConnection("192.0.2.200:4000") {
+		t.Error("IPv4 /24 not grouped")
+	}
+	if !rl.TryConnection("[::ffff:192.0.3.1]:4000") {
+		t.Error("v4-mapped address in another /24 refused")
+	}
+	if got := rl.extractIP("[2001:db8:1:2::1]:4000"); got != "2001:db8:1:2::/64" {
+		t.Errorf("key = %q", got)
+	}
+
+	if err := rl.GroupByPrefix(0, 64); err == nil {
+		t.Error("/0 accepted")
+	}
+	if got := NewRateLimiter(1, 1).extractIP("[2001:db8::1]:80"); got != "2001:db8::1" {
+		t.Errorf("default key = %q, want the bare address", got)
+	}
+}
+
+func TestRateLimiterExempt(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimiter(1, 1)
+	rl.Exempt(nets)
+
+	for _, addr := range []string{"10.1.2.3:5000", "[2001:db8::1]:5000"} {
+		for i := 0; i < 3; i++ {
+			if !rl.TryAcquireSession(addr) || !rl.AcquireSession(context.Background(), addr) {
+				t.Fatalf("%s: session %d refused", addr, i)
+			}
+			if !rl.TryConnection(addr) {
+				t.Fatalf("%s: connection %d refused", addr, i)
+			}
+		}
+		rl.ReleaseSession(addr)
+	}
+	if total, ips := rl.Stats(); total != 0 || ips != 0 {
+		t.Errorf("exempt clients were counted: %d sessions from %d IPs", total, ips)
+	}
+	if len(rl.ipConnections) != 0 {
+		t.Errorf("exempt connections were counted: %v", rl.ipConnections)
+	}
+
+	// Everyone else is still limited
+	if !rl.TryConnection("192.0.2.1:5000") || rl.TryConnection("192.0.2.1:5000") {
+		t.Error("non-exempt client not limited")
+	}
+}
+
+// TestQuicCloseReason checks QUIC connection errors are described by cause
+func TestQuicCloseReason(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{&quic.IdleTimeoutError{}, "idle timeout"},
+		{&quic.StatelessResetError{}, "stateless reset"},
+		{&quic.ApplicationError{Remote: true, ErrorCode: 0x10, ErrorMessage: "bye"}, "closed by client (code 0x10): bye"},
+		{&quic.TransportError{ErrorCode: quic.NoViablePathError}, "transport error from proxy"},
+		{fmt.Errorf("wrapped: %w", &quic.HandshakeTimeoutError{}), "handshake timeout"},
+	}
+	for _, c := range cases {
+		if got := quicCloseReason(c.err); !strings.Contains(got, c.want) {
+			t.Errorf("quicCloseReason(%v) = %q, want it to contain %q", c.err, got, c.want)
+		}
+	}
+}
+
+// TestAcceptPrecedesData connects many external clients at once, each
+// writing immediately, and checks every accepted connection's first event
+// (in timestamp order) is MsgAccept
+func TestAcceptPrecedesData(t *testing.T) {
+	setupTestServer(t)
+
+	session := connectToProxyPath(t, "/connect?event_ts=1")
+	defer session.CloseWithError(0, "test done")
+
+	const clients = 20
+	listenID := uint32(200)
+	listenPort := uint16(19877)
+
+	send := func(msg []byte) {
+		str, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		str.Write(msg)
+		str.Close()
+	}
+
+	bind := []byte{MsgBind, 0, 0, 0, 0, SOCK_STREAM, 0, 0}
+	binary.BigEndian.PutUint32(bind[1:5], listenID)
+	binary.BigEndian.PutUint16(bind[6:8], listenPort)
+	send(bind)
+	time.Sleep(100 * time.Millisecond)
+
+	listen := []byte{MsgListen, 0, 0, 0, 0, 0, 0, 0, clients}
+	binary.BigEndian.PutUint32(listen[1:5], listenID)
+	send(listen)
+	time.Sleep(100 * time.Millisecond)
+
+	events := readEvents(session, true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort), 2*time.Second)
+			if err != nil {
+				t.Errorf("client %d: %v", i, err)
+				return
+			}
+			defer c.Close()
+			c.Write([]byte("hello"))
+			time.Sleep(time.Second) // keep open until its data has been read
+		}()
+	}
+
+	var got []testEvent
+	accepts, data := 0, 0
+	timeout := time.After(5 * time.Second)
+	for accepts < clients || data < clients {
+		select {
+		case ev := <-events:
+			switch ev.msgType {
+			case MsgAccept:
+				accepts++
+			case MsgData:
+				data++
+			default:
+				continue
+			}
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatalf("timed out with %d accepts, %d data events", accepts, data)
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(got, func(i, j int) bool { return got[i].ts < got[j].ts })
+	seen := make(map[uint32]bool)
+	for i, ev := range got {
+		if i > 0 && ev.ts == got[i-1].ts {
+			t.Fatalf("duplicate event timestamp %d", ev.ts)
+		}
+		if !seen[ev.connID] && ev.msgType != MsgAccept {
+			t.Fatalf("conn %d: first event is 0x%02x, want MsgAccept", ev.connID, ev.msgType)
+		}
+		seen[ev.connID] = true
+	}
+}
+
+// TestIdleReadLatency checks a byte arriving on a connection that has been
+// idle for a while is forwarded at once, not on the next poll tick
+func TestIdleReadLatency(t *testing.T) {
+	setupTestServer(t)
+
+	session := connectToProxy(t)
+	defer session.CloseWithError(0, "test done")
+
+	listenID := uint32(210)
+	listenPort := uint16(19878)
+	send := func(msg []byte) {
+		str, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		str.Write(msg)
+		str.Close()
+	}
+
+	bind := []byte{MsgBind, 0, 0, 0, 0, SOCK_STREAM, 0, 0}
+	binary.BigEndian.PutUint32(bind[1:5], listenID)
+	binary.BigEndian.PutUint16(bind[6:8], listenPort)
+	send(bind)
+	time.Sleep(100 * time.Millisecond)
+	listen := []byte{MsgListen, 0, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint32(listen[1:5], listenID)
+	send(listen)
+	time.Sleep(100 * time.Millisecond)
+
+	events := readEvents(session, false)
+	waitFor := func(msgType byte, within time.Duration) {
+		t.Helper()
+		timeout := time.After(within)
+		for {
+			select {
+			case ev := <-events:
+				if ev.msgType == msgType {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no 0x%02x event within %v", msgType, within)
+			}
+		}
+	}
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(MsgAccept, 2*time.Second)
+
+	time.Sleep(time.Second)
+	start := time.Now()
+	c.Write([]byte{'x'})
+	waitFor(MsgData, time.Second)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("byte after idle period took %v to arrive", d)
+	}
+}
+
+// readerStream is a request stream whose payload is already known
+type readerStream struct {
+	webtransport.Stream
+	r io.Reader
+}
+
+func (s readerStream) Read(p []byte) (int, error) { return s.r.Read(p) }
+
+func TestCloseWrite(t *testing.T) {
+	conn, remote := tcpPair(t)
+	sess := &Session{ctx: context.Background()}
+	sess.connections.Store(conn.id, conn)
+	conn.dest = &Destination{} // would be pooled if it weren't half-closed
+
+	req := binary.BigEndian.AppendUint32(nil, conn.id)
+	sess.handleCloseWrite(readerStream{r: strings.NewReader(string(req))})
+
+	// The peer sees EOF...
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := remote.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("peer read %d, %v; want EOF", n, err)
+	}
+	// ...and can still answer, which the proxy side can still read
+	remote.Write([]byte("response"))
+	conn.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := conn.conn.Read(buf); err != nil || string(buf[:n]) != "response" {
+		t.Fatalf("proxy read %q, %v", buf[:n], err)
+	}
+
+	if _, ok := sess.connections.Load(conn.id); !ok {
+		t.Fatal("half-closed connection removed from the session")
+	}
+	if sess.parkConnection(conn) {
+		t.Fatal("half-closed connection was pooled")
+	}
+}
+
+func TestBindEphemeralPort(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	for i, sockType := range []byte{SOCK_STREAM, SOCK_DGRAM} {
+		connID := uint32(i + 1)
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, sockType, 0, 0) // port 0
+		go sess.handleBind(readerStream{r: strings.NewReader(string(req))})
+
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType != MsgConnected || len(ev.data) < 2 {
+			t.Fatalf("type %d: got event %#x %q, want MsgConnected with an address", sockType, ev.msgType, ev.data)
+		}
+		addr := string(ev.data[2:])
+		if int(binary.BigEndian.Uint16(ev.data)) != len(addr) {
+			t.Fatalf("type %d: addrLen %d for %q", sockType, binary.BigEndian.Uint16(ev.data), addr)
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil || port == "0" {
+			t.Fatalf("type %d: bound address %q", sockType, addr)
+		}
+
+		v, _ := sess.connections.Load(connID)
+		conn := v.(*Connection)
+		defer conn.Close()
+		if sockType == SOCK_STREAM {
+			c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+			if err != nil {
+				t.Fatalf("reported port %s isn't listening: %v", port, err)
+			}
+			c.Close()
+		}
+	}
+}
+
+// TestBindAddress checks MsgBind's optional address picks the interface
+// and is checked against -bind-cidrs
+func TestBindAddress(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.srv.bindNets = mustParseCIDRs(defaultBindCIDRs) })
+
+	for i, tc := range []struct {
+		sockType byte
+		addr     string
+		wantIP   string // empty = want MsgError
+	}{
+		{SOCK_STREAM, "127.0.0.1", "127.0.0.1"},
+		{SOCK_DGRAM, "127.0.0.1", "127.0.0.1"},
+		{SOCK_STREAM, "0.0.0.0", "0.0.0.0"},
+		{SOCK_STREAM, "", "0.0.0.0"}, // empty keeps the old all-interfaces bind
+		{SOCK_STREAM, "192.0.2.1", ""},
+		{SOCK_STREAM, "not-an-ip", ""},
+	} {
+		connID := uint32(i + 1)
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, tc.sockType, 0, 0)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(tc.addr)))
+		req = append(req, tc.addr...)
+		go sess.handleBind(readerStream{r: bytes.NewReader(req)})
+
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantIP == "" {
+			if ev.msgType != MsgError {
+				t.Errorf("bind %q: got event %#x, want MsgError", tc.addr, ev.msgType)
+			}
+			continue
+		}
+		if ev.msgType != MsgConnected || len(ev.data) < 2 {
+			t.Fatalf("bind %q: got event %#x %q, want MsgConnected", tc.addr, ev.msgType, ev.data)
+		}
+		// Go may report an IPv4 wildcard bind as the dual-stack [::]
+		host, _, _ := net.SplitHostPort(string(ev.data[2:]))
+		got, want := net.ParseIP(host), net.ParseIP(tc.wantIP)
+		if !got.Equal(want) && !(got.IsUnspecified() && want.IsUnspecified()) {
+			t.Errorf("bind %q: bound %q, want %s", tc.addr, ev.data[2:], tc.wantIP)
+		}
+		v, _ := sess.connections.Load(connID)
+		v.(*Connection).Close()
+		if tc.sockType == SOCK_DGRAM {
+			// udpReadLoop reports the socket closed
+			if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgClosed || ev.connID != connID {
+				t.Fatalf("bind %q: got event %#x, %v after close, want MsgClosed", tc.addr, ev.msgType, err)
+			}
+		}
+	}
+}
+
+// TestClosedByteCounts checks MsgClosed reports the bytes that crossed the
+// connection each way
+func TestClosedByteCounts(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	req := binary.BigEndian.AppendUint32(nil, conn.id)
+	req = binary.BigEndian.AppendUint32(req, 1000)
+	req = append(req, bytes.Repeat([]byte("x"), 1000)...)
+	sess.handleSend(readerStream{r: bytes.NewReader(req)})
+	if _, err := io.ReadFull(remote, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	remote.Write(bytes.Repeat([]byte("y"), 300))
+	remote.Close()
+
+	received := 0
+	for {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType == MsgData {
+			received += len(ev.data)
+			continue
+		}
+		if ev.msgType != MsgClosed || len(ev.data) != 16 {
+			t.Fatalf("got event %#x %x, want MsgClosed with byte counts", ev.msgType, ev.data)
+		}
+		in, out := binary.BigEndian.Uint64(ev.data[0:8]), binary.BigEndian.Uint64(ev.data[8:16])
+		if in != 300 || out != 1000 || received != 300 {
+			t.Fatalf("bytesIn %d bytesOut %d (MsgData carried %d), want 300 and 1000", in, out, received)
+		}
+		break
+	}
+
+	// Closing an unknown connection still sends the fixed layout
+	go sess.handleClose(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, 99))})
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgClosed || ev.connID != 99 || !bytes.Equal(ev.data, make([]byte, 16)) {
+		t.Fatalf("got event %#x conn %d %x, want zeroed MsgClosed", ev.msgType, ev.connID, ev.data)
+	}
+}
+
+// TestCloseDrainsPendingData checks MsgClose relays what the remote host
+// already sent before reporting MsgClosed, and MsgShutdown doesn't wait
+func TestCloseDrainsPendingData(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.closeDrain = 5 * time.Second })
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	// More than one read's worth, so most of it is still in the socket
+	// when the container closes
+	payload := bytes.Repeat([]byte("z"), 4*readBufSize)
+	go func() {
+		remote.Write(payload)
+		// The proxy's FIN arrives once the container has closed
+		if n, err := remote.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("remote read %d, %v, want EOF", n, err)
+		}
+		remote.Close()
+	}()
+	go sess.handleClose(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, conn.id))})
+
+	received := 0
+	for {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType == MsgData {
+			received += len(ev.data)
+			continue
+		}
+		if ev.msgType != MsgClosed {
+			t.Fatalf("got event %#x", ev.msgType)
+		}
+		if in := binary.BigEndian.Uint64(ev.data[0:8]); received != len(payload) || in != uint64(len(payload)) {
+			t.Fatalf("MsgClosed after %d bytes (bytesIn %d), want all %d", received, in, len(payload))
+		}
+		break
+	}
+	if !conn.closed.Load() {
+		t.Fatal("drained connection left open")
+	}
+
+	// MsgShutdown closes at once, even with the remote host still sending
+	aborted, busy := tcpPair(t)
+	aborted.id = 2
+	sess.connections.Store(aborted.id, aborted)
+	busy.Write([]byte("unread"))
+	go sess.handleShutdown(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, aborted.id))})
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgClosed || ev.connID != 2 || !aborted.closed.Load() {
+		t.Fatalf("got event %#x conn %d, want MsgClosed with the socket closed", ev.msgType, ev.connID)
+	}
+}
+
+// TestShutdownReportsOnce checks MsgShutdown on a connection with a
+// readLoop reports it closed once, and refuses a connID it doesn't know
+func TestShutdownReportsOnce(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	conn, _ := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	go sess.handleShutdown(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, conn.id))})
+	if n := closedEvents(t, pr, conn.id, 500*time.Millisecond); n != 1 {
+		t.Fatalf("got %d MsgClosed events, want 1", n)
+	}
+
+	sess, pr = newTestSession(t, nil)
+	go sess.handleShutdown(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, 99))})
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgError || ev.connID != 99 {
+		t.Fatalf("got event %#x conn %d, want MsgError for 99", ev.msgType, ev.connID)
+	}
+}
+
+// setTimeoutRequest is MsgSetTimeout's body: connID (4), read timeout ms
+// (4), write timeout ms (4)
+func setTimeoutRequest(connID uint32, read, write time.Duration) readerStream {
+	req := binary.BigEndian.AppendUint32(nil, connID)
+	req = binary.BigEndian.AppendUint32(req, uint32(read.Milliseconds()))
+	req = binary.BigEndian.AppendUint32(req, uint32(write.Milliseconds()))
+	return readerStream{r: bytes.NewReader(req)}
+}
+
+// TestSetTimeoutRead checks a read timeout sends MsgTimeout once per idle
+// period, rearmed by data, and a timeout of 0 clears it
+func TestSetTimeoutRead(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+
+	events := make(chan testEvent, 16)
+	go func() {
+		for {
+			ev, err := readEvent(pr, false)
+			if err != nil {
+				return
+			}
+			events <- ev
+		}
+	}()
+	next := func(within time.Duration) (testEvent, bool) {
+		select {
+		case ev := <-events:
+			return ev, true
+		case <-time.After(within):
+			return testEvent{}, false
+		}
+	}
+	timedOut := func() {
+		t.Helper()
+		ev, ok := next(2 * time.Second)
+		if !ok || ev.msgType != MsgTimeout || ev.connID != conn.id || !bytes.Equal(ev.data, []byte{timeoutRead}) {
+			t.Fatalf("got event %#x %x (%v), want MsgTimeout for a read", ev.msgType, ev.data, ok)
+		}
+	}
+
+	start := time.Now()
+	sess.handleSetTimeout(setTimeoutRequest(conn.id, 100*time.Millisecond, 0))
+	timedOut()
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("MsgTimeout after %v, want at least 100ms", d)
+	}
+	// Once per idle period
+	if ev, ok := next(300 * time.Millisecond); ok {
+		t.Fatalf("got event %#x while still idle", ev.msgType)
+	}
+
+	// Data rearms it
+	remote.Write([]byte("x"))
+	if ev, ok := next(2 * time.Second); !ok || ev.msgType != MsgData {
+		t.Fatalf("got event %#x (%v), want MsgData", ev.msgType, ok)
+	}
+	timedOut()
+
+	// 0 clears it; data still flows
+	sess.handleSetTimeout(setTimeoutRequest(conn.id, 0, 0))
+	remote.Write([]byte("y"))
+	if ev, ok := next(2 * time.Second); !ok || ev.msgType != MsgData {
+		t.Fatalf("got event %#x (%v), want MsgData", ev.msgType, ok)
+	}
+	if ev, ok := next(400 * time.Millisecond); ok {
+		t.Fatalf("got event %#x with the timeout cleared", ev.msgType)
+	}
+}
+
+// BenchmarkWriteEvent measures framing cost per MsgData event (the stream
+// open is excluded; it dominates but isn't ours to optimize)
+func BenchmarkWriteEvent(b *testing.B) {
+	data := make([]byte, 1400)
+	for _, bc := range []struct {
+		name string
+		ts   int64
+	}{{"plain", 0}, {"timestamped", time.Now().UnixNano()}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := writeEvent(io.Discard, MsgData, 7, bc.ts, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadLoopThroughput drives readLoop over in-memory pipes; the
+// session has ended, so sendEvent returns at once and only readLoop's own
+// cost shows. "conns" is the short-lived connection case the read buffer
+// pool is for.
+func BenchmarkReadLoopThroughput(b *testing.B) {
+	ended, end := context.WithCancel(context.Background())
+	end()
+	sess := &Session{ctx: ended}
+	chunk := make([]byte, 16*1024)
+
+	run := func(b *testing.B, chunks int) {
+		local, remote := net.Pipe()
+		conn := newConnection(1, SOCK_STREAM)
+		conn.conn = local
+		done := make(chan struct{})
+		go func() {
+			sess.readLoop(conn)
+			close(done)
+		}()
+		for i := 0; i < chunks; i++ {
+			if _, err := remote.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		remote.Close()
+		<-done
+		local.Close()
+	}
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(chunk)))
+		run(b, b.N)
+	})
+	b.Run("conns", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(chunk)))
+		for i := 0; i < b.N; i++ {
+			run(b, 1)
+		}
+	})
+}
+
+// TestBindAPIDisabled checks -api-disable leaves the API port closed
+// while the WebTransport socket is still bound
+func TestBindAPIDisabled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiAddr := ln.Addr().String()
+	ln.Close()
+
+	s := NewServer("127.0.0.1:0", testCertFile, testKeyFile, NewRateLimiter(1, 1), nil)
+	if err := s.Bind(""); err != nil {
+		t.Fatal(err)
+	}
+	if s.packetConn == nil || s.apiListener != nil {
+		t.Fatalf("bound packetConn %v, apiListener %v", s.packetConn, s.apiListener)
+	}
+	defer s.packetConn.Close()
+	if c, err := net.DialTimeout("tcp", apiAddr, time.Second); err == nil {
+		c.Close()
+		t.Fatalf("something is listening on %s", apiAddr)
+	}
+
+	// And with an address, the API socket is opened there
+	s = NewServer("127.0.0.1:0", testCertFile, testKeyFile, NewRateLimiter(1, 1), nil)
+	if err := s.Bind(apiAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.packetConn.Close()
+	defer s.apiListener.Close()
+	if got := s.apiListener.Addr().String(); got != apiAddr {
+		t.Fatalf("API bound to %s, want %s", got, apiAddr)
+	}
+}
+
+// forwardSession returns a session holding an accepted connection, its
+// readLoop running, whose MsgForward destinations all dial upstream; client
+// is the peer that connected in
+func forwardSession(t *testing.T, tbl *DestinationTable, upstream net.Conn) (*Session, *Connection, net.Conn, io.Reader) {
+	t.Helper()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return upstream, nil
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	conn, client := tcpPair(t)
+	conn.readDone = make(chan struct{})
+	sess.connections.Store(conn.id, conn)
+	go sess.readLoop(conn)
+	return sess, conn, client, pr
+}
+
+// forwardRequest is MsgForward's body: connID (4), hostLen (2), host, port (2)
+func forwardRequest(connID uint32, host string, port uint16) readerStream {
+	req := binary.BigEndian.AppendUint32(nil, connID)
+	req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, port)
+	return readerStream{r: bytes.NewReader(req)}
+}
+
+func TestForwardSplice(t *testing.T) {
+	local, upstream := net.Pipe()
+	defer upstream.Close()
+	sess, conn, client, events := forwardSession(t, NewDestinationTable(), local)
+
+	go sess.handleForward(forwardRequest(conn.id, "upstream.example", 443))
+	ev, err := readEvent(events, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgConnected || ev.connID != conn.id {
+		t.Fatalf("got event %#x conn %d, want MsgConnected", ev.msgType, ev.connID)
+	}
+
+	// Both ways, without passing through the session
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(upstream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("upstream read %q, %v", buf, err)
+	}
+	upstream.Write([]byte("pong"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+	if !conn.forwarding.Load() {
+		t.Fatal("connection not marked forwarding")
+	}
+}
+
+func TestForwardDenied(t *testing.T) {
+	local, upstream := net.Pipe()
+	defer upstream.Close()
+	tbl := NewDestinationTable()
+	tbl.denied, _ = newHostDenyList("*.c2.example", "")
+	sess, conn, client, events := forwardSession(t, tbl, local)
+	sess.token = &Token{TokenSpec: TokenSpec{Name: "ci", Expires: time.Now().Add(-time.Minute)}}
+
+	for _, tc := range []struct {
+		host     string
+		category string
+	}{
+		{"beacon.c2.example", PolicyHostDenied},
+		{"169.254.169.254", PolicyBlocked},
+		{"upstream.example", PolicyTokenExpired},
+	} {
+		go sess.handleForward(forwardRequest(conn.id, tc.host, 443))
+		ev, err := readEvent(events, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d PolicyDecision
+		if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != tc.category {
+			t.Errorf("%s: got event %#x %s, want %s", tc.host, ev.msgType, ev.data, tc.category)
+		}
+	}
+
+	// The accepted connection is still the container's to read
+	if conn.forwarding.Load() || conn.closed.Load() {
+		t.Fatal("refused forward took over the connection")
+	}
+	client.Write([]byte("x"))
+	if ev, err := readEvent(events, false); err != nil || ev.msgType != MsgData {
+		t.Fatalf("got event %#x, %v, want MsgData", ev.msgType, err)
+	}
+}
+
+// TestForwardCloseTearsDown checks MsgClose on a forwarded connection
+// closes both sides and reports it once
+func TestForwardCloseTearsDown(t *testing.T) {
+	local, upstream := net.Pipe()
+	defer upstream.Close()
+	sess, conn, client, events := forwardSession(t, NewDestinationTable(), local)
+
+	go sess.handleForward(forwardRequest(conn.id, "upstream.example", 443))
+	if ev, err := readEvent(events, false); err != nil || ev.msgType != MsgConnected {
+		t.Fatalf("got event %#x, %v, want MsgConnected", ev.msgType, err)
+	}
+
+	go sess.handleClose(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, conn.id))})
+	if n := closedEvents(t, events, conn.id, 500*time.Millisecond); n != 1 {
+		t.Fatalf("got %d MsgClosed events, want 1", n)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read: %v, want EOF", err)
+	}
+	upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := upstream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("upstream read: %v, want EOF", err)
+	}
+}
+
+// TestForwardCloseRace closes a forwarded connection from both ends at
+// once: the upstream hanging up while MsgClose arrives. Whichever of
+// splice and handleClose gets there first reports it, and only once.
+func TestForwardCloseRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		local, upstream := net.Pipe()
+		sess, conn, _, events := forwardSession(t, NewDestinationTable(), local)
+
+		go sess.handleForward(forwardRequest(conn.id, "upstream.example", 443))
+		if ev, err := readEvent(events, false); err != nil || ev.msgType != MsgConnected {
+			t.Fatalf("got event %#x, %v, want MsgConnected", ev.msgType, err)
+		}
+
+		go upstream.Close()
+		go sess.handleClose(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(nil, conn.id))})
+		if n := closedEvents(t, events, conn.id, 100*time.Millisecond); n != 1 {
+			t.Fatalf("run %d: got %d MsgClosed events, want 1", i, n)
+		}
+	}
+}
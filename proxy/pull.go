@@ -0,0 +1,549 @@
+// pull.go - Docker Pull API (HTTP on -api-listen, behind Caddy reverse proxy)
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// defaultMaxQueryLen bounds API query parameters; image references are at
+// most 255 characters of name plus a tag or digest
+const defaultMaxQueryLen = 512
+
+// apiMux routes the API server
+func (s *Server) apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/pull", s.handleDockerPull)
+	mux.HandleFunc("/inspect", s.handleInspect)
+	mux.HandleFunc("/search", s.handleDockerSearch)
+
+	// Liveness (/livez), health (/health) and readiness (/ready, /readyz);
+	// see health.go. CORS handled by Caddy reverse proxy
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/admin/transport", s.adminOnly(s.handleAdminTransport))
+	mux.HandleFunc("GET /admin/sessions", s.adminOnly(s.handleAdminSessions))
+	mux.HandleFunc("GET /admin/dashboard", s.adminOnly(s.handleAdminDashboard))
+	mux.HandleFunc("GET /dashboard", s.handleDashboard)
+	mux.HandleFunc("POST /admin/sessions/{id}/close", s.adminOnly(s.handleAdminCloseSession))
+	return mux
+}
+
+func (s *Server) RunAPIServer(apiListen string) error {
+	srv := &http.Server{
+		Addr:           apiListen,
+		Handler:        s.apiMux(),
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   10 * time.Minute, // large images take time to stream
+		MaxHeaderBytes: 64 << 10,         // includes the request line, bounding URLs
+	}
+	s.srvMu.Lock()
+	s.apiServer = srv
+	s.srvMu.Unlock()
+	if s.ctx.Err() != nil {
+		return http.ErrServerClosed
+	}
+
+	if s.apiTLS {
+		if _, err := s.loadCert(); err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: s.getCertificate}
+		s.tlsPolicy.Apply(srv.TLSConfig)
+
+		slog.Info("API server listening", "url", "https://"+wildcardHost(apiListen))
+		if s.apiListener != nil {
+			return srv.ServeTLS(s.apiListener, "", "")
+		}
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	slog.Info("API server listening behind reverse proxy", "url", "http://"+wildcardHost(apiListen))
+	if s.apiListener != nil {
+		return srv.Serve(s.apiListener)
+	}
+	return srv.ListenAndServe()
+}
+
+// wildcardHost spells out the host of a ":port" listen address for logging
+func wildcardHost(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "0.0.0.0" + addr
+	}
+	return addr
+}
+
+func (s *Server) corsHeaders(w http.ResponseWriter) {
+	// CORS allow-origin/methods/headers handled by Caddy; only expose-headers needed here
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Image-Name, X-Image-Arch, X-Image-Digest, X-Image-Config-Digest, X-Image-Compressed-Size")
+}
+
+func (s *Server) handleDockerPull(w http.ResponseWriter, r *http.Request) {
+	s.corsHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	req, ok := s.imageRequest(w, r)
+	if !ok {
+		return
+	}
+	imageRef := req.imageRef
+
+	slog.Info("pull", "image", req.ref.String(), "remote_ip", r.RemoteAddr)
+
+	span := s.tracer.Start("pull", r.Header.Get("traceparent"), SpanKindServer)
+	span.SetAttr("friscy.image", req.ref.String())
+	defer span.End()
+
+	release, ok := s.acquirePull(w, r.RemoteAddr)
+	if !ok {
+		return
+	}
+	defer release()
+
+	img, platform, err := s.resolveRequest(req)
+	if err != nil {
+		span.Fail(err.Error())
+		http.Error(w, fmt.Sprintf("failed to pull image: %v", err), resolveStatus(err))
+		return
+	}
+	span.SetAttr("friscy.arch", platform.Architecture)
+
+	// Resolve digests before streaming so clients can cache by digest and
+	// notice when an upstream tag has moved
+	digest, err := img.Digest()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to resolve image digest: %v", err), http.StatusBadGateway)
+		return
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to resolve config digest: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	size, sizeErr := compressedImageSize(img)
+	if s.maxImageBytes > 0 {
+		if sizeErr != nil {
+			http.Error(w, fmt.Sprintf("failed to size image: %v", sizeErr), http.StatusBadGateway)
+			return
+		}
+		if size > s.maxImageBytes {
+			http.Error(w, fmt.Sprintf("image is %d bytes compressed, over the %d byte limit", size, s.maxImageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("X-Image-Name", imageRef)
+	w.Header().Set("X-Image-Arch", platform.Architecture)
+	w.Header().Set("X-Image-Digest", digest.String())
+	w.Header().Set("X-Image-Config-Digest", configDigest.String())
+
+	slog.Info("pull resolved, exporting", "image", imageRef, "arch", platform.Architecture, "digest", digest)
+
+	// The flattened tar size isn't known until export finishes, but the sum of
+	// compressed layer sizes gives clients a progress estimate
+	if sizeErr == nil {
+		w.Header().Set("X-Image-Compressed-Size", strconv.FormatInt(size, 10))
+	}
+
+	// Can't set a status code once streaming starts, so completeness is
+	// reported in trailers: clients must see X-Export-Status: ok and may
+	// check the tar against X-Export-Sha256/X-Export-Bytes
+	w.Header().Set("Trailer", "X-Export-Status, X-Export-Sha256, X-Export-Bytes")
+
+	hash := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(w, hash)}
+
+	if s.imageCache != nil {
+		// Nothing has been written yet, so a failed export can still get
+		// a proper status
+		key := digest.Hex + "-" + platform.Architecture
+		f, hit, err := s.imageCache.Open(key, func(tw io.Writer) error { return crane.Export(img, s.limitExport(tw)) })
+		if err != nil {
+			span.Fail(err.Error())
+			slog.Error("export failed", "image", imageRef, "err", err)
+			status := http.StatusBadGateway
+			if errors.Is(err, errImageTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("failed to export image: %v", err), status)
+			return
+		}
+		defer f.Close()
+		if hit {
+			w.Header().Set("X-Image-Cache", "hit")
+		} else {
+			w.Header().Set("X-Image-Cache", "miss")
+		}
+		if _, err := io.Copy(cw, f); err != nil {
+			span.Fail(err.Error())
+			slog.Warn("cached export send failed", "image", imageRef, "bytes", cw.n, "err", err)
+			w.Header().Set("X-Export-Status", "error")
+			return
+		}
+	} else if err := crane.Export(img, s.limitExport(cw)); err != nil {
+		// Export flattened filesystem as tar directly to response
+		span.Fail(err.Error())
+		slog.Error("export failed", "image", imageRef, "bytes", cw.n, "err", err)
+		w.Header().Set("X-Export-Status", "error")
+		return
+	}
+
+	w.Header().Set("X-Export-Status", "ok")
+	w.Header().Set("X-Export-Sha256", hex.EncodeToString(hash.Sum(nil)))
+	w.Header().Set("X-Export-Bytes", strconv.FormatInt(cw.n, 10))
+	span.SetAttr("friscy.bytes", cw.n)
+	slog.Info("export finished", "image", imageRef, "bytes", cw.n)
+}
+
+// imageReq is a validated /pull or /inspect request
+type imageReq struct {
+	imageRef string
+	ref      name.Reference
+	order    []v1.Platform
+	auth     remote.Option
+	authKey  string
+	digest   *v1.Hash // ?digest=: the manifest the pull must resolve to
+}
+
+// imageRequest parses the image, arch order and credentials of an image API
+// request, answering 400 when any is invalid
+func (s *Server) imageRequest(w http.ResponseWriter, r *http.Request) (*imageReq, bool) {
+	imageRef, ok := s.queryParam(w, r, "image")
+	if !ok {
+		return nil, false
+	}
+
+	// Validate image reference
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid image reference: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	auth, authKey, err := s.pullAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	order := s.archOrder
+	if arch := r.URL.Query().Get("arch"); arch != "" {
+		if order, err = parseArchOrder(arch); err != nil {
+			http.Error(w, fmt.Sprintf("invalid ?arch= parameter: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	req := &imageReq{imageRef: imageRef, ref: ref, order: order, auth: auth, authKey: authKey}
+	if d := r.URL.Query().Get("digest"); d != "" {
+		h, err := v1.NewHash(d)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ?digest= parameter: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+		req.digest = &h
+	}
+	return req, true
+}
+
+// acquirePull charges an image API request to the pull quota (concurrent +
+// daily), which is independent of the WebTransport networking limiter. The
+// returned release must be called once the request is done.
+func (s *Server) acquirePull(w http.ResponseWriter, remoteIP string) (func(), bool) {
+	if s.pullLimiter == nil {
+		return func() {}, true
+	}
+	if !s.pullLimiter.TryAcquireSession(remoteIP) {
+		http.Error(w, "too many concurrent pulls", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if !s.pullLimiter.TryConnection(remoteIP) {
+		s.pullLimiter.ReleaseSession(remoteIP)
+		http.Error(w, "daily pull limit exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return func() { s.pullLimiter.ReleaseSession(remoteIP) }, true
+}
+
+// defaultArchOrder is what /pull tries when neither ?arch= nor
+// -default-arch-order says otherwise
+var defaultArchOrder = []v1.Platform{
+	{OS: "linux", Architecture: "riscv64"},
+	{OS: "linux", Architecture: "amd64"},
+}
+
+// maxArchOrder caps how many platforms one pull may try, each costing a
+// registry round trip
+const maxArchOrder = 8
+
+// parseArchOrder parses a comma-separated platform preference such as
+// "riscv64,arm64,amd64"; entries may carry a variant ("arm/v7")
+func parseArchOrder(s string) ([]v1.Platform, error) {
+	var order []v1.Platform
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		arch, variant, _ := strings.Cut(f, "/")
+		if !isArchName(arch) || (variant != "" && !isArchName(variant)) {
+			return nil, fmt.Errorf("invalid architecture %q", f)
+		}
+		order = append(order, v1.Platform{OS: "linux", Architecture: arch, Variant: variant})
+	}
+	if len(order) > maxArchOrder {
+		return nil, fmt.Errorf("too many architectures (max %d)", maxArchOrder)
+	}
+	return order, nil
+}
+
+func isArchName(s string) bool {
+	if s == "" || len(s) > 16 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// archOrderKey identifies an arch order for coalescing pulls
+func archOrderKey(order []v1.Platform) string {
+	names := make([]string, len(order))
+	for i, p := range order {
+		names[i] = p.Architecture
+		if p.Variant != "" {
+			names[i] += "/" + p.Variant
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// resolveImage looks ref up for each platform of order in turn, returning the
+// first that resolves. Concurrent pulls of one reference with the same order
+// and credentials (authKey) share a single lookup; with -cache-dir they share
+// the export too.
+func (s *Server) resolveImage(ref name.Reference, order []v1.Platform, auth remote.Option, authKey string) (v1.Image, v1.Platform, error) {
+	type resolved struct {
+		img      v1.Image
+		platform v1.Platform
+	}
+	key := ref.String() + "|" + archOrderKey(order) + "|" + authKey
+	v, err, shared := s.pulls.Do(key, func() (any, error) {
+		var err error
+		for _, platform := range order {
+			var img v1.Image
+			if img, err = s.remoteImage(ref, auth, remote.WithPlatform(platform)); err == nil {
+				return resolved{img, platform}, nil
+			}
+			slog.Info("platform not available", "image", ref, "platform", archOrderKey([]v1.Platform{platform}), "err", err)
+		}
+		return nil, err
+	})
+	if err != nil {
+		return nil, v1.Platform{}, err
+	}
+	if shared {
+		slog.Debug("sharing resolution with a concurrent pull", "image", ref)
+	}
+	r := v.(resolved)
+	return r.img, r.platform, nil
+}
+
+// errDigestMismatch means the reference no longer resolves to the ?digest=
+// the client pinned, typically because the tag has moved
+var errDigestMismatch = errors.New("image does not match pinned digest")
+
+// resolveRequest resolves an image API request. With ?digest= the platform
+// fallback is skipped: a manifest digest belongs to one platform, so the
+// pinned manifest is located in the index (or must be the image itself) and
+// the resolved image is checked against it.
+func (s *Server) resolveRequest(req *imageReq) (v1.Image, v1.Platform, error) {
+	if req.digest == nil {
+		return s.resolveImage(req.ref, req.order, req.auth, req.authKey)
+	}
+	platform, err := s.pinnedPlatform(req)
+	if err != nil {
+		return nil, v1.Platform{}, err
+	}
+	img, platform, err := s.resolveImage(req.ref, []v1.Platform{platform}, req.auth, req.authKey)
+	if err != nil {
+		return nil, v1.Platform{}, err
+	}
+	got, err := img.Digest()
+	if err != nil {
+		return nil, v1.Platform{}, err
+	}
+	if got != *req.digest {
+		return nil, v1.Platform{}, fmt.Errorf("%w: %s is %s, want %s", errDigestMismatch, req.ref, got, req.digest)
+	}
+	return img, platform, nil
+}
+
+// pinnedPlatform finds the platform of the manifest a request pinned
+func (s *Server) pinnedPlatform(req *imageReq) (v1.Platform, error) {
+	desc, err := remote.Get(req.ref, req.auth)
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	if !desc.MediaType.IsIndex() {
+		if desc.Digest != *req.digest {
+			return v1.Platform{}, fmt.Errorf("%w: %s is %s, want %s", errDigestMismatch, req.ref, desc.Digest, req.digest)
+		}
+		img, err := desc.Image()
+		if err != nil {
+			return v1.Platform{}, err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return v1.Platform{}, err
+		}
+		return v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	for _, m := range im.Manifests {
+		if m.Digest == *req.digest && m.Platform != nil {
+			return *m.Platform, nil
+		}
+	}
+	return v1.Platform{}, fmt.Errorf("%w: %s has no platform manifest %s", errDigestMismatch, req.ref, req.digest)
+}
+
+// resolveStatus maps a resolveRequest error to an HTTP status
+func resolveStatus(err error) int {
+	if errors.Is(err, errDigestMismatch) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// compressedImageSize sums the manifest's layer sizes
+func compressedImageSize(img v1.Image) (int64, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, l := range layers {
+		sz, err := l.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += sz
+	}
+	return total, nil
+}
+
+// countingWriter tracks how many bytes have been written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errImageTooLarge aborts an export that outgrows -max-image-bytes
+var errImageTooLarge = errors.New("image exceeds size limit")
+
+// capWriter refuses writes past its budget, so an image whose manifest
+// understates its layer sizes still can't stream without bound
+type capWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.left {
+		return 0, errImageTooLarge
+	}
+	n, err := c.w.Write(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+// limitExport caps an export at -max-image-bytes
+func (s *Server) limitExport(w io.Writer) io.Writer {
+	if s.maxImageBytes <= 0 {
+		return w
+	}
+	return &capWriter{w: w, left: s.maxImageBytes}
+}
+
+// queryParam returns a required query parameter, answering 400 when it is
+// missing or longer than maxQueryLen so no work is done on abusive requests
+func (s *Server) queryParam(w http.ResponseWriter, r *http.Request, key string) (string, bool) {
+	if len(r.URL.RawQuery) > 4*s.maxQueryLen {
+		http.Error(w, "query string too long", http.StatusBadRequest)
+		return "", false
+	}
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		http.Error(w, fmt.Sprintf("missing ?%s= parameter", key), http.StatusBadRequest)
+		return "", false
+	}
+	if len(v) > s.maxQueryLen {
+		http.Error(w, fmt.Sprintf("?%s= parameter too long (max %d bytes)", key, s.maxQueryLen), http.StatusBadRequest)
+		return "", false
+	}
+	return v, true
+}
+
+func (s *Server) handleDockerSearch(w http.ResponseWriter, r *http.Request) {
+	s.corsHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q, ok := s.queryParam(w, r, "q")
+	if !ok {
+		return
+	}
+
+	// Proxy Docker Hub search API
+	searchURL := "https://hub.docker.com/v2/search/repositories/?query=" + url.QueryEscape(q) + "&page_size=20"
+	resp, err := http.Get(searchURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("search failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+}
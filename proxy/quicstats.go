@@ -0,0 +1,214 @@
+// quicstats.go - RTT, congestion window and loss of each QUIC connection
+//
+// quic-go has no stats getter, so a logging.ConnectionTracer keeps a few
+// atomics up to date as the connection runs. Reading them is a snapshot,
+// never a walk through quic-go internals, so both consumers stay cheap:
+//
+//   - GET /admin/transport (Bearer -admin-token) lists every live session
+//     with its QUIC path stats
+//   - sessions that connect with /connect?transport_stats=N receive
+//     MsgTransportStats (connID 0, JSON QUICStats) every N seconds
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Bounds for the container-requested MsgTransportStats interval
+const (
+	minTransportStatsInterval = 1 * time.Second
+	maxTransportStatsInterval = 5 * time.Minute
+)
+
+// quicStats is updated from quic-go's connection goroutine
+type quicStats struct {
+	remote  string
+	started time.Time
+
+	smoothedRTT   atomic.Int64 // ns
+	minRTT        atomic.Int64
+	latestRTT     atomic.Int64
+	rttVar        atomic.Int64
+	cwnd          atomic.Int64 // bytes
+	bytesInFlight atomic.Int64
+
+	packetsSent     atomic.Int64
+	packetsReceived atomic.Int64
+	packetsLost     atomic.Int64
+	bytesSent       atomic.Int64
+	bytesReceived   atomic.Int64
+}
+
+// QUICStats is a point-in-time copy of a connection's quicStats
+type QUICStats struct {
+	Remote          string  `json:"remote"`
+	AgeSecs         int64   `json:"age_secs"`
+	SmoothedRTTMs   float64 `json:"smoothed_rtt_ms"`
+	MinRTTMs        float64 `json:"min_rtt_ms"`
+	LatestRTTMs     float64 `json:"latest_rtt_ms"`
+	RTTVarMs        float64 `json:"rtt_var_ms"`
+	CongestionWnd   int64   `json:"cwnd_bytes"`
+	BytesInFlight   int64   `json:"bytes_in_flight"`
+	PacketsSent     int64   `json:"packets_sent"`
+	PacketsReceived int64   `json:"packets_received"`
+	PacketsLost     int64   `json:"packets_lost"`
+	LossRate        float64 `json:"loss_rate"` // lost / sent
+	BytesSent       int64   `json:"bytes_sent"`
+	BytesReceived   int64   `json:"bytes_received"`
+}
+
+func (q *quicStats) snapshot() QUICStats {
+	ms := func(v *atomic.Int64) float64 { return float64(v.Load()) / float64(time.Millisecond) }
+	st := QUICStats{
+		Remote:          q.remote,
+		AgeSecs:         int64(time.Since(q.started) / time.Second),
+		SmoothedRTTMs:   ms(&q.smoothedRTT),
+		MinRTTMs:        ms(&q.minRTT),
+		LatestRTTMs:     ms(&q.latestRTT),
+		RTTVarMs:        ms(&q.rttVar),
+		CongestionWnd:   q.cwnd.Load(),
+		BytesInFlight:   q.bytesInFlight.Load(),
+		PacketsSent:     q.packetsSent.Load(),
+		PacketsReceived: q.packetsReceived.Load(),
+		PacketsLost:     q.packetsLost.Load(),
+		BytesSent:       q.bytesSent.Load(),
+		BytesReceived:   q.bytesReceived.Load(),
+	}
+	if st.PacketsSent > 0 {
+		st.LossRate = float64(st.PacketsLost) / float64(st.PacketsSent)
+	}
+	return st
+}
+
+// quicTracer is the quic.Config Tracer: it registers each connection's
+// stats under its remote address so handleSession can find them
+func (s *Server) quicTracer(_ context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	q := &quicStats{started: time.Now()}
+	return &logging.ConnectionTracer{
+		StartedConnection: func(_, remote net.Addr, _, _ logging.ConnectionID) {
+			q.remote = remote.String()
+			s.quicConns.Store(q.remote, q)
+		},
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+			q.smoothedRTT.Store(int64(rtt.SmoothedRTT()))
+			q.minRTT.Store(int64(rtt.MinRTT()))
+			q.latestRTT.Store(int64(rtt.LatestRTT()))
+			q.rttVar.Store(int64(rtt.MeanDeviation()))
+			q.cwnd.Store(int64(cwnd))
+			q.bytesInFlight.Store(int64(bytesInFlight))
+		},
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			q.packetsSent.Add(1)
+			q.bytesSent.Add(int64(size))
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			q.packetsSent.Add(1)
+			q.bytesSent.Add(int64(size))
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			q.packetsReceived.Add(1)
+			q.bytesReceived.Add(int64(size))
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			q.packetsReceived.Add(1)
+			q.bytesReceived.Add(int64(size))
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			q.packetsLost.Add(1)
+		},
+		Close: func() {
+			if q.remote != "" {
+				s.quicConns.CompareAndDelete(q.remote, q)
+			}
+		},
+	}
+}
+
+// lookupQUICStats finds the stats of the QUIC connection a session runs on
+func (s *Server) lookupQUICStats(remote net.Addr) *quicStats {
+	if v, ok := s.quicConns.Load(remote.String()); ok {
+		return v.(*quicStats)
+	}
+	return nil
+}
+
+// transportStatsLoop sends MsgTransportStats every interval until the
+// session ends
+func (sess *Session) transportStatsLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-sess.ctx.Done():
+			return
+		case <-t.C:
+			data, _ := json.Marshal(sess.quic.snapshot())
+			sess.sendEvent(MsgTransportStats, 0, data)
+		}
+	}
+}
+
+// parseTransportStatsInterval reads ?transport_stats=N (seconds); 0 = off
+func parseTransportStatsInterval(v string) time.Duration {
+	d, err := time.ParseDuration(v + "s")
+	if v == "" || err != nil || d <= 0 {
+		return 0
+	}
+	return clampDuration(d, minTransportStatsInterval, maxTransportStatsInterval)
+}
+
+// adminOnly guards an admin handler with the -admin-token bearer token.
+// Without -admin-token the admin endpoints don't exist.
+func (s *Server) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAdminTransport lists live sessions with their QUIC path stats
+func (s *Server) handleAdminTransport(w http.ResponseWriter, r *http.Request) {
+	type sessionStats struct {
+		ID          uint64     `json:"id"`
+		RemoteIP    string     `json:"remote_ip"`
+		Connections int        `json:"connections"`
+		QUIC        *QUICStats `json:"quic,omitempty"`
+	}
+	out := []sessionStats{}
+	s.sessions.Range(func(_, v any) bool {
+		sess := v.(*Session)
+		st := sessionStats{ID: sess.id, RemoteIP: sess.remoteIP}
+		sess.connections.Range(func(_, _ any) bool {
+			st.Connections++
+			return true
+		})
+		if sess.quic != nil {
+			snap := sess.quic.snapshot()
+			st.QUIC = &snap
+		}
+		out = append(out, st)
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,149 @@
+// quicstats_test.go - QUIC path stats, MsgTransportStats and /admin/transport tests
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+func TestQUICTracer(t *testing.T) {
+	s := &Server{}
+	tr := s.quicTracer(context.Background(), logging.PerspectiveServer, quic.ConnectionID{})
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	tr.StartedConnection(nil, remote, logging.ConnectionID{}, logging.ConnectionID{})
+
+	q := s.lookupQUICStats(remote)
+	if q == nil {
+		t.Fatal("connection not registered")
+	}
+
+	var rtt logging.RTTStats
+	rtt.UpdateRTT(40*time.Millisecond, 0, time.Now())
+	tr.UpdatedMetrics(&rtt, 12000, 3000, 2)
+	for i := 0; i < 10; i++ {
+		tr.SentShortHeaderPacket(nil, 1200, 0, nil, nil)
+	}
+	tr.ReceivedShortHeaderPacket(nil, 100, 0, nil)
+	tr.LostPacket(0, 0, 0)
+
+	st := q.snapshot()
+	if st.SmoothedRTTMs != 40 || st.CongestionWnd != 12000 || st.BytesInFlight != 3000 {
+		t.Fatalf("metrics not recorded: %+v", st)
+	}
+	if st.PacketsSent != 10 || st.BytesSent != 12000 || st.PacketsReceived != 1 || st.PacketsLost != 1 || st.LossRate != 0.1 {
+		t.Fatalf("packet counters wrong: %+v", st)
+	}
+
+	tr.Close()
+	if s.lookupQUICStats(remote) != nil {
+		t.Fatal("closed connection still registered")
+	}
+}
+
+func TestParseTransportStatsInterval(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"":     0,
+		"0":    0,
+		"-3":   0,
+		"junk": 0,
+		"5":    5 * time.Second,
+		"0.1":  minTransportStatsInterval,
+		"9999": maxTransportStatsInterval,
+	} {
+		if got := parseTransportStatsInterval(in); got != want {
+			t.Errorf("%q: got %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestAdminTransportAuth(t *testing.T) {
+	s := &Server{}
+	s.sessions.Store(uint64(1), &Session{id: 1, remoteIP: "198.51.100.7:5000", quic: &quicStats{remote: "198.51.100.7:5000", started: time.Now()}})
+	h := s.adminOnly(s.handleAdminTransport)
+
+	get := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/transport", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	// Disabled without -admin-token
+	if w := get("Bearer "); w.Code != http.StatusNotFound {
+		t.Fatalf("no admin token: got %d, want 404", w.Code)
+	}
+
+	s.adminToken = "hunter2"
+	for _, auth := range []string{"", "Bearer wrong", "hunter2"} {
+		if w := get(auth); w.Code != http.StatusUnauthorized {
+			t.Errorf("auth %q: got %d, want 401", auth, w.Code)
+		}
+	}
+
+	w := get("Bearer hunter2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var out []struct {
+		ID       uint64     `json:"id"`
+		RemoteIP string     `json:"remote_ip"`
+		QUIC     *QUICStats `json:"quic"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].ID != 1 || out[0].QUIC == nil || out[0].QUIC.Remote != "198.51.100.7:5000" {
+		t.Fatalf("unexpected listing: %s", w.Body)
+	}
+}
+
+// TestTransportStatsEvent checks a live session receives MsgTransportStats
+// for its own QUIC connection
+func TestTransportStatsEvent(t *testing.T) {
+	setupTestServer(t)
+
+	session := connectToProxyPath(t, "/connect?transport_stats=1")
+	defer session.CloseWithError(0, "test done")
+
+	events := readEvents(session, false)
+	timeout := time.After(5 * time.Second)
+	for {
+		var ev testEvent
+		select {
+		case ev = <-events:
+		case <-timeout:
+			t.Fatal("no MsgTransportStats")
+		}
+		if ev.msgType != MsgTransportStats {
+			continue
+		}
+		if ev.connID != 0 {
+			t.Fatalf("connID %d, want 0", ev.connID)
+		}
+		var st QUICStats
+		if err := json.Unmarshal(ev.data, &st); err != nil {
+			t.Fatalf("bad payload %q: %v", ev.data, err)
+		}
+		if st.PacketsSent == 0 || st.PacketsReceived == 0 || st.SmoothedRTTMs <= 0 {
+			t.Fatalf("stats look empty: %+v", st)
+		}
+		_, port, _ := net.SplitHostPort(st.Remote)
+		_, ourPort, _ := net.SplitHostPort(session.LocalAddr().String())
+		if port != ourPort {
+			t.Fatalf("stats for %s, session is %s", st.Remote, session.LocalAddr())
+		}
+		return
+	}
+}
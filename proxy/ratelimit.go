@@ -0,0 +1,354 @@
+// ratelimit.go - Per-client session and connection limits
+//
+// The RateLimiter caps how many sessions a client holds at once and how
+// many outbound connections it opens in any 24 hours. Clients are keyed by
+// IP, by network with -ratelimit-v4-prefix and -ratelimit-v6-prefix, or by
+// Origin with -limit-by-origin; -ratelimit-exempt sources skip the checks.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Rate limiter tracks per-IP usage, or per Origin with LimitByOrigin. The
+// maps below are keyed by client key (see key), which is usually an IP.
+type RateLimiter struct {
+	mu             sync.Mutex
+	ipSessions     map[string]int         // current concurrent sessions per IP
+	ipConnections  map[string]*connWindow // connections made in the last 24h per IP (ratewindow.go)
+	maxSessions    int                    // max concurrent sessions per IP
+	maxConnsPerDay int                    // max outbound connections per IP in any 24h
+
+	// Optional per-IP FIFO of sessions waiting for a free slot
+	waiters   map[string][]chan struct{}
+	queueLen  int           // max waiters per IP; 0 = reject immediately
+	queueWait time.Duration // max time a waiter queues before rejection
+
+	byOrigin bool // key browser sessions by their Origin header instead of IP
+
+	// Addresses are grouped by these prefix lengths before keying; full
+	// length (the default) keys each address on its own
+	v4Prefix int
+	v6Prefix int
+
+	exempt []*net.IPNet // sources never limited or counted (-ratelimit-exempt)
+}
+
+func NewRateLimiter(maxSessions, maxConnsPerDay int) *RateLimiter {
+	return &RateLimiter{
+		ipSessions:     make(map[string]int),
+		ipConnections:  make(map[string]*connWindow),
+		maxSessions:    maxSessions,
+		maxConnsPerDay: maxConnsPerDay,
+		waiters:        make(map[string][]chan struct{}),
+		v4Prefix:       32,
+		v6Prefix:       128,
+	}
+}
+
+// Exempt stops limiting, or counting, clients in nets
+func (rl *RateLimiter) Exempt(nets []*net.IPNet) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.exempt = nets
+}
+
+// isExempt reports whether remoteAddr is in an exempt network
+func (rl *RateLimiter) isExempt(remoteAddr string) bool {
+	rl.mu.Lock()
+	exempt := rl.exempt
+	rl.mu.Unlock()
+	if len(exempt) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupByPrefix counts every address in the same IPv4 /v4 or IPv6 /v6
+// network as one client, so rotating through a /64 doesn't buy a fresh
+// quota each time
+func (rl *RateLimiter) GroupByPrefix(v4, v6 int) error {
+	if v4 < 1 || v4 > 32 {
+		return fmt.Errorf("IPv4 prefix /%d out of range", v4)
+	}
+	if v6 < 1 || v6 > 128 {
+		return fmt.Errorf("IPv6 prefix /%d out of range", v6)
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.v4Prefix, rl.v6Prefix = v4, v6
+	return nil
+}
+
+// EnableSessionQueue lets up to queueLen sessions per IP wait up to wait for
+// a slot instead of being rejected, so a reconnect doesn't lose the race
+// against its old session's teardown. Each IP has its own queue, so one
+// address can't crowd others out.
+func (rl *RateLimiter) EnableSessionQueue(queueLen int, wait time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.queueLen = queueLen
+	rl.queueWait = wait
+}
+
+// LimitByOrigin keys sessions and connections that carry an Origin header
+// by that origin rather than by IP, so browsers sharing a corporate NAT
+// don't share one budget. The header is the client's claim: pair this with
+// -origins so the set of buckets is bounded. Requests without an Origin
+// are still keyed by IP.
+func (rl *RateLimiter) LimitByOrigin() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.byOrigin = true
+}
+
+// key returns the bucket a client's usage is counted in
+func (rl *RateLimiter) key(remoteAddr, origin string) string {
+	rl.mu.Lock()
+	byOrigin := rl.byOrigin
+	rl.mu.Unlock()
+	if byOrigin && origin != "" {
+		return "origin:" + origin
+	}
+	return rl.extractIP(remoteAddr)
+}
+
+func (rl *RateLimiter) extractIP(addr string) string {
+	// Handle both "ip:port" and bare "ip"
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	rl.mu.Lock()
+	bits := rl.v6Prefix
+	if ip = ip.Unmap(); ip.Is4() {
+		bits = rl.v4Prefix
+	}
+	rl.mu.Unlock()
+	if bits >= ip.BitLen() {
+		return host
+	}
+	p, _ := ip.Prefix(bits)
+	return p.String()
+}
+
+// TryAcquireSession returns true if a new session is allowed for this IP
+func (rl *RateLimiter) TryAcquireSession(remoteAddr string) bool {
+	if rl.isExempt(remoteAddr) {
+		return true
+	}
+	ip := rl.extractIP(remoteAddr)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.ipSessions[ip] >= rl.maxSessions {
+		return false
+	}
+	rl.ipSessions[ip]++
+	return true
+}
+
+// AcquireSession is TryAcquireSession that, when the IP is at its cap,
+// queues (FIFO, bounded) for up to the configured wait for a slot
+func (rl *RateLimiter) AcquireSession(ctx context.Context, remoteAddr string) bool {
+	return rl.AcquireSessionFrom(ctx, remoteAddr, "")
+}
+
+// AcquireSessionFrom is AcquireSession for a client that sent origin
+func (rl *RateLimiter) AcquireSessionFrom(ctx context.Context, remoteAddr, origin string) bool {
+	if rl.isExempt(remoteAddr) {
+		return true
+	}
+	ip := rl.key(remoteAddr, origin)
+	rl.mu.Lock()
+	if rl.ipSessions[ip] < rl.maxSessions {
+		rl.ipSessions[ip]++
+		rl.mu.Unlock()
+		return true
+	}
+	if len(rl.waiters[ip]) >= rl.queueLen {
+		rl.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	rl.waiters[ip] = append(rl.waiters[ip], ch)
+	wait := rl.queueWait
+	rl.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true // slot handed over by ReleaseSession
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	select {
+	case <-ch:
+		return true // handed over while we were timing out
+	default:
+	}
+	q := rl.waiters[ip]
+	for i, w := range q {
+		if w == ch {
+			rl.waiters[ip] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(rl.waiters[ip]) == 0 {
+		delete(rl.waiters, ip)
+	}
+	return false
+}
+
+// ReleaseSession decrements the session count for an IP, or hands the slot
+// straight to the longest-waiting queued session
+func (rl *RateLimiter) ReleaseSession(remoteAddr string) {
+	rl.ReleaseSessionFrom(remoteAddr, "")
+}
+
+// ReleaseSessionFrom releases a slot taken by AcquireSessionFrom
+func (rl *RateLimiter) ReleaseSessionFrom(remoteAddr, origin string) {
+	if rl.isExempt(remoteAddr) {
+		return // never counted
+	}
+	ip := rl.key(remoteAddr, origin)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if q := rl.waiters[ip]; len(q) > 0 {
+		rl.waiters[ip] = q[1:]
+		if len(rl.waiters[ip]) == 0 {
+			delete(rl.waiters, ip)
+		}
+		close(q[0])
+		return
+	}
+
+	if rl.ipSessions[ip] > 0 {
+		rl.ipSessions[ip]--
+	}
+	if rl.ipSessions[ip] == 0 {
+		delete(rl.ipSessions, ip)
+	}
+}
+
+// TryConnection returns true if a new outbound connection is allowed for this IP
+func (rl *RateLimiter) TryConnection(remoteAddr string) bool {
+	return rl.TryConnectionFrom(remoteAddr, "")
+}
+
+// TryConnectionFrom is TryConnection for a client that sent origin
+func (rl *RateLimiter) TryConnectionFrom(remoteAddr, origin string) bool {
+	return rl.tryConnectionAt(remoteAddr, origin, time.Now())
+}
+
+// tryConnectionAt is TryConnectionFrom for a connection made at now
+func (rl *RateLimiter) tryConnectionAt(remoteAddr, origin string, now time.Time) bool {
+	if rl.isExempt(remoteAddr) {
+		return true
+	}
+	ip := rl.key(remoteAddr, origin)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	w := rl.ipConnections[ip]
+	if w == nil {
+		w = &connWindow{}
+		rl.ipConnections[ip] = w
+	}
+	if w.count(now) >= rl.maxConnsPerDay {
+		return false
+	}
+	w.add(now, 1)
+	return true
+}
+
+// ResetIn returns how long until an IP's oldest connection in the last 24h
+// stops counting, freeing room for another
+func (rl *RateLimiter) ResetIn(remoteAddr string) time.Duration {
+	return rl.ResetInFrom(remoteAddr, "")
+}
+
+// ResetInFrom is ResetIn for a client that sent origin
+func (rl *RateLimiter) ResetInFrom(remoteAddr, origin string) time.Duration {
+	ip := rl.key(remoteAddr, origin)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	w := rl.ipConnections[ip]
+	if w == nil {
+		return 0
+	}
+	return w.freesIn(time.Now())
+}
+
+// Sweep forgets clients with no connections in the last 24h that hold no
+// sessions, so the maps don't grow with every address ever seen
+func (rl *RateLimiter) Sweep(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweepLocked(now)
+}
+
+// sweepLocked is Sweep with rl.mu held
+func (rl *RateLimiter) sweepLocked(now time.Time) {
+	for ip, w := range rl.ipConnections {
+		if w.count(now) == 0 && rl.ipSessions[ip] == 0 {
+			delete(rl.ipConnections, ip)
+		}
+	}
+}
+
+// SweepEvery runs Sweep every interval until ctx is done
+func (rl *RateLimiter) SweepEvery(ctx context.Context, interval time.Duration) {
+	sweepEvery(ctx, interval, rl.Sweep)
+}
+
+// sweepEvery calls sweep with the time every interval until ctx is done
+func sweepEvery(ctx context.Context, interval time.Duration, sweep func(time.Time)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			sweep(now)
+		}
+	}
+}
+
+func (rl *RateLimiter) Stats() (totalSessions int, totalIPs int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, v := range rl.ipSessions {
+		totalSessions += v
+	}
+	return totalSessions, len(rl.ipSessions)
+}
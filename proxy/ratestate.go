@@ -0,0 +1,131 @@
+// ratestate.go - Persisting RateLimiter daily counters across restarts
+//
+// Without this, restarting the proxy resets everyone's daily connection
+// quota. The state file is JSON, written on shutdown and every
+// -ratelimit-save-interval so a crash loses at most one interval of counts.
+// Clients with nothing left in their 24h window are pruned on save and
+// dropped on load, and an unreadable file, or one in another version's
+// format, is reported rather than silently trusted.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const rateStateVersion = 2
+
+type rateState struct {
+	Version int                    `json:"version"`
+	SavedAt time.Time              `json:"saved_at"`
+	IPs     map[string]rateStateIP `json:"ips"`
+}
+
+// rateStateIP is connWindow's buckets, oldest first, the last being Hour
+type rateStateIP struct {
+	Hour    int64 `json:"hour"`
+	Buckets []int `json:"buckets"`
+}
+
+const defaultRateStateInterval = 5 * time.Minute
+
+// SaveState writes the per-IP daily counters to path atomically, first
+// pruning counters whose window has reset
+func (rl *RateLimiter) SaveState(path string) error {
+	now := time.Now()
+	rl.mu.Lock()
+	st := rateState{
+		Version: rateStateVersion,
+		SavedAt: now,
+		IPs:     make(map[string]rateStateIP, len(rl.ipConnections)),
+	}
+	rl.sweepLocked(now)
+	for ip, w := range rl.ipConnections {
+		e := rateStateIP{Hour: w.newest, Buckets: make([]int, connWindowBuckets)}
+		for i := range e.Buckets {
+			e.Buckets[i] = w.buckets[(w.newest+1+int64(i))%connWindowBuckets]
+		}
+		st.IPs[ip] = e
+	}
+	rl.mu.Unlock()
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ratelimit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SaveStateEvery saves to path every interval until ctx is done
+func (rl *RateLimiter) SaveStateEvery(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := rl.SaveState(path); err != nil {
+				slog.Error("failed to save rate-limit state", "err", err)
+			}
+		}
+	}
+}
+
+// LoadState restores daily counters saved by SaveState. A missing file is
+// not an error; a corrupt one is, and leaves the limiter untouched.
+func (rl *RateLimiter) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st rateState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("corrupt rate-limit state %s: %w", path, err)
+	}
+	if st.Version != rateStateVersion {
+		return fmt.Errorf("rate-limit state %s: unsupported version %d", path, st.Version)
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for ip, e := range st.IPs {
+		// Skip malformed entries and windows from the future
+		if e.Hour > bucketOf(now) || len(e.Buckets) != connWindowBuckets {
+			continue
+		}
+		w := &connWindow{newest: e.Hour}
+		for i, n := range e.Buckets {
+			w.buckets[(e.Hour+1+int64(i))%connWindowBuckets] = max(n, 0)
+		}
+		// Skip windows that have emptied since
+		if w.count(now) > 0 {
+			rl.ipConnections[ip] = w
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// ratestate_test.go - Rate-limiter persistence tests
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRateStateRoundTrip saves counters, drops stale entries and rejects corrupt files
+func TestRateStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rl.json")
+
+	rl := NewRateLimiter(3, 5)
+	for i := 0; i < 4; i++ {
+		rl.TryConnection("1.2.3.4:1000")
+	}
+	rl.ipConnections["5.6.7.8"] = &connWindow{}
+	rl.ipConnections["5.6.7.8"].add(time.Now().Add(-25*time.Hour), 2) // window already over
+	if err := rl.SaveState(path); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	if _, ok := rl.ipConnections["5.6.7.8"]; ok {
+		t.Errorf("stale entry should be pruned on save")
+	}
+
+	restored := NewRateLimiter(3, 5)
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if got := restored.ipConnections["1.2.3.4"].count(time.Now()); got != 4 {
+		t.Errorf("restored count = %d, want 4", got)
+	}
+	if _, ok := restored.ipConnections["5.6.7.8"]; ok {
+		t.Errorf("stale entry should not be restored")
+	}
+	if !restored.TryConnection("1.2.3.4:1000") || restored.TryConnection("1.2.3.4:1000") {
+		t.Errorf("restored limiter should allow exactly one more connection")
+	}
+
+	for _, bad := range []string{"{not json", `{"version":1,"ips":{"1.2.3.4":{"connections":5}}}`} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fresh := NewRateLimiter(3, 5)
+		if err := fresh.LoadState(path); err == nil {
+			t.Errorf("%s: corrupt or unsupported state should return an error", bad)
+		}
+		if len(fresh.ipConnections) != 0 {
+			t.Errorf("%s: corrupt or unsupported state should leave the limiter empty", bad)
+		}
+	}
+	fresh := NewRateLimiter(3, 5)
+	if err := fresh.LoadState(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("missing state file should not be an error: %v", err)
+	}
+}
+
+// TestRateStateSavedPeriodically checks counters reach disk without a
+// clean shutdown, so a crash doesn't reset everyone's quota
+func TestRateStateSavedPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rl.json")
+	rl := NewRateLimiter(3, 5)
+	rl.TryConnection("1.2.3.4:1000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.SaveStateEvery(ctx, path, 20*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		restored := NewRateLimiter(3, 5)
+		if err := restored.LoadState(path); err != nil {
+			t.Fatal(err)
+		}
+		if w := restored.ipConnections["1.2.3.4"]; w != nil && w.count(time.Now()) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state never saved")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
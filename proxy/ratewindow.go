@@ -0,0 +1,75 @@
+// ratewindow.go - Rolling 24h connection counts for -max-conns
+//
+// A counter reset 24h after first use let a client spend its whole quota
+// just before the reset and all of it again just after. Each client
+// instead keeps a ring of hourly buckets covering the last 24 hours, and a
+// connection counts against the quota until its bucket falls out of the
+// window: after 23 to 24 hours, depending on where in the hour it was made.
+
+package main
+
+import "time"
+
+const (
+	connWindowBuckets = 24
+	connWindowBucket  = time.Hour
+)
+
+// connWindow counts one client's connections over the last 24 hours
+type connWindow struct {
+	buckets [connWindowBuckets]int // indexed by bucket number mod connWindowBuckets
+	newest  int64                  // bucket number (hours since the epoch) of the current bucket
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.Unix() / int64(connWindowBucket/time.Second)
+}
+
+// advance moves the window to now, emptying buckets that fell out of it.
+// A clock that steps back leaves the window where it is.
+func (w *connWindow) advance(now time.Time) {
+	b := bucketOf(now)
+	if b <= w.newest {
+		return
+	}
+	if b-w.newest >= connWindowBuckets {
+		w.buckets = [connWindowBuckets]int{}
+	} else {
+		for i := w.newest + 1; i <= b; i++ {
+			w.buckets[i%connWindowBuckets] = 0
+		}
+	}
+	w.newest = b
+}
+
+// count returns the connections made in the 24 hours up to now
+func (w *connWindow) count(now time.Time) int {
+	w.advance(now)
+	n := 0
+	for _, c := range w.buckets {
+		n += c
+	}
+	return n
+}
+
+// add counts n connections made at t, which may be in an earlier bucket
+// than the window's newest
+func (w *connWindow) add(t time.Time, n int) {
+	w.advance(t)
+	if b := bucketOf(t); b > w.newest-connWindowBuckets {
+		w.buckets[b%connWindowBuckets] += n
+	}
+}
+
+// freesIn returns how long until the oldest connection in the window stops
+// counting, or 0 if there are none
+func (w *connWindow) freesIn(now time.Time) time.Duration {
+	w.advance(now)
+	for b := w.newest - connWindowBuckets + 1; b <= w.newest; b++ {
+		if w.buckets[b%connWindowBuckets] > 0 {
+			expires := time.Unix((b+connWindowBuckets)*int64(connWindowBucket/time.Second), 0)
+			return expires.Sub(now)
+		}
+	}
+	return 0
+}
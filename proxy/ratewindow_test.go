@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConnWindowBoundary spends the quota just before the old reset point
+// and tries again just after: the rolling window still counts the first
+// batch, and only frees it once those hours have passed
+func TestConnWindowBoundary(t *testing.T) {
+	rl := NewRateLimiter(1, 5)
+	const addr = "192.0.2.1:1000"
+	first := time.Date(2026, 3, 1, 0, 1, 0, 0, time.UTC)
+	if !rl.tryConnectionAt(addr, "", first) {
+		t.Fatal("first connection refused")
+	}
+
+	// A fixed window started at `first` would reset at 00:01 the next day
+	burst := first.Add(24*time.Hour - 2*time.Minute) // 23:59
+	for i := 0; i < 4; i++ {
+		if !rl.tryConnectionAt(addr, "", burst) {
+			t.Fatalf("connection %d of the quota refused", i+2)
+		}
+	}
+	if rl.tryConnectionAt(addr, "", burst) {
+		t.Fatal("quota exceeded before the boundary")
+	}
+	// Only the 00:01 connection has aged out after the boundary
+	after := first.Add(24*time.Hour + time.Minute) // 00:02
+	if !rl.tryConnectionAt(addr, "", after) {
+		t.Fatal("the first connection's slot wasn't freed after 24h")
+	}
+	for _, at := range []time.Time{after, after.Add(time.Hour), burst.Add(23 * time.Hour)} {
+		if rl.tryConnectionAt(addr, "", at) {
+			t.Fatalf("connection at %s allowed while the 23:59 burst still counts", at.Format(time.Kitchen))
+		}
+	}
+	// The burst's hour leaves the window after 24h, at the latest
+	if !rl.tryConnectionAt(addr, "", burst.Add(24*time.Hour)) {
+		t.Fatal("quota not freed 24h after the burst")
+	}
+}
+
+func TestConnWindowFreesIn(t *testing.T) {
+	var w connWindow
+	now := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	if d := w.freesIn(now); d != 0 {
+		t.Fatalf("empty window frees in %s", d)
+	}
+	w.add(now.Add(-5*time.Hour), 1) // the 05:00 bucket, out at 05:00 tomorrow
+	w.add(now, 1)
+	if d, want := w.freesIn(now), 18*time.Hour+30*time.Minute; d != want {
+		t.Fatalf("frees in %s, want %s", d, want)
+	}
+	if n := w.count(now.Add(19 * time.Hour)); n != 1 {
+		t.Fatalf("count after the 05:00 bucket expired = %d, want 1", n)
+	}
+	// A clock stepping back doesn't lose or move counts
+	if n := w.count(now); n != 1 {
+		t.Fatalf("count after the clock stepped back = %d, want 1", n)
+	}
+}
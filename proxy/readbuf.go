@@ -0,0 +1,76 @@
+// readbuf.go - Per-connection read buffer size (OptReadBuf)
+//
+// Each read readLoop makes becomes at most one MsgData, and its buffer is
+// held while the event is queued. 64KiB suits bulk transfers but is mostly
+// idle memory on a DNS-over-TCP or telnet connection, while a container
+// pulling a large download may want fewer, larger events. OptReadBuf hints
+// a size, clamped to [-min-read-buf, -max-read-buf] and rounded up to a
+// power of two so connections of the same size class share a buffer pool.
+// Datagram sockets always read into readBufSize: a shorter read would
+// truncate the packet.
+
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Hard bounds on read buffer sizes, whatever the flags say
+const (
+	minReadBufShift = 10 // 1KiB
+	maxReadBufShift = 22 // 4MiB
+)
+
+// Read buffer sizes OptReadBuf is clamped to by default
+const (
+	defaultMinReadBuf = 4 * 1024
+	defaultMaxReadBuf = 256 * 1024
+)
+
+// readBufPools holds one pool per power-of-two size class
+var readBufPools [maxReadBufShift - minReadBufShift + 1]sync.Pool
+
+// readBufClass is the pool index for a buffer of at least size bytes
+func readBufClass(size int) int {
+	shift := bits.Len(uint(size - 1))
+	return min(max(shift, minReadBufShift), maxReadBufShift) - minReadBufShift
+}
+
+// getReadBuf returns a pooled buffer of size rounded up to its class
+func getReadBuf(size int) *[]byte {
+	class := readBufClass(size)
+	if bp, ok := readBufPools[class].Get().(*[]byte); ok {
+		return bp
+	}
+	b := make([]byte, 1<<(class+minReadBufShift))
+	return &b
+}
+
+// putReadBuf returns a buffer from getReadBuf to its pool
+func putReadBuf(bp *[]byte) {
+	readBufPools[readBufClass(cap(*bp))].Put(bp)
+}
+
+// readBufFor is the read buffer size for a connection made with opts
+func (s *Server) readBufFor(opts *ConnectOptions, sockType int) int {
+	if opts.ReadBuf <= 0 || sockType == SOCK_DGRAM {
+		return readBufSize
+	}
+	size := opts.ReadBuf
+	if s.minReadBuf > 0 {
+		size = max(size, s.minReadBuf)
+	}
+	if s.maxReadBuf > 0 {
+		size = min(size, s.maxReadBuf)
+	}
+	return 1 << (readBufClass(size) + minReadBufShift)
+}
+
+// bufSize is the connection's read buffer size
+func (c *Connection) bufSize() int {
+	if c.readBuf > 0 {
+		return c.readBuf
+	}
+	return readBufSize
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestReadBufFor(t *testing.T) {
+	s := &Server{minReadBuf: defaultMinReadBuf, maxReadBuf: defaultMaxReadBuf}
+	for _, tc := range []struct {
+		hint, sockType, want int
+	}{
+		{0, SOCK_STREAM, readBufSize},
+		{512, SOCK_STREAM, 4096},
+		{5000, SOCK_STREAM, 8192},
+		{1 << 20, SOCK_STREAM, 256 * 1024},
+		{512, SOCK_DGRAM, readBufSize},
+	} {
+		if got := s.readBufFor(&ConnectOptions{ReadBuf: tc.hint}, tc.sockType); got != tc.want {
+			t.Errorf("hint %d type %d: got %d, want %d", tc.hint, tc.sockType, got, tc.want)
+		}
+	}
+	if got := (&Server{}).readBufFor(&ConnectOptions{ReadBuf: 1 << 30}, SOCK_STREAM); got != 1<<maxReadBufShift {
+		t.Errorf("unclamped server: got %d", got)
+	}
+
+	opts, err := readConnectOptions(bytes.NewReader([]byte{OptReadBuf, 4, 0, 0, 0x10, 0}))
+	if err != nil || opts.ReadBuf != 4096 {
+		t.Fatalf("got %+v, %v", opts, err)
+	}
+	if _, err := readConnectOptions(bytes.NewReader([]byte{OptReadBuf, 2, 0x10, 0})); err == nil {
+		t.Fatal("accepted a 2-byte read buffer option")
+	}
+}
+
+// TestReadLoopBufSize checks MsgData events are cut at the connection's
+// read buffer size
+func TestReadLoopBufSize(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	local, remote := net.Pipe()
+	conn := newConnection(1, SOCK_STREAM)
+	conn.conn = local
+	conn.readBuf = 4096
+	go sess.readLoop(conn)
+	go remote.Write(make([]byte, 10000))
+
+	for got := 0; got < 10000; {
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType != MsgData || len(ev.data) > 4096 {
+			t.Fatalf("got event %#x with %d bytes", ev.msgType, len(ev.data))
+		}
+		got += len(ev.data)
+	}
+
+	sess.cancel()
+	conn.Close()
+	remote.Close()
+}
+
+// BenchmarkReadBufSize compares readLoop throughput on a bulk transfer at
+// the smallest and largest default read buffers
+func BenchmarkReadBufSize(b *testing.B) {
+	ended, end := context.WithCancel(context.Background())
+	end()
+	sess := &Session{ctx: ended}
+	chunk := make([]byte, 256*1024)
+
+	for _, size := range []int{defaultMinReadBuf, defaultMaxReadBuf} {
+		b.Run(strconv.Itoa(size/1024)+"KiB", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(chunk)))
+			local, remote := net.Pipe()
+			conn := newConnection(1, SOCK_STREAM)
+			conn.conn = local
+			conn.readBuf = size
+			done := make(chan struct{})
+			go func() {
+				sess.readLoop(conn)
+				close(done)
+			}()
+			for i := 0; i < b.N; i++ {
+				if _, err := remote.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			remote.Close()
+			<-done
+			local.Close()
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// readloop.go - Relaying what each connection receives to the container
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// readBufSize is the read buffer of datagram sockets and of connections
+// without OptReadBuf. Buffers are pooled (readbuf.go), so a churn of
+// short-lived connections doesn't allocate one apiece.
+const readBufSize = 64 * 1024
+
+func (sess *Session) readLoop(conn *Connection) {
+	if conn.readDone != nil {
+		defer close(conn.readDone)
+	}
+	span := sess.span.Child("conn", SpanKindInternal)
+	span.SetAttr("friscy.conn_id", conn.id)
+	defer func() {
+		span.SetAttr("friscy.bytes_in", conn.bytesIn.Load())
+		span.SetAttr("friscy.bytes_out", conn.bytesOut.Load())
+		span.End()
+	}()
+	// Runs after q.close, so a drained connection's MsgClosed follows
+	// its last data; see drainConnection
+	defer func() {
+		conn.readExited.Store(true)
+		if conn.drainUntil.Load() != 0 {
+			sess.finishDrain(conn)
+		}
+	}()
+	// Registered after close(readDone), so it runs first: readDone means
+	// every queued event has been written
+	q := sess.newReadQueue(conn)
+	defer q.close()
+	// Whatever closed the socket (MsgClose, MsgShutdown, the janitor in
+	// idle.go) may have reported it already
+	reportClosed := func() {
+		if !conn.closeReported.Swap(true) {
+			q.send(sess, conn, MsgClosed, closedPayload(conn), nil)
+		}
+	}
+	size := conn.bufSize()
+	bp := getReadBuf(size)
+	defer func() { putReadBuf(bp) }()
+	buf := (*bp)[:size]
+
+	// Read timeout tracking (MsgSetTimeout)
+	var readTimeout time.Duration
+	lastData := time.Now()
+	timedOut := false
+
+	for {
+		if conn.closed.Load() || conn.forwarding.Load() {
+			return
+		}
+
+		conn.mu.Lock()
+		netConn := conn.conn
+		conn.mu.Unlock()
+
+		if netConn == nil {
+			return
+		}
+
+		// A changed timeout starts a fresh idle period
+		if rt := time.Duration(conn.readTimeout.Load()); rt != readTimeout {
+			readTimeout = rt
+			lastData = time.Now()
+			timedOut = false
+		}
+
+		// Block until data arrives. The only deadline is the read timeout,
+		// or the drain deadline once MsgClose has been received; Close,
+		// forwarding, parking, MsgClose and MsgSetTimeout interrupt the
+		// Read by moving the deadline to now.
+		var deadline time.Time
+		drainUntil := conn.drainUntil.Load()
+		if drainUntil != 0 {
+			deadline = time.Unix(0, drainUntil)
+		} else if readTimeout > 0 && !timedOut {
+			deadline = lastData.Add(readTimeout)
+		}
+		netConn.SetReadDeadline(deadline)
+		// A wakeup that landed before SetReadDeadline was overwritten by it;
+		// look again at what it was for
+		if conn.closed.Load() || conn.forwarding.Load() || time.Duration(conn.readTimeout.Load()) != readTimeout ||
+			conn.drainUntil.Load() != drainUntil {
+			continue
+		}
+		n, err := netConn.Read(buf)
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if drainUntil != 0 {
+					if time.Now().Before(deadline) {
+						continue
+					}
+					return
+				}
+				if readTimeout > 0 && !timedOut && !time.Now().Before(lastData.Add(readTimeout)) {
+					timedOut = true
+					q.send(sess, conn, MsgTimeout, []byte{timeoutRead}, nil)
+				}
+				continue
+			}
+			if conn.forwarding.Load() || conn.drainUntil.Load() != 0 {
+				return
+			}
+			// An ICMP error for an earlier datagram fails one read, as
+			// recv(2) does; the socket itself is still usable
+			if conn.sockType == SOCK_DGRAM && errors.Is(err, syscall.ECONNREFUSED) {
+				q.send(sess, conn, MsgError, []byte("connection refused"), nil)
+				continue
+			}
+			if err != io.EOF && !conn.closed.Load() {
+				sess.log().Info("read error", "conn_id", conn.id, "err", err)
+			}
+			reportClosed()
+			return
+		}
+
+		if n > 0 {
+			sess.log().Debug("read", "conn_id", conn.id, "bytes", n)
+			conn.bytesIn.Add(uint64(n))
+			sess.bytesReceived.Add(int64(n))
+			lastData = time.Now()
+			timedOut = false
+			conn.touch()
+			if !sess.chargeBytes(n) || !sess.throttle(sess.recvLimiter, n) {
+				return
+			}
+			if sess.sendConnDatagram(conn, buf[:n]) {
+				continue
+			}
+			data, dataBuf := buf[:n], bp
+			if conn.compress != CompressNone {
+				if data, err = sess.compressData(conn.compress, data); err != nil {
+					sess.log().Error("compress error", "conn_id", conn.id, "err", err)
+					reportClosed()
+					return
+				}
+				dataBuf = nil // compressed into a fresh slice; buf is free again
+			}
+			// The event is written before buf is read into again, so it
+			// goes out without a copy: inline, or by the sender, which
+			// then owns buf and returns it to the pool
+			if q.send(sess, conn, MsgData, data, dataBuf) {
+				bp = getReadBuf(size)
+				buf = (*bp)[:size]
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// registryauth.go - Credentials for pulls from private registries
+//
+// With -registry-auth set, /pull authenticates with the matching "auths"
+// entry of a Docker config.json, chosen by the registry of the requested
+// image. A client may instead send "Authorization: Basic ..." or
+// "Authorization: Bearer ..." with the pull, which takes precedence and is
+// only ever presented to that image's registry. Credentials are never logged.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var errBadRegistryAuth = errors.New("registry Authorization must be Basic or Bearer")
+
+// RegistryKeychain serves credentials from a Docker config.json, keyed by
+// registry host
+type RegistryKeychain struct {
+	auths map[string]authn.AuthConfig
+}
+
+// LoadRegistryKeychain reads the "auths" section of a Docker config.json.
+// Credential helpers (credsStore, credHelpers) are not consulted.
+func LoadRegistryKeychain(path string) (*RegistryKeychain, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Auths map[string]authn.AuthConfig `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		// The error may quote the file, so don't pass it on
+		return nil, fmt.Errorf("parse %s: invalid config.json", path)
+	}
+
+	k := &RegistryKeychain{auths: make(map[string]authn.AuthConfig)}
+	for key, auth := range cfg.Auths {
+		k.auths[registryHost(key)] = auth
+	}
+	return k, nil
+}
+
+// registryHost normalizes a config.json key ("https://index.docker.io/v1/",
+// "ghcr.io") to the form name.Registry.RegistryStr returns
+func registryHost(key string) string {
+	host := key
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "docker.io", "registry-1.docker.io":
+		return name.DefaultRegistry
+	}
+	return host
+}
+
+// Resolve implements authn.Keychain
+func (k *RegistryKeychain) Resolve(res authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k.auths[res.RegistryStr()]; ok {
+		return authn.FromConfig(auth), nil
+	}
+	return authn.Anonymous, nil
+}
+
+// authFromHeader turns a client's Authorization header into an
+// authenticator; nil means the header was absent
+func authFromHeader(h string) (authn.Authenticator, error) {
+	scheme, cred, _ := strings.Cut(h, " ")
+	switch {
+	case h == "":
+		return nil, nil
+	case strings.EqualFold(scheme, "Basic"):
+		raw, err := base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			return nil, errBadRegistryAuth
+		}
+		user, pass, ok := strings.Cut(string(raw), ":")
+		if !ok {
+			return nil, errBadRegistryAuth
+		}
+		return &authn.Basic{Username: user, Password: pass}, nil
+	case strings.EqualFold(scheme, "Bearer") && cred != "":
+		return &authn.Bearer{Token: cred}, nil
+	}
+	return nil, errBadRegistryAuth
+}
+
+// pullAuth picks the credentials for a pull and a key identifying them, so
+// pulls only share a registry lookup when they would have made the same one
+func (s *Server) pullAuth(r *http.Request) (remote.Option, string, error) {
+	h := r.Header.Get("Authorization")
+	auth, err := authFromHeader(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if auth != nil {
+		sum := sha256.Sum256([]byte(h))
+		return remote.WithAuth(auth), hex.EncodeToString(sum[:]), nil
+	}
+	if s.registryAuth != nil {
+		return remote.WithAuthFromKeychain(s.registryAuth), "", nil
+	}
+	return remote.WithAuth(authn.Anonymous), "", nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// privateRegistry serves an in-memory registry that requires basic auth and
+// holds one image at the returned reference
+func privateRegistry(t *testing.T, user, pass string) string {
+	t.Helper()
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	imageRef := strings.TrimPrefix(srv.URL, "http://") + "/private/app:latest"
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: user, Password: pass})); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	return imageRef
+}
+
+func pull(s *Server, imageRef, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/pull?image="+imageRef, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	s.handleDockerPull(rec, req)
+	return rec
+}
+
+func TestPullPrivateRegistry(t *testing.T) {
+	imageRef := privateRegistry(t, "alice", "s3cret")
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	s := NewServer(":0", testCertFile, testKeyFile, NewRateLimiter(3, 100), nil)
+	if rec := pull(s, imageRef, ""); rec.Code == http.StatusOK {
+		t.Fatalf("anonymous pull of a private image succeeded")
+	}
+	if rec := pull(s, imageRef, basic("alice", "wrong")); rec.Code == http.StatusOK {
+		t.Fatalf("pull with a wrong password succeeded")
+	}
+	if rec := pull(s, imageRef, basic("alice", "s3cret")); rec.Code != http.StatusOK {
+		t.Fatalf("pull with Authorization header: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := pull(s, imageRef, "Digest abc"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unsupported Authorization scheme: got %d, want 400", rec.Code)
+	}
+
+	// Credentials from -registry-auth, matched by registry host
+	host, _, _ := strings.Cut(imageRef, "/")
+	cfg := `{"auths": {"http://` + host + `/v2/": {"auth": "` +
+		base64.StdEncoding.EncodeToString([]byte("alice:s3cret")) + `"}}}`
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if s.registryAuth, err = LoadRegistryKeychain(path); err != nil {
+		t.Fatal(err)
+	}
+	if rec := pull(s, imageRef, ""); rec.Code != http.StatusOK {
+		t.Fatalf("pull with -registry-auth: got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	for key, want := range map[string]string{
+		"https://index.docker.io/v1/": name.DefaultRegistry,
+		"docker.io":                   name.DefaultRegistry,
+		"ghcr.io":                     "ghcr.io",
+		"https://localhost:5000":      "localhost:5000",
+	} {
+		if got := registryHost(key); got != want {
+			t.Errorf("registryHost(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// resolve.go - Name lookups on the container's behalf (MsgResolve)
+//
+// Connects resolve names implicitly, but a container sometimes needs the
+// answer itself: to pick an address family, to look up MX records, or to
+// decide whether to connect at all. MsgResolve asks for one query type;
+// the answer comes back as MsgResolved, a refusal as MsgResolveError with
+// the same JSON policy decision MsgConnectError uses (policy.go).
+//
+// Address answers pass through the same screen as dials, so private and
+// blocked addresses are dropped and a name that only has such addresses is
+// refused: resolving can't be used to map the proxy's internal network. Each
+// lookup is charged to the session's -dns-rate budget and, like a connect,
+// to the client IP's daily connection quota.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// MsgResolve query types; A, AAAA and MX use their DNS type numbers
+const (
+	ResolveIP   = 0  // A and AAAA
+	ResolveA    = 1  // IPv4 addresses
+	ResolveMX   = 15 // mail exchangers, as "preference host"
+	ResolveAAAA = 28 // IPv6 addresses
+)
+
+const resolveTimeout = 10 * time.Second
+
+var errUnsupportedQuery = errors.New("unsupported query type")
+
+// lookupName answers one MsgResolve query
+func (t *DestinationTable) lookupName(ctx context.Context, host string, qtype uint16) ([]string, error) {
+	if qtype == ResolveMX {
+		mxs, err := t.lookupMX(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		answers := make([]string, len(mxs))
+		for i, mx := range mxs {
+			answers[i] = fmt.Sprintf("%d %s", mx.Pref, mx.Host)
+		}
+		return answers, nil
+	}
+	if qtype != ResolveIP && qtype != ResolveA && qtype != ResolveAAAA {
+		return nil, errUnsupportedQuery
+	}
+
+	ips, err := t.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if ips, err = t.screenAddrs(host, ips); err != nil {
+		return nil, err
+	}
+	var answers []string
+	for _, ip := range ips {
+		v4 := ip.IP.To4() != nil
+		if (qtype == ResolveA && !v4) || (qtype == ResolveAAAA && v4) {
+			continue
+		}
+		answers = append(answers, ip.String())
+	}
+	if len(answers) == 0 {
+		return nil, &net.DNSError{Err: "no addresses of the requested type", Name: host, IsNotFound: true}
+	}
+	return answers, nil
+}
+
+// resolvedPayload is MsgResolved's payload: qtype (2), count (2), then
+// count x [len (2), answer]
+func resolvedPayload(qtype uint16, answers []string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, qtype)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(answers)))
+	for _, a := range answers {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(a)))
+		payload = append(payload, a...)
+	}
+	return payload
+}
+
+func (sess *Session) handleResolve(stream webtransport.Stream) {
+	// Read: reqID (4), qtype (2), hostLen (2), host. The reply's connID
+	// field carries reqID back.
+	var header [4 + 2 + 2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("resolve: failed to read header", "err", err)
+		return
+	}
+
+	reqID := binary.BigEndian.Uint32(header[0:4])
+	qtype := binary.BigEndian.Uint16(header[4:6])
+	hostLen := binary.BigEndian.Uint16(header[6:8])
+	hostBuf := make([]byte, hostLen)
+	if _, err := io.ReadFull(stream, hostBuf); err != nil {
+		sess.log().Warn("resolve: failed to read host", "req_id", reqID, "err", err)
+		return
+	}
+	host := string(hostBuf)
+	sess.log().Info("resolve", "req_id", reqID, "host", host, "qtype", qtype)
+
+	if sess.token != nil && !sess.token.AllowsHost(host) {
+		sess.resolveDenied(reqID, PolicyDecision{Category: PolicyTokenScope, Rule: sess.token.Name, Message: "destination not permitted by token"})
+		return
+	}
+	if !sess.rateLimiter.TryConnectionFrom(sess.remoteIP, sess.origin) {
+		sess.log().Warn("resolve rate limited", "req_id", reqID)
+		sess.resolveDenied(reqID, sess.rateLimitDecision())
+		return
+	}
+	if !sess.allowLookup(host) {
+		sess.resolveDenied(reqID, sess.dnsRateDecision())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, resolveTimeout)
+	answers, err := sess.srv.dests.lookupName(ctx, host, qtype)
+	cancel()
+	if err != nil {
+		sess.log().Info("resolve failed", "req_id", reqID, "host", host, "err", err)
+		d := dialDecision(err)
+		if errors.Is(err, errUnsupportedQuery) {
+			d = PolicyDecision{Category: PolicyInvalidRequest, Rule: fmt.Sprintf("qtype=%d", qtype), Message: err.Error()}
+		}
+		sess.resolveDenied(reqID, d)
+		return
+	}
+	sess.sendEvent(MsgResolved, reqID, resolvedPayload(qtype, answers))
+}
+
+// resolveDenied reports a refused or failed MsgResolve
+func (sess *Session) resolveDenied(reqID uint32, d PolicyDecision) {
+	sess.sendEvent(MsgResolveError, reqID, d.Encode())
+}
@@ -0,0 +1,101 @@
+// resolve_test.go - MsgResolve tests
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// resolveTable answers every name with one public and one private address
+// of each family, and a single MX record
+func resolveTable() *DestinationTable {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "internal.example" {
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		}
+		return []net.IPAddr{
+			{IP: net.ParseIP("203.0.113.7")},
+			{IP: net.ParseIP("192.168.1.1")},
+			{IP: net.ParseIP("2001:db8::7")},
+			{IP: net.ParseIP("fd00::1")},
+		}, nil
+	}
+	tbl.lookupMX = func(ctx context.Context, host string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "mx." + host + ".", Pref: 10}}, nil
+	}
+	return tbl
+}
+
+func TestLookupName(t *testing.T) {
+	tbl := resolveTable()
+	for _, tc := range []struct {
+		qtype uint16
+		want  []string
+	}{
+		{ResolveIP, []string{"203.0.113.7", "2001:db8::7"}},
+		{ResolveA, []string{"203.0.113.7"}},
+		{ResolveAAAA, []string{"2001:db8::7"}},
+		{ResolveMX, []string{"10 mx.example.com."}},
+	} {
+		got, err := tbl.lookupName(context.Background(), "example.com", tc.qtype)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("qtype %d: got %v, %v; want %v", tc.qtype, got, err, tc.want)
+		}
+	}
+
+	if _, err := tbl.lookupName(context.Background(), "internal.example", ResolveIP); dialDecision(err).Category != PolicyPrivateAddress {
+		t.Errorf("private-only name: got %v, want a private address refusal", err)
+	}
+	if _, err := tbl.lookupName(context.Background(), "example.com", 16); err != errUnsupportedQuery {
+		t.Errorf("TXT query: got %v, want errUnsupportedQuery", err)
+	}
+}
+
+func resolveRequest(reqID uint32, qtype uint16, host string) readerStream {
+	req := binary.BigEndian.AppendUint32(nil, reqID)
+	req = binary.BigEndian.AppendUint16(req, qtype)
+	req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+	return readerStream{r: strings.NewReader(string(req) + host)}
+}
+
+func TestHandleResolve(t *testing.T) {
+	sess, pr := newTestSession(t, resolveTable(), func(s *Session) {
+		s.rateLimiter = NewRateLimiter(1, 2)
+		s.remoteIP = "198.51.100.1:4000"
+	})
+
+	go sess.handleResolve(resolveRequest(7, ResolveA, "example.com"))
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgResolved || ev.connID != 7 {
+		t.Fatalf("got event %#x for %d, want MsgResolved for 7", ev.msgType, ev.connID)
+	}
+	if want := resolvedPayload(ResolveA, []string{"203.0.113.7"}); string(ev.data) != string(want) {
+		t.Fatalf("payload %q, want %q", ev.data, want)
+	}
+
+	expectRefusal := func(req readerStream, category string) {
+		t.Helper()
+		go sess.handleResolve(req)
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d PolicyDecision
+		if ev.msgType != MsgResolveError || json.Unmarshal(ev.data, &d) != nil || d.Category != category {
+			t.Fatalf("got event %#x %s, want MsgResolveError %s", ev.msgType, ev.data, category)
+		}
+	}
+	expectRefusal(resolveRequest(8, ResolveIP, "internal.example"), PolicyPrivateAddress)
+	// The quota of two is now used up
+	expectRefusal(resolveRequest(9, ResolveIP, "example.com"), PolicyRateLimit)
+}
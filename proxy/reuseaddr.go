@@ -0,0 +1,40 @@
+// reuseaddr.go - Address reuse on MsgBind sockets
+//
+// A container that restarts its server rebinds the port straight away,
+// while connections the old listener closed are still in TIME_WAIT.
+// With -reuse-addr (the default) bound sockets get SO_REUSEADDR, so that
+// rebind succeeds; Go sets it on TCP listeners anyway, and this adds it
+// to datagram binds. SO_REUSEPORT lets several sockets share one port,
+// which a bind asks for with BindReusePort. Every session's sockets
+// belong to the proxy's one user, so it would also let a session bind
+// over another's port; it's refused unless -reuse-port is set.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// MsgBind flags (1), optional after the address
+const (
+	BindReusePort = 0x01 // SO_REUSEPORT; needs -reuse-port
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// bindConfig is what a bind's sockets are opened with; a nil Server
+// applies the defaults
+func (s *Server) bindConfig(reusePort bool) *net.ListenConfig {
+	reuseAddr := s == nil || !s.noReuseAddr
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) { err = setReuse(fd, reuseAddr, reusePort) }); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+}
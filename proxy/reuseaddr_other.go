@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+// setReuse leaves the platform's defaults alone; only SO_REUSEPORT, which
+// a bind asked for explicitly, is an error
+func setReuse(fd uintptr, reuseAddr, reusePort bool) error {
+	if reusePort {
+		return errReusePortUnsupported
+	}
+	return nil
+}
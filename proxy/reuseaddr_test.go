@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// bindPortReq is a MsgBind for port on every interface, with flags
+func bindPortReq(connID uint32, sockType byte, port uint16, flags byte) []byte {
+	req := append(binary.BigEndian.AppendUint32(nil, connID), sockType)
+	req = binary.BigEndian.AppendUint16(req, port)
+	return append(binary.BigEndian.AppendUint16(req, 0), flags)
+}
+
+// TestRebindTimeWait closes a listener whose accepted connection it shut
+// first, leaving TIME_WAIT on the port, and rebinds the port at once
+func TestRebindTimeWait(t *testing.T) {
+	for _, reuse := range []bool{true, false} {
+		t.Run("reuse="+strconv.FormatBool(reuse), func(t *testing.T) {
+			sess, pr := newTestSession(t, nil, func(s *Session) { s.srv.noReuseAddr = !reuse })
+
+			event := func() testEvent {
+				ev, err := readEvent(pr, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ev
+			}
+			bind := func(connID uint32, port uint16) testEvent {
+				go sess.handleBind(readerStream{r: bytes.NewReader(bindPortReq(connID, SOCK_STREAM, port, 0))})
+				return event()
+			}
+
+			ev := bind(1, 0)
+			if ev.msgType != MsgConnected {
+				t.Fatalf("bind: got event %#x %q", ev.msgType, ev.data)
+			}
+			_, portStr, _ := net.SplitHostPort(string(ev.data[2:]))
+			port, _ := strconv.Atoi(portStr)
+			sess.handleListen(readerStream{r: bytes.NewReader(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 1), 16))})
+			peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", portStr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+			ev = event()
+			if ev.msgType != MsgAccept {
+				t.Fatalf("got event %#x, want MsgAccept", ev.msgType)
+			}
+			accepted := binary.BigEndian.Uint32(ev.data[4:8])
+
+			// Our side closes first, so the port is left in TIME_WAIT
+			v, _ := sess.connections.Load(accepted)
+			v.(*Connection).Close()
+			peer.Read(make([]byte, 1))
+			peer.Close()
+			v, _ = sess.connections.LoadAndDelete(uint32(1))
+			v.(*Connection).Close()
+
+			ev = bind(2, uint16(port))
+			for ev.msgType == MsgClosed { // the accepted connection's
+				ev = event()
+			}
+			if reuse && ev.msgType != MsgConnected {
+				t.Fatalf("rebind: got event %#x %q", ev.msgType, ev.data)
+			}
+			if !reuse && ev.msgType != MsgError {
+				t.Fatalf("rebind without SO_REUSEADDR: got event %#x %q", ev.msgType, ev.data)
+			}
+
+			sess.cancel() // drop the MsgClosed events of the teardown below
+			sess.connections.Range(func(_, v any) bool {
+				v.(*Connection).Close()
+				return true
+			})
+		})
+	}
+}
+
+func TestBindReusePort(t *testing.T) {
+	srv := &Server{}
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.srv = srv })
+
+	bind := func(connID uint32, port uint16) testEvent {
+		go sess.handleBind(readerStream{r: bytes.NewReader(bindPortReq(connID, SOCK_DGRAM, port, BindReusePort))})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+
+	if ev := bind(1, 0); ev.msgType != MsgError {
+		t.Fatalf("SO_REUSEPORT without -reuse-port: got event %#x %q", ev.msgType, ev.data)
+	}
+	srv.reusePort = true
+	ev := bind(1, 0)
+	if ev.msgType != MsgConnected {
+		t.Fatalf("bind: got event %#x %q", ev.msgType, ev.data)
+	}
+	_, portStr, _ := net.SplitHostPort(string(ev.data[2:]))
+	port, _ := strconv.Atoi(portStr)
+	if ev := bind(2, uint16(port)); ev.msgType != MsgConnected {
+		t.Fatalf("second bind of the port: got event %#x %q", ev.msgType, ev.data)
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// setReuse sets SO_REUSEADDR to reuseAddr, and SO_REUSEPORT if reusePort,
+// on a socket about to be bound
+func setReuse(fd uintptr, reuseAddr, reusePort bool) error {
+	v := 0
+	if reuseAddr {
+		v = 1
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, v); err != nil {
+		return err
+	}
+	if reusePort {
+		return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}
+	return nil
+}
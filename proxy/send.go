@@ -0,0 +1,236 @@
+// send.go - MsgSend and the per-connection requests around it: MsgFlush,
+// MsgCloseWrite and MsgSetTimeout
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// MsgTimeout operations. The container fails the blocked call with EAGAIN
+// for reads and ETIMEDOUT for writes, whose outcome is then indeterminate.
+const (
+	timeoutRead  = 0
+	timeoutWrite = 1
+)
+
+func (sess *Session) handleSend(stream webtransport.Stream) {
+	// Read: connID (4), dataLen (4), data
+	var header [8]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("send: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	dataLen := binary.BigEndian.Uint32(header[4:8])
+	if !sess.checkMessageLen(stream, connID, "data", int(dataLen)) {
+		return
+	}
+
+	data := make([]byte, dataLen)
+	_, err := io.ReadFull(stream, data)
+	if err != nil {
+		sess.log().Warn("send: failed to read data", "conn_id", connID, "err", err)
+		// Part of an upload never arrived; don't let teardown pass the
+		// connection off as cleanly finished
+		if v, ok := sess.connections.Load(connID); ok {
+			v.(*Connection).truncated.Store(true)
+		}
+		return
+	}
+
+	if !sess.chargeBytes(len(data)) {
+		return
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		return
+	}
+	conn := v.(*Connection)
+
+	conn.mu.Lock()
+	netConn := conn.conn
+	coalescer := conn.coalescer
+	conn.mu.Unlock()
+
+	if netConn == nil {
+		if conn.udpConn != nil {
+			sess.sendEvent(MsgError, connID, []byte("not a connected socket; use MsgSendTo"))
+		}
+		return
+	}
+	if conn.sockType == SOCK_DGRAM && len(data) > maxDatagramSize {
+		sess.sendEvent(MsgError, connID, []byte("datagram too large"))
+		return
+	}
+
+	conn.pendingSends.Add(1)
+	defer conn.pendingSends.Add(-1)
+
+	if conn.compress != CompressNone {
+		wire := len(data)
+		if data, err = sess.decompressData(conn.compress, data); err != nil {
+			sess.log().Warn("send: bad compressed data", "conn_id", connID, "err", err)
+			sess.sendEvent(MsgError, connID, []byte("bad compressed data: "+err.Error()))
+			return
+		}
+		// The byte budget covers what reaches the remote peer
+		if !sess.chargeBytes(len(data) - wire) {
+			return
+		}
+	}
+
+	if !sess.throttle(sess.sendLimiter, len(data)) {
+		return
+	}
+	if coalescer != nil {
+		err = coalescer.Write(data)
+	} else {
+		setWriteDeadline(netConn, conn.writeTimeout.Load())
+		_, err = netConn.Write(data)
+	}
+	if err != nil {
+		sess.sendFailed(connID, err)
+		return
+	}
+	conn.touch()
+	conn.bytesOut.Add(uint64(len(data)))
+	sess.bytesSent.Add(int64(len(data)))
+	sess.log().Debug("send", "conn_id", connID, "bytes", len(data))
+	// Credit is counted in what the container sent, before decompression
+	sess.ackSent(conn, int(dataLen))
+}
+
+// sendFailed reports a failed write, turning deadline expiry into MsgTimeout
+func (sess *Session) sendFailed(connID uint32, err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		sess.sendEvent(MsgTimeout, connID, []byte{timeoutWrite})
+		return
+	}
+	sess.log().Info("send error", "conn_id", connID, "err", err)
+}
+
+// setWriteDeadline arms or clears a write deadline from a timeout in nanoseconds
+func setWriteDeadline(c net.Conn, timeout int64) {
+	if timeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(time.Duration(timeout)))
+	} else {
+		c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// handleFlush writes out a connection's coalesced sends without waiting for
+// the flush timer, e.g. after the last keystroke of a command
+func (sess *Session) handleFlush(stream webtransport.Stream) {
+	// Read: connID (4)
+	var header [4]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		return
+	}
+	conn := v.(*Connection)
+
+	conn.mu.Lock()
+	coalescer := conn.coalescer
+	conn.mu.Unlock()
+
+	if coalescer != nil {
+		if err := coalescer.Flush(); err != nil {
+			sess.sendFailed(connID, err)
+		}
+	}
+}
+
+// handleCloseWrite shuts down the write side of a TCP connection. The
+// connection stays in sess.connections and readLoop keeps delivering MsgData
+// until the peer closes; MsgClose still releases it.
+func (sess *Session) handleCloseWrite(stream webtransport.Stream) {
+	// Read: connID (4)
+	var header [4]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+
+	conn.mu.Lock()
+	netConn := conn.conn
+	coalescer := conn.coalescer
+	conn.mu.Unlock()
+
+	cw, ok := netConn.(interface{ CloseWrite() error }) // *net.TCPConn, *tls.Conn, *net.UnixConn
+	if !ok || conn.sockType == SOCK_DGRAM {
+		sess.sendEvent(MsgError, connID, []byte("half-close requires a connected stream socket"))
+		return
+	}
+	if conn.forwarding.Load() {
+		sess.sendEvent(MsgError, connID, []byte("connection is forwarded"))
+		return
+	}
+
+	// Anything still coalesced must go out before the FIN
+	if coalescer != nil {
+		if err := coalescer.Flush(); err != nil {
+			sess.sendFailed(connID, err)
+		}
+	}
+	// A half-closed socket can't be handed to another session
+	conn.halfClosed.Store(true)
+	if err := cw.CloseWrite(); err != nil {
+		sess.log().Info("close write failed", "conn_id", connID, "err", err)
+		sess.sendEvent(MsgError, connID, []byte(err.Error()))
+		return
+	}
+	sess.log().Debug("write side closed", "conn_id", connID)
+}
+
+// handleSetTimeout sets SO_RCVTIMEO/SO_SNDTIMEO equivalents for a connection.
+// A read timeout fires once per idle period: MsgTimeout is sent when no data
+// has arrived for that long, and rearmed by the next data.
+func (sess *Session) handleSetTimeout(stream webtransport.Stream) {
+	// Read: connID (4), read timeout ms (4), write timeout ms (4); 0 = none
+	var header [12]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("set timeout: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	readTimeout := time.Duration(binary.BigEndian.Uint32(header[4:8])) * time.Millisecond
+	writeTimeout := time.Duration(binary.BigEndian.Uint32(header[8:12])) * time.Millisecond
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+	conn.readTimeout.Store(int64(readTimeout))
+	conn.writeTimeout.Store(int64(writeTimeout))
+	sess.log().Debug("timeouts set", "conn_id", connID, "read", readTimeout, "write", writeTimeout)
+
+	// Wake readLoop so it rearms its deadline with the new read timeout
+	conn.mu.Lock()
+	if conn.conn != nil {
+		conn.conn.SetReadDeadline(time.Now())
+	}
+	conn.mu.Unlock()
+}
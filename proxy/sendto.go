@@ -0,0 +1,148 @@
+// sendto.go - MsgSendTo: batches of datagrams from a bound UDP socket
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// MsgSendTo bounds
+const (
+	maxSendToBatch  = 64    // datagrams per MsgSendTo
+	maxDatagramSize = 65507 // largest UDP payload over IPv4
+)
+
+// handleSendTo sends a batch of datagrams from a bound UDP socket, in order.
+// A failed datagram doesn't stop the rest; failures are reported together
+// in one MsgSendToError so the container can map each back to its sendto().
+func (sess *Session) handleSendTo(stream webtransport.Stream) {
+	// Read: connID (4), count (1), then count x [hostLen (2), host, port (2), dataLen (2), data]
+	var header [5]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("sendto: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	count := int(header[4])
+	if count == 0 || count > maxSendToBatch {
+		sess.sendEvent(MsgError, connID, []byte("invalid datagram batch size"))
+		return
+	}
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	conn := v.(*Connection)
+	if conn.udpConn == nil {
+		sess.sendEvent(MsgError, connID, []byte("not a bound datagram socket"))
+		return
+	}
+
+	// Failures: index (1), errLen (2), err
+	var failures []byte
+	failed := 0
+	fail := func(i int, msg string) {
+		failed++
+		failures = append(failures, byte(i))
+		failures = binary.BigEndian.AppendUint16(failures, uint16(len(msg)))
+		failures = append(failures, msg...)
+	}
+
+	for i := 0; i < count; i++ {
+		var hostLen [2]byte
+		if _, err := io.ReadFull(stream, hostLen[:]); err != nil {
+			sess.log().Warn("sendto: truncated batch", "conn_id", connID, "err", err)
+			return
+		}
+		n := int(binary.BigEndian.Uint16(hostLen[:]))
+		// The rest of the batch can't be found without reading the host
+		if !hostLenOK(n) {
+			sess.log().Warn("sendto: host too long", "conn_id", connID, "len", n)
+			fail(i, "host too long")
+			break
+		}
+		rest := make([]byte, n+4)
+		if _, err := io.ReadFull(stream, rest); err != nil {
+			sess.log().Warn("sendto: truncated batch", "conn_id", connID, "err", err)
+			return
+		}
+		host := string(rest[:len(rest)-4])
+		port := binary.BigEndian.Uint16(rest[len(rest)-4:])
+		dataLen := int(binary.BigEndian.Uint16(rest[len(rest)-2:]))
+
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			sess.log().Warn("sendto: truncated batch", "conn_id", connID, "err", err)
+			return
+		}
+
+		if msg, ok := sess.writeDatagram(conn, host, port, data); !ok {
+			return
+		} else if msg != "" {
+			fail(i, msg)
+		}
+	}
+
+	if failed > 0 {
+		sess.log().Info("sendto: datagrams failed", "conn_id", connID, "failed", failed, "count", count)
+		sess.sendEvent(MsgSendToError, connID, append([]byte{byte(failed)}, failures...))
+	}
+}
+
+// writeDatagram applies the outbound policy to one datagram and sends it
+// from conn's UDP socket. It returns why the datagram was dropped ("" if it
+// was sent), and false if the session is being torn down.
+func (sess *Session) writeDatagram(conn *Connection, host string, port uint16, data []byte) (string, bool) {
+	if len(data) > maxDatagramSize {
+		return "datagram too large", true
+	}
+	host = unbracketHost(host)
+	if err := validHost(host); err != nil {
+		return err.Error(), true
+	}
+	if _, ok := sess.srv.ports.Check(port); !ok {
+		return "port not permitted", true
+	}
+	if !sess.allowLookup(host) {
+		return "dns query rate exceeded", true
+	}
+	if err := sess.srv.dests.checkHost(host); err != nil {
+		return sendToRefusal(err), true
+	}
+	if sess.token != nil && !sess.token.AllowsHost(host) {
+		return "destination not permitted by token", true
+	}
+	if !sess.chargeBytes(len(data)) {
+		return "token byte budget exhausted", false
+	}
+	if !sess.throttle(sess.sendLimiter, len(data)) {
+		return "session closed", false
+	}
+
+	addr, err := sess.srv.dests.Get(host, int(port)).ResolveUDP(sess.ctx)
+	if err != nil {
+		return sendToRefusal(err), true
+	}
+	if _, err := conn.udpConn.WriteToUDP(data, addr); err != nil {
+		return err.Error(), true
+	}
+	conn.touch()
+	conn.bytesOut.Add(uint64(len(data)))
+	sess.bytesSent.Add(int64(len(data)))
+	return "", true
+}
+
+// sendToRefusal words a refused or failed datagram destination
+func sendToRefusal(err error) string {
+	if errors.Is(err, errPrivateAddress) {
+		return "sending to private addresses not allowed"
+	}
+	return err.Error()
+}
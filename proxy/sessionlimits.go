@@ -0,0 +1,50 @@
+// sessionlimits.go - Per-session caps on open sockets
+//
+// -max-listeners-per-session bounds the sockets a session holds from
+// MsgBind, so one client can't sweep the host's ports; -max-conns-per-session
+// bounds its dialed and accepted connections together. Each Connection
+// holds its slot until Close (or parkConnection) gives it back.
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Session limit defaults; 0 = unlimited
+const (
+	defaultMaxListeners    = 64
+	defaultMaxSessionConns = 1024
+)
+
+// takeSlot counts conn against counter, refusing once limit are held;
+// limit 0 = unlimited. The slot is given back when conn closes.
+func takeSlot(conn *Connection, counter *atomic.Int32, limit int) bool {
+	if n := counter.Add(1); limit > 0 && int(n) > limit {
+		counter.Add(-1)
+		return false
+	}
+	conn.release = func() { counter.Add(-1) }
+	return true
+}
+
+// takeListener reserves a listener slot for a MsgBind socket
+func (sess *Session) takeListener(conn *Connection) bool {
+	return takeSlot(conn, &sess.listeners, sess.maxListeners)
+}
+
+// takeConn reserves a connection slot for a dialed or accepted socket
+func (sess *Session) takeConn(conn *Connection) bool {
+	return takeSlot(conn, &sess.conns, sess.maxConns)
+}
+
+// sessionLimitDecision refuses a connect over -max-conns-per-session
+func (sess *Session) sessionLimitDecision() PolicyDecision {
+	return PolicyDecision{
+		Category:  PolicySessionLimit,
+		Rule:      fmt.Sprintf("max-conns-per-session=%d", sess.maxConns),
+		Transient: true,
+		Message:   "connection limit reached",
+	}
+}
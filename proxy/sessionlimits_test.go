@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func bindReq(connID uint32) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, connID), SOCK_STREAM, 0, 0)
+}
+
+func TestListenerLimit(t *testing.T) {
+	sess, pr := newTestSession(t, nil, func(s *Session) { s.maxListeners = 2 })
+
+	bind := func(connID uint32) testEvent {
+		go sess.handleBind(readerStream{r: bytes.NewReader(bindReq(connID))})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	for id := uint32(1); id <= 2; id++ {
+		if ev := bind(id); ev.msgType != MsgConnected {
+			t.Fatalf("bind %d: got event %#x %q", id, ev.msgType, ev.data)
+		}
+	}
+	if ev := bind(3); ev.msgType != MsgError || string(ev.data) != "listener limit reached" {
+		t.Fatalf("bind over the limit: got event %#x %q", ev.msgType, ev.data)
+	}
+
+	// Closing a listener frees its slot
+	v, _ := sess.connections.LoadAndDelete(uint32(1))
+	v.(*Connection).Close()
+	if ev := bind(4); ev.msgType != MsgConnected {
+		t.Fatalf("bind after close: got event %#x %q", ev.msgType, ev.data)
+	}
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+	if n := sess.listeners.Load(); n != 0 {
+		t.Fatalf("%d listener slots held after closing everything", n)
+	}
+}
+
+func TestSessionConnLimit(t *testing.T) {
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	sess, pr := newTestSession(t, tbl, func(s *Session) { s.maxConns = 2 })
+
+	connect := func(connID uint32) testEvent {
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len("example.com")))
+		req = append(req, "example.com"...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+
+	// A listener doesn't count as a connection, but what it accepts does
+	go sess.handleBind(readerStream{r: bytes.NewReader(bindReq(10))})
+	ev, err := readEvent(pr, false)
+	if err != nil || ev.msgType != MsgConnected {
+		t.Fatalf("bind: got event %#x %q, %v", ev.msgType, ev.data, err)
+	}
+	listenAddr := string(ev.data[2:])
+	sess.handleListen(readerStream{r: bytes.NewReader(append(binary.BigEndian.AppendUint32(nil, 10), 0, 0, 0, 16))})
+	if ev := connect(101); ev.msgType != MsgConnected {
+		t.Fatalf("connect: got event %#x %q", ev.msgType, ev.data)
+	}
+	peer, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgAccept {
+		t.Fatalf("accept: got event %#x %q, %v", ev.msgType, ev.data, err)
+	}
+
+	// Both slots are taken: connects are refused and accepts dropped
+	ev = connect(102)
+	var d PolicyDecision
+	if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicySessionLimit {
+		t.Fatalf("connect over the limit: got event %#x %q", ev.msgType, ev.data)
+	}
+	over, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer over.Close()
+	over.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := over.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatalf("accept over the limit: read got %v, want the connection closed", err)
+	}
+
+	// Closing a connection frees its slot
+	v, _ := sess.connections.LoadAndDelete(uint32(101))
+	v.(*Connection).Close()
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgClosed {
+		t.Fatalf("close: got event %#x %q, %v", ev.msgType, ev.data, err)
+	}
+	if ev := connect(103); ev.msgType != MsgConnected {
+		t.Fatalf("connect after close: got event %#x %q", ev.msgType, ev.data)
+	}
+
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
@@ -0,0 +1,75 @@
+// shutdown.go - Graceful shutdown on SIGINT/SIGTERM
+//
+// Shutdown stops /connect taking sessions and ends the live ones, each
+// tearing down its connections per -disconnect-mode. API requests already
+// in flight, such as a half-streamed image pull, are left to finish. Both
+// servers close once everything has drained or -shutdown-timeout passes.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// defaultShutdownTimeout bounds how long a shutdown waits for draining
+const defaultShutdownTimeout = 30 * time.Second
+
+// Shutdown drains and closes the server; it returns once both servers are
+// closed
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	slog.Info("shutting down, draining sessions", "timeout", s.shutdownTimeout)
+	s.cancel()
+
+	s.srvMu.Lock()
+	wtServer, apiServer := s.wtServer, s.apiServer
+	s.srvMu.Unlock()
+
+	apiDone := make(chan struct{})
+	go func() {
+		defer close(apiDone)
+		if apiServer == nil {
+			return
+		}
+		if err := apiServer.Shutdown(ctx); err != nil {
+			slog.Warn("API requests still running at shutdown timeout", "err", err)
+			apiServer.Close()
+		}
+	}()
+
+	if n := s.waitSessions(ctx); n > 0 {
+		slog.Warn("sessions still open at shutdown timeout", "sessions", n)
+	}
+	<-apiDone
+	if wtServer != nil {
+		wtServer.Close()
+	}
+	s.tracer.Shutdown()
+	slog.Info("shutdown complete")
+}
+
+// waitSessions waits for every session to end, or ctx to expire; it returns
+// how many are left
+func (s *Server) waitSessions(ctx context.Context) int {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		n := 0
+		s.sessions.Range(func(_, _ any) bool {
+			n++
+			return true
+		})
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-t.C:
+		}
+	}
+}
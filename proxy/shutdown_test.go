@@ -0,0 +1,96 @@
+// shutdown_test.go - Graceful shutdown tests
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	s := NewServer(":0", "", "", NewRateLimiter(1, 1), nil)
+	s.shutdownTimeout = 5 * time.Second
+	s.sessions.Store(uint64(1), &Session{id: 1})
+
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if s.ctx.Err() == nil {
+		t.Fatal("root context not cancelled")
+	}
+	select {
+	case <-done:
+		t.Fatal("returned with a session still open")
+	default:
+	}
+
+	s.sessions.Delete(uint64(1))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the last session ended")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := NewServer(":0", "", "", NewRateLimiter(1, 1), nil)
+	s.shutdownTimeout = 100 * time.Millisecond
+	s.sessions.Store(uint64(1), &Session{id: 1})
+
+	start := time.Now()
+	s.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stuck session held shutdown for %v", d)
+	}
+}
+
+// TestShutdownDrainsAPI checks a request in flight, like an image pull,
+// completes while new connections are refused
+func TestShutdownDrainsAPI(t *testing.T) {
+	s := NewServer(":0", "", "", NewRateLimiter(1, 1), nil)
+	s.shutdownTimeout = 5 * time.Second
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s.apiServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("all layers"))
+	})}
+	go s.apiServer.Serve(ln)
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/pull")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		got <- result{string(b), err}
+	}()
+
+	<-started
+	s.Shutdown()
+	if r := <-got; r.err != nil || r.body != "all layers" {
+		t.Fatalf("in-flight request got %q, %v", r.body, r.err)
+	}
+	if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		t.Fatal("API server still accepting after shutdown")
+	}
+}
@@ -0,0 +1,88 @@
+// sockname.go - getsockname/getpeername for tunneled sockets (MsgGetName)
+//
+// MsgOpened already carries both addresses, but only when the session asked
+// for it and only once. MsgGetName answers on demand, for any connection the
+// session holds: dialed, accepted, bound listeners and UDP sockets.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// MsgGetName which-flags
+const (
+	NameLocal = 0x00 // getsockname
+	NamePeer  = 0x01 // getpeername
+)
+
+var errNotConnected = errors.New("socket is not connected")
+
+// addrs reports the socket's local and remote addresses; either is nil
+// when the socket has none yet (a dial in progress, or a listener's peer)
+func (c *Connection) addrs() (local, remote net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.conn != nil:
+		return c.conn.LocalAddr(), c.conn.RemoteAddr()
+	case c.listener != nil:
+		return c.listener.Addr(), nil
+	case c.udpConn != nil:
+		return c.udpConn.LocalAddr(), nil
+	}
+	return nil, nil
+}
+
+// sockName looks up the address MsgGetName asked for
+func sockName(conn *Connection, which byte) (string, error) {
+	local, remote := conn.addrs()
+	addr := local
+	switch which {
+	case NameLocal:
+	case NamePeer:
+		addr = remote
+	default:
+		return "", errors.New("unknown name selector")
+	}
+	if addr == nil {
+		return "", errNotConnected
+	}
+	return addr.String(), nil
+}
+
+// namePayload is MsgName's payload: which (1), addrLen (2), addr ("ip:port")
+func namePayload(which byte, addr string) []byte {
+	payload := []byte{which}
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(addr)))
+	return append(payload, addr...)
+}
+
+func (sess *Session) handleGetName(stream webtransport.Stream) {
+	// Read: connID (4), which (1)
+	var header [5]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("getname: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	which := header[4]
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	addr, err := sockName(v.(*Connection), which)
+	if err != nil {
+		sess.sendEvent(MsgError, connID, []byte(err.Error()))
+		return
+	}
+	sess.sendEvent(MsgName, connID, namePayload(which, addr))
+}
@@ -0,0 +1,92 @@
+// sockname_test.go - MsgGetName tests
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func getNameRequest(connID uint32, which byte) readerStream {
+	req := binary.BigEndian.AppendUint32(nil, connID)
+	return readerStream{r: strings.NewReader(string(append(req, which)))}
+}
+
+func TestGetNameDialed(t *testing.T) {
+	sess, pr := newTestSession(t, nil)
+
+	conn, remote := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+
+	for which, want := range map[byte]string{
+		NameLocal: remote.RemoteAddr().String(),
+		NamePeer:  remote.LocalAddr().String(),
+	} {
+		go sess.handleGetName(getNameRequest(conn.id, which))
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.msgType != MsgName || ev.connID != conn.id {
+			t.Fatalf("got event %#x for %d, want MsgName for %d", ev.msgType, ev.connID, conn.id)
+		}
+		if ev.data[0] != which || string(ev.data[3:]) != want {
+			t.Errorf("which %d: payload %q, want %q", which, ev.data, namePayload(which, want))
+		}
+		if int(binary.BigEndian.Uint16(ev.data[1:3])) != len(want) {
+			t.Errorf("which %d: addrLen %d, want %d", which, binary.BigEndian.Uint16(ev.data[1:3]), len(want))
+		}
+	}
+
+	go sess.handleGetName(getNameRequest(99, NameLocal))
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgError {
+		t.Fatalf("unknown connection: got %#x, %v; want MsgError", ev.msgType, err)
+	}
+}
+
+func TestGetNameAccepted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	listener := newConnection(1, SOCK_STREAM)
+	listener.listener = ln
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(2, SOCK_STREAM)
+	conn.conn = accepted
+	defer conn.Close()
+
+	if addr, err := sockName(conn, NameLocal); err != nil || addr != ln.Addr().String() {
+		t.Errorf("getsockname = %q, %v; want %s", addr, err, ln.Addr())
+	}
+	if addr, err := sockName(conn, NamePeer); err != nil || addr != client.LocalAddr().String() {
+		t.Errorf("getpeername = %q, %v; want %s", addr, err, client.LocalAddr())
+	}
+
+	// The listener has a name but no peer
+	if addr, err := sockName(listener, NameLocal); err != nil || addr != ln.Addr().String() {
+		t.Errorf("listener getsockname = %q, %v", addr, err)
+	}
+	if _, err := sockName(listener, NamePeer); err != errNotConnected {
+		t.Errorf("listener getpeername: got %v, want errNotConnected", err)
+	}
+	// Still dialing
+	if _, err := sockName(newConnection(3, SOCK_STREAM), NameLocal); err != errNotConnected {
+		t.Errorf("unconnected getsockname: got %v, want errNotConnected", err)
+	}
+	if _, err := sockName(conn, 7); err == nil {
+		t.Error("unknown selector accepted")
+	}
+}
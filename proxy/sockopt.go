@@ -0,0 +1,87 @@
+// sockopt.go - Socket options set on a live connection (MsgSetOption)
+//
+// MsgSetOption is the proxy's setsockopt(): it names a connection, an
+// option code and an int value. Each option is one entry in sockOptions,
+// so adding keepalive or buffer sizes later means adding an entry here.
+// Options apply to the TCP socket under OptTLS, not to the TLS layer.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Socket option codes
+const (
+	SockOptNoDelay = 0x01 // TCP_NODELAY: nonzero disables Nagle, 0 enables it
+)
+
+// sockOptions applies each supported option to a TCP socket
+var sockOptions = map[byte]func(tc *net.TCPConn, value int32) error{
+	SockOptNoDelay: func(tc *net.TCPConn, value int32) error {
+		return tc.SetNoDelay(value != 0)
+	},
+}
+
+var errNotTCP = errors.New("socket options require a connected TCP socket")
+
+// tcpConnOf finds the TCP socket under a connection, unwrapping OptTLS and
+// an -upstream-proxy tunnel
+func tcpConnOf(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch w := c.(type) {
+		case *net.TCPConn:
+			return w, true
+		case interface{ NetConn() net.Conn }: // *tls.Conn, *bufferedConn
+			c = w.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// setSockOpt applies option opt to conn's socket
+func setSockOpt(conn *Connection, opt byte, value int32) error {
+	apply, ok := sockOptions[opt]
+	if !ok {
+		return errors.New("unsupported socket option")
+	}
+	conn.mu.Lock()
+	netConn := conn.conn
+	conn.mu.Unlock()
+	tc, ok := tcpConnOf(netConn)
+	if !ok {
+		return errNotTCP
+	}
+	return apply(tc, value)
+}
+
+func (sess *Session) handleSetOption(stream webtransport.Stream) {
+	// Read: connID (4), option (1), value (4, signed)
+	var header [9]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		sess.log().Warn("setoption: failed to read header", "err", err)
+		return
+	}
+
+	connID := binary.BigEndian.Uint32(header[0:4])
+	opt := header[4]
+	value := int32(binary.BigEndian.Uint32(header[5:9]))
+
+	v, ok := sess.connections.Load(connID)
+	if !ok {
+		sess.sendEvent(MsgError, connID, []byte("connection not found"))
+		return
+	}
+	if err := setSockOpt(v.(*Connection), opt, value); err != nil {
+		sess.log().Info("setoption failed", "conn_id", connID, "opt", opt, "value", value, "err", err)
+		sess.sendEvent(MsgError, connID, []byte(err.Error()))
+		return
+	}
+	sess.log().Debug("option set", "conn_id", connID, "opt", opt, "value", value)
+}
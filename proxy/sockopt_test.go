@@ -0,0 +1,72 @@
+//go:build unix
+
+// sockopt_test.go - MsgSetOption tests
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// noDelay reads TCP_NODELAY back from the socket
+func noDelay(t *testing.T, c net.Conn) int {
+	t.Helper()
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var gerr error
+	raw.Control(func(fd uintptr) {
+		v, gerr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	return v
+}
+
+func setOptionRequest(connID uint32, opt byte, value int32) string {
+	req := binary.BigEndian.AppendUint32(nil, connID)
+	req = append(req, opt)
+	return string(binary.BigEndian.AppendUint32(req, uint32(value)))
+}
+
+func TestSetOptionNoDelay(t *testing.T) {
+	ended, end := context.WithCancel(context.Background())
+	end()
+	sess := &Session{ctx: ended}
+	conn, _ := tcpPair(t)
+	sess.connections.Store(conn.id, conn)
+
+	for _, want := range []int32{0, 1} {
+		sess.handleSetOption(readerStream{r: strings.NewReader(setOptionRequest(conn.id, SockOptNoDelay, want))})
+		if got := noDelay(t, conn.conn); (got != 0) != (want != 0) {
+			t.Fatalf("TCP_NODELAY = %d after setting %d", got, want)
+		}
+	}
+}
+
+func TestSetSockOptErrors(t *testing.T) {
+	conn, _ := tcpPair(t)
+	if err := setSockOpt(conn, 0x7F, 1); err == nil {
+		t.Error("unknown option accepted")
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	piped := newConnection(2, SOCK_STREAM)
+	piped.conn = local
+	if err := setSockOpt(piped, SockOptNoDelay, 1); err != errNotTCP {
+		t.Errorf("non-TCP socket: got %v, want errNotTCP", err)
+	}
+	if err := setSockOpt(newConnection(3, SOCK_DGRAM), SockOptNoDelay, 1); err != errNotTCP {
+		t.Errorf("unconnected socket: got %v, want errNotTCP", err)
+	}
+}
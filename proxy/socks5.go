@@ -0,0 +1,308 @@
+// socks5.go - SOCKS5 front-end for clients that can't speak WebTransport
+//
+// With -socks5 set, the proxy also accepts plain SOCKS5 (RFC 1928) CONNECT
+// requests. They go through the same checkConnect as MsgConnect (port
+// policy, SSRF guard, token scope, the client IP's daily quota) and dial
+// through the same DestinationTable, so resolved addresses are screened and
+// the circuit breaker applies; a fix to either front-end covers both.
+//
+// With -token-file set, clients must authenticate with username/password
+// (RFC 1929), the password being a session token; the username is only
+// logged. Each SOCKS connection holds one of the token's session slots and
+// is charged to its byte budget. Quotas stay keyed by client IP, whichever
+// token is used. BIND and UDP ASSOCIATE are not supported.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion          = 0x05
+	socksPasswordVer      = 0x01 // RFC 1929 subnegotiation version
+	socksCmdConnect       = 0x01
+	socksHandshakeTimeout = 10 * time.Second
+	socksDialTimeout      = 10 * time.Second
+)
+
+// Auth methods
+const (
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xFF
+)
+
+// Address types
+const (
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksNotAllowed       = 0x02
+	socksNetUnreachable   = 0x03
+	socksHostUnreachable  = 0x04
+	socksConnRefused      = 0x05
+	socksTTLExpired       = 0x06
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+var errSocksBudget = errors.New("token byte budget exhausted")
+
+// ServeSOCKS5 accepts SOCKS5 clients on ln until the server shuts down
+func (s *Server) ServeSOCKS5(ln net.Listener) error {
+	go func() {
+		<-s.ctx.Done()
+		ln.Close()
+	}()
+	slog.Info("SOCKS5 listening", "addr", ln.Addr())
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handleSOCKS5(c)
+	}
+}
+
+// handleSOCKS5 serves one client connection: handshake, one CONNECT, relay
+func (s *Server) handleSOCKS5(c net.Conn) {
+	defer c.Close()
+	remoteIP := c.RemoteAddr().String()
+	log := slog.Default().With("socks5", newCorrelationID(), "remote_ip", remoteIP)
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	token, err := s.socksAuthenticate(c)
+	if err != nil {
+		log.Info("socks5 request failed", "err", err)
+		return
+	}
+	if token != nil {
+		defer s.tokens.Release(token)
+	}
+
+	host, port, rep := readSocksRequest(c)
+	if rep != socksSucceeded {
+		writeSocksReply(c, rep, nil)
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	if d, ok := s.checkConnect(s.rateLimiter, remoteIP, "", token, host, port); !ok {
+		log.Info("socks5 connect refused", "addr", addr, "reason", d.Message, "rule", d.Rule)
+		writeSocksReply(c, socksReplyFor(d), nil)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	upstream, _, err := s.dests.Get(host, int(port)).Dial(ctx, socksDialTimeout, "")
+	if err != nil {
+		log.Info("socks5 connect failed", "addr", addr, "err", err)
+		writeSocksReply(c, socksReplyFor(dialDecision(err)), nil)
+		return
+	}
+	defer upstream.Close()
+	if err := applyKeepalive(upstream, &s.keepalive); err != nil {
+		log.Warn("socks5 keepalive", "err", err)
+	}
+	if err := writeSocksReply(c, socksSucceeded, upstream.LocalAddr()); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+	log.Info("socks5 connected", "addr", addr)
+
+	// Relay until either side finishes; the session ending closes both
+	var toClient, toUpstream io.Writer = c, upstream
+	if token != nil && token.ByteBudget > 0 {
+		toClient, toUpstream = budgetWriter{c, token}, budgetWriter{upstream, token}
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(toUpstream, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(toClient, upstream)
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// socksAuthenticate negotiates the auth method and, when the proxy requires
+// tokens, checks the password against them
+func (s *Server) socksAuthenticate(c net.Conn) (*Token, error) {
+	// Greeting: ver (1), nmethods (1), methods
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksVersion {
+		return nil, errors.New("not a SOCKS5 client")
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+	want := byte(socksAuthNone)
+	if s.tokens != nil {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		c.Write([]byte{socksVersion, socksAuthUnacceptable})
+		return nil, errors.New("no acceptable auth method")
+	}
+	if _, err := c.Write([]byte{socksVersion, want}); err != nil {
+		return nil, err
+	}
+	if want == socksAuthNone {
+		return nil, nil
+	}
+
+	// Username/password: ver (1), ulen (1), user, plen (1), password
+	var ver [2]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return nil, err
+	}
+	user := make([]byte, ver[1]+1) // the username, then plen
+	if _, err := io.ReadFull(c, user); err != nil {
+		return nil, err
+	}
+	pass := make([]byte, user[ver[1]])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return nil, err
+	}
+	token, err := s.tokens.Acquire(string(pass), time.Now())
+	if ver[0] != socksPasswordVer || err != nil {
+		c.Write([]byte{socksPasswordVer, 1})
+		if err == nil {
+			s.tokens.Release(token)
+			err = errors.New("bad auth version")
+		}
+		return nil, err
+	}
+	if _, err := c.Write([]byte{socksPasswordVer, 0}); err != nil {
+		s.tokens.Release(token)
+		return nil, err
+	}
+	slog.Info("socks5 authenticated", "remote_ip", c.RemoteAddr().String(), "user", string(user[:ver[1]]), "token", token.Name)
+	return token, nil
+}
+
+// readSocksRequest reads the CONNECT request, returning a reply code other
+// than socksSucceeded if it can't be served
+func readSocksRequest(r io.Reader) (host string, port uint16, rep byte) {
+	// ver (1), cmd (1), rsv (1), atyp (1), dst.addr, dst.port (2)
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != socksVersion {
+		return "", 0, socksGeneralFailure
+	}
+	var addr []byte
+	switch hdr[3] {
+	case socksAddrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, socksGeneralFailure
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, socksAddrNotSupported
+	}
+	var portBuf [2]byte
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, socksGeneralFailure
+	}
+	if _, err := io.ReadFull(r, portBuf[:]); err != nil {
+		return "", 0, socksGeneralFailure
+	}
+	if hdr[1] != socksCmdConnect {
+		return "", 0, socksCmdNotSupported
+	}
+	host = string(addr)
+	if hdr[3] != socksAddrDomain {
+		host = net.IP(addr).String()
+	}
+	return host, binary.BigEndian.Uint16(portBuf[:]), socksSucceeded
+}
+
+// writeSocksReply sends the reply to a request; bound may be nil
+func writeSocksReply(w io.Writer, rep byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if ta, ok := bound.(*net.TCPAddr); ok {
+		ip, port = ta.IP, ta.Port
+	}
+	reply := []byte{socksVersion, rep, 0, socksAddrIPv4}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, ip4...)
+	} else {
+		reply[3] = socksAddrIPv6
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// socksReplyFor maps a refusal onto the nearest SOCKS5 reply code
+func socksReplyFor(d PolicyDecision) byte {
+	switch d.Category {
+	case PolicyPrivateAddress, PolicyPort, PolicyBlocked, PolicyTokenExpired, PolicyTokenScope, PolicyRateLimit:
+		return socksNotAllowed
+	case PolicyDNS, PolicyCircuitOpen:
+		return socksHostUnreachable
+	case PolicyDial:
+		switch d.Rule {
+		case "refused":
+			return socksConnRefused
+		case "unreachable":
+			return socksNetUnreachable
+		case "timeout":
+			return socksTTLExpired
+		}
+	}
+	return socksGeneralFailure
+}
+
+// budgetWriter charges what it writes to a token's byte budget
+type budgetWriter struct {
+	w io.Writer
+	t *Token
+}
+
+func (bw budgetWriter) Write(p []byte) (int, error) {
+	if !bw.t.ChargeBytes(len(p)) {
+		return 0, errSocksBudget
+	}
+	return bw.w.Write(p)
+}
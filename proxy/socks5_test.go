@@ -0,0 +1,157 @@
+// socks5_test.go - SOCKS5 front-end tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socksServer serves SOCKS5 on loopback, resolving every name to a public
+// address and landing dials on an echo listener
+func socksServer(t *testing.T, tokens *TokenStore) (socksAddr string) {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	s := NewServer(":0", "", "", NewRateLimiter(1, 100), nil)
+	s.tokens = tokens
+	s.dests.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	var dialer net.Dialer
+	s.dests.dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, echo.Addr().String())
+	}
+	t.Cleanup(s.cancel)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeSOCKS5(ln)
+	return ln.Addr().String()
+}
+
+// socksConnect runs a client handshake for a CONNECT to host:port by name,
+// authenticating when pass is set, and returns the reply code
+func socksConnect(t *testing.T, addr, pass, host string, port uint16) (net.Conn, byte) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := byte(socksAuthNone)
+	if pass != "" {
+		method = socksAuthPassword
+	}
+	c.Write([]byte{socksVersion, 1, method})
+	var choice [2]byte
+	if _, err := io.ReadFull(c, choice[:]); err != nil {
+		t.Fatal(err)
+	}
+	if choice[1] != method {
+		return c, socksAuthUnacceptable
+	}
+	if pass != "" {
+		auth := append([]byte{socksPasswordVer, 4}, "user"...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		c.Write(auth)
+		var status [2]byte
+		if _, err := io.ReadFull(c, status[:]); err != nil {
+			t.Fatal(err)
+		}
+		if status[1] != 0 {
+			return c, socksNotAllowed
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0, socksAddrIPv4}
+	if ip := net.ParseIP(host); ip != nil {
+		req = append(req, ip.To4()...)
+	} else {
+		req[3] = socksAddrDomain
+		req = append(append(req, byte(len(host))), host...)
+	}
+	c.Write(binary.BigEndian.AppendUint16(req, port))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	return c, reply[1]
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	addr := socksServer(t, nil)
+
+	c, rep := socksConnect(t, addr, "", "echo.example", 7)
+	if rep != socksSucceeded {
+		t.Fatalf("reply %#x, want success", rep)
+	}
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo read %q, %v", buf, err)
+	}
+
+	// The same SSRF guard as MsgConnect
+	if _, rep := socksConnect(t, addr, "", "127.0.0.1", 7); rep != socksNotAllowed {
+		t.Errorf("loopback literal: reply %#x, want not allowed", rep)
+	}
+	if _, rep := socksConnect(t, addr, "", "169.254.169.254", 80); rep != socksNotAllowed {
+		t.Errorf("metadata address: reply %#x, want not allowed", rep)
+	}
+}
+
+func TestSOCKS5TokenAuth(t *testing.T) {
+	tokens, err := LoadTokenStore(writeTokenFile(t, `[
+		{"token": "s3cret", "name": "alice", "allow_hosts": ["*.example.com"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := socksServer(t, tokens)
+
+	if _, rep := socksConnect(t, addr, "", "www.example.com", 80); rep != socksAuthUnacceptable {
+		t.Errorf("no auth: reply %#x, want no acceptable method", rep)
+	}
+	if _, rep := socksConnect(t, addr, "wrong", "www.example.com", 80); rep != socksNotAllowed {
+		t.Errorf("bad password: reply %#x, want auth failure", rep)
+	}
+	if _, rep := socksConnect(t, addr, "s3cret", "www.example.com", 80); rep != socksSucceeded {
+		t.Errorf("good password: reply %#x, want success", rep)
+	}
+	if _, rep := socksConnect(t, addr, "s3cret", "other.test", 80); rep != socksNotAllowed {
+		t.Errorf("host outside token scope: reply %#x, want not allowed", rep)
+	}
+}
+
+func TestSOCKS5UnsupportedCommand(t *testing.T) {
+	r := []byte{socksVersion, 0x03, 0, socksAddrIPv4, 1, 2, 3, 4, 0, 53} // UDP ASSOCIATE
+	if _, _, rep := readSocksRequest(bytes.NewReader(r)); rep != socksCmdNotSupported {
+		t.Errorf("UDP ASSOCIATE: reply %#x, want command not supported", rep)
+	}
+}
@@ -0,0 +1,45 @@
+// streamlimit.go - Per-session cap on requests in progress
+//
+// Every request stream the container opens gets its own goroutine, and a
+// MsgSend holds its payload until written, so a client opening streams
+// faster than they finish can pile up goroutines and memory without bound.
+// With -max-streams-per-session, a session may have that many streams in
+// handleStream at once; one past the limit is reset with
+// StreamErrTooManyStreams unread, and the session carries on.
+
+package main
+
+import "github.com/quic-go/webtransport-go"
+
+// defaultMaxStreams is the per-session limit on streams being handled
+const defaultMaxStreams = 1024
+
+// StreamErrTooManyStreams resets a request stream refused by the limit
+const StreamErrTooManyStreams webtransport.StreamErrorCode = 0x01
+
+// acquireStream takes a stream slot, or resets stream if none is free.
+// Sessions without a limit always get one.
+func (sess *Session) acquireStream(stream webtransport.Stream) bool {
+	if sess.streams == nil {
+		return true
+	}
+	select {
+	case sess.streams <- struct{}{}:
+		return true
+	default:
+	}
+	stream.CancelRead(StreamErrTooManyStreams)
+	stream.CancelWrite(StreamErrTooManyStreams)
+	if sess.srv != nil {
+		sess.srv.metrics.streamsRejected.Add(1)
+	}
+	sess.log().Warn("stream refused: too many streams", "limit", cap(sess.streams))
+	return false
+}
+
+// releaseStream gives back a slot from acquireStream
+func (sess *Session) releaseStream() {
+	if sess.streams != nil {
+		<-sess.streams
+	}
+}
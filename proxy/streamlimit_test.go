@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// fakeStream is a request stream that records how it was ended
+type fakeStream struct {
+	webtransport.Stream
+	r      io.Reader
+	closed chan struct{}
+	reset  chan webtransport.StreamErrorCode
+}
+
+func newFakeStream(r io.Reader) *fakeStream {
+	return &fakeStream{r: r, closed: make(chan struct{}), reset: make(chan webtransport.StreamErrorCode, 2)}
+}
+
+func (s *fakeStream) Read(p []byte) (int, error)                    { return s.r.Read(p) }
+func (s *fakeStream) Close() error                                  { close(s.closed); return nil }
+func (s *fakeStream) CancelRead(code webtransport.StreamErrorCode)  { s.reset <- code }
+func (s *fakeStream) CancelWrite(code webtransport.StreamErrorCode) { s.reset <- code }
+
+func TestStreamLimit(t *testing.T) {
+	srv := &Server{}
+	sess, pr := newTestSession(t, nil, func(s *Session) {
+		s.srv = srv
+		s.streams = make(chan struct{}, 2)
+	})
+
+	// Two streams that haven't sent their message type yet fill the limit
+	var stalled []*io.PipeWriter
+	for i := 0; i < 2; i++ {
+		r, w := io.Pipe()
+		stalled = append(stalled, w)
+		go sess.handleStream(newFakeStream(r))
+	}
+	for len(sess.streams) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	excess := newFakeStream(bytes.NewReader(nil))
+	sess.handleStream(excess)
+	if code := <-excess.reset; code != StreamErrTooManyStreams {
+		t.Fatalf("reset with code %d", code)
+	}
+	if n := srv.metrics.streamsRejected.Load(); n != 1 {
+		t.Fatalf("%d streams counted as rejected", n)
+	}
+
+	// Once one finishes, the session takes requests again
+	stalled[0].Close()
+	for len(sess.streams) > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	bind := newFakeStream(bytes.NewReader(append([]byte{MsgBind}, bindReq(1)...)))
+	go sess.handleStream(bind)
+	ev, err := readEvent(pr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.msgType != MsgConnected {
+		t.Fatalf("bind after the limit: got event %#x %q", ev.msgType, ev.data)
+	}
+	<-bind.closed
+
+	stalled[1].Close()
+	sess.cancel() // drop the MsgClosed events of the teardown below
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
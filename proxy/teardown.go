@@ -0,0 +1,94 @@
+// teardown.go - What happens to a session's sockets when the session drops
+//
+// A plain close sends FIN, which the remote reads as "transfer complete"
+// even if the container was halfway through an upload or the proxy had
+// downloaded bytes it never managed to deliver. With -disconnect-mode=auto
+// (the default) connections caught mid-transfer are reset instead, so the
+// remote sees ECONNRESET, while idle ones still close gracefully.
+//
+// There is no session resumption yet; once there is, resumable sessions
+// should keep their connections rather than tearing them down here.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Disconnect modes for -disconnect-mode
+const (
+	DisconnectAuto     = "auto"     // reset connections with unsent data, close idle ones
+	DisconnectGraceful = "graceful" // flush and close everything
+	DisconnectAbort    = "abort"    // reset everything
+)
+
+func parseDisconnectMode(s string) (string, error) {
+	switch s {
+	case DisconnectAuto, DisconnectGraceful, DisconnectAbort:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown disconnect mode %q (want %s, %s or %s)", s, DisconnectAuto, DisconnectGraceful, DisconnectAbort)
+}
+
+// unsentReasons lists why a connection is mid-transfer; empty = idle
+func (c *Connection) unsentReasons() []string {
+	var reasons []string
+	if c.truncated.Load() {
+		reasons = append(reasons, "transfer cut off")
+	}
+	if n := c.pendingSends.Load(); n > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d sends in flight", n))
+	}
+	if c.coalescer != nil {
+		if n := c.coalescer.Buffered(); n > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d bytes buffered", n))
+		}
+	}
+	return reasons
+}
+
+// teardown closes c after its session ended, resetting or closing
+// gracefully according to mode, and logs what it did
+func (c *Connection) teardown(log *slog.Logger, mode string) {
+	if c.closed.Load() {
+		return
+	}
+	reasons := c.unsentReasons()
+
+	c.mu.Lock()
+	conn, upstream := c.conn, c.upstream
+	c.mu.Unlock()
+
+	reset := mode == DisconnectAbort || (mode == DisconnectAuto && len(reasons) > 0)
+	if reset {
+		if c.coalescer != nil {
+			c.coalescer.Discard()
+		}
+		resetOnClose(conn)
+		resetOnClose(upstream)
+	}
+	c.Close()
+
+	if conn == nil && upstream == nil {
+		return // listeners and bound sockets have no peer to tell
+	}
+	disposition := "closed"
+	if reset {
+		disposition = "reset"
+	}
+	if len(reasons) > 0 {
+		log.Info("session lost", "conn_id", c.id, "disposition", disposition, "unsent", strings.Join(reasons, ", "))
+	} else {
+		log.Info("session lost", "conn_id", c.id, "disposition", disposition, "unsent", "idle")
+	}
+}
+
+// resetOnClose makes the next Close send RST rather than FIN
+func resetOnClose(c net.Conn) {
+	if tc, ok := tcpConnOf(c); ok {
+		tc.SetLinger(0)
+	}
+}
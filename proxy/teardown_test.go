@@ -0,0 +1,115 @@
+// teardown_test.go - Session-loss teardown tests
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns a proxy-side Connection wrapping one end of a loopback TCP
+// connection, and the remote end
+func tcpPair(t *testing.T) (*Connection, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	conn := newConnection(1, SOCK_STREAM)
+	conn.conn = c
+	return conn, remote
+}
+
+// remoteSees reads until the remote end gets EOF or an error
+func remoteSees(t *testing.T, remote net.Conn) ([]byte, error) {
+	t.Helper()
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(remote)
+	return data, err
+}
+
+func TestTeardownIdleCloses(t *testing.T) {
+	conn, remote := tcpPair(t)
+	conn.teardown(slog.Default(), DisconnectAuto)
+	if _, err := remoteSees(t, remote); err != nil {
+		t.Fatalf("idle connection: remote got %v, want clean EOF", err)
+	}
+	if !conn.closed.Load() {
+		t.Fatal("connection not marked closed")
+	}
+}
+
+func TestTeardownMidTransferResets(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mark func(*Connection)
+	}{
+		{"truncated send", func(c *Connection) { c.truncated.Store(true) }},
+		{"send in flight", func(c *Connection) { c.pendingSends.Add(1) }},
+		{"buffered", func(c *Connection) {
+			c.coalescer = newWriteCoalescer(c.conn, c.id, time.Hour)
+			c.coalescer.Write([]byte("half an upload"))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, remote := tcpPair(t)
+			tc.mark(conn)
+			conn.teardown(slog.Default(), DisconnectAuto)
+			data, err := remoteSees(t, remote)
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("remote got %q, %v; want ECONNRESET", data, err)
+			}
+		})
+	}
+}
+
+func TestTeardownModes(t *testing.T) {
+	// graceful delivers buffered sends even mid-transfer
+	conn, remote := tcpPair(t)
+	conn.coalescer = newWriteCoalescer(conn.conn, conn.id, time.Hour)
+	conn.coalescer.Write([]byte("last words"))
+	conn.truncated.Store(true)
+	conn.teardown(slog.Default(), DisconnectGraceful)
+	if data, err := remoteSees(t, remote); err != nil || string(data) != "last words" {
+		t.Fatalf("graceful: remote got %q, %v", data, err)
+	}
+
+	// abort resets even idle connections
+	conn, remote = tcpPair(t)
+	conn.teardown(slog.Default(), DisconnectAbort)
+	if _, err := remoteSees(t, remote); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("abort: remote got %v, want ECONNRESET", err)
+	}
+}
+
+func TestParseDisconnectMode(t *testing.T) {
+	for _, m := range []string{DisconnectAuto, DisconnectGraceful, DisconnectAbort} {
+		if got, err := parseDisconnectMode(m); err != nil || got != m {
+			t.Errorf("%s: got %q, %v", m, got, err)
+		}
+	}
+	if _, err := parseDisconnectMode("rst"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
@@ -0,0 +1,76 @@
+// tls.go - TLS hardening policy shared by the WebTransport and API servers
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy pins the minimum protocol version and the TLS 1.2 cipher suites
+// offered by both listeners. QUIC always negotiates TLS 1.3, so the cipher
+// list only affects the API server when it terminates TLS itself.
+type TLSPolicy struct {
+	MinVersion   uint16
+	CipherSuites []uint16 // nil = Go defaults
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSPolicy validates the -tls-min-version, -tls13-only and -tls-ciphers
+// flags. Only suites from tls.CipherSuites() are accepted; the insecure list
+// is rejected outright.
+func ParseTLSPolicy(minVersion string, require13 bool, ciphers string) (*TLSPolicy, error) {
+	p := &TLSPolicy{}
+
+	v, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS minimum version %q (want 1.2 or 1.3)", minVersion)
+	}
+	p.MinVersion = v
+	if require13 {
+		p.MinVersion = tls.VersionTLS13
+	}
+
+	if ciphers == "" {
+		return p, nil
+	}
+	if p.MinVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("-tls-ciphers has no effect when TLS 1.3 is required (TLS 1.3 suites are not configurable)")
+	}
+
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, n := range strings.Split(ciphers, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", n)
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+	if len(p.CipherSuites) == 0 {
+		return nil, fmt.Errorf("-tls-ciphers did not name any cipher suites")
+	}
+	return p, nil
+}
+
+// Apply copies the policy onto cfg. A nil policy leaves Go defaults in place.
+func (p *TLSPolicy) Apply(cfg *tls.Config) {
+	if p == nil {
+		return
+	}
+	cfg.MinVersion = p.MinVersion
+	if p.CipherSuites != nil {
+		cfg.CipherSuites = p.CipherSuites
+	}
+}
@@ -0,0 +1,129 @@
+// tlsorigin.go - TLS origination for outbound connections
+//
+// With OptTLS on MsgConnect the proxy performs the TLS handshake with the
+// destination itself, and the container sends and receives plaintext. The
+// upstream certificate is verified against the system roots and the
+// requested server name unless the container pins keys (OptTLSPin) or asks
+// to skip verification, which the proxy only honors with
+// -upstream-tls-insecure. A failed verification is reported as
+// MsgCertError rather than MsgConnectError so the container can surface it
+// distinctly.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// OptTLS flags
+const tlsFlagInsecure = 0x01 // skip certificate verification (needs -upstream-tls-insecure)
+
+// OriginTLS describes how to originate TLS on a connection
+type OriginTLS struct {
+	ServerName string     // empty = the MsgConnect host
+	Insecure   bool       // skip verification entirely
+	Pins       [][32]byte // SHA-256 of an accepted SubjectPublicKeyInfo (leaf or CA)
+}
+
+// tlsVerifyError marks a handshake that failed on certificate checks
+type tlsVerifyError struct {
+	err error
+}
+
+func (e *tlsVerifyError) Error() string { return "certificate verification failed: " + e.err.Error() }
+func (e *tlsVerifyError) Unwrap() error { return e.err }
+
+// originateTLS runs a client handshake over raw, returning a *tlsVerifyError
+// when the peer's certificate is rejected
+func originateTLS(ctx context.Context, raw net.Conn, host string, o *OriginTLS) (*tls.Conn, error) {
+	serverName := o.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(o.Pins) > 0 {
+		// Pins replace the system roots: the chain must lead to a pinned key
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinned(cs, serverName, o.Pins)
+		}
+	} else if o.Insecure {
+		cfg.InsecureSkipVerify = true
+	}
+
+	tc := tls.Client(raw, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		var certErr *tls.CertificateVerificationError
+		var hostErr x509.HostnameError
+		var pinErr *tlsVerifyError
+		switch {
+		case errors.As(err, &pinErr):
+			return nil, pinErr
+		case errors.As(err, &certErr), errors.As(err, &hostErr):
+			return nil, &tlsVerifyError{err: err}
+		}
+		return nil, err
+	}
+	return tc, nil
+}
+
+// verifyPinned accepts the peer if a pinned certificate among those it
+// presented anchors a valid chain for serverName
+func verifyPinned(cs tls.ConnectionState, serverName string, pins [][32]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return &tlsVerifyError{err: errors.New("no peer certificate")}
+	}
+	roots := x509.NewCertPool()
+	inter := x509.NewCertPool()
+	pinned := false
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if matchesPin(sum, pins) {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			inter.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return &tlsVerifyError{err: errors.New("no presented certificate matches a pin")}
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: inter,
+	})
+	if err != nil {
+		return &tlsVerifyError{err: err}
+	}
+	return nil
+}
+
+func matchesPin(sum [32]byte, pins [][32]byte) bool {
+	for _, p := range pins {
+		if bytes.Equal(sum[:], p[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTLSOption(val []byte) (*OriginTLS, error) {
+	if len(val) < 1 {
+		return nil, fmt.Errorf("tls option: missing flags")
+	}
+	return &OriginTLS{
+		Insecure:   val[0]&tlsFlagInsecure != 0,
+		ServerName: string(val[1:]),
+	}, nil
+}
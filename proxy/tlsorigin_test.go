@@ -0,0 +1,194 @@
+// tlsorigin_test.go - Upstream certificate verification tests
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginateTLSVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	pin := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+
+	handshake := func(o *OriginTLS) error {
+		raw, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+		tc, err := originateTLS(context.Background(), raw, "127.0.0.1", o)
+		if err == nil {
+			tc.Close()
+		}
+		return err
+	}
+
+	var verr *tlsVerifyError
+	if err := handshake(&OriginTLS{}); !errors.As(err, &verr) {
+		t.Errorf("self-signed upstream should fail verification, got %v", err)
+	}
+	if err := handshake(&OriginTLS{ServerName: "example.com", Pins: [][32]byte{pin}}); err != nil {
+		t.Errorf("pinned upstream should verify: %v", err)
+	}
+	if err := handshake(&OriginTLS{ServerName: "wrong.test", Pins: [][32]byte{pin}}); !errors.As(err, &verr) {
+		t.Errorf("pin with mismatched server name should fail, got %v", err)
+	}
+	if err := handshake(&OriginTLS{ServerName: "example.com", Pins: [][32]byte{{1}}}); !errors.As(err, &verr) {
+		t.Errorf("wrong pin should fail verification, got %v", err)
+	}
+	if err := handshake(&OriginTLS{Insecure: true}); err != nil {
+		t.Errorf("insecure handshake should succeed: %v", err)
+	}
+}
+
+func TestReadConnectOptionsTLS(t *testing.T) {
+	pin := bytes.Repeat([]byte{0xab}, 32)
+	trailer := append([]byte{OptTLS, 12, tlsFlagInsecure}, "example.com"...)
+	trailer = append(append(trailer, OptTLSPin, 32), pin...)
+	opts, err := readConnectOptions(bytes.NewReader(trailer))
+	if err != nil {
+		t.Fatalf("readConnectOptions: %v", err)
+	}
+	if opts.TLS == nil || !opts.TLS.Insecure || opts.TLS.ServerName != "example.com" || len(opts.TLS.Pins) != 1 || opts.TLS.Pins[0][0] != 0xab {
+		t.Fatalf("unexpected tls options: %+v", opts.TLS)
+	}
+
+	for _, bad := range [][]byte{
+		append([]byte{OptTLSPin, 32}, pin...), // pin without OptTLS
+		{OptTLS, 0},                           // missing flags
+		{OptTLS, 1, 0, OptTLSPin, 2, 1, 2},    // short pin
+	} {
+		if _, err := readConnectOptions(bytes.NewReader(bad)); err == nil {
+			t.Errorf("readConnectOptions(%v) should fail", bad)
+		}
+	}
+}
+
+// TestConnectOriginTLS runs MsgConnect with OptTLS against a local TLS echo
+// server: the handshake happens before MsgConnected, and the container's
+// plaintext comes back through it
+func TestConnectOriginTLS(t *testing.T) {
+	cert := testCert(t, "echo.test", false, nil)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// A public address for policy, dialed through to the local server
+	tbl := NewDestinationTable()
+	tbl.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+	}
+	target := ln.Addr().String()
+	tbl.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", target)
+	}
+	sess, pr := newTestSession(t, tbl)
+
+	connect := func(connID uint32, host string, pin [32]byte, opts ...byte) testEvent {
+		t.Helper()
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_STREAM)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, 443)
+		req = append(req, OptTLS, byte(1+len("localhost")), 0) // testCert's name
+		req = append(req, "localhost"...)
+		req = append(append(req, OptTLSPin, 32), pin[:]...)
+		req = append(req, opts...)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	pin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+
+	if ev := connect(1, "echo.example.com", pin); ev.msgType != MsgConnected || ev.connID != 1 {
+		t.Fatalf("got event %#x %q, want MsgConnected", ev.msgType, ev.data)
+	}
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = binary.BigEndian.AppendUint32(req, 5)
+	req = append(req, "hello"...)
+	go sess.handleSend(readerStream{r: bytes.NewReader(req)})
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgData || string(ev.data) != "hello" {
+		t.Fatalf("got event %#x %q, %v, want the echo", ev.msgType, ev.data, err)
+	}
+
+	if ev := connect(2, "echo.example.com", [32]byte{1}); ev.msgType != MsgCertError {
+		t.Fatalf("wrong pin: got event %#x %q, want MsgCertError", ev.msgType, ev.data)
+	}
+
+	// TLS doesn't get around the destination rules
+	ev := connect(3, "127.0.0.1", pin)
+	var d PolicyDecision
+	if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicyPrivateAddress {
+		t.Fatalf("private address: got event %#x %s, want %s", ev.msgType, ev.data, PolicyPrivateAddress)
+	}
+
+	// A server that accepts but never answers the handshake holds it up
+	// only for the connect timeout (OptTimeout), not a fixed 10s
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		var held []net.Conn
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				for _, c := range held {
+					c.Close()
+				}
+				return
+			}
+			held = append(held, c)
+		}
+	}()
+	target = silent.Addr().String()
+	start := time.Now()
+	ev = connect(4, "echo.example.com", pin, OptTimeout, 2, 0, 200)
+	if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicyTLS || d.Rule != "timeout" {
+		t.Fatalf("silent server: got event %#x %s, want a %s timeout", ev.msgType, ev.data, PolicyTLS)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("handshake gave up after %v, want the 200ms connect timeout", waited)
+	}
+
+	sess.cancel()
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
@@ -0,0 +1,183 @@
+// tracing.go - Optional OpenTelemetry spans (-otel-endpoint)
+//
+// For chasing latency through the proxy, each WebTransport session gets a
+// "session" span, with a "connect" child per MsgConnect (the dial up to
+// MsgConnected or the refusal) and a "conn" child per connection's read
+// loop; each /pull gets a "pull" span. A W3C traceparent header on the
+// /connect or /pull request makes the span a child of the caller's trace.
+//
+// Spans go through the OpenTelemetry SDK: a batch span processor queues
+// finished spans and the OTLP/HTTP exporter posts them to the collector.
+// Without -otel-endpoint the Tracer is nil, and a nil Tracer or Span does
+// nothing at all.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	traceExportInterval = 5 * time.Second
+	traceShutdownWait   = 5 * time.Second // for queued spans to go out at shutdown
+	maxPendingSpans     = 4096            // spans kept while the collector is slow or down
+	traceServiceName    = "friscy-proxy"
+)
+
+// Span kinds
+const (
+	SpanKindInternal = trace.SpanKindInternal
+	SpanKindServer   = trace.SpanKindServer
+	SpanKindClient   = trace.SpanKindClient
+)
+
+// Tracer starts spans and exports them to an OTLP collector
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// NewTracer exports to the OTLP/HTTP collector at endpoint; a bare
+// "http://host:4318" gets the standard /v1/traces path. An empty
+// endpoint disables tracing: the nil Tracer.
+func NewTracer(endpoint string) (*Tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("trace export failed", "err", err)
+	}))
+	return newTracer(sdktrace.NewBatchSpanProcessor(exp,
+		sdktrace.WithBatchTimeout(traceExportInterval),
+		sdktrace.WithMaxQueueSize(maxPendingSpans),
+	)), nil
+}
+
+// newTracer sends finished spans to sp
+func newTracer(sp sdktrace.SpanProcessor) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", traceServiceName))),
+	)
+	return &Tracer{provider: provider, tracer: provider.Tracer(traceServiceName)}
+}
+
+// Span is one timed operation; its methods are safe on a nil Span
+type Span struct {
+	tracer *Tracer
+	ctx    context.Context // carries span, for children
+	span   trace.Span
+}
+
+// Start begins a span, continuing the trace in a W3C traceparent header
+// if there is a valid one
+func (t *Tracer) Start(name, traceparent string, kind trace.SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceparent})
+	return t.start(ctx, name, kind)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind trace.SpanKind) *Span {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return &Span{tracer: t, ctx: ctx, span: span}
+}
+
+// Child begins a span under s
+func (s *Span) Child(name string, kind trace.SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(s.ctx, name, kind)
+}
+
+// SetAttr records an attribute; v is a string, an integer or a bool
+func (s *Span) SetAttr(key string, v any) {
+	if s == nil {
+		return
+	}
+	var kv attribute.KeyValue
+	switch x := v.(type) {
+	case string:
+		kv = attribute.String(key, x)
+	case bool:
+		kv = attribute.Bool(key, x)
+	case int:
+		kv = attribute.Int(key, x)
+	case int64:
+		kv = attribute.Int64(key, x)
+	case uint16:
+		kv = attribute.Int64(key, int64(x))
+	case uint32:
+		kv = attribute.Int64(key, int64(x))
+	case uint64:
+		kv = attribute.Int64(key, int64(x))
+	default:
+		kv = attribute.String(key, fmt.Sprint(x))
+	}
+	s.span.SetAttributes(kv)
+}
+
+// Fail marks the span as failed with msg
+func (s *Span) Fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, msg)
+}
+
+// FailDecision marks the span failed with a refusal's message and code
+func (s *Span) FailDecision(d PolicyDecision) {
+	if s == nil {
+		return
+	}
+	s.SetAttr("friscy.error_code", d.errorCode())
+	s.SetAttr("friscy.policy", d.Category)
+	s.Fail(d.Message)
+}
+
+// End finishes the span and queues it for export; later calls do nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// Shutdown exports the spans still queued, waiting up to
+// traceShutdownWait, and stops the exporter
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownWait)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		slog.Warn("trace shutdown", "err", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNilTracer(t *testing.T) {
+	tr, err := NewTracer("")
+	if err != nil || tr != nil {
+		t.Fatalf("got %v, %v", tr, err)
+	}
+	span := tr.Start("session", "", SpanKindServer)
+	child := span.Child("connect", SpanKindClient)
+	child.SetAttr("server.port", 443)
+	child.FailDecision(PolicyDecision{Category: PolicyDial, Message: "refused"})
+	child.End()
+	span.End()
+	tr.Shutdown()
+
+	for _, endpoint := range []string{"localhost:4318", "ftp://collector", "http://"} {
+		if _, err := NewTracer(endpoint); err == nil {
+			t.Errorf("accepted endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestTracerSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tr := newTracer(rec)
+	defer tr.Shutdown()
+
+	session := tr.Start("session", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", SpanKindServer)
+	connect := session.Child("connect", SpanKindClient)
+	connect.SetAttr("server.address", "example.com")
+	connect.SetAttr("server.port", uint16(443))
+	connect.FailDecision(PolicyDecision{Category: PolicyDial, Message: "connection refused"})
+	connect.End()
+	connect.End() // once only
+	session.End()
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	c, s := spans[0], spans[1]
+	if s.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || s.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("session span not in the caller's trace: %v parent %v", s.SpanContext(), s.Parent())
+	}
+	if c.Name() != "connect" || c.Parent().SpanID() != s.SpanContext().SpanID() || c.SpanContext().TraceID() != s.SpanContext().TraceID() {
+		t.Errorf("connect span not a child of the session: %v", c.Parent())
+	}
+	if st := c.Status(); st.Code != codes.Error || st.Description != "connection refused" {
+		t.Errorf("connect status %v", st)
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, a := range c.Attributes() {
+		attrs[a.Key] = a.Value
+	}
+	if v := attrs["server.port"]; v.AsInt64() != 443 {
+		t.Errorf("server.port %v", v.Emit())
+	}
+	if v := attrs["server.address"]; v.AsString() != "example.com" {
+		t.Errorf("server.address %v", v.Emit())
+	}
+	if _, ok := attrs["friscy.error_code"]; !ok {
+		t.Error("no error code recorded")
+	}
+
+	// Without a valid traceparent the session starts its own trace
+	root := tr.Start("pull", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", SpanKindServer)
+	root.End()
+	if spans := rec.Ended(); spans[2].Parent().IsValid() {
+		t.Errorf("zero trace id adopted as parent: %v", spans[2].Parent())
+	}
+}
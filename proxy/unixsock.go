@@ -0,0 +1,76 @@
+// unixsock.go - Connecting to Unix domain sockets on the host (SOCK_UNIX)
+//
+// MsgConnect with SOCK_UNIX dials a Unix stream socket on the proxy's
+// host, for a container that needs a local service such as a database.
+// The host field carries the socket path and the port is ignored; a path
+// starting with "@" names a Linux abstract socket. Only paths the operator
+// lists in -unix-sockets may be dialed, compared after cleaning, so
+// "/run/pg/../docker.sock" isn't "/run/pg". Everything else a connect
+// passes still applies: the token's expiry and allow_hosts (which can
+// name the path) and the client's daily quota. Once dialed it's an
+// ordinary stream connection for readLoop and handleSend.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// parseUnixSockets reads -unix-sockets: comma-separated absolute paths, or
+// @names for abstract sockets
+func parseUnixSockets(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	allowed := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "@") && !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("unix socket %q: path must be absolute, or @name for an abstract socket", p)
+		}
+		allowed[cleanUnixPath(p)] = true
+	}
+	return allowed, nil
+}
+
+// cleanUnixPath normalizes a filesystem socket path; abstract names are
+// taken as they are
+func cleanUnixPath(p string) string {
+	if strings.HasPrefix(p, "@") {
+		return p
+	}
+	return filepath.Clean(p)
+}
+
+// checkUnixConnect is checkConnect for a SOCK_UNIX connect to path
+func (s *Server) checkUnixConnect(rl *RateLimiter, remoteIP, origin string, token *Token, path string) (PolicyDecision, bool) {
+	if !s.unixSockets[cleanUnixPath(path)] {
+		return PolicyDecision{Category: PolicyUnixSocket, Rule: "unix-sockets", Message: "unix socket not allowed"}, false
+	}
+	if token != nil {
+		if token.Expired(time.Now()) {
+			return PolicyDecision{Category: PolicyTokenExpired, Rule: token.Name, Message: "token expired"}, false
+		}
+		if !token.AllowsHost(path) {
+			return PolicyDecision{Category: PolicyTokenScope, Rule: token.Name, Message: "destination not permitted by token"}, false
+		}
+	}
+	if !rl.TryConnectionFrom(remoteIP, origin) {
+		return quotaDecision(rl, remoteIP, origin), false
+	}
+	return PolicyDecision{}, true
+}
+
+// dialUnix connects to the Unix stream socket at path
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", cleanUnixPath(path))
+}
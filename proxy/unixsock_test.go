@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func unixEcho(t *testing.T, path string) {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+}
+
+// TestConnectUnix echoes through an allowed Unix socket and checks paths
+// outside -unix-sockets are refused
+func TestConnectUnix(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "echo.sock")
+	unixEcho(t, sock)
+	unixEcho(t, filepath.Join(dir, "other.sock"))
+	list := sock
+	abstract := "@friscy-test-" + filepath.Base(dir)
+	if runtime.GOOS == "linux" {
+		unixEcho(t, abstract)
+		list += "," + abstract
+	}
+	allowed, err := parseUnixSockets(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, pr := newTestSession(t, NewDestinationTable(), func(s *Session) { s.srv.unixSockets = allowed })
+
+	connect := func(connID uint32, path string) testEvent {
+		t.Helper()
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = append(req, SOCK_UNIX)
+		req = binary.BigEndian.AppendUint16(req, uint16(len(path)))
+		req = append(req, path...)
+		req = binary.BigEndian.AppendUint16(req, 0)
+		go sess.handleConnect(readerStream{r: bytes.NewReader(req)})
+		ev, err := readEvent(pr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	echo := func(connID uint32, msg string) {
+		t.Helper()
+		req := binary.BigEndian.AppendUint32(nil, connID)
+		req = binary.BigEndian.AppendUint32(req, uint32(len(msg)))
+		req = append(req, msg...)
+		go sess.handleSend(readerStream{r: bytes.NewReader(req)})
+		if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgData || ev.connID != connID || string(ev.data) != msg {
+			t.Fatalf("got event %#x conn %d %q, %v, want the echo", ev.msgType, ev.connID, ev.data, err)
+		}
+	}
+
+	if ev := connect(1, sock); ev.msgType != MsgConnected {
+		t.Fatalf("got event %#x %q, want MsgConnected", ev.msgType, ev.data)
+	}
+	echo(1, "hello")
+
+	// Half-close reaches the socket: the echo server sees EOF and closes
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	go sess.handleCloseWrite(readerStream{r: bytes.NewReader(req)})
+	if ev, err := readEvent(pr, false); err != nil || ev.msgType != MsgClosed {
+		t.Fatalf("after half-close: got event %#x %q, %v, want MsgClosed", ev.msgType, ev.data, err)
+	}
+
+	for i, path := range []string{
+		filepath.Join(dir, "other.sock"),
+		filepath.Join(dir, "sub", "..", "other.sock"),
+		"@friscy-not-listed",
+		"echo.sock",
+	} {
+		ev := connect(uint32(10+i), path)
+		var d PolicyDecision
+		if ev.msgType != MsgConnectError || json.Unmarshal(ev.data, &d) != nil || d.Category != PolicyUnixSocket {
+			t.Errorf("%s: got event %#x %s, want %s", path, ev.msgType, ev.data, PolicyUnixSocket)
+		}
+	}
+
+	if runtime.GOOS == "linux" {
+		if ev := connect(2, abstract); ev.msgType != MsgConnected {
+			t.Fatalf("abstract socket: got event %#x %q, want MsgConnected", ev.msgType, ev.data)
+		}
+		echo(2, "abstract")
+	}
+
+	sess.cancel()
+	sess.connections.Range(func(_, v any) bool {
+		v.(*Connection).Close()
+		return true
+	})
+}
+
+func TestParseUnixSockets(t *testing.T) {
+	allowed, err := parseUnixSockets(" /run/pg/.s.PGSQL.5432 , /var/run/../run/redis.sock,@dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/run/pg/.s.PGSQL.5432", "/var/run/redis.sock", "@dbus"} {
+		if !allowed[p] {
+			t.Errorf("%s not allowed: %v", p, allowed)
+		}
+	}
+	if _, err := parseUnixSockets("run/pg.sock"); err == nil {
+		t.Error("relative path accepted")
+	}
+	if allowed, err := parseUnixSockets(""); allowed != nil || err != nil {
+		t.Errorf("empty list: %v, %v", allowed, err)
+	}
+}
@@ -0,0 +1,174 @@
+// upstreamproxy.go - Sending the proxy's own TCP dials through another proxy
+//
+// Inside a restricted network the only way out may be a corporate SOCKS5
+// or HTTP proxy. With -upstream-proxy every outbound TCP connection made
+// for a container, by MsgConnect, the SOCKS5 listener or a pooled dial,
+// is tunneled through it. Destination names are still resolved here and
+// checked against the private-address and blocklist rules as usual; the
+// upstream proxy is only ever asked for an address that passed, as an IP
+// literal, so it can't resolve a name to somewhere internal. UDP isn't
+// tunneled and is dialed directly.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstreamConnectTimeout bounds the HTTP CONNECT exchange when the dial
+// context has no deadline of its own
+const upstreamConnectTimeout = 30 * time.Second
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// upstreamDialer returns a dial function for DestinationTable that makes
+// TCP connections through the proxy at rawURL: socks5://[user:pass@]host[:port]
+// or http://[user:pass@]host[:port]
+func upstreamDialer(rawURL string) (dialFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %q", rawURL)
+	}
+	var direct net.Dialer
+	var tunnel dialFunc
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1080")
+		}
+		tunnel = func(ctx context.Context, network, target string) (net.Conn, error) {
+			// The SOCKS dialer wraps the socket it returns; the raw one is
+			// kept so socket options and half-close still reach it
+			fwd := &captureDialer{d: &direct}
+			d, err := proxy.SOCKS5("tcp", addr, auth, fwd)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := d.(proxy.ContextDialer).DialContext(ctx, network, target); err != nil {
+				return nil, err
+			}
+			return fwd.conn, nil
+		}
+	case "http":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		tunnel = func(ctx context.Context, network, target string) (net.Conn, error) {
+			return httpConnect(ctx, &direct, addr, u.User, target)
+		}
+	default:
+		return nil, fmt.Errorf("upstream proxy %q: scheme must be socks5 or http", rawURL)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			return tunnel(ctx, network, addr)
+		}
+		return direct.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// httpConnect opens a tunnel to target with an HTTP CONNECT request to the
+// proxy at proxyAddr
+func httpConnect(ctx context.Context, d *net.Dialer, proxyAddr string, user *url.Userinfo, target string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(upstreamConnectTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT %s: %s", target, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// captureDialer dials directly, remembering the connection
+type captureDialer struct {
+	d    *net.Dialer
+	conn net.Conn
+}
+
+func (c *captureDialer) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+func (c *captureDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.d.DialContext(ctx, network, addr)
+	c.conn = conn
+	return conn, err
+}
+
+// bufferedConn is a tunnel whose first bytes were read along with the
+// CONNECT response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *bufferedConn) NetConn() net.Conn          { return c.Conn }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNotTCP
+}